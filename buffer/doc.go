@@ -0,0 +1,9 @@
+// Package buffer provides the buffers used by haijun-net for protocol code outside the module:
+// a linked zero-copy buffer with reference-counted nodes, the ring buffer and the buffer pools.
+// The engine buffers the data of the conns in LinkBuffers, a RingBuffer is only ever created by
+// the application for its own use.
+//
+// Compatibility: the exported API of this package follows semantic versioning, it's not changed
+// incompatibly within a major version. The memory got from the pools is accounted by the
+// process-wide limit set by haijun_net.SetPoolMemoryLimit.
+package buffer
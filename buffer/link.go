@@ -0,0 +1,362 @@
+package buffer
+
+import (
+	"errors"
+	"io"
+	"sync/atomic"
+
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/byteslice"
+)
+
+// DefaultBlockSize is the smallest block allocated by LinkBuffer.Write and LinkBuffer.Reserve.
+const DefaultBlockSize = 4096
+
+// ErrNotEnough is returned when the LinkBuffer holds fewer bytes than requested.
+var ErrNotEnough = errors.New("buffer: not enough data")
+
+// block is a piece of memory shared by the nodes of the LinkBuffers, free is called when the last
+// node referencing it is released.
+type block struct {
+	buf    []byte
+	refs   int32
+	pooled bool // buf is got from the pool, otherwise it's owned by the caller
+	free   func()
+}
+
+func newBlock(size int) *block {
+	b := &block{buf: byteslice.Get(size), refs: 1, pooled: true}
+	b.free = func() { byteslice.Put(b.buf) }
+	return b
+}
+
+func (b *block) retain() {
+	atomic.AddInt32(&b.refs, 1)
+}
+
+func (b *block) release() {
+	if atomic.AddInt32(&b.refs, -1) == 0 && b.free != nil {
+		b.free()
+		b.buf = nil
+	}
+}
+
+// linkNode is a view of a block, only the node allocating the block may append to it.
+type linkNode struct {
+	blk  *block
+	b    []byte
+	next *linkNode
+}
+
+// LinkBuffer is a linked list of byte slices. Appending, slicing and splitting it don't copy the data,
+// the nodes reference the memory appended by the caller or blocks shared with other LinkBuffers,
+// which are reference-counted and returned to the pool when the last reference is released.
+//
+// A LinkBuffer isn't safe for concurrent use, but the LinkBuffers sharing memory by Slice or Split
+// may be used by different goroutines.
+type LinkBuffer struct {
+	head, tail *linkNode
+	length     int
+
+	blockSize int
+	// spare is the block handed out by Reserve which isn't linked yet
+	spare *block
+}
+
+// NewLinkBuffer returns an empty LinkBuffer allocating blocks of DefaultBlockSize.
+func NewLinkBuffer() *LinkBuffer {
+	return NewLinkBufferSize(DefaultBlockSize)
+}
+
+// NewLinkBufferSize returns an empty LinkBuffer allocating blocks of at least blockSize bytes,
+// it's meant for sizing the blocks by the expected traffic.
+func NewLinkBufferSize(blockSize int) *LinkBuffer {
+	if blockSize <= 0 {
+		blockSize = DefaultBlockSize
+	}
+	return &LinkBuffer{blockSize: blockSize}
+}
+
+// Len returns the number of bytes in the buffer.
+func (l *LinkBuffer) Len() int {
+	return l.length
+}
+
+// IsEmpty reports whether the buffer holds no data.
+func (l *LinkBuffer) IsEmpty() bool {
+	return l.length == 0
+}
+
+func (l *LinkBuffer) push(n *linkNode) {
+	if l.tail == nil {
+		l.head = n
+	} else {
+		l.tail.next = n
+	}
+	l.tail = n
+	l.length += len(n.b)
+}
+
+// Append appends p to the buffer without copying, p mustn't be modified until the buffer
+// and all the buffers sliced from it are released.
+func (l *LinkBuffer) Append(p []byte) {
+	if len(p) == 0 {
+		return
+	}
+	// 调用者持有的内存不能再追加写入，限制切片容量
+	l.push(&linkNode{blk: &block{refs: 1}, b: p[:len(p):len(p)]})
+}
+
+// AppendOwned is like Append, but release is called once p is no longer referenced by the buffer
+// and the buffers sliced from it, so that the caller can reuse p.
+func (l *LinkBuffer) AppendOwned(p []byte, release func()) {
+	if len(p) == 0 {
+		if release != nil {
+			release()
+		}
+		return
+	}
+	l.push(&linkNode{blk: &block{refs: 1, free: release}, b: p[:len(p):len(p)]})
+}
+
+// AppendBuffer moves the data of o to the end of the buffer without copying, o is left empty.
+func (l *LinkBuffer) AppendBuffer(o *LinkBuffer) {
+	if o == l || o.head == nil {
+		return
+	}
+	if l.tail == nil {
+		l.head = o.head
+	} else {
+		l.tail.next = o.head
+	}
+	l.tail = o.tail
+	l.length += o.length
+	o.head, o.tail, o.length = nil, nil, 0
+}
+
+// Write copies p to the end of the buffer, it always returns len(p) and a nil error.
+func (l *LinkBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	for len(p) > 0 {
+		b := l.tailSpace()
+		if len(b) == 0 {
+			b = l.Reserve(len(p))
+		}
+		c := copy(b, p)
+		l.Commit(c)
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// tailSpace returns the free space of the block allocated for the last node.
+func (l *LinkBuffer) tailSpace() []byte {
+	if t := l.tail; l.spare == nil && t != nil && t.blk.pooled {
+		return t.b[len(t.b):cap(t.b)]
+	}
+	return nil
+}
+
+// Reserve returns the writable space of at least n bytes at the end of the buffer, so that the data
+// can be written in place, e.g. by a read system call. The data isn't part of the buffer until Commit.
+func (l *LinkBuffer) Reserve(n int) []byte {
+	if b := l.tailSpace(); len(b) >= n && len(b) > 0 {
+		return b
+	}
+	if l.spare != nil {
+		if len(l.spare.buf) >= n {
+			return l.spare.buf
+		}
+		l.spare.release()
+	}
+	size := n
+	if size < l.blockSize {
+		size = l.blockSize
+	}
+	l.spare = newBlock(size)
+	return l.spare.buf
+}
+
+// Commit appends the first n bytes written to the space returned by the last Reserve.
+func (l *LinkBuffer) Commit(n int) {
+	if n <= 0 {
+		return
+	}
+	if b := l.spare; b != nil {
+		l.spare = nil
+		l.push(&linkNode{blk: b, b: b.buf[:n]})
+		return
+	}
+	t := l.tail
+	t.b = t.b[:len(t.b)+n]
+	l.length += n
+}
+
+// WriteString is like Write, but writes the contents of s.
+func (l *LinkBuffer) WriteString(s string) (int, error) {
+	return l.Write([]byte(s))
+}
+
+// Peek returns the next n bytes without advancing the buffer. The bytes are returned in place when
+// they are in a single node, otherwise they are copied. The result is valid until the buffer is advanced.
+func (l *LinkBuffer) Peek(n int) ([]byte, error) {
+	if n > l.length {
+		return nil, ErrNotEnough
+	}
+	if n <= 0 {
+		return nil, nil
+	}
+	if len(l.head.b) >= n {
+		return l.head.b[:n], nil
+	}
+	p := make([]byte, 0, n)
+	for node := l.head; len(p) < n; node = node.next {
+		p = append(p, node.b[:min(len(node.b), n-len(p))]...)
+	}
+	return p, nil
+}
+
+// Bytes returns the data of the buffer in place, node by node, e.g. for writev.
+// The slices are valid until the buffer is advanced.
+func (l *LinkBuffer) Bytes() [][]byte {
+	var bs [][]byte
+	for node := l.head; node != nil; node = node.next {
+		bs = append(bs, node.b)
+	}
+	return bs
+}
+
+// Skip advances the buffer by n bytes, the memory no longer referenced is returned to the pool.
+func (l *LinkBuffer) Skip(n int) error {
+	if n > l.length {
+		return ErrNotEnough
+	}
+	l.length -= n
+	for n > 0 {
+		node := l.head
+		if len(node.b) > n {
+			node.b = node.b[n:]
+			return nil
+		}
+		n -= len(node.b)
+		l.popHead().blk.release()
+	}
+	return nil
+}
+
+func (l *LinkBuffer) popHead() *linkNode {
+	node := l.head
+	l.head = node.next
+	if l.head == nil {
+		l.tail = nil
+	}
+	node.next = nil
+	return node
+}
+
+// Read reads up to len(p) bytes into p and advances the buffer, it returns io.EOF when the buffer is empty.
+func (l *LinkBuffer) Read(p []byte) (n int, err error) {
+	if l.length == 0 {
+		if len(p) == 0 {
+			return 0, nil
+		}
+		return 0, io.EOF
+	}
+	for node := l.head; node != nil && n < len(p); node = node.next {
+		n += copy(p[n:], node.b)
+	}
+	_ = l.Skip(n)
+	return n, nil
+}
+
+// WriteTo writes the data to w until the buffer is drained or an error occurs.
+func (l *LinkBuffer) WriteTo(w io.Writer) (n int64, err error) {
+	for l.head != nil {
+		var m int
+		m, err = w.Write(l.head.b)
+		n += int64(m)
+		_ = l.Skip(m)
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+// Slice returns a LinkBuffer referencing the next n bytes without copying or advancing the buffer.
+func (l *LinkBuffer) Slice(n int) (*LinkBuffer, error) {
+	if n > l.length {
+		return nil, ErrNotEnough
+	}
+	s := NewLinkBuffer()
+	for node := l.head; n > 0; node = node.next {
+		b := node.b
+		if len(b) > n {
+			b = b[:n]
+		}
+		n -= len(b)
+		node.blk.retain()
+		// 共享的内存只读，限制切片容量防止被追加写入
+		s.push(&linkNode{blk: node.blk, b: b[:len(b):len(b)]})
+	}
+	return s, nil
+}
+
+// Split removes the next n bytes from the buffer and returns them as a new LinkBuffer without copying.
+func (l *LinkBuffer) Split(n int) (*LinkBuffer, error) {
+	if n > l.length {
+		return nil, ErrNotEnough
+	}
+	s := NewLinkBuffer()
+	for n > 0 {
+		node := l.head
+		if len(node.b) > n {
+			node.blk.retain()
+			s.push(&linkNode{blk: node.blk, b: node.b[:n:n]})
+			node.b = node.b[n:]
+			l.length -= n
+			return s, nil
+		}
+		n -= len(node.b)
+		l.length -= len(node.b)
+		s.push(l.popHead())
+	}
+	return s, nil
+}
+
+// Vectors appends the slices holding the next max bytes of the buffer to dst in place, in at most
+// maxVectors slices, e.g. for writev. The slices are valid until the buffer is advanced.
+func (l *LinkBuffer) Vectors(dst [][]byte, max, maxVectors int) [][]byte {
+	for node := l.head; node != nil && max > 0 && maxVectors > 0; node = node.next {
+		b := node.b
+		if len(b) > max {
+			b = b[:max]
+		}
+		dst = append(dst, b)
+		max -= len(b)
+		maxVectors--
+	}
+	return dst
+}
+
+// Release drops the data of the buffer, the memory no longer referenced is returned to the pool.
+// The buffer can be reused afterwards.
+func (l *LinkBuffer) Release() {
+	for l.head != nil {
+		l.popHead().blk.release()
+	}
+	l.length = 0
+	if l.spare != nil {
+		l.spare.release()
+		l.spare = nil
+	}
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,315 @@
+package buffer
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/accounting"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkBuffer_AppendNoCopy(t *testing.T) {
+	l := NewLinkBuffer()
+	assert.True(t, l.IsEmpty())
+	backing := []byte("hello#")
+	p := backing[:5]
+	l.Append(p)
+	l.Append(nil)
+	l.Append([]byte(" world"))
+	assert.Equal(t, 11, l.Len())
+
+	// 追加的内存不会被复制
+	p[0] = 'H'
+	b, err := l.Peek(5)
+	require.NoError(t, err)
+	assert.Equal(t, "Hello", string(b))
+	assert.Equal(t, [][]byte{[]byte("Hello"), []byte(" world")}, l.Bytes())
+
+	// 调用者的内存不会被后续的写入覆盖
+	_, _ = l.WriteString("!")
+	assert.Equal(t, "Hello#", string(backing))
+	assert.Equal(t, "Hello world!", readAll(t, l))
+}
+
+func TestLinkBuffer_Write(t *testing.T) {
+	l := NewLinkBuffer()
+	defer l.Release()
+	n, err := l.Write([]byte("abc"))
+	assert.Equal(t, 3, n)
+	assert.NoError(t, err)
+	_, _ = l.WriteString("def")
+	// 小块的写入合并到同一个节点
+	assert.Len(t, l.Bytes(), 1)
+
+	big := bytes.Repeat([]byte("x"), DefaultBlockSize*2)
+	_, _ = l.Write(big)
+	assert.Equal(t, 6+len(big), l.Len())
+	assert.Len(t, l.Bytes(), 2)
+	assert.Equal(t, "abcdef"+string(big), string(bytes.Join(l.Bytes(), nil)))
+}
+
+func TestLinkBuffer_Peek(t *testing.T) {
+	l := NewLinkBuffer()
+	l.Append([]byte("ab"))
+	l.Append([]byte("cd"))
+
+	b, err := l.Peek(0)
+	assert.NoError(t, err)
+	assert.Empty(t, b)
+	b, err = l.Peek(3)
+	assert.NoError(t, err)
+	assert.Equal(t, "abc", string(b))
+	_, err = l.Peek(5)
+	assert.Equal(t, ErrNotEnough, err)
+	assert.Equal(t, 4, l.Len())
+}
+
+func TestLinkBuffer_Skip(t *testing.T) {
+	l := NewLinkBuffer()
+	l.Append([]byte("ab"))
+	l.Append([]byte("cd"))
+	l.Append([]byte("ef"))
+
+	assert.Equal(t, ErrNotEnough, l.Skip(7))
+	require.NoError(t, l.Skip(3))
+	assert.Equal(t, 3, l.Len())
+	assert.Equal(t, "def", string(bytes.Join(l.Bytes(), nil)))
+	require.NoError(t, l.Skip(3))
+	assert.True(t, l.IsEmpty())
+	assert.Nil(t, l.Bytes())
+
+	// 清空之后可以继续使用
+	l.Append([]byte("g"))
+	assert.Equal(t, "g", readAll(t, l))
+}
+
+func TestLinkBuffer_Read(t *testing.T) {
+	l := NewLinkBuffer()
+	n, err := l.Read(nil)
+	assert.Zero(t, n)
+	assert.NoError(t, err)
+	_, err = l.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	l.Append([]byte("abc"))
+	l.Append([]byte("def"))
+	p := make([]byte, 4)
+	n, err = l.Read(p)
+	assert.NoError(t, err)
+	assert.Equal(t, "abcd", string(p[:n]))
+	n, _ = l.Read(p)
+	assert.Equal(t, "ef", string(p[:n]))
+}
+
+type shortWriter struct {
+	buf bytes.Buffer
+	max int
+	err error
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	w.buf.Write(p)
+	if w.max == 0 {
+		return 0, w.err
+	}
+	return len(p), nil
+}
+
+func TestLinkBuffer_WriteTo(t *testing.T) {
+	l := NewLinkBuffer()
+	l.Append([]byte("abc"))
+	l.Append([]byte("def"))
+	w := &shortWriter{max: 2}
+	n, err := l.WriteTo(w)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(6), n)
+	assert.Equal(t, "abcdef", w.buf.String())
+	assert.True(t, l.IsEmpty())
+
+	l.Append([]byte("ghi"))
+	n, err = l.WriteTo(&shortWriter{})
+	assert.Zero(t, n)
+	assert.Equal(t, io.ErrShortWrite, err)
+	errWrite := errors.New("write failed")
+	_, err = l.WriteTo(&shortWriter{err: errWrite})
+	assert.Equal(t, errWrite, err)
+	assert.Equal(t, 3, l.Len())
+
+	n, err = l.WriteTo(ioutil.Discard)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+}
+
+func TestLinkBuffer_Slice(t *testing.T) {
+	l := NewLinkBuffer()
+	_, _ = l.WriteString("hello")
+	l.Append([]byte(" world"))
+
+	s, err := l.Slice(7)
+	require.NoError(t, err)
+	assert.Equal(t, 7, s.Len())
+	assert.Equal(t, 11, l.Len())
+	_, err = l.Slice(12)
+	assert.Equal(t, ErrNotEnough, err)
+
+	// 原缓冲区继续写入不影响切片
+	_, _ = l.WriteString("!")
+	_, _ = s.WriteString("?")
+	assert.Equal(t, "hello w?", readAll(t, s))
+	assert.Equal(t, "hello world!", readAll(t, l))
+}
+
+func TestLinkBuffer_Split(t *testing.T) {
+	l := NewLinkBuffer()
+	l.Append([]byte("abc"))
+	_, _ = l.WriteString("defgh")
+
+	s, err := l.Split(2)
+	require.NoError(t, err)
+	assert.Equal(t, "ab", readAll(t, s))
+	assert.Equal(t, 6, l.Len())
+
+	s, err = l.Split(4)
+	require.NoError(t, err)
+	assert.Equal(t, 2, l.Len())
+	_, err = l.Split(3)
+	assert.Equal(t, ErrNotEnough, err)
+
+	_, _ = l.WriteString("ij")
+	_, _ = s.WriteString("XY")
+	assert.Equal(t, "cdefXY", readAll(t, s))
+	assert.Equal(t, "ghij", readAll(t, l))
+
+	s, err = l.Split(0)
+	require.NoError(t, err)
+	assert.True(t, s.IsEmpty())
+}
+
+func TestLinkBuffer_AppendBuffer(t *testing.T) {
+	l, o := NewLinkBuffer(), NewLinkBuffer()
+	l.AppendBuffer(o)
+	assert.True(t, l.IsEmpty())
+
+	o.Append([]byte("ab"))
+	l.AppendBuffer(o)
+	assert.True(t, o.IsEmpty())
+	o.Append([]byte("cd"))
+	l.AppendBuffer(o)
+	l.AppendBuffer(l)
+	assert.Equal(t, 4, l.Len())
+	assert.Equal(t, "abcd", readAll(t, l))
+}
+
+func TestLinkBuffer_RefCount(t *testing.T) {
+	before := accounting.InUse(accounting.ByteSlice)
+	l := NewLinkBuffer()
+	_, _ = l.WriteString(strings.Repeat("x", 100))
+	inUse := accounting.InUse(accounting.ByteSlice) - before
+	assert.Greater(t, inUse, int64(0))
+
+	s1, _ := l.Slice(10)
+	s2, _ := l.Split(50)
+	l.Release()
+	assert.True(t, l.IsEmpty())
+	// 还有切片引用时内存不会归还
+	assert.Equal(t, inUse, accounting.InUse(accounting.ByteSlice)-before)
+	s1.Release()
+	assert.Equal(t, inUse, accounting.InUse(accounting.ByteSlice)-before)
+	require.NoError(t, s2.Skip(50))
+	assert.Equal(t, before, accounting.InUse(accounting.ByteSlice))
+}
+
+func TestLinkBuffer_ConcurrentSlices(t *testing.T) {
+	l := NewLinkBuffer()
+	_, _ = l.WriteString(strings.Repeat("0123456789", 100))
+
+	var wg sync.WaitGroup
+	for l.Len() > 0 {
+		s, err := l.Split(10)
+		require.NoError(t, err)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer s.Release()
+			b, err := s.Peek(10)
+			if assert.NoError(t, err) {
+				assert.Equal(t, "0123456789", string(b))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func readAll(t *testing.T, l *LinkBuffer) string {
+	b, err := ioutil.ReadAll(l)
+	require.NoError(t, err)
+	return string(b)
+}
+
+func TestLinkBuffer_AppendOwned(t *testing.T) {
+	var released int
+	l := NewLinkBuffer()
+	l.AppendOwned(nil, func() { released++ })
+	assert.Equal(t, 1, released)
+
+	l.AppendOwned([]byte("hello"), func() { released++ })
+	s, err := l.Slice(2)
+	require.NoError(t, err)
+	require.NoError(t, l.Skip(5))
+	// 切片仍然引用着调用者的内存
+	assert.Equal(t, 1, released)
+	s.Release()
+	assert.Equal(t, 2, released)
+}
+
+func TestLinkBuffer_ReserveCommit(t *testing.T) {
+	l := NewLinkBufferSize(16)
+	defer l.Release()
+	p := l.Reserve(4)
+	assert.GreaterOrEqual(t, len(p), 16)
+	copy(p, "abcd")
+	l.Commit(4)
+	assert.Equal(t, 4, l.Len())
+
+	// 剩余空间足够时原地写入同一个块
+	p = l.Reserve(8)
+	copy(p, "efgh")
+	l.Commit(4)
+	assert.Len(t, l.Bytes(), 1)
+
+	// 剩余空间不够时分配新的块，未提交的块可以被更大的预留替换
+	p = l.Reserve(20)
+	assert.GreaterOrEqual(t, len(p), 20)
+	p = l.Reserve(40)
+	copy(p, "ij")
+	l.Commit(2)
+	l.Commit(0)
+	assert.Len(t, l.Bytes(), 2)
+	assert.Equal(t, "abcdefghij", string(bytes.Join(l.Bytes(), nil)))
+
+	assert.NotNil(t, l.Reserve(1))
+	l.Release()
+	assert.True(t, l.IsEmpty())
+	assert.Equal(t, DefaultBlockSize, len(NewLinkBufferSize(0).Reserve(1)))
+}
+
+func TestLinkBuffer_Vectors(t *testing.T) {
+	l := NewLinkBuffer()
+	l.Append([]byte("abc"))
+	l.Append([]byte("def"))
+	l.Append([]byte("ghi"))
+
+	assert.Equal(t, [][]byte{[]byte("abc"), []byte("de")}, l.Vectors(nil, 5, 3))
+	assert.Equal(t, [][]byte{[]byte("abc"), []byte("def")}, l.Vectors(nil, 100, 2))
+	assert.Empty(t, l.Vectors(nil, 0, 3))
+	assert.Equal(t, 9, l.Len())
+}
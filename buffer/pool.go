@@ -0,0 +1,27 @@
+package buffer
+
+import (
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/byteslice"
+	rbPool "github.com/Ccheers/haijun-net/internal/pkg/pool/ringbuffer"
+)
+
+// GetBytes returns a byte slice of length size from the pool, its capacity is size rounded up to a power of 2.
+func GetBytes(size int) []byte {
+	return byteslice.Get(size)
+}
+
+// PutBytes returns the byte slice got from GetBytes to the pool, it mustn't be used afterwards.
+func PutBytes(b []byte) {
+	byteslice.Put(b)
+}
+
+// GetRingBuffer returns an empty ring buffer with at least size bytes of capacity from the pool.
+func GetRingBuffer(size int) *RingBuffer {
+	return rbPool.GetWithSize(size)
+}
+
+// PutRingBuffer returns the ring buffer got from GetRingBuffer to the pool, it mustn't be used afterwards.
+// The buffers much larger than the ones usually put are discarded instead of pooled.
+func PutRingBuffer(rb *RingBuffer) {
+	rbPool.Put(rb)
+}
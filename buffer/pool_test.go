@@ -0,0 +1,72 @@
+package buffer
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBytesPool(t *testing.T) {
+	b := GetBytes(100)
+	assert.Len(t, b, 100)
+	assert.Equal(t, 128, cap(b))
+	PutBytes(b)
+	assert.Nil(t, GetBytes(0))
+}
+
+func TestRingBufferPool(t *testing.T) {
+	rb := GetRingBuffer(4096)
+	assert.True(t, rb.IsEmpty())
+	assert.GreaterOrEqual(t, rb.Cap(), 4096)
+	_, err := rb.Write([]byte("hello"))
+	require.NoError(t, err)
+	PutRingBuffer(rb)
+}
+
+func TestRingBuffer(t *testing.T) {
+	rb, err := NewRingBuffer(5)
+	require.NoError(t, err)
+	assert.Equal(t, 8, rb.Cap())
+	_, err = rb.ReadByte()
+	assert.Equal(t, ErrRingBufferEmpty, err)
+
+	_, _ = rb.Write([]byte("abcdef"))
+	rb.Discard(4)
+	// 写入绕过缓冲区末尾后分成两段返回
+	_, _ = rb.Write([]byte("ghi"))
+	head, tail := rb.PeekAll()
+	assert.Equal(t, "efgh", string(head))
+	assert.Equal(t, "i", string(tail))
+
+	// 超过容量的写入会扩容
+	_, _ = rb.Write([]byte("jklmnopq"))
+	assert.Equal(t, 13, rb.Length())
+	p := make([]byte, 13)
+	n, err := rb.Read(p)
+	require.NoError(t, err)
+	assert.Equal(t, "efghijklmnopq", string(p[:n]))
+}
+
+func TestRingBuffer_MaxCapAndShrink(t *testing.T) {
+	rb := GetRingBuffer(1024)
+	defer PutRingBuffer(rb)
+	rb.SetMaxCap(4096)
+	rb.SetShrinkPolicy(ShrinkPolicy{IdleReads: 2, MinCap: 1024})
+
+	// 增长受 MaxCap 限制
+	n, err := rb.Write(make([]byte, 8192))
+	assert.Equal(t, ErrRingBufferFull, err)
+	assert.Equal(t, 4096, n)
+	assert.Equal(t, 4096, rb.Cap())
+	assert.Equal(t, 4096, rb.MaxCap())
+	rb.Discard(4096)
+
+	// 突发之后连续的小量读写让缓冲区收缩回去
+	p := make([]byte, 16)
+	for i := 0; i < 2; i++ {
+		_, _ = rb.Write(p)
+		_, _ = rb.Read(p)
+	}
+	assert.Equal(t, 1024, rb.Cap())
+}
@@ -0,0 +1,31 @@
+package buffer
+
+import (
+	"github.com/Ccheers/haijun-net/internal/pkg/ringbuffer"
+)
+
+// RingBuffer is a circular buffer implementing io.ReadWriter for the application, such as a per-conn
+// frame assembler which sees occasional large frames. It grows when it's written beyond its capacity
+// up to its MaxCap, and shrinks back after a burst according to its ShrinkPolicy.
+//
+// MaxCap and ShrinkPolicy only affect the RingBuffers owned by the application, they don't apply to
+// the buffers of the conns: those are LinkBuffers bounded by haijun_net.Options.MaxReadBufferSize
+// and MemoryBudget, and released by the engine once they are drained.
+//
+// Peek and PeekAll return the buffered bytes in place as two slices, the tail is non-empty when
+// the data wraps around the end of the buffer.
+type RingBuffer = ringbuffer.RingBuffer
+
+// ErrRingBufferEmpty is returned when reading an empty ring buffer.
+var ErrRingBufferEmpty = ringbuffer.ErrIsEmpty
+
+// ErrRingBufferFull is returned when writing a ring buffer which can't grow beyond its MaxCap.
+var ErrRingBufferFull = ringbuffer.ErrIsFull
+
+// ShrinkPolicy tells a RingBuffer owned by the application when to give back the memory it grew for a burst.
+type ShrinkPolicy = ringbuffer.ShrinkPolicy
+
+// NewRingBuffer returns a ring buffer whose capacity is size rounded up to a power of 2.
+func NewRingBuffer(size int) (*RingBuffer, error) {
+	return ringbuffer.New(size)
+}
@@ -0,0 +1,170 @@
+// Package codec provides the frame codecs decoding the inbound data of a connection in place.
+//
+// The decoders work on an Inbound, which is implemented by *haijun_net.HjConn for the event-driven
+// mode, where they're called from OnTraffic until they return ErrIncomplete, and by Stream for the
+// blocking mode, where Stream.ReadFrame reads the conn until a frame is decoded.
+package codec
+
+import (
+	"errors"
+	"io"
+	"math"
+
+	"github.com/Ccheers/haijun-net/buffer"
+)
+
+var (
+	// ErrIncomplete is returned by the decoders when the next frame isn't fully buffered yet,
+	// nothing is consumed in that case.
+	ErrIncomplete = errors.New("codec: incomplete frame")
+
+	// ErrTooLarge is returned when a frame exceeds the max frame length, the conn should be closed
+	// since the rest of the stream can't be decoded.
+	ErrTooLarge = errors.New("codec: frame too large")
+
+	// ErrInvalidLength is returned when the length field of a frame is corrupted.
+	ErrInvalidLength = errors.New("codec: invalid length field")
+)
+
+// Inbound is the buffered inbound data of a connection the decoders consume.
+type Inbound interface {
+	// InboundBuffered returns the number of buffered bytes.
+	InboundBuffered() int
+	// Peek returns up to n buffered bytes without consuming them, split into head and tail.
+	Peek(n int) (head, tail []byte)
+	// PeekVectors appends the slices holding up to n buffered bytes to dst in place without consuming them.
+	PeekVectors(dst [][]byte, n int) [][]byte
+	// Discard consumes the next n bytes.
+	Discard(n int) int
+	// Next consumes the next n bytes and returns them without copying.
+	Next(n int) (*buffer.LinkBuffer, error)
+}
+
+// Decoder decodes the frames of a protocol.
+type Decoder interface {
+	// Decode consumes the next frame of in and returns it, it returns ErrIncomplete without
+	// consuming anything when the frame isn't fully buffered.
+	Decode(in Inbound) (*buffer.LinkBuffer, error)
+}
+
+// peekAt returns the n buffered bytes of in starting at offset as one slice, scratch is used when
+// they are split in head and tail. It returns nil when fewer bytes are buffered.
+func peekAt(in Inbound, offset, n int, scratch []byte) []byte {
+	head, tail := in.Peek(offset + n)
+	if len(head)+len(tail) < offset+n {
+		return nil
+	}
+	if len(head) >= offset+n {
+		return head[offset : offset+n]
+	}
+	scratch = scratch[:0]
+	if offset < len(head) {
+		scratch = append(scratch, head[offset:]...)
+		return append(scratch, tail[:n-len(scratch)]...)
+	}
+	return append(scratch, tail[offset-len(head):offset-len(head)+n]...)
+}
+
+// Stream buffers the data read from a blocking reader, e.g. a HjConn which isn't served by an
+// EventHandler or any other net.Conn, so that the decoders can consume it.
+//
+// A Stream isn't safe for concurrent use.
+type Stream struct {
+	r   io.Reader
+	buf *buffer.LinkBuffer
+	err error
+}
+
+// NewStream returns a Stream reading r.
+func NewStream(r io.Reader) *Stream {
+	return &Stream{r: r, buf: buffer.NewLinkBuffer()}
+}
+
+// InboundBuffered returns the number of bytes read from the reader and not consumed yet.
+func (s *Stream) InboundBuffered() int {
+	return s.buf.Len()
+}
+
+// Peek returns up to n buffered bytes without consuming them, tail is non-empty when they span
+// more than one block of the buffer.
+func (s *Stream) Peek(n int) (head, tail []byte) {
+	if l := s.buf.Len(); n > l {
+		n = l
+	}
+	var bs [2][]byte
+	vs := s.buf.Vectors(bs[:0], n, 2)
+	switch len(vs) {
+	case 0:
+		return
+	case 1:
+		return vs[0], nil
+	}
+	head, tail = vs[0], vs[1]
+	if len(head)+len(tail) < n {
+		p, _ := s.buf.Peek(n)
+		tail = p[len(head):]
+	}
+	return
+}
+
+// PeekVectors appends the slices holding up to n buffered bytes to dst in place without consuming them.
+func (s *Stream) PeekVectors(dst [][]byte, n int) [][]byte {
+	return s.buf.Vectors(dst, n, math.MaxInt32)
+}
+
+// Discard consumes the next n buffered bytes and returns the number of bytes discarded.
+func (s *Stream) Discard(n int) int {
+	if l := s.buf.Len(); n > l {
+		n = l
+	}
+	_ = s.buf.Skip(n)
+	return n
+}
+
+// Next consumes the next n buffered bytes and returns them without copying.
+func (s *Stream) Next(n int) (*buffer.LinkBuffer, error) {
+	return s.buf.Split(n)
+}
+
+// Fill reads the reader once and buffers the data, it blocks until some data is read.
+func (s *Stream) Fill() error {
+	if s.err != nil {
+		return s.err
+	}
+	for {
+		p := s.buf.Reserve(1)
+		n, err := s.r.Read(p)
+		s.buf.Commit(n)
+		if err != nil {
+			s.err = err
+		}
+		if n > 0 {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// ReadFrame blocks until d decodes a frame from the data read from the reader. It returns
+// io.ErrUnexpectedEOF when the reader hits EOF in the middle of a frame.
+func (s *Stream) ReadFrame(d Decoder) (*buffer.LinkBuffer, error) {
+	for {
+		frame, err := d.Decode(s)
+		if err != ErrIncomplete {
+			return frame, err
+		}
+		if err = s.Fill(); err != nil {
+			if err == io.EOF && s.buf.Len() > 0 {
+				return nil, io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+	}
+}
+
+// Release drops the buffered data and returns its memory to the pool.
+func (s *Stream) Release() {
+	s.buf.Release()
+}
@@ -0,0 +1,141 @@
+package codec
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	hjnet "github.com/Ccheers/haijun-net"
+	"github.com/Ccheers/haijun-net/buffer"
+)
+
+var _ Inbound = (*hjnet.HjConn)(nil)
+
+func TestPeekAt(t *testing.T) {
+	s := NewStream(nil)
+	s.buf.Append([]byte("abc"))
+	s.buf.Append([]byte("de"))
+	s.buf.Append([]byte("fg"))
+
+	var scratch [8]byte
+	assert.Equal(t, "bc", string(peekAt(s, 1, 2, scratch[:])))
+	assert.Equal(t, "bcd", string(peekAt(s, 1, 3, scratch[:])))
+	assert.Equal(t, "de", string(peekAt(s, 3, 2, scratch[:])))
+	// 跨越两个以上的块
+	assert.Equal(t, "cdef", string(peekAt(s, 2, 4, scratch[:])))
+	assert.Nil(t, peekAt(s, 5, 3, scratch[:]))
+
+	assert.Equal(t, 2, s.Discard(2))
+	b, err := s.Next(3)
+	require.NoError(t, err)
+	assert.Equal(t, "cde", frameString(t, b))
+	assert.Equal(t, 2, s.Discard(5))
+	assert.Zero(t, s.InboundBuffered())
+}
+
+type frameHandler struct {
+	hjnet.BuiltinEventHandler
+	codec *LengthFieldCodec
+}
+
+func (h *frameHandler) OnTraffic(c *hjnet.HjConn) hjnet.Action {
+	for {
+		frame, err := h.codec.Decode(c)
+		if err == ErrIncomplete {
+			return hjnet.None
+		}
+		if err != nil {
+			return hjnet.Close
+		}
+		out := buffer.NewLinkBuffer()
+		p, _ := frame.Peek(frame.Len())
+		_ = h.codec.EncodeTo(out, p)
+		_, _ = c.WriteBuffer(out)
+		frame.Release()
+	}
+}
+
+func newTestCodec(t *testing.T) *LengthFieldCodec {
+	c, err := NewLengthFieldCodec(LengthFieldConfig{LengthFieldLength: 4, InitialBytesToStrip: 4, MaxFrameLength: 1024})
+	require.NoError(t, err)
+	return c
+}
+
+// exchange sends the frames in pieces and reads the echoed frames by a Stream.
+func exchange(t *testing.T, c *LengthFieldCodec, addr string) {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+
+	var wire []byte
+	msgs := []string{"hello", "", "world"}
+	for _, msg := range msgs {
+		p, err := c.Encode([]byte(msg))
+		require.NoError(t, err)
+		wire = append(wire, p...)
+	}
+	for i := 0; i < len(wire); i += 3 {
+		_, err = conn.Write(wire[i:min(i+3, len(wire))])
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+
+	s := NewStream(conn)
+	defer s.Release()
+	for _, msg := range msgs {
+		frame, err := s.ReadFrame(c)
+		require.NoError(t, err)
+		assert.Equal(t, msg, frameString(t, frame))
+	}
+
+	// 超过上限的帧导致连接被关闭
+	_, err = conn.Write([]byte{0, 0, 4, 0})
+	require.NoError(t, err)
+	_, err = s.ReadFrame(c)
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestLengthFieldCodec_EventDriven(t *testing.T) {
+	c := newTestCodec(t)
+	l, err := hjnet.NewHjListener("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		_ = l.(*hjnet.HjListener).Serve(&frameHandler{codec: c})
+	}()
+	exchange(t, c, l.Addr().String())
+}
+
+func TestLengthFieldCodec_Blocking(t *testing.T) {
+	c := newTestCodec(t)
+	l, err := hjnet.NewHjListener("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		s := NewStream(conn)
+		defer s.Release()
+		for {
+			frame, err := s.ReadFrame(c)
+			if err != nil {
+				return
+			}
+			p, _ := frame.Peek(frame.Len())
+			out, _ := c.Encode(p)
+			frame.Release()
+			if _, err = conn.Write(out); err != nil {
+				return
+			}
+		}
+	}()
+	exchange(t, c, l.Addr().String())
+}
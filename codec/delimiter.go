@@ -0,0 +1,213 @@
+package codec
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/Ccheers/haijun-net/buffer"
+)
+
+// DelimiterConfig configures a DelimiterCodec.
+type DelimiterConfig struct {
+	// Delimiter ends the frames.
+	Delimiter []byte
+	// MaxLength is the max length of a frame excluding the delimiter, DefaultMaxFrameLength if zero.
+	MaxLength int
+	// StripDelimiter drops the delimiter from the decoded frames.
+	StripDelimiter bool
+}
+
+// DelimiterCodec decodes the frames ended by a delimiter and encodes the frames by appending it,
+// it's safe for concurrent use.
+//
+// The inbound data is scanned in place, including the delimiters spanning the blocks of the buffer,
+// and consumed without copying once a full frame is buffered.
+type DelimiterCodec struct {
+	delim     []byte
+	encDelim  []byte
+	maxLength int
+	strip     bool
+	line      bool // 按行分割，"\r\n" 和 "\n" 都作为分隔符
+}
+
+// NewDelimiterCodec returns a DelimiterCodec configured by cfg.
+func NewDelimiterCodec(cfg DelimiterConfig) (*DelimiterCodec, error) {
+	if len(cfg.Delimiter) == 0 {
+		return nil, errors.New("codec: empty delimiter")
+	}
+	if cfg.MaxLength < 0 {
+		return nil, errors.New("codec: negative max length")
+	}
+	if cfg.MaxLength == 0 {
+		cfg.MaxLength = DefaultMaxFrameLength
+	}
+	delim := append([]byte(nil), cfg.Delimiter...)
+	return &DelimiterCodec{delim: delim, encDelim: delim, maxLength: cfg.MaxLength, strip: cfg.StripDelimiter}, nil
+}
+
+// NewLineCodec returns a DelimiterCodec for the lines ended by "\n" or "\r\n", the whole line ending
+// is stripped when strip is true. The encoded lines are ended by "\r\n". maxLength is the max length
+// of a line excluding the line ending, DefaultMaxFrameLength if zero.
+func NewLineCodec(maxLength int, strip bool) *DelimiterCodec {
+	if maxLength <= 0 {
+		maxLength = DefaultMaxFrameLength
+	}
+	return &DelimiterCodec{delim: []byte("\n"), encDelim: []byte("\r\n"), maxLength: maxLength, strip: strip, line: true}
+}
+
+// Decode consumes the next frame of in and returns it. It returns ErrIncomplete when the delimiter
+// isn't buffered yet, and ErrTooLarge when it isn't found within the max length.
+//
+// The buffered data is scanned from the start on every call, a conn receiving its frames in many
+// small pieces should decode them by its own decoder, see NewDecoder.
+func (c *DelimiterCodec) Decode(in Inbound) (*buffer.LinkBuffer, error) {
+	d := DelimiterDecoder{codec: c}
+	return d.Decode(in)
+}
+
+// NewDecoder returns a decoder for the frames of one conn, e.g. kept by HjConn.SetContext.
+func (c *DelimiterCodec) NewDecoder() *DelimiterDecoder {
+	return &DelimiterDecoder{codec: c}
+}
+
+// DelimiterDecoder decodes the frames of one conn like its DelimiterCodec, it remembers how far
+// the buffered data has been scanned so that a frame arriving in many pieces is scanned only once.
+// It must be the only consumer of the inbound data of the conn, and it isn't safe for concurrent use.
+type DelimiterDecoder struct {
+	codec *DelimiterCodec
+	// scanned is the number of buffered bytes where no delimiter starts.
+	scanned int
+	vs      [][]byte // 复用以避免分配
+}
+
+// Decode consumes the next frame of in and returns it, the scan resumes where the last call stopped.
+// It returns ErrIncomplete when the delimiter isn't buffered yet, and ErrTooLarge when it isn't found
+// within the max length.
+func (d *DelimiterDecoder) Decode(in Inbound) (*buffer.LinkBuffer, error) {
+	c := d.codec
+	// 最多扫描 maxLength 加上分隔符的长度，行分割时还要算上 "\r"
+	limit := c.maxLength + len(c.delim)
+	if c.line {
+		limit++
+	}
+	d.vs = in.PeekVectors(d.vs[:0], limit)
+	defer d.clearVectors()
+	avail := 0
+	for _, v := range d.vs {
+		avail += len(v)
+	}
+	if d.scanned > avail {
+		d.scanned = 0
+	}
+	i := indexVectors(d.vs, c.delim, d.scanned)
+	if i < 0 {
+		if avail >= limit {
+			d.scanned = 0
+			return nil, ErrTooLarge
+		}
+		// 末尾不足一个分隔符的字节下次还要再看
+		if d.scanned = avail - len(c.delim) + 1; d.scanned < 0 {
+			d.scanned = 0
+		}
+		return nil, ErrIncomplete
+	}
+	d.scanned = 0
+
+	n, dl := i, len(c.delim)
+	if c.line && n > 0 && byteAt(d.vs, n-1) == '\r' {
+		n--
+		dl++
+	}
+	if n > c.maxLength {
+		return nil, ErrTooLarge
+	}
+	if !c.strip {
+		return in.Next(n + dl)
+	}
+	frame, err := in.Next(n)
+	if err != nil {
+		return nil, err
+	}
+	in.Discard(dl)
+	return frame, nil
+}
+
+// clearVectors drops the references to the inbound data, which may be consumed after Decode returns.
+func (d *DelimiterDecoder) clearVectors() {
+	for i := range d.vs {
+		d.vs[i] = nil
+	}
+}
+
+// indexVectors returns the index of the first delim starting at from or later in the data held by vs, or -1.
+func indexVectors(vs [][]byte, delim []byte, from int) int {
+	var scratch [32]byte
+	pos := 0 // vs[i] 在数据中的偏移
+	for i, v := range vs {
+		if pos+len(v) <= from {
+			pos += len(v)
+			continue
+		}
+		start := 0
+		if from > pos {
+			start = from - pos
+		}
+		if j := bytes.Index(v[start:], delim); j >= 0 {
+			return pos + start + j
+		}
+		// 分隔符可能跨越后面的几个分段
+		if d := len(delim) - 1; d > 0 && i+1 < len(vs) {
+			k := min(d, len(v)-start)
+			boundary := append(scratch[:0], v[len(v)-k:]...)
+			for _, next := range vs[i+1:] {
+				if len(boundary) >= k+d {
+					break
+				}
+				boundary = append(boundary, next[:min(k+d-len(boundary), len(next))]...)
+			}
+			if j := bytes.Index(boundary, delim); j >= 0 {
+				return pos + len(v) - k + j
+			}
+		}
+		pos += len(v)
+	}
+	return -1
+}
+
+// byteAt returns the byte at i of the data held by vs, i must be in range.
+func byteAt(vs [][]byte, i int) byte {
+	for _, v := range vs {
+		if i < len(v) {
+			return v[i]
+		}
+		i -= len(v)
+	}
+	return 0
+}
+
+// Encode returns frame followed by the delimiter.
+func (c *DelimiterCodec) Encode(frame []byte) ([]byte, error) {
+	if len(frame) > c.maxLength {
+		return nil, ErrTooLarge
+	}
+	dst := make([]byte, 0, len(frame)+len(c.encDelim))
+	return append(append(dst, frame...), c.encDelim...), nil
+}
+
+// EncodeTo appends frame to dst without copying and writes the delimiter after it, so that they can
+// be sent by HjConn.WriteBuffer. frame mustn't be modified until dst is released.
+func (c *DelimiterCodec) EncodeTo(dst *buffer.LinkBuffer, frame []byte) error {
+	if len(frame) > c.maxLength {
+		return ErrTooLarge
+	}
+	dst.Append(frame)
+	_, _ = dst.Write(c.encDelim)
+	return nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
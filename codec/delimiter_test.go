@@ -0,0 +1,237 @@
+package codec
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	hjnet "github.com/Ccheers/haijun-net"
+	"github.com/Ccheers/haijun-net/buffer"
+)
+
+// splitStream returns a Stream whose data is in pieces, so that Peek returns them as head and tail.
+func splitStream(pieces ...string) *Stream {
+	s := NewStream(bytes.NewReader(nil))
+	for _, p := range pieces {
+		s.buf.Append([]byte(p))
+	}
+	return s
+}
+
+func decodeAll(t *testing.T, c Decoder, s *Stream) (frames []string, err error) {
+	for {
+		frame, err := c.Decode(s)
+		if err != nil {
+			return frames, err
+		}
+		frames = append(frames, frameString(t, frame))
+	}
+}
+
+func TestDelimiterCodec_Decode(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		codec  *DelimiterCodec
+		pieces []string
+		frames []string
+	}{
+		{
+			name:   "line",
+			codec:  NewLineCodec(0, true),
+			pieces: []string{"HELO a\r\nQUIT\n", "rest"},
+			frames: []string{"HELO a", "QUIT"},
+		},
+		{
+			name:   "line keep ending",
+			codec:  NewLineCodec(0, false),
+			pieces: []string{"HELO a\r\nQUIT\n"},
+			frames: []string{"HELO a\r\n", "QUIT\n"},
+		},
+		{
+			name:   "crlf across head and tail",
+			codec:  NewLineCodec(0, true),
+			pieces: []string{"PING\r", "\nPONG\r\n"},
+			frames: []string{"PING", "PONG"},
+		},
+		{
+			name:   "frame across head and tail",
+			codec:  NewLineCodec(0, true),
+			pieces: []string{"GET ke", "y\r\n"},
+			frames: []string{"GET key"},
+		},
+		{
+			name:   "empty line",
+			codec:  NewLineCodec(0, true),
+			pieces: []string{"\r\n\n"},
+			frames: []string{"", ""},
+		},
+		{
+			name:   "delimiter across head and tail",
+			codec:  mustDelimiter(t, DelimiterConfig{Delimiter: []byte("||"), StripDelimiter: true}),
+			pieces: []string{"abc|", "|de||f"},
+			frames: []string{"abc", "de"},
+		},
+		{
+			name:   "delimiter in tail",
+			codec:  mustDelimiter(t, DelimiterConfig{Delimiter: []byte("\x00\x00")}),
+			pieces: []string{"ab", "cd\x00\x00"},
+			frames: []string{"abcd\x00\x00"},
+		},
+		{
+			name:   "delimiter across three blocks",
+			codec:  mustDelimiter(t, DelimiterConfig{Delimiter: []byte("|||"), StripDelimiter: true}),
+			pieces: []string{"ab|", "|", "|cd|||"},
+			frames: []string{"ab", "cd"},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			s := splitStream(tc.pieces...)
+			defer s.Release()
+			frames, err := decodeAll(t, tc.codec, s)
+			assert.Equal(t, ErrIncomplete, err)
+			assert.Equal(t, tc.frames, frames)
+
+			s = splitStream(tc.pieces...)
+			defer s.Release()
+			frames, err = decodeAll(t, tc.codec.NewDecoder(), s)
+			assert.Equal(t, ErrIncomplete, err)
+			assert.Equal(t, tc.frames, frames)
+		})
+	}
+}
+
+func TestDelimiterDecoder_SmallPieces(t *testing.T) {
+	c := mustDelimiter(t, DelimiterConfig{Delimiter: []byte("\r\n\r\n"), MaxLength: 64 << 10})
+	d := c.NewDecoder()
+	s := NewStream(bytes.NewReader(nil))
+	defer s.Release()
+
+	// 一个帧分成很多小块到达，每次只扫描新到的数据，不复制也不分配
+	msg := strings.Repeat("0123456789\r\n", 2000) + "\r\n"
+	for i := 0; i < len(msg)-1; i += 7 {
+		_, _ = s.buf.WriteString(msg[i:min(i+7, len(msg)-1)])
+		_, err := d.Decode(s)
+		require.Equal(t, ErrIncomplete, err)
+		assert.Equal(t, s.InboundBuffered()-3, d.scanned)
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		_, _ = d.Decode(s)
+	})
+	assert.Zero(t, allocs)
+
+	_, _ = s.buf.WriteString(msg[len(msg)-1:])
+	frame, err := d.Decode(s)
+	require.NoError(t, err)
+	assert.Equal(t, msg, frameString(t, frame))
+	assert.Zero(t, s.InboundBuffered())
+	assert.Zero(t, d.scanned)
+}
+
+func mustDelimiter(t *testing.T, cfg DelimiterConfig) *DelimiterCodec {
+	c, err := NewDelimiterCodec(cfg)
+	require.NoError(t, err)
+	return c
+}
+
+func TestDelimiterCodec_MaxLength(t *testing.T) {
+	_, err := NewDelimiterCodec(DelimiterConfig{})
+	assert.Error(t, err)
+	_, err = NewDelimiterCodec(DelimiterConfig{Delimiter: []byte(";"), MaxLength: -1})
+	assert.Error(t, err)
+
+	c := NewLineCodec(4, true)
+	frames, err := decodeAll(t, c, splitStream("abcd\r\n", "abcd\n", "abc"))
+	assert.Equal(t, ErrIncomplete, err)
+	assert.Equal(t, []string{"abcd", "abcd"}, frames)
+
+	// 超过上限还没有找到分隔符，不会一直缓冲下去
+	_, err = decodeAll(t, c, splitStream("abcde", "f"))
+	assert.Equal(t, ErrTooLarge, err)
+	_, err = decodeAll(t, c, splitStream("abcde\n"))
+	assert.Equal(t, ErrTooLarge, err)
+
+	d := mustDelimiter(t, DelimiterConfig{Delimiter: []byte(";"), MaxLength: 2})
+	_, err = decodeAll(t, d, splitStream("ab", "c;"))
+	assert.Equal(t, ErrTooLarge, err)
+	_, err = d.Encode([]byte("abc"))
+	assert.Equal(t, ErrTooLarge, err)
+	assert.Equal(t, ErrTooLarge, d.EncodeTo(buffer.NewLinkBuffer(), []byte("abc")))
+}
+
+func TestDelimiterCodec_Encode(t *testing.T) {
+	c := NewLineCodec(0, true)
+	p, err := c.Encode([]byte("QUIT"))
+	require.NoError(t, err)
+	assert.Equal(t, "QUIT\r\n", string(p))
+
+	d := mustDelimiter(t, DelimiterConfig{Delimiter: []byte("||")})
+	lb := buffer.NewLinkBuffer()
+	require.NoError(t, d.EncodeTo(lb, []byte("abc")))
+	assert.Equal(t, "abc||", frameString(t, lb))
+}
+
+type lineHandler struct {
+	hjnet.BuiltinEventHandler
+	codec *DelimiterCodec
+}
+
+func (h *lineHandler) OnOpen(c *hjnet.HjConn) hjnet.Action {
+	c.SetContext(h.codec.NewDecoder())
+	return hjnet.None
+}
+
+func (h *lineHandler) OnTraffic(c *hjnet.HjConn) hjnet.Action {
+	d := c.Context().(*DelimiterDecoder)
+	for {
+		line, err := d.Decode(c)
+		if err == ErrIncomplete {
+			return hjnet.None
+		}
+		if err != nil {
+			return hjnet.Close
+		}
+		p, _ := line.Peek(line.Len())
+		out, _ := h.codec.Encode(bytes.ToUpper(p))
+		line.Release()
+		_, _ = c.Write(out)
+	}
+}
+
+func TestLineCodec_EventDriven(t *testing.T) {
+	c := NewLineCodec(16, true)
+	l, err := hjnet.NewHjListener("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		_ = l.(*hjnet.HjListener).Serve(&lineHandler{codec: c})
+	}()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	for _, piece := range []string{"he", "lo\r", "\nqu", "it\nabc\r\n"} {
+		_, err = conn.Write([]byte(piece))
+		require.NoError(t, err)
+		time.Sleep(time.Millisecond)
+	}
+	s := NewStream(conn)
+	defer s.Release()
+	for _, want := range []string{"HELO", "QUIT", "ABC"} {
+		line, err := s.ReadFrame(c)
+		require.NoError(t, err)
+		assert.Equal(t, want, frameString(t, line))
+	}
+
+	_, err = conn.Write([]byte(strings.Repeat("x", 32)))
+	require.NoError(t, err)
+	// 超过上限的行导致连接被关闭
+	_, err = s.ReadFrame(c)
+	assert.Equal(t, io.EOF, err)
+}
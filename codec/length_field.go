@@ -0,0 +1,215 @@
+package codec
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+
+	"github.com/Ccheers/haijun-net/buffer"
+)
+
+// Varint is the LengthFieldLength of a length field encoded as an unsigned varint, which is
+// independent of the byte order.
+const Varint = -1
+
+// DefaultMaxFrameLength is the max frame length used when LengthFieldConfig.MaxFrameLength is zero.
+const DefaultMaxFrameLength = 4 << 20 // 4MB
+
+// ErrUnsupportedLength is returned by NewLengthFieldCodec for a LengthFieldLength other than
+// 1, 2, 4, 8 and Varint.
+var ErrUnsupportedLength = errors.New("codec: unsupported length field length")
+
+// LengthFieldConfig configures a LengthFieldCodec, the fields follow the netty LengthFieldBasedFrameDecoder:
+// the frame length is the value of the length field plus LengthAdjustment plus the bytes up to the end
+// of the length field, and the first InitialBytesToStrip bytes of the frame are dropped.
+//
+// For example a 2 bytes header holding the length of the body:
+//
+//	LengthFieldLength = 2, InitialBytesToStrip = 2
+//	+--------+----------------+      +----------------+
+//	| 0x000C | "HELLO, WORLD" |----->| "HELLO, WORLD" |
+//	+--------+----------------+      +----------------+
+//
+// and a 1 byte type followed by a 4 bytes length counting the whole frame:
+//
+//	LengthFieldOffset = 1, LengthFieldLength = 4, LengthAdjustment = -5
+//	+------+------------+----------------+      +------+------------+----------------+
+//	| 0x01 | 0x00000011 | "HELLO, WORLD" |----->| 0x01 | 0x00000011 | "HELLO, WORLD" |
+//	+------+------------+----------------+      +------+------------+----------------+
+type LengthFieldConfig struct {
+	// ByteOrder is the byte order of the length field, binary.BigEndian if nil.
+	ByteOrder binary.ByteOrder
+	// LengthFieldOffset is the offset of the length field in the frame.
+	LengthFieldOffset int
+	// LengthFieldLength is the width of the length field in bytes: 1, 2, 4, 8 or Varint.
+	LengthFieldLength int
+	// LengthAdjustment is added to the value of the length field to get the length of the rest of the frame.
+	LengthAdjustment int
+	// InitialBytesToStrip is the number of bytes dropped from the start of the decoded frame.
+	InitialBytesToStrip int
+	// MaxFrameLength is the max length of a frame including its header, DefaultMaxFrameLength if zero.
+	MaxFrameLength int
+}
+
+// LengthFieldCodec decodes the frames prefixed by their length and encodes the frames with a length
+// field, it's safe for concurrent use.
+type LengthFieldCodec struct {
+	cfg LengthFieldConfig
+}
+
+// NewLengthFieldCodec returns a LengthFieldCodec configured by cfg.
+func NewLengthFieldCodec(cfg LengthFieldConfig) (*LengthFieldCodec, error) {
+	switch cfg.LengthFieldLength {
+	case 1, 2, 4, 8, Varint:
+	default:
+		return nil, ErrUnsupportedLength
+	}
+	if cfg.LengthFieldOffset < 0 || cfg.InitialBytesToStrip < 0 || cfg.MaxFrameLength < 0 {
+		return nil, errors.New("codec: negative offset, bytes to strip or max frame length")
+	}
+	if cfg.ByteOrder == nil {
+		cfg.ByteOrder = binary.BigEndian
+	}
+	if cfg.MaxFrameLength == 0 {
+		cfg.MaxFrameLength = DefaultMaxFrameLength
+	}
+	return &LengthFieldCodec{cfg: cfg}, nil
+}
+
+// Decode consumes the next frame of in and returns it without the stripped bytes. It returns ErrIncomplete
+// when the frame isn't fully buffered, ErrTooLarge when it exceeds MaxFrameLength and ErrInvalidLength
+// when its length field is corrupted.
+func (c *LengthFieldCodec) Decode(in Inbound) (*buffer.LinkBuffer, error) {
+	length, err := c.frameLength(in)
+	if err != nil {
+		return nil, err
+	}
+	if c.cfg.InitialBytesToStrip > length {
+		return nil, ErrInvalidLength
+	}
+	if in.InboundBuffered() < length {
+		return nil, ErrIncomplete
+	}
+	in.Discard(c.cfg.InitialBytesToStrip)
+	return in.Next(length - c.cfg.InitialBytesToStrip)
+}
+
+// frameLength returns the length of the next frame including its header.
+func (c *LengthFieldCodec) frameLength(in Inbound) (int, error) {
+	var scratch [binary.MaxVarintLen64]byte
+	var v uint64
+	var end int
+	offset := c.cfg.LengthFieldOffset
+	if c.cfg.LengthFieldLength == Varint {
+		n := binary.MaxVarintLen64
+		if avail := in.InboundBuffered() - offset; avail < n {
+			n = avail
+		}
+		if n <= 0 {
+			return 0, ErrIncomplete
+		}
+		var w int
+		v, w = binary.Uvarint(peekAt(in, offset, n, scratch[:]))
+		switch {
+		case w == 0 && n < binary.MaxVarintLen64:
+			return 0, ErrIncomplete
+		case w <= 0:
+			return 0, ErrInvalidLength
+		}
+		end = offset + w
+	} else {
+		p := peekAt(in, offset, c.cfg.LengthFieldLength, scratch[:])
+		if p == nil {
+			return 0, ErrIncomplete
+		}
+		v = c.uint(p)
+		end = offset + c.cfg.LengthFieldLength
+	}
+
+	max := c.cfg.MaxFrameLength
+	if v > uint64(max) {
+		return 0, ErrTooLarge
+	}
+	length := int(v) + c.cfg.LengthAdjustment + end
+	if length < end {
+		return 0, ErrInvalidLength
+	}
+	if length > max {
+		return 0, ErrTooLarge
+	}
+	return length, nil
+}
+
+func (c *LengthFieldCodec) uint(p []byte) uint64 {
+	switch len(p) {
+	case 1:
+		return uint64(p[0])
+	case 2:
+		return uint64(c.cfg.ByteOrder.Uint16(p))
+	case 4:
+		return uint64(c.cfg.ByteOrder.Uint32(p))
+	default:
+		return c.cfg.ByteOrder.Uint64(p)
+	}
+}
+
+// AppendHeader appends the length field of a frame carrying n bytes after the length field to dst,
+// the value of the field is n minus LengthAdjustment so that Decode restores the frame with the same
+// config. LengthFieldOffset and InitialBytesToStrip don't apply to the encoding, the bytes before the
+// length field are up to the caller.
+func (c *LengthFieldCodec) AppendHeader(dst []byte, n int) ([]byte, error) {
+	v := n - c.cfg.LengthAdjustment
+	if v < 0 {
+		return dst, ErrInvalidLength
+	}
+	if n > c.cfg.MaxFrameLength {
+		return dst, ErrTooLarge
+	}
+	var b [8]byte
+	switch c.cfg.LengthFieldLength {
+	case Varint:
+		var vb [binary.MaxVarintLen64]byte
+		return append(dst, vb[:binary.PutUvarint(vb[:], uint64(v))]...), nil
+	case 1:
+		if v > math.MaxUint8 {
+			return dst, ErrTooLarge
+		}
+		return append(dst, byte(v)), nil
+	case 2:
+		if v > math.MaxUint16 {
+			return dst, ErrTooLarge
+		}
+		c.cfg.ByteOrder.PutUint16(b[:], uint16(v))
+	case 4:
+		if uint64(v) > math.MaxUint32 {
+			return dst, ErrTooLarge
+		}
+		c.cfg.ByteOrder.PutUint32(b[:], uint32(v))
+	default:
+		c.cfg.ByteOrder.PutUint64(b[:], uint64(v))
+	}
+	return append(dst, b[:c.cfg.LengthFieldLength]...), nil
+}
+
+// Encode returns frame prefixed by its length field.
+func (c *LengthFieldCodec) Encode(frame []byte) ([]byte, error) {
+	dst := make([]byte, 0, binary.MaxVarintLen64+len(frame))
+	dst, err := c.AppendHeader(dst, len(frame))
+	if err != nil {
+		return nil, err
+	}
+	return append(dst, frame...), nil
+}
+
+// EncodeTo writes the length field of frame to dst and appends frame without copying, so that
+// they can be sent by HjConn.WriteBuffer. frame mustn't be modified until dst is released.
+func (c *LengthFieldCodec) EncodeTo(dst *buffer.LinkBuffer, frame []byte) error {
+	var b [binary.MaxVarintLen64]byte
+	hdr, err := c.AppendHeader(b[:0], len(frame))
+	if err != nil {
+		return err
+	}
+	_, _ = dst.Write(hdr)
+	dst.Append(frame)
+	return nil
+}
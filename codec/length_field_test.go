@@ -0,0 +1,156 @@
+package codec
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+	"testing/iotest"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Ccheers/haijun-net/buffer"
+)
+
+func frameString(t *testing.T, b *buffer.LinkBuffer) string {
+	defer b.Release()
+	p, err := b.Peek(b.Len())
+	require.NoError(t, err)
+	return string(p)
+}
+
+func TestLengthFieldCodec_Decode(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		cfg   LengthFieldConfig
+		input []byte
+		frame string
+	}{
+		{
+			name:  "strip header",
+			cfg:   LengthFieldConfig{LengthFieldLength: 2, InitialBytesToStrip: 2},
+			input: []byte("\x00\x0cHELLO, WORLD"),
+			frame: "HELLO, WORLD",
+		},
+		{
+			name:  "keep header",
+			cfg:   LengthFieldConfig{LengthFieldLength: 2},
+			input: []byte("\x00\x0cHELLO, WORLD"),
+			frame: "\x00\x0cHELLO, WORLD",
+		},
+		{
+			name:  "length includes header",
+			cfg:   LengthFieldConfig{LengthFieldLength: 2, LengthAdjustment: -2},
+			input: []byte("\x00\x0eHELLO, WORLD"),
+			frame: "\x00\x0eHELLO, WORLD",
+		},
+		{
+			name:  "offset and adjustment",
+			cfg:   LengthFieldConfig{LengthFieldOffset: 1, LengthFieldLength: 4, LengthAdjustment: -5},
+			input: []byte("\x01\x00\x00\x00\x11HELLO, WORLD"),
+			frame: "\x01\x00\x00\x00\x11HELLO, WORLD",
+		},
+		{
+			name:  "header after length",
+			cfg:   LengthFieldConfig{LengthFieldLength: 1, LengthAdjustment: 2, InitialBytesToStrip: 1},
+			input: []byte("\x05\xca\xfeHELLO"),
+			frame: "\xca\xfeHELLO",
+		},
+		{
+			name:  "little endian",
+			cfg:   LengthFieldConfig{ByteOrder: binary.LittleEndian, LengthFieldLength: 4, InitialBytesToStrip: 4},
+			input: []byte("\x05\x00\x00\x00HELLO"),
+			frame: "HELLO",
+		},
+		{
+			name:  "uint64",
+			cfg:   LengthFieldConfig{LengthFieldLength: 8, InitialBytesToStrip: 8},
+			input: []byte("\x00\x00\x00\x00\x00\x00\x00\x05HELLO"),
+			frame: "HELLO",
+		},
+		{
+			name:  "varint",
+			cfg:   LengthFieldConfig{LengthFieldOffset: 1, LengthFieldLength: Varint, InitialBytesToStrip: 3},
+			input: append([]byte("\x07\xac\x02"), bytes.Repeat([]byte("x"), 300)...),
+			frame: string(bytes.Repeat([]byte("x"), 300)),
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			c, err := NewLengthFieldCodec(tc.cfg)
+			require.NoError(t, err)
+
+			// 一次只读一个字节，每个前缀都是不完整的帧
+			input := append(append([]byte{}, tc.input...), tc.input...)
+			s := NewStream(iotest.OneByteReader(bytes.NewReader(input)))
+			for i := 0; i < 2; i++ {
+				frame, err := s.ReadFrame(c)
+				require.NoError(t, err)
+				assert.Equal(t, tc.frame, frameString(t, frame))
+			}
+			_, err = s.ReadFrame(c)
+			assert.Equal(t, io.EOF, err)
+		})
+	}
+}
+
+func TestLengthFieldCodec_Errors(t *testing.T) {
+	_, err := NewLengthFieldCodec(LengthFieldConfig{LengthFieldLength: 3})
+	assert.Equal(t, ErrUnsupportedLength, err)
+	_, err = NewLengthFieldCodec(LengthFieldConfig{LengthFieldLength: 1, LengthFieldOffset: -1})
+	assert.Error(t, err)
+
+	decode := func(cfg LengthFieldConfig, input string) error {
+		c, err := NewLengthFieldCodec(cfg)
+		require.NoError(t, err)
+		s := NewStream(bytes.NewReader([]byte(input)))
+		defer s.Release()
+		_, err = s.ReadFrame(c)
+		return err
+	}
+	assert.Equal(t, ErrTooLarge, decode(LengthFieldConfig{LengthFieldLength: 2, MaxFrameLength: 10}, "\x00\x09"))
+	assert.Equal(t, ErrTooLarge, decode(LengthFieldConfig{LengthFieldLength: 8}, "\xff\xff\xff\xff\xff\xff\xff\xff"))
+	assert.Equal(t, ErrInvalidLength, decode(LengthFieldConfig{LengthFieldLength: 1, LengthAdjustment: -2}, "\x01"))
+	assert.Equal(t, ErrInvalidLength, decode(LengthFieldConfig{LengthFieldLength: 1, InitialBytesToStrip: 3}, "\x01x"))
+	assert.Equal(t, ErrInvalidLength, decode(LengthFieldConfig{LengthFieldLength: Varint}, "\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff\xff"))
+	assert.Equal(t, io.ErrUnexpectedEOF, decode(LengthFieldConfig{LengthFieldLength: 1}, "\x05abc"))
+	assert.Equal(t, io.ErrUnexpectedEOF, decode(LengthFieldConfig{LengthFieldLength: Varint}, "\x80"))
+}
+
+func TestLengthFieldCodec_Encode(t *testing.T) {
+	for _, cfg := range []LengthFieldConfig{
+		{LengthFieldLength: 1, InitialBytesToStrip: 1},
+		{LengthFieldLength: 2, LengthAdjustment: -2, InitialBytesToStrip: 2},
+		{LengthFieldLength: 4, ByteOrder: binary.LittleEndian, InitialBytesToStrip: 4},
+		{LengthFieldLength: 8, InitialBytesToStrip: 8},
+		{LengthFieldLength: Varint, InitialBytesToStrip: 2},
+	} {
+		c, err := NewLengthFieldCodec(cfg)
+		require.NoError(t, err)
+		payload := bytes.Repeat([]byte("y"), 200)
+		p, err := c.Encode(payload)
+		require.NoError(t, err)
+
+		lb := buffer.NewLinkBuffer()
+		require.NoError(t, c.EncodeTo(lb, payload))
+		assert.Equal(t, p, bytes.Join(lb.Bytes(), nil))
+
+		// 用同一个配置解码得到原来的数据
+		s := NewStream(lb)
+		frame, err := s.ReadFrame(c)
+		require.NoError(t, err, "%+v", cfg)
+		assert.Equal(t, string(payload), frameString(t, frame))
+	}
+
+	c, _ := NewLengthFieldCodec(LengthFieldConfig{LengthFieldLength: 1})
+	_, err := c.Encode(make([]byte, 256))
+	assert.Equal(t, ErrTooLarge, err)
+	c, _ = NewLengthFieldCodec(LengthFieldConfig{LengthFieldLength: 2})
+	_, err = c.Encode(make([]byte, 1<<16))
+	assert.Equal(t, ErrTooLarge, err)
+	c, _ = NewLengthFieldCodec(LengthFieldConfig{LengthFieldLength: 4, MaxFrameLength: 10})
+	assert.Equal(t, ErrTooLarge, c.EncodeTo(buffer.NewLinkBuffer(), make([]byte, 11)))
+	c, _ = NewLengthFieldCodec(LengthFieldConfig{LengthFieldLength: 4, LengthAdjustment: 5})
+	_, err = c.Encode(make([]byte, 4))
+	assert.Equal(t, ErrInvalidLength, err)
+}
@@ -1,78 +1,443 @@
 package haijun_net
 
 import (
-	"log"
+	"io"
+	"math"
 	"net"
 	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/Ccheers/haijun-net/internal/pkg/mixedbuffer"
-	rbPool "github.com/Ccheers/haijun-net/internal/pkg/pool/ringbuffer"
-	"github.com/Ccheers/haijun-net/internal/pkg/ringbuffer"
+	"github.com/Ccheers/haijun-net/buffer"
 	"github.com/Ccheers/haijun-net/internal/poller"
-	"golang.org/x/sys/unix"
 )
 
 var connOnce sync.Once
 var manager *connManager
 
+// nextConnID generates the ids of the conns, fds are reused by the kernel so they can't identify a conn.
+var nextConnID uint64
+
 type HjConn struct {
+	id            uint64
 	fd            int
 	localAddr     net.Addr
 	remoteAddr    net.Addr
 	readDeadline  atomic.Value
 	writeDeadline atomic.Value
 
-	readBuffer  *ringbuffer.RingBuffer
+	// mu guards the buffers, which are shared by the event loop and the user goroutines.
+	// The buffers are allocated on the first use and released when they are drained, see memory.go.
+	mu         sync.Mutex
+	readBuffer *buffer.LinkBuffer
+	// readLimit is the amount of inbound data buffered before reading the socket is paused
+	readLimit   int
 	waitRead    chan struct{}
-	writeBuffer *mixedbuffer.Buffer
+	writeBuffer *buffer.LinkBuffer
+	released    bool
+	// the largest amount of data buffered since the buffer was allocated, and before it was released last time
+	readPeak, readHint   int
+	writePeak, writeHint int
+
+	closed   int32
+	closeErr error
+	done     chan struct{}
+
+	handler  EventHandler
+	executor connExecutor
+	ctx      interface{}
+
+	// statistics, see Stats
+	createdAt time.Time
+	lastRead  int64 // unix nano
+	lastWrite int64 // unix nano
+	bytesIn   uint64
+	bytesOut  uint64
+	pingAt    int64 // unix nano of the unanswered ping, see Heartbeat
+
+	// pending is 1 while the conn is held by the engine until its first bytes arrive, see Options.FirstByteTimeout.
+	pending   int32
+	gateTimer *loopTimer
+	// 仅在事件循环中访问，见 checkReadRate
+	rateBytes     uint64
+	rateReceiving bool
+
+	// bandwidth shaping, the buckets and the pause reasons are guarded by mu, see updateInterest
+	readBucket  *TokenBucket
+	writeBucket *TokenBucket
+	readPaused  uint8
+	writePaused uint8
+	// 仅在事件循环中访问
+	readResume  resumeTimers
+	writeResume resumeTimers
+
+	// tls terminates TLS for the conn when Options.TLSConfig is set
+	tls *tlsTransport
 
 	manager *connManager
 }
 
+// ConnStats is a snapshot of the statistics of a conn.
+type ConnStats struct {
+	CreatedAt time.Time
+	// LastRead is the last time data was read from the socket, it's zero if nothing has been read.
+	LastRead time.Time
+	// LastWrite is the last time data was written to the socket, it's zero if nothing has been written.
+	LastWrite time.Time
+	BytesIn   uint64
+	BytesOut  uint64
+	// PendingOutbound is the number of bytes waiting in the outbound buffer.
+	PendingOutbound int
+	// BufferedInbound is the number of bytes read from the socket but not consumed by the application.
+	BufferedInbound int
+	// Interest is the set of events the conn is polled for.
+	Interest Interest
+}
+
+// Interest is the set of events a conn is polled for.
+type Interest uint8
+
+const (
+	InterestRead Interest = 1 << iota
+	InterestWrite
+)
+
+func (i Interest) String() string {
+	switch i {
+	case InterestRead:
+		return "read"
+	case InterestWrite:
+		return "write"
+	case InterestRead | InterestWrite:
+		return "read|write"
+	}
+	return "none"
+}
+
 func NewHjConn(fd int, localAddr, remoteAddr net.Addr) (net.Conn, error) {
 	connOnce.Do(initConnPoller)
-	conn := &HjConn{
+	conn := newHjConn(fd, localAddr, remoteAddr, manager)
+	err := conn.manager.RegisterConn(conn)
+	if err != nil {
+		manager.opts.Logger.Error("register conn", "fd", fd, "remote_addr", remoteAddr, "error", err)
+		return nil, err
+	}
+	return conn, nil
+}
+
+func newHjConn(fd int, localAddr, remoteAddr net.Addr, m *connManager) *HjConn {
+	return &HjConn{
+		id:            atomic.AddUint64(&nextConnID, 1),
 		fd:            fd,
 		localAddr:     localAddr,
 		remoteAddr:    remoteAddr,
 		readDeadline:  atomic.Value{},
 		writeDeadline: atomic.Value{},
-		readBuffer:    rbPool.GetWithSize(ringbuffer.MaxStreamBufferCap),
 		waitRead:      make(chan struct{}, 1),
-		writeBuffer:   mixedbuffer.New(ringbuffer.MaxStreamBufferCap),
-		manager:       manager,
+		done:          make(chan struct{}),
+		createdAt:     time.Now(),
+		readBucket:    setBucketLimit(nil, m.opts.ConnReadLimit),
+		writeBucket:   setBucketLimit(nil, m.opts.ConnWriteLimit),
+		manager:       m,
 	}
-	err := conn.manager.RegisterConn(conn)
+}
+
+// ID returns the unique id of the conn in the process.
+func (h *HjConn) ID() uint64 {
+	return h.id
+}
+
+// Stats returns a snapshot of the statistics of the conn.
+func (h *HjConn) Stats() ConnStats {
+	s := ConnStats{
+		CreatedAt: h.createdAt,
+		LastRead:  unixNanoToTime(atomic.LoadInt64(&h.lastRead)),
+		LastWrite: unixNanoToTime(atomic.LoadInt64(&h.lastWrite)),
+		BytesIn:   atomic.LoadUint64(&h.bytesIn),
+		BytesOut:  atomic.LoadUint64(&h.bytesOut),
+	}
+	h.mu.Lock()
+	if h.readBuffer != nil {
+		s.BufferedInbound = h.readBuffer.Len()
+	}
+	if h.writeBuffer != nil {
+		s.PendingOutbound = h.writeBuffer.Len()
+	}
+	h.mu.Unlock()
+	if mode, err := h.manager.poller.Mode(h.fd); err == nil && !h.isClosed() {
+		s.Interest = interestOf(mode)
+	}
+	return s
+}
+
+func interestOf(mode poller.PollMode) (i Interest) {
+	if mode&poller.PollModeRead != 0 {
+		i |= InterestRead
+	}
+	if mode&poller.PollModeWrite != 0 {
+		i |= InterestWrite
+	}
+	return
+}
+
+func unixNanoToTime(ns int64) time.Time {
+	if ns == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, ns)
+}
+
+// Read reads the buffered inbound data, it blocks until there is data or the conn is closed.
+//
+// In the event-driven mode Read never blocks, it returns 0, nil when nothing is buffered.
+func (h *HjConn) Read(b []byte) (n int, err error) {
+	for {
+		h.mu.Lock()
+		if h.released {
+			h.mu.Unlock()
+			return 0, net.ErrClosed
+		}
+		if h.readBuffer != nil && !h.readBuffer.IsEmpty() {
+			n, err = h.readBuffer.Read(b)
+			h.consumed()
+			h.mu.Unlock()
+			return
+		}
+		h.mu.Unlock()
+
+		if h.isClosed() {
+			if h.closeErr != nil {
+				return 0, h.closeErr
+			}
+			return 0, io.EOF
+		}
+		if h.handler != nil {
+			return 0, nil
+		}
+		select {
+		case <-h.waitRead:
+		case <-h.done:
+		}
+	}
+}
+
+// Peek returns up to n bytes of the inbound buffer without consuming them, the bytes are valid until
+// they are consumed. They are split into head and tail when they span two blocks of the buffer,
+// tail is a copy when they span more blocks.
+func (h *HjConn) Peek(n int) (head, tail []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.readBuffer == nil {
+		return
+	}
+	if l := h.readBuffer.Len(); n > l {
+		n = l
+	}
+	var bs [2][]byte
+	vs := h.readBuffer.Vectors(bs[:0], n, 2)
+	switch len(vs) {
+	case 0:
+		return
+	case 1:
+		return vs[0], nil
+	}
+	head, tail = vs[0], vs[1]
+	if len(head)+len(tail) < n {
+		// 跨越了两个以上的块，只能复制
+		p, _ := h.readBuffer.Peek(n)
+		tail = p[len(head):]
+	}
+	return
+}
+
+// PeekVectors appends the slices holding up to n bytes of the inbound buffer to dst in place,
+// without consuming them. The slices are valid until the data is consumed.
+func (h *HjConn) PeekVectors(dst [][]byte, n int) [][]byte {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.readBuffer == nil {
+		return dst
+	}
+	return h.readBuffer.Vectors(dst, n, math.MaxInt32)
+}
+
+// Discard skips the next n bytes of the inbound buffer and returns the number of bytes discarded.
+func (h *HjConn) Discard(n int) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.readBuffer == nil {
+		return 0
+	}
+	if l := h.readBuffer.Len(); n > l {
+		n = l
+	}
+	_ = h.readBuffer.Skip(n)
+	h.consumed()
+	return n
+}
+
+// Next consumes the next n bytes of the inbound buffer and returns them without copying, it returns
+// buffer.ErrNotEnough when fewer bytes are buffered. The returned buffer may be handed to another
+// goroutine, it must be released after use so that its memory goes back to the pool.
+func (h *HjConn) Next(n int) (*buffer.LinkBuffer, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.released {
+		return nil, net.ErrClosed
+	}
+	if h.readBuffer == nil {
+		if n > 0 {
+			return nil, buffer.ErrNotEnough
+		}
+		return buffer.NewLinkBuffer(), nil
+	}
+	b, err := h.readBuffer.Split(n)
 	if err != nil {
-		log.Println(err)
 		return nil, err
 	}
-	return conn, nil
+	h.consumed()
+	return b, nil
 }
 
-func (h *HjConn) Read(b []byte) (n int, err error) {
-	if h.readBuffer.IsEmpty() {
-		<-h.waitRead
+// consumed resumes reading the socket if it was paused because the inbound buffer was full,
+// it must be called with mu held after the application consumes the inbound data.
+func (h *HjConn) consumed() {
+	if h.readPaused&pauseBufferFull != 0 && h.readBuffer != nil && h.readBuffer.Len() < h.readLimit && !h.isClosed() {
+		h.readPaused &^= pauseBufferFull
+		_ = h.manager.updateInterest(h)
 	}
-	return h.readBuffer.Read(b)
 }
 
+// Context returns the user-defined context of the conn.
+func (h *HjConn) Context() interface{} {
+	return h.ctx
+}
+
+// SetContext sets up the user-defined context of the conn, e.g. the protocol state kept by the callbacks.
+// It isn't safe for concurrent use, it's meant to be called by the callbacks, which never run concurrently.
+func (h *HjConn) SetContext(ctx interface{}) {
+	h.ctx = ctx
+}
+
+// InboundBuffered returns the number of bytes that can be read from the inbound buffer.
+func (h *HjConn) InboundBuffered() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.readBuffer == nil {
+		return 0
+	}
+	return h.readBuffer.Len()
+}
+
+// InboundFull reports whether the inbound buffer is full and can't grow anymore, no more data is read
+// until the application consumes some. A protocol leaving an incomplete request in the buffer learns
+// that the request is larger than Options.MaxReadBufferSize.
+func (h *HjConn) InboundFull() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.readBuffer != nil && h.readBuffer.Len() >= h.readLimit && h.manager.opts.growReadBuffer(h.readLimit) == 0
+}
+
+// Write appends b to the outbound buffer, the data is sent by the event loop once the fd becomes writable.
+// b is encrypted right away if the conn uses TLS, unless the kernel encrypts it, see Options.KernelTLS.
 func (h *HjConn) Write(b []byte) (n int, err error) {
-	err = h.manager.ModWrite(h)
-	if err != nil {
-		return
+	if h.tls != nil && !h.tls.kernelTX {
+		return h.tls.write(b)
+	}
+	h.mu.Lock()
+	if err = h.prepareWrite(len(b)); err != nil {
+		h.mu.Unlock()
+		return 0, err
 	}
-	return h.writeBuffer.Write(b)
+	n, _ = h.writeBuffer.Write(b)
+	err = h.queued(n)
+	h.mu.Unlock()
+	if o := h.manager.opts.Observer; o != nil && n > 0 {
+		o.OnWriteQueued(h, n)
+	}
+	return
+}
+
+// WriteBuffer moves the data of b to the outbound buffer without copying, b is left empty.
+// The memory referenced by b is released once it's sent.
+func (h *HjConn) WriteBuffer(b *buffer.LinkBuffer) (n int, err error) {
+	if h.tls != nil && !h.tls.kernelTX {
+		return h.tls.writeBuffer(b)
+	}
+	n = b.Len()
+	h.mu.Lock()
+	if err = h.prepareWrite(n); err != nil {
+		h.mu.Unlock()
+		return 0, err
+	}
+	h.writeBuffer.AppendBuffer(b)
+	err = h.queued(n)
+	h.mu.Unlock()
+	if o := h.manager.opts.Observer; o != nil && n > 0 {
+		o.OnWriteQueued(h, n)
+	}
+	return
+}
+
+// prepareWrite takes n bytes from the memory budget and allocates the outbound buffer,
+// it must be called with mu held.
+func (h *HjConn) prepareWrite(n int) error {
+	if h.released || h.isClosed() {
+		return net.ErrClosed
+	}
+	if !h.manager.memory.reserve(n, "write") {
+		return ErrMemoryBudget
+	}
+	if h.writeBuffer == nil {
+		h.manager.newWriteBuffer(h, n)
+	}
+	return nil
+}
+
+// queued accounts the n bytes appended to the outbound buffer and enables the write events,
+// it must be called with mu held.
+func (h *HjConn) queued(n int) error {
+	h.manager.metrics.outboundBytes.Add(int64(n))
+	if l := h.writeBuffer.Len(); l > h.writePeak {
+		h.writePeak = l
+	}
+	return h.manager.updateInterest(h)
 }
 
 func (h *HjConn) Close() error {
-	h.readBuffer.Reset()
-	rbPool.Put(h.readBuffer)
-	h.writeBuffer.Release()
+	err := h.manager.closeConn(h, nil)
+	// 事件驱动模式下由 OnClose 之后释放缓冲区
+	if h.handler == nil {
+		h.release()
+	}
+	return err
+}
+
+// outboundEmpty reports whether all the outbound data has been sent.
+func (h *HjConn) outboundEmpty() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.writeBuffer == nil || h.writeBuffer.IsEmpty()
+}
 
-	return unix.Close(h.fd)
+func (h *HjConn) isClosed() bool {
+	return atomic.LoadInt32(&h.closed) == 1
+}
+
+// release returns the buffers to the pools, it must be called after the conn is closed.
+func (h *HjConn) release() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.released = true
+	if h.readBuffer != nil {
+		h.manager.releaseReadBuffer(h)
+	}
+	if h.writeBuffer != nil {
+		pending := h.writeBuffer.Len()
+		h.manager.metrics.outboundBytes.Add(int64(-pending))
+		h.manager.memory.add(-pending)
+		h.manager.releaseWriteBuffer(h)
+	}
 }
 
 func (h *HjConn) LocalAddr() net.Addr {
@@ -101,20 +466,20 @@ func (h *HjConn) SetWriteDeadline(t time.Time) error {
 	return nil
 }
 
+// connExecutor serializes the event callbacks of one conn when they run on the worker pool.
+type connExecutor struct {
+	mu            sync.Mutex
+	tasks         []func()
+	running       bool
+	trafficQueued bool
+}
+
 func initConnPoller() {
 	connPoller, err := poller.NewPoller()
 	if err != nil {
 		panic(err)
 	}
-	manager = newConnManager(connPoller)
-	go func() {
-		//defer func() {
-		//	// recover
-		//	err := recover()
-		//	if err != nil {
-		//		log.Println(errors.New(fmt.Sprintf("%v", err)))
-		//	}
-		//}()
-		manager.Run()
-	}()
+	opts := loadOptions()
+	manager = newConnManager(connPoller, opts, newEngineMetrics(opts.Metrics))
+	go manager.serve()
 }
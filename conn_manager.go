@@ -1,10 +1,17 @@
 package haijun_net
 
 import (
-	"runtime"
+	"crypto/tls"
+	goio "io"
+	"net"
+	"os"
+	"runtime/debug"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/Ccheers/haijun-net/internal/io"
+	goPool "github.com/Ccheers/haijun-net/internal/pkg/pool/goroutine"
 	"github.com/Ccheers/haijun-net/internal/poller"
 	"golang.org/x/sys/unix"
 )
@@ -17,12 +24,126 @@ const (
 )
 
 type connManager struct {
+	idx     int // index of the event loop, it's used to identify the loop in logs and metrics
 	connMap sync.Map
 	poller  poller.Poller
+	opts    *Options
+
+	metrics     *engineMetrics
+	loopMetrics *loopMetrics
+	memory      *memoryBudget
+
+	// tlsConfig is Options.TLSConfig, or a copy of it logging the session keys to keyLog for
+	// Options.KernelTLS.
+	tlsConfig *tls.Config
+	keyLog    *ktlsKeyLog
+	// handshaking is the number of goroutines running TLS handshakes, the conns beyond
+	// Options.MaxTLSHandshakes wait in waitingHandshakes, see startTLS.
+	handshakeMu       sync.Mutex
+	handshaking       int
+	waitingHandshakes []*HjConn
+
+	// workers runs the event callbacks when Options.WorkerPoolSize is set.
+	workers *goPool.Pool
+	// deferred holds the conns whose callbacks were rejected by the overloaded worker pool,
+	// they are submitted again in the next loop iteration.
+	deferredMu sync.Mutex
+	deferred   []*HjConn
+
+	timers  timerQueue
+	expired []*loopTimer // 仅在事件循环中使用，复用以避免分配
+	iovecs  [][]byte     // 同上
+	tlsIn   []byte       // 同上，见 tlsReadBuffer
+	tlsOut  []byte       // 同上，见 tlsPlain
+
+	// onReady receives the conns passing the gate in blocking mode, see HjListener.acceptGated.
+	onReady func(conn *HjConn)
+
+	// stopping is set when the listener is closed, the loop exits once its conns are all closed.
+	stopping int32
+	// closing is the number of closed conns whose OnClose is waiting for the loop, see closeConn.
+	closing int32
+	// executing is the number of conns whose callbacks are queued to or running on the worker pool,
+	// the pool is released once it drops to zero after the loop is stopped.
+	executing int32
+
+	// unregisterPoller removes the syscall metrics of poller from the registry, see engineMetrics.pollerSyscalls.
+	unregisterPoller func()
+}
+
+// loopSeq numbers the event loops of the process, so that the loops sharing a metrics registry are told apart.
+var loopSeq int32
+
+func newConnManager(poller poller.Poller, opts *Options, em *engineMetrics) *connManager {
+	m := &connManager{poller: poller, opts: opts, metrics: em, idx: int(atomic.AddInt32(&loopSeq, 1)) - 1}
+	m.loopMetrics = em.loop(m.idx)
+	m.memory = newMemoryBudget(opts.MemoryBudget, em)
+	m.tlsConfig = opts.TLSConfig
+	if opts.TLSConfig != nil && opts.KernelTLS {
+		m.tlsConfig, m.keyLog = newKTLSConfig(opts.TLSConfig)
+	}
+	m.unregisterPoller = em.pollerSyscalls(poller)
+	if opts.WorkerPoolSize > 0 {
+		m.workers = goPool.New(goPool.Options{
+			MaxWorkers:  opts.WorkerPoolSize,
+			QueueSize:   opts.WorkerQueueSize,
+			IdleTimeout: opts.WorkerIdleTimeout,
+			PanicHandler: func(v interface{}, stack []byte) {
+				// 回调中的 panic 已经被 runTask 处理，这里只会是调度本身的问题
+				if opts.PanicPolicy == PanicPolicyCrash {
+					panic(v)
+				}
+				reportError(opts, &PanicError{Value: v, Stack: stack})
+			},
+		})
+	}
+	if opts.IdleTimeout > 0 || opts.Heartbeat != nil {
+		m.every(idleCheckInterval(opts), m.checkIdle)
+	}
+	if opts.MinReadRate != nil {
+		m.every(opts.MinReadRate.Interval, m.checkReadRate)
+	}
+	m.every(bufferIdleTime, m.reapBuffers)
+	return m
+}
+
+// afterFunc runs f on the event loop after d, it's safe to call it from any goroutine.
+func (m *connManager) afterFunc(d time.Duration, f func()) *loopTimer {
+	t := &loopTimer{when: time.Now().Add(d), f: f}
+	m.timers.add(t)
+	return t
+}
+
+// every runs f on the event loop every d until the timer is stopped.
+func (m *connManager) every(d time.Duration, f func()) *loopTimer {
+	t := &loopTimer{when: time.Now().Add(d), period: d, f: f}
+	m.timers.add(t)
+	return t
+}
+
+// stopTimer cancels t, f won't be called anymore unless it's already running.
+func (m *connManager) stopTimer(t *loopTimer) {
+	m.timers.stop(t)
 }
 
-func newConnManager(poller poller.Poller) *connManager {
-	return &connManager{poller: poller}
+// runTimers runs the expired timers, the panics are handled like those of the events.
+func (m *connManager) runTimers() {
+	m.expired = m.timers.expired(time.Now(), m.expired[:0])
+	for i, t := range m.expired {
+		m.runTimer(t)
+		m.expired[i] = nil
+	}
+}
+
+func (m *connManager) runTimer(t *loopTimer) {
+	if m.opts.PanicPolicy != PanicPolicyCrash {
+		defer func() {
+			if v := recover(); v != nil {
+				reportError(m.opts, &PanicError{Value: v, Stack: debug.Stack()})
+			}
+		}()
+	}
+	t.f()
 }
 
 func (m *connManager) getConn(fd int) (*HjConn, bool) {
@@ -41,99 +162,573 @@ func (m *connManager) setConn(fd int, conn *HjConn) {
 	m.connMap.Store(fd, conn)
 }
 
-func (m *connManager) unsetConn(fd int) {
-	conn, ok := m.getConn(fd)
-	if ok {
-		m.connMap.Delete(fd)
-		m.poller.Remove(fd)
-		conn.Close()
-	}
+// Range calls f for each live conn of the event loop until f returns false.
+func (m *connManager) Range(f func(conn *HjConn) bool) {
+	m.connMap.Range(func(_, value interface{}) bool {
+		return f(value.(*HjConn))
+	})
 }
 
 func (m *connManager) RegisterConn(conn *HjConn) (err error) {
+	conn.mu.Lock()
+	if conn.isClosed() {
+		conn.mu.Unlock()
+		return net.ErrClosed
+	}
 	_, ok := m.getConn(conn.fd)
 	if ok {
+		conn.mu.Unlock()
 		return
 	}
+	// 先加入 connMap 再注册到 poller，否则事件循环可能在两步之间收到事件，找不到连接而把 fd 移除
+	m.setConn(conn.fd, conn)
 	err = m.poller.Register(conn.fd, poller.PollModeRead)
 	if err != nil {
+		m.connMap.Delete(conn.fd)
+		conn.mu.Unlock()
 		return
 	}
-	m.setConn(conn.fd, conn)
+	m.loopMetrics.activeConns.Inc()
+	conn.mu.Unlock()
+	if m.opts.Observer != nil {
+		m.opts.Observer.OnRegister(conn)
+	}
 	return
 }
 
-func (m *connManager) ModWrite(conn *HjConn) (err error) {
-	return m.poller.ModReadWrite(conn.fd)
+// openConn fires OnOpen of the conn in event-driven mode and registers it to the poller.
+func (m *connManager) openConn(conn *HjConn) error {
+	if conn.handler != nil {
+		m.execute(conn, func() {
+			if action := conn.handler.OnOpen(conn); action == Close || action == Shutdown {
+				_ = m.closeConn(conn, nil)
+			}
+		})
+	}
+	err := m.RegisterConn(conn)
+	if err == net.ErrClosed {
+		// 已经在 OnOpen 中被关闭
+		return nil
+	}
+	return err
+}
+
+// closeConn removes the conn from the poller and closes its fd, it's safe to call it more than once.
+// err is the reason of closing, nil means that the conn was closed by the peer or locally.
+func (m *connManager) closeConn(conn *HjConn, err error) error {
+	conn.mu.Lock()
+	if conn.isClosed() {
+		conn.mu.Unlock()
+		return nil
+	}
+	conn.closeErr = err
+	atomic.StoreInt32(&conn.closed, 1)
+	pending := atomic.LoadInt32(&conn.pending) == 1
+	if c, ok := m.getConn(conn.fd); ok && c == conn {
+		m.connMap.Delete(conn.fd)
+		_ = m.poller.Remove(conn.fd)
+		m.loopMetrics.activeConns.Dec()
+	}
+	m.metrics.closed.Inc()
+	closeErr := os.NewSyscallError("close", unix.Close(conn.fd))
+	conn.mu.Unlock()
+	m.opts.Logger.Debug("close conn", "fd", conn.fd, "remote_addr", conn.remoteAddr, "loop", m.idx, "error", err)
+
+	close(conn.done)
+	if conn.tls != nil {
+		_ = conn.tls.Close()
+	}
+	if m.opts.Observer != nil {
+		m.opts.Observer.OnClose(conn, err)
+	}
+	if pending {
+		// 尚未交给应用，直接释放
+		if conn.gateTimer != nil {
+			m.stopTimer(conn.gateTimer)
+		}
+		conn.release()
+	} else if conn.handler != nil {
+		task := func() {
+			conn.handler.OnClose(conn, err)
+			conn.release()
+		}
+		if m.workers == nil {
+			// 没有工作池时回调都在事件循环中执行，Close 可能来自其他 goroutine，
+			// 交给事件循环执行，否则会和正在执行的 OnTraffic 并发并释放它在读的缓冲区
+			atomic.AddInt32(&m.closing, 1)
+			m.afterFunc(0, func() {
+				defer atomic.AddInt32(&m.closing, -1)
+				m.runTask(conn, task)
+			})
+		} else {
+			m.execute(conn, task)
+		}
+	}
+	return closeErr
+}
+
+// execute runs the callback of the conn on the worker pool, or on the current goroutine if there is no pool.
+// The callbacks of one conn are queued and run one after another.
+func (m *connManager) execute(conn *HjConn, task func()) {
+	if m.workers == nil {
+		m.runTask(conn, task)
+		return
+	}
+	e := &conn.executor
+	e.mu.Lock()
+	e.tasks = append(e.tasks, task)
+	if e.running {
+		e.mu.Unlock()
+		return
+	}
+	e.running = true
+	e.mu.Unlock()
+	atomic.AddInt32(&m.executing, 1)
+	m.submit(conn)
+}
+
+// dispatchTraffic fires OnTraffic of the conn, the pending OnTraffic events of one conn are merged into one
+// since the callback consumes whatever is in the inbound buffer.
+func (m *connManager) dispatchTraffic(conn *HjConn) {
+	if m.workers == nil {
+		m.onTraffic(conn)
+		return
+	}
+	e := &conn.executor
+	e.mu.Lock()
+	if e.trafficQueued {
+		e.mu.Unlock()
+		return
+	}
+	e.trafficQueued = true
+	e.mu.Unlock()
+	m.execute(conn, func() {
+		e.mu.Lock()
+		e.trafficQueued = false
+		e.mu.Unlock()
+		m.onTraffic(conn)
+	})
+}
+
+func (m *connManager) onTraffic(conn *HjConn) {
+	if conn.isClosed() {
+		return
+	}
+	switch conn.handler.OnTraffic(conn) {
+	case Close:
+		_ = m.closeConn(conn, nil)
+	case Shutdown:
+		m.shutdown(conn)
+	}
+}
+
+// shutdown closes the conn once its outbound data is sent for the Shutdown action, the conn isn't read meanwhile.
+// The conn is closed right away when there is nothing to send.
+func (m *connManager) shutdown(conn *HjConn) {
+	if conn.tls != nil {
+		conn.tls.closeNotify()
+	}
+	conn.mu.Lock()
+	if conn.isClosed() || conn.writeBuffer == nil || conn.writeBuffer.IsEmpty() {
+		conn.mu.Unlock()
+		if conn.tls != nil {
+			conn.tls.closeNotifyKernel()
+		}
+		_ = m.closeConn(conn, nil)
+		return
+	}
+	// write 在发送完之后关闭连接
+	conn.readPaused |= pauseClosing
+	_ = m.updateInterest(conn)
+	conn.mu.Unlock()
 }
 
-func (m *connManager) ModRead(conn *HjConn) (err error) {
-	return m.poller.ModRead(conn.fd)
+func (m *connManager) submit(conn *HjConn) {
+	if err := m.workers.Submit(func() { m.drain(conn) }); err != nil {
+		// 工作池已满，留到下一轮循环再提交
+		m.deferredMu.Lock()
+		m.deferred = append(m.deferred, conn)
+		m.deferredMu.Unlock()
+	}
 }
 
-func (m *connManager) Run() {
+func (m *connManager) submitDeferred() {
+	m.deferredMu.Lock()
+	deferred := m.deferred
+	m.deferred = nil
+	m.deferredMu.Unlock()
+	for _, conn := range deferred {
+		m.submit(conn)
+	}
+}
+
+// drain runs the queued callbacks of the conn until the queue is empty.
+func (m *connManager) drain(conn *HjConn) {
+	e := &conn.executor
+	for {
+		e.mu.Lock()
+		if len(e.tasks) == 0 {
+			e.running = false
+			e.mu.Unlock()
+			atomic.AddInt32(&m.executing, -1)
+			return
+		}
+		task := e.tasks[0]
+		e.tasks[0] = nil
+		e.tasks = e.tasks[1:]
+		e.mu.Unlock()
+		m.runTask(conn, task)
+	}
+}
+
+// runTask runs the callback and closes the conn if it panics.
+func (m *connManager) runTask(conn *HjConn, task func()) {
+	if m.opts.PanicPolicy != PanicPolicyCrash {
+		defer m.recoverConn(conn)
+	}
+	task()
+}
+
+// write flushes the outbound buffer of the conn.
+func (m *connManager) write(conn *HjConn) error {
+	conn.mu.Lock()
+	if conn.writeBuffer == nil || conn.isClosed() {
+		// 缓冲区在上一次发送完时已经释放
+		if !conn.isClosed() {
+			err := m.updateInterest(conn)
+			conn.mu.Unlock()
+			return err
+		}
+		conn.mu.Unlock()
+		return nil
+	}
+	var (
+		n   int
+		err error
+	)
+	if !conn.writeBuffer.IsEmpty() {
+		limit := MaxBytesToWritePerLoop
+		if conn.writeBucket != nil || m.opts.WriteBucket != nil {
+			q, wait := quota(time.Now(), conn.writeBucket, m.opts.WriteBucket)
+			if q == 0 {
+				// 令牌耗尽，暂停写事件直到令牌恢复
+				m.pauseWrite(conn, pauseShaping, wait)
+				conn.mu.Unlock()
+				return nil
+			}
+			if q < limit {
+				limit = q
+			}
+		}
+		m.metrics.writevCalls.Inc()
+		m.iovecs = conn.writeBuffer.Vectors(m.iovecs[:0], limit, MaxIovSize)
+		n, err = io.Writev(conn.fd, m.iovecs)
+		for i := range m.iovecs {
+			// 不持有已发送的内存
+			m.iovecs[i] = nil
+		}
+		if n > 0 {
+			consume(n, conn.writeBucket, m.opts.WriteBucket)
+			_ = conn.writeBuffer.Skip(n)
+			atomic.AddUint64(&conn.bytesOut, uint64(n))
+			atomic.StoreInt64(&conn.lastWrite, time.Now().UnixNano())
+			m.metrics.writtenBytes.Add(uint64(n))
+			m.metrics.outboundBytes.Add(int64(-n))
+			m.memory.add(-n)
+		}
+	}
+	pending := conn.writeBuffer.Len()
+	closing := false
+	if pending == 0 {
+		m.releaseWriteBuffer(conn)
+		closing = conn.readPaused&pauseClosing != 0
+		if err == nil && !closing {
+			err = m.updateInterest(conn)
+		}
+	}
+	conn.mu.Unlock()
+	if closing {
+		if conn.tls != nil {
+			conn.tls.closeNotifyKernel()
+		}
+		_ = m.closeConn(conn, nil)
+		return nil
+	}
+
+	if o := m.opts.Observer; o != nil && n > 0 {
+		o.OnFlush(conn, n, pending)
+	}
+	switch err {
+	case nil:
+	case unix.EAGAIN:
+		m.metrics.writeEAGAIN.Inc()
+		if m.opts.Observer != nil {
+			m.opts.Observer.OnEAGAIN(conn, "write")
+		}
+	default:
+		return os.NewSyscallError("writev", err)
+	}
+	return nil
+}
+
+// read copies the data from the socket into the inbound buffer of the conn, and then notifies the reader.
+func (m *connManager) read(conn *HjConn) error {
+	conn.mu.Lock()
+	if conn.released || conn.isClosed() {
+		conn.mu.Unlock()
+		return nil
+	}
+	if conn.readBuffer == nil && !m.allocReadBuffer(conn) {
+		// 超出内存预算，稍后再读
+		m.pauseRead(conn, pauseMemory, memoryRetryInterval)
+		conn.mu.Unlock()
+		return nil
+	}
+	full := conn.readBuffer.Len() >= conn.readLimit
+	if full && m.growReadBuffer(conn) {
+		// 解密后的 TLS 明文可能超出上限，扩容后仍然可能是满的
+		full = conn.readBuffer.Len() >= conn.readLimit
+	}
+	if full {
+		// 缓冲区已满，暂停读事件直到应用消费数据，否则水平触发会让事件循环空转
+		m.pauseRead(conn, pauseBufferFull, 0)
+		conn.mu.Unlock()
+		m.notifyReadable(conn)
+		return nil
+	}
+	max := conn.readLimit - conn.readBuffer.Len()
+	if conn.readBucket != nil || m.opts.ReadBucket != nil {
+		q, wait := quota(time.Now(), conn.readBucket, m.opts.ReadBucket)
+		if q == 0 {
+			// 令牌耗尽，暂停读事件直到令牌恢复
+			m.pauseRead(conn, pauseShaping, wait)
+			conn.mu.Unlock()
+			return nil
+		}
+		if q < max {
+			max = q
+		}
+	}
+	// 直接读到缓冲区的空闲空间中，剩余空间太小时分配新的块
+	reserve := minBufferSize
+	if max < reserve {
+		reserve = max
+	}
+	// 内核解密时读到的已经是明文
+	decrypt := conn.tls != nil && !conn.tls.kernelRX
+	var p []byte
+	if decrypt {
+		// 密文读到事件循环共享的缓冲区，解密后的明文才进入连接的缓冲区
+		p = m.tlsReadBuffer()
+	} else {
+		p = conn.readBuffer.Reserve(reserve)
+	}
+	if len(p) > max {
+		p = p[:max]
+	}
+	m.metrics.readCalls.Inc()
+	var (
+		n   int
+		err error
+	)
+	if conn.tls != nil && conn.tls.kernelRX {
+		n, err = readKernelTLS(conn.fd, p)
+	} else {
+		n, err = unix.Read(conn.fd, p)
+	}
+	if n > 0 {
+		if !decrypt {
+			conn.readBuffer.Commit(n)
+		}
+		consume(n, conn.readBucket, m.opts.ReadBucket)
+		if l := conn.readBuffer.Len(); l > conn.readPeak {
+			conn.readPeak = l
+		}
+	}
+	conn.mu.Unlock()
+	switch err {
+	case nil:
+	case unix.EAGAIN:
+		m.metrics.readEAGAIN.Inc()
+		if m.opts.Observer != nil {
+			m.opts.Observer.OnEAGAIN(conn, "read")
+		}
+		return nil
+	default:
+		return os.NewSyscallError("read", err)
+	}
+	if n == 0 {
+		if conn.tls != nil && m.tlsEOF(conn) {
+			return nil
+		}
+		return goio.EOF
+	}
+	atomic.AddUint64(&conn.bytesIn, uint64(n))
+	atomic.StoreInt64(&conn.lastRead, time.Now().UnixNano())
+	m.metrics.readBytes.Add(uint64(n))
+	if m.opts.Observer != nil {
+		m.opts.Observer.OnRead(conn, n)
+	}
+	if decrypt {
+		return m.readTLS(conn, p[:n])
+	}
+	m.notifyReadable(conn)
+	return nil
+}
+
+func (m *connManager) notifyReadable(conn *HjConn) {
+	if atomic.LoadInt32(&conn.pending) == 1 && !m.handOff(conn) {
+		return
+	}
+	if conn.handler != nil {
+		m.dispatchTraffic(conn)
+		return
+	}
+	select {
+	case conn.waitRead <- struct{}{}:
+	default:
+	}
+}
+
+// Run runs the event loop until the poller fails, the panics of one event are recovered and
+// only close the conn being processed, see Options.PanicPolicy.
+func (m *connManager) Run() error {
 	//runtime.LockOSThread()
 	for {
+		if m.workers != nil {
+			m.submitDeferred()
+		}
 		events, err := m.poller.Wait()
 		if err != nil {
-			runtime.Gosched()
+			return err
+		}
+		m.runTimers()
+		if len(events) == 0 {
+			if m.drained() {
+				return nil
+			}
 			continue
 		}
+		start := time.Now()
 		for _, event := range events {
-			conn, ok := m.getConn(int(event.Fd))
-			if !ok {
-				m.poller.Remove(int(event.Fd))
-				continue
-			}
-			// Don't change the ordering of processing EPOLLOUT | EPOLLRDHUP / EPOLLIN unless you're 100%
-			// sure what you're doing!
-			// Re-ordering can easily introduce bugs and bad side-effects, as I found out painfully in the past.
-
-			// We should always check for the EPOLLOUT event first, as we must try to send the leftover data back to
-			// the peer when any error occurs on a connection.
-			//
-			// Either an EPOLLOUT or EPOLLERR event may be fired when a connection is refused.
-			// In either case write() should take care of it properly:
-			// 1) writing data back,
-			// 2) closing the connection.
-			if event.Events&poller.OutEvents != 0 && !conn.writeBuffer.IsEmpty() {
-				if _, err := io.Writev(int(event.Fd), conn.writeBuffer.Peek(MaxBytesToWritePerLoop)); err != nil {
-					switch err {
-					case nil, unix.EAGAIN:
-					default:
-						m.unsetConn(int(event.Fd))
-					}
-				}
-				if conn.writeBuffer.IsEmpty() {
-					err := m.poller.ModRead(conn.fd)
-					if err != nil {
-						m.unsetConn(conn.fd)
-						continue
-					}
-				}
-			}
-			// If there is pending data in outbound buffer, then we should omit this readable event
-			// and prioritize the writable events to achieve a higher performance.
-			//
-			// Note that the peer may send massive amounts of data to server by write() under blocking mode,
-			// resulting in that it won't receive any responses before the server reads all data from the peer,
-			// in which case if the server socket send buffer is full, we need to let it go and continue reading
-			// the data to prevent blocking forever.
-			// 读事件处理
-			if event.Events&poller.InEvents != 0 && (event.Events&poller.OutEvents == 0 || conn.writeBuffer.IsEmpty()) {
-				if _, err := conn.readBuffer.CopyFromSocket(int(event.Fd)); err != nil {
-					switch err {
-					case nil, unix.EAGAIN:
-					default:
-						m.unsetConn(int(event.Fd))
-					}
-				}
+			m.handleEvent(event)
+		}
+		m.loopMetrics.iteration.ObserveDuration(time.Since(start))
+	}
+}
 
-				select {
-				case conn.waitRead <- struct{}{}:
-				default:
-				}
+// stop makes the event loop exit once the conns it serves are all closed.
+func (m *connManager) stop() {
+	atomic.StoreInt32(&m.stopping, 1)
+}
+
+// drained reports whether the loop is stopping and has no conn left, nor any callback left to run.
+func (m *connManager) drained() bool {
+	if atomic.LoadInt32(&m.stopping) == 0 || atomic.LoadInt32(&m.closing) > 0 || atomic.LoadInt32(&m.executing) > 0 {
+		return false
+	}
+	empty := true
+	m.connMap.Range(func(_, _ interface{}) bool {
+		empty = false
+		return false
+	})
+	return empty
+}
+
+func (m *connManager) handleEvent(event unix.EpollEvent) {
+	conn, ok := m.getConn(int(event.Fd))
+	if !ok {
+		m.poller.Remove(int(event.Fd))
+		return
+	}
+	if m.opts.PanicPolicy != PanicPolicyCrash {
+		defer m.recoverConn(conn)
+	}
+	// 暂停读事件时 EPOLLERR/EPOLLHUP 仍然是水平触发的，read 不会去读 socket 而发现错误，
+	// 在这里关闭连接，否则事件循环会一直空转到恢复读取
+	if event.Events&(unix.EPOLLERR|unix.EPOLLHUP) != 0 && conn.readingPaused() {
+		err := socketError(conn.fd)
+		if err != nil && m.opts.Observer != nil {
+			m.opts.Observer.OnError(conn, err)
+		}
+		_ = m.closeConn(conn, err)
+		return
+	}
+	// Don't change the ordering of processing EPOLLOUT | EPOLLRDHUP / EPOLLIN unless you're 100%
+	// sure what you're doing!
+	// Re-ordering can easily introduce bugs and bad side-effects, as I found out painfully in the past.
+
+	// We should always check for the EPOLLOUT event first, as we must try to send the leftover data back to
+	// the peer when any error occurs on a connection.
+	//
+	// Either an EPOLLOUT or EPOLLERR event may be fired when a connection is refused.
+	// In either case write() should take care of it properly:
+	// 1) writing data back,
+	// 2) closing the connection.
+	if event.Events&poller.OutEvents != 0 {
+		if err := m.write(conn); err != nil {
+			if m.opts.Observer != nil {
+				m.opts.Observer.OnError(conn, err)
 			}
+			_ = m.closeConn(conn, err)
+			return
 		}
 	}
+	// If there is pending data in outbound buffer, then we should omit this readable event
+	// and prioritize the writable events to achieve a higher performance.
+	//
+	// Note that the peer may send massive amounts of data to server by write() under blocking mode,
+	// resulting in that it won't receive any responses before the server reads all data from the peer,
+	// in which case if the server socket send buffer is full, we need to let it go and continue reading
+	// the data to prevent blocking forever.
+	// 读事件处理
+	if event.Events&poller.InEvents != 0 && (event.Events&poller.OutEvents == 0 || conn.outboundEmpty()) {
+		if m.opts.Observer != nil {
+			m.opts.Observer.OnReadable(conn)
+		}
+		if err := m.read(conn); err != nil {
+			if err == goio.EOF {
+				err = nil
+			} else if m.opts.Observer != nil {
+				m.opts.Observer.OnError(conn, err)
+			}
+			_ = m.closeConn(conn, err)
+		}
+	}
+}
+
+// socketError returns the pending error of the socket, such as ECONNRESET, or nil if the peer hung up
+// without an error.
+func socketError(fd int) error {
+	errno, err := unix.GetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_ERROR)
+	if err != nil {
+		return os.NewSyscallError("getsockopt", err)
+	}
+	if errno != 0 {
+		return os.NewSyscallError("read", unix.Errno(errno))
+	}
+	return nil
+}
+
+// recoverConn recovers the panic raised while processing the conn, reports it and closes the conn.
+func (m *connManager) recoverConn(conn *HjConn) {
+	if v := recover(); v != nil {
+		err := &PanicError{Value: v, Stack: debug.Stack(), Conn: conn}
+		reportError(m.opts, err)
+		_ = m.closeConn(conn, err)
+	}
+}
+
+// serve runs the event loop and restarts it when it fails, see supervise.
+// It closes the poller after the loop is stopped and drained.
+func (m *connManager) serve() {
+	supervise(m.opts, m.poller, m.Run, m.drained, "loop", m.idx)
+	if m.workers != nil {
+		// 所有回调都已执行完，不会再有任务提交
+		m.workers.Release()
+	}
+	_ = m.poller.Close()
+	m.unregisterPoller()
+	m.loopMetrics.remove()
+	m.memory.close()
 }
@@ -0,0 +1,200 @@
+package haijun_net
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Ccheers/haijun-net/buffer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestHjConn_Stats(t *testing.T) {
+	l, err := NewHjListener("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	c, err := l.Accept()
+	require.NoError(t, err)
+	defer c.Close()
+	conn := c.(*HjConn)
+
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return conn.Stats().BufferedInbound == 5 }, 5*time.Second, 10*time.Millisecond)
+
+	_, err = conn.Write([]byte("abc"))
+	require.NoError(t, err)
+	_, err = client.Read(make([]byte, 3))
+	require.NoError(t, err)
+
+	// 发送完成后会切换回只监听读事件
+	assert.Eventually(t, func() bool { return conn.Stats().Interest == InterestRead }, 5*time.Second, 10*time.Millisecond)
+	s := conn.Stats()
+	assert.EqualValues(t, 5, s.BytesIn)
+	assert.EqualValues(t, 3, s.BytesOut)
+	assert.Equal(t, 0, s.PendingOutbound)
+	assert.False(t, s.LastRead.Before(s.CreatedAt))
+	assert.False(t, s.LastWrite.Before(s.LastRead))
+
+	var found []*HjConn
+	l.(*HjListener).RangeConns(func(c *HjConn) bool {
+		found = append(found, c)
+		return true
+	})
+	assert.Equal(t, []*HjConn{conn}, found)
+}
+
+func TestHjConn_ReadBufferFull(t *testing.T) {
+	l, err := NewHjListener("127.0.0.1:0", WithReadBuffer(4096, 0))
+	require.NoError(t, err)
+	defer l.Close()
+	hl := l.(*HjListener)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	c, err := l.Accept()
+	require.NoError(t, err)
+	defer c.Close()
+	conn := c.(*HjConn)
+
+	msg := bytes.Repeat([]byte("0123456789"), 100<<10)
+	go func() { _, _ = client.Write(msg) }()
+
+	// 缓冲区写满后不再监听读事件，事件循环也不会空转
+	assert.Eventually(t, func() bool { return conn.Stats().Interest == 0 }, 5*time.Second, 10*time.Millisecond)
+	reads := hl.manager.metrics.readCalls.Value()
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, reads, hl.manager.metrics.readCalls.Value())
+
+	got := make([]byte, len(msg))
+	_, err = io.ReadFull(conn, got)
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+}
+
+func TestHjConn_ResetWhileReadPaused(t *testing.T) {
+	h := &closeReasonHandler{reason: make(chan error, 1)}
+	l := serveTest(t, h, WithReadBuffer(4096, 0))
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	// 应用不消费数据，缓冲区写满后暂停读取
+	_, err = client.Write(make([]byte, 16<<10))
+	require.NoError(t, err)
+	var conn *HjConn
+	assert.Eventually(t, func() bool {
+		l.RangeConns(func(c *HjConn) bool {
+			conn = c
+			return false
+		})
+		return conn != nil && conn.Stats().Interest == 0
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// 对端重置连接，暂停期间也要发现并关闭
+	require.NoError(t, client.(*net.TCPConn).SetLinger(0))
+	require.NoError(t, client.Close())
+	select {
+	case err = <-h.reason:
+		assert.True(t, errors.Is(err, unix.ECONNRESET), "%v", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose isn't called")
+	}
+}
+
+// frameHandler consumes the inbound data only when a whole frame has been buffered.
+type frameHandler struct {
+	BuiltinEventHandler
+	size int
+	got  chan []byte
+}
+
+func (h *frameHandler) OnTraffic(c *HjConn) Action {
+	if c.InboundBuffered() < h.size {
+		return None
+	}
+	b := make([]byte, h.size)
+	_, _ = c.Read(b)
+	h.got <- b
+	return None
+}
+
+func TestHjConn_ReadBufferGrow(t *testing.T) {
+	h := &frameHandler{size: 200 << 10, got: make(chan []byte, 1)}
+	l := serveTest(t, h, WithReadBuffer(64<<10, 256<<10))
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+
+	msg := bytes.Repeat([]byte("x"), h.size)
+	_, err = client.Write(msg)
+	require.NoError(t, err)
+	select {
+	case got := <-h.got:
+		assert.Equal(t, msg, got)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the frame larger than the initial buffer isn't received")
+	}
+}
+
+func TestHjConn_NextWriteBuffer(t *testing.T) {
+	l, err := NewHjListener("127.0.0.1:0", WithReadBuffer(1024, 0))
+	require.NoError(t, err)
+	defer l.Close()
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	c, err := l.Accept()
+	require.NoError(t, err)
+	defer c.Close()
+	conn := c.(*HjConn)
+
+	msg := bytes.Repeat([]byte("0123456789"), 300)
+	go func() { _, _ = client.Write(msg) }()
+	// 读缓冲区只有 1KB，数据分多次读入
+	for conn.InboundBuffered() < 1024 {
+		time.Sleep(time.Millisecond)
+	}
+	head, tail := conn.Peek(1024)
+	assert.Equal(t, msg[:1024], append(append([]byte(nil), head...), tail...))
+
+	// 读出的数据交给另一个 goroutine 原样写回，全程不复制
+	got := 0
+	for got < len(msg) {
+		n := conn.InboundBuffered()
+		if n == 0 {
+			time.Sleep(time.Millisecond)
+			continue
+		}
+		b, err := conn.Next(n)
+		require.NoError(t, err)
+		got += n
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			_, err := conn.WriteBuffer(b)
+			assert.NoError(t, err)
+			assert.True(t, b.IsEmpty())
+		}()
+		<-done
+	}
+	_, err = conn.Next(1)
+	assert.Equal(t, buffer.ErrNotEnough, err)
+
+	echo := make([]byte, len(msg))
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = io.ReadFull(client, echo)
+	require.NoError(t, err)
+	assert.Equal(t, msg, echo)
+}
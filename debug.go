@@ -0,0 +1,190 @@
+package haijun_net
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ccheers/haijun-net/internal/poller"
+)
+
+type debugState struct {
+	Listener debugListener `json:"listener"`
+	Loops    []debugLoop   `json:"loops"`
+	Conns    []debugConn   `json:"conns"`
+}
+
+type debugListener struct {
+	Addr          string `json:"addr"`
+	Fd            int    `json:"fd"`
+	PollerFd      int    `json:"poller_fd"`
+	Closed        bool   `json:"closed"`
+	EventDriven   bool   `json:"event_driven"`
+	WorkerRunning int    `json:"worker_running,omitempty"`
+	WorkerWaiting int    `json:"worker_waiting,omitempty"`
+	BufferMemory  int64  `json:"buffer_memory"`
+}
+
+type debugLoop struct {
+	Idx           int       `json:"idx"`
+	PollerFd      int       `json:"poller_fd"`
+	EventListSize int       `json:"event_list_size"`
+	Fds           []debugFd `json:"fds"`
+}
+
+type debugFd struct {
+	Fd   int    `json:"fd"`
+	Mode string `json:"mode"`
+}
+
+type debugConn struct {
+	ID              uint64 `json:"id"`
+	Fd              int    `json:"fd"`
+	Loop            int    `json:"loop"`
+	LocalAddr       string `json:"local_addr"`
+	RemoteAddr      string `json:"remote_addr"`
+	Interest        string `json:"interest"`
+	InboundBuffered int    `json:"inbound_buffered"`
+	InboundCap      int    `json:"inbound_cap"`
+	PendingOutbound int    `json:"pending_outbound"`
+	BytesIn         uint64 `json:"bytes_in"`
+	BytesOut        uint64 `json:"bytes_out"`
+	// 以下时长均为秒
+	Age       float64 `json:"age"`
+	ReadIdle  float64 `json:"read_idle"`
+	WriteIdle float64 `json:"write_idle"`
+}
+
+// DebugHandler returns a handler dumping the internal state of l as JSON: the listener, the event loops
+// with the fds registered to their pollers and the live conns with their buffers.
+//
+// A POST request to the path ending in "/close" with the query "id" force-closes the conn with that id.
+// The handler exposes the addresses of the clients and lets anyone close the conns, it must not be
+// served publicly.
+func DebugHandler(l *HjListener) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/close") {
+			l.debugClose(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		_ = enc.Encode(l.debugState())
+	})
+}
+
+func (h *HjListener) debugClose(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, err := strconv.ParseUint(r.URL.Query().Get("id"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid id", http.StatusBadRequest)
+		return
+	}
+	var conn *HjConn
+	h.RangeConns(func(c *HjConn) bool {
+		if c.ID() == id {
+			conn = c
+			return false
+		}
+		return true
+	})
+	if conn == nil {
+		http.Error(w, "conn not found", http.StatusNotFound)
+		return
+	}
+	h.opts.Logger.Info("close conn by debug handler", "id", id, "fd", conn.fd, "remote_addr", conn.RemoteAddr())
+	// 在事件循环中关闭，不与 OnTraffic 等回调并发
+	result := make(chan error, 1)
+	h.manager.afterFunc(0, func() { result <- conn.Close() })
+	select {
+	case err = <-result:
+	case <-r.Context().Done():
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (h *HjListener) debugState() debugState {
+	s := debugState{
+		Listener: debugListener{
+			Addr:        h.Addr().String(),
+			Fd:          h.listenFd,
+			PollerFd:    h.poller.Fd(),
+			Closed:      atomic.LoadInt32(&h.closed) == 1,
+			EventDriven: h.handler != nil,
+			// 包含读缓冲区的容量和写缓冲区中待发送的数据
+			BufferMemory: h.manager.memory.Used(),
+		},
+		Loops: []debugLoop{debugLoopOf(h.manager)},
+		Conns: []debugConn{},
+	}
+	if h.manager.workers != nil {
+		s.Listener.WorkerRunning = h.manager.workers.Running()
+		s.Listener.WorkerWaiting = h.manager.workers.Waiting()
+	}
+
+	now := time.Now()
+	h.RangeConns(func(c *HjConn) bool {
+		st := c.Stats()
+		dc := debugConn{
+			ID:              c.ID(),
+			Fd:              c.fd,
+			Loop:            h.manager.idx,
+			LocalAddr:       c.LocalAddr().String(),
+			RemoteAddr:      c.RemoteAddr().String(),
+			Interest:        st.Interest.String(),
+			InboundBuffered: st.BufferedInbound,
+			PendingOutbound: st.PendingOutbound,
+			BytesIn:         st.BytesIn,
+			BytesOut:        st.BytesOut,
+			Age:             now.Sub(st.CreatedAt).Seconds(),
+			ReadIdle:        now.Sub(lastActive(st.LastRead, st.CreatedAt)).Seconds(),
+			WriteIdle:       now.Sub(lastActive(st.LastWrite, st.CreatedAt)).Seconds(),
+		}
+		c.mu.Lock()
+		if c.readBuffer != nil {
+			dc.InboundCap = c.readLimit
+		}
+		c.mu.Unlock()
+		s.Conns = append(s.Conns, dc)
+		return true
+	})
+	sort.Slice(s.Conns, func(i, j int) bool { return s.Conns[i].ID < s.Conns[j].ID })
+	return s
+}
+
+func debugLoopOf(m *connManager) debugLoop {
+	dl := debugLoop{
+		Idx:           m.idx,
+		PollerFd:      m.poller.Fd(),
+		EventListSize: m.poller.EventListSize(),
+		Fds:           []debugFd{},
+	}
+	m.poller.Range(func(fd int, mode poller.PollMode) bool {
+		dl.Fds = append(dl.Fds, debugFd{Fd: fd, Mode: interestOf(mode).String()})
+		return true
+	})
+	sort.Slice(dl.Fds, func(i, j int) bool { return dl.Fds[i].Fd < dl.Fds[j].Fd })
+	return dl
+}
+
+// lastActive returns t, or the creation time of the conn if nothing has happened yet.
+func lastActive(t, createdAt time.Time) time.Time {
+	if t.IsZero() {
+		return createdAt
+	}
+	return t
+}
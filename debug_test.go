@@ -0,0 +1,117 @@
+package haijun_net
+
+import (
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDebugHandler(t *testing.T) {
+	l := serveTest(t, &echoHandler{})
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(client, make([]byte, 5))
+	require.NoError(t, err)
+
+	srv := httptest.NewServer(DebugHandler(l))
+	defer srv.Close()
+
+	var s debugState
+	resp, err := http.Get(srv.URL + "/debug/haijun")
+	require.NoError(t, err)
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&s))
+	resp.Body.Close()
+
+	assert.Equal(t, l.Addr().String(), s.Listener.Addr)
+	assert.True(t, s.Listener.EventDriven)
+	assert.False(t, s.Listener.Closed)
+	require.Len(t, s.Loops, 1)
+	assert.Equal(t, l.manager.idx, s.Loops[0].Idx)
+	assert.Greater(t, s.Loops[0].PollerFd, 0)
+	assert.Greater(t, s.Loops[0].EventListSize, 0)
+	require.Len(t, s.Conns, 1)
+	c := s.Conns[0]
+	assert.Equal(t, client.LocalAddr().String(), c.RemoteAddr)
+	assert.Equal(t, l.manager.idx, c.Loop)
+	assert.EqualValues(t, 5, c.BytesIn)
+	assert.Greater(t, c.InboundCap, 0)
+	assert.Contains(t, s.Loops[0].Fds, debugFd{Fd: c.Fd, Mode: "read"})
+
+	resp, err = http.Get(srv.URL + "/debug/haijun/close?id=" + strconv.FormatUint(c.ID, 10))
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+
+	resp, err = http.Post(srv.URL+"/debug/haijun/close?id=0", "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	resp, err = http.Post(srv.URL+"/debug/haijun/close?id="+strconv.FormatUint(c.ID, 10), "", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestDebugHandler_CloseOnLoop(t *testing.T) {
+	h := &blockingHandler{entered: make(chan struct{}), release: make(chan struct{}), closed: make(chan struct{})}
+	l := serveTest(t, h)
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	select {
+	case <-h.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnTraffic isn't called")
+	}
+	var conn *HjConn
+	l.RangeConns(func(c *HjConn) bool {
+		conn = c
+		return false
+	})
+	require.NotNil(t, conn)
+
+	srv := httptest.NewServer(DebugHandler(l))
+	defer srv.Close()
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Post(srv.URL+"/debug/haijun/close?id="+strconv.FormatUint(conn.ID(), 10), "", nil)
+		if !assert.NoError(t, err) {
+			status <- 0
+			return
+		}
+		resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+
+	// 关闭要等 OnTraffic 返回
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, conn.isClosed(), "the conn is closed during OnTraffic")
+	close(h.release)
+	select {
+	case code := <-status:
+		assert.Equal(t, http.StatusNoContent, code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the close request doesn't return")
+	}
+	<-h.closed
+	assert.Zero(t, atomic.LoadInt32(&h.overlap))
+}
@@ -0,0 +1,203 @@
+package haijun_net
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ccheers/haijun-net/internal/socket"
+)
+
+var (
+	// ErrFirstByteTimeout is the reason of closing the conns which sent nothing within Options.FirstByteTimeout.
+	ErrFirstByteTimeout = errors.New("no data received within the first-byte timeout")
+	// ErrReadTooSlow is the reason of closing the conns which sent slower than Options.MinReadRate.
+	ErrReadTooSlow = errors.New("conn sends slower than the minimum read rate")
+)
+
+// ReadRate is the minimum rate a client must send at while a request is being received,
+// see Options.MinReadRate.
+type ReadRate struct {
+	Bytes    int
+	Interval time.Duration
+}
+
+// gated reports whether the new conns are held by the engine until their first bytes arrive,
+// or until their TLS handshakes complete.
+func (o *Options) gated() bool {
+	return o.FirstByteTimeout > 0 || o.MinReadRate != nil || o.TLSConfig != nil
+}
+
+// readyQueue holds the conns which have passed the gate and wait for Accept. The accept errors aren't
+// queued, only the latest one is kept until Accept returns it, otherwise a persistent error such as
+// EMFILE would pile up while nobody calls Accept.
+type readyQueue struct {
+	once   sync.Once
+	mu     sync.Mutex
+	conns  []*HjConn
+	err    error
+	signal chan struct{}
+}
+
+func (q *readyQueue) push(conn *HjConn) {
+	q.mu.Lock()
+	q.conns = append(q.conns, conn)
+	q.mu.Unlock()
+	q.notify()
+}
+
+// fail sets the error returned by the next Accept, it replaces the error not returned yet.
+func (q *readyQueue) fail(err error) {
+	q.mu.Lock()
+	q.err = err
+	q.mu.Unlock()
+	q.notify()
+}
+
+func (q *readyQueue) notify() {
+	select {
+	case q.signal <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns a ready conn, or the pending accept error when there is none. Both are nil when
+// nothing is waiting.
+func (q *readyQueue) pop() (*HjConn, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if len(q.conns) > 0 {
+		conn := q.conns[0]
+		q.conns[0] = nil
+		q.conns = q.conns[1:]
+		return conn, nil
+	}
+	err := q.err
+	q.err = nil
+	return nil, err
+}
+
+// acceptGated waits for a conn which has passed the gate, the conns are accepted in background
+// since they are handed to Accept in the order their first bytes arrive.
+func (h *HjListener) acceptGated() (net.Conn, error) {
+	q := &h.ready
+	q.once.Do(func() {
+		q.signal = make(chan struct{}, 1)
+		h.manager.onReady = q.push
+		go h.gateAccept()
+	})
+	for {
+		conn, err := q.pop()
+		if err != nil {
+			return nil, err
+		}
+		if conn != nil {
+			return conn, nil
+		}
+		select {
+		case <-q.signal:
+		case <-h.done:
+			return nil, net.ErrClosed
+		}
+	}
+}
+
+// gateAccept accepts the conns and registers them to the event loop until the listener is closed.
+func (h *HjListener) gateAccept() {
+	for {
+		nfd, sa, err := h.accept()
+		if err != nil {
+			if atomic.LoadInt32(&h.closed) == 1 {
+				return
+			}
+			h.ready.fail(err)
+			// 避免在 EMFILE 等持续性错误上空转
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		conn := newHjConn(nfd, h.Addr(), socket.SockaddrToTCPOrUnixAddr(sa), h.manager)
+		if err = h.manager.registerPending(conn); err != nil {
+			h.manager.metrics.rejected.Inc()
+			_ = h.manager.closeConn(conn, err)
+		}
+	}
+}
+
+// registerPending registers the conn which is held until its first bytes arrive, it's closed
+// with ErrFirstByteTimeout if nothing arrives in time. The handshake of a TLS conn starts here.
+func (m *connManager) registerPending(conn *HjConn) error {
+	atomic.StoreInt32(&conn.pending, 1)
+	// 定时器要在注册之前设置，注册后事件循环随时可能访问它
+	if d := m.opts.FirstByteTimeout; d > 0 {
+		conn.gateTimer = m.afterFunc(d, func() {
+			if atomic.LoadInt32(&conn.pending) == 1 && atomic.LoadUint64(&conn.bytesIn) == 0 && !conn.isClosed() {
+				m.opts.Logger.Debug("first-byte timeout", "fd", conn.fd, "remote_addr", conn.remoteAddr, "loop", m.idx)
+				_ = m.closeConn(conn, ErrFirstByteTimeout)
+			}
+		})
+	}
+	if m.opts.TLSConfig != nil {
+		m.startTLS(conn)
+	}
+	return m.RegisterConn(conn)
+}
+
+// handOff releases the pending conn to OnOpen or Accept after its first bytes arrive, or after its
+// TLS handshake completes, it reports false if the conn has been closed.
+func (m *connManager) handOff(conn *HjConn) bool {
+	conn.mu.Lock()
+	ok := !conn.isClosed() && atomic.CompareAndSwapInt32(&conn.pending, 1, 0)
+	conn.mu.Unlock()
+	if !ok {
+		return false
+	}
+	if conn.gateTimer != nil {
+		m.stopTimer(conn.gateTimer)
+	}
+	if conn.handler != nil {
+		m.execute(conn, func() {
+			if action := conn.handler.OnOpen(conn); action == Close || action == Shutdown {
+				_ = m.closeConn(conn, nil)
+			}
+		})
+	} else {
+		m.onReady(conn)
+	}
+	return true
+}
+
+// receiving reports whether a request of the conn is being received: the conn hasn't been handed off yet,
+// or OnTraffic has returned leaving an incomplete request in the inbound buffer.
+// The rate isn't enforced on the conns handed to Accept, since the engine can't tell a slow client from
+// a slow reader.
+func (m *connManager) receiving(conn *HjConn) bool {
+	if atomic.LoadInt32(&conn.pending) == 1 {
+		return true
+	}
+	if conn.handler == nil || conn.InboundBuffered() == 0 {
+		return false
+	}
+	e := &conn.executor
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !e.running && !e.trafficQueued
+}
+
+// checkReadRate closes the conns receiving less than Options.MinReadRate in the last interval,
+// it runs on the timer of the event loop.
+func (m *connManager) checkReadRate() {
+	rate := m.opts.MinReadRate
+	m.Range(func(c *HjConn) bool {
+		in := atomic.LoadUint64(&c.bytesIn)
+		if c.rateReceiving && in-c.rateBytes < uint64(rate.Bytes) {
+			m.opts.Logger.Debug("read too slow", "fd", c.fd, "remote_addr", c.remoteAddr, "loop", m.idx,
+				"bytes", in-c.rateBytes)
+			_ = m.closeConn(c, ErrReadTooSlow)
+			return true
+		}
+		c.rateBytes, c.rateReceiving = in, m.receiving(c)
+		return true
+	})
+}
@@ -0,0 +1,132 @@
+package haijun_net
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// lineHandler echoes the complete lines and leaves the incomplete one in the inbound buffer.
+type lineHandler struct {
+	closeReasonHandler
+	opened int32
+}
+
+func (h *lineHandler) OnOpen(_ *HjConn) Action {
+	atomic.AddInt32(&h.opened, 1)
+	return None
+}
+
+func (h *lineHandler) OnTraffic(c *HjConn) Action {
+	head, tail := c.Peek(c.InboundBuffered())
+	data := append(append([]byte{}, head...), tail...)
+	if i := bytes.LastIndexByte(data, '\n'); i >= 0 {
+		_, _ = c.Write(data[:i+1])
+		c.Discard(i + 1)
+	}
+	return None
+}
+
+func TestWithFirstByteTimeout_Serve(t *testing.T) {
+	h := &lineHandler{closeReasonHandler: closeReasonHandler{reason: make(chan error, 2)}}
+	l := serveTest(t, h, WithFirstByteTimeout(100*time.Millisecond))
+
+	silent, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer silent.Close()
+	talker, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer talker.Close()
+	_, err = talker.Write([]byte("hi\n"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(talker, make([]byte, 3))
+	require.NoError(t, err)
+
+	_ = silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = silent.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	// 被拦截的连接不会触发 OnOpen 和 OnClose
+	assert.EqualValues(t, 1, atomic.LoadInt32(&h.opened))
+	assert.Len(t, h.reason, 0)
+}
+
+func TestWithFirstByteTimeout_Accept(t *testing.T) {
+	l, err := NewHjListener("127.0.0.1:0", WithFirstByteTimeout(100*time.Millisecond))
+	require.NoError(t, err)
+	defer l.Close()
+
+	silent, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer silent.Close()
+	talker, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer talker.Close()
+	_, err = talker.Write([]byte("hello"))
+	require.NoError(t, err)
+
+	c, err := l.Accept()
+	require.NoError(t, err)
+	defer c.Close()
+	assert.Equal(t, talker.LocalAddr().String(), c.RemoteAddr().String())
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(buf))
+
+	_ = silent.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = silent.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+func TestWithMinReadRate(t *testing.T) {
+	h := &lineHandler{closeReasonHandler: closeReasonHandler{reason: make(chan error, 1)}}
+	l := serveTest(t, h, WithMinReadRate(4, 100*time.Millisecond))
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	// 完整的请求之后没有数据不算慢速
+	_, err = c.Write([]byte("fast\n"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(c, make([]byte, 5))
+	require.NoError(t, err)
+	time.Sleep(300 * time.Millisecond)
+	_, err = c.Write([]byte("fast\n"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(c, make([]byte, 5))
+	require.NoError(t, err)
+
+	// 逐字节慢速发送一个请求
+	start := time.Now()
+	for err == nil && time.Since(start) < 5*time.Second {
+		_, err = c.Write([]byte("s"))
+		time.Sleep(50 * time.Millisecond)
+	}
+	assert.Equal(t, ErrReadTooSlow, <-h.reason)
+}
+
+func TestReadyQueue_CoalescesErrors(t *testing.T) {
+	q := &readyQueue{signal: make(chan struct{}, 1)}
+	for i := 0; i < 100; i++ {
+		q.fail(io.ErrUnexpectedEOF)
+	}
+	conn := &HjConn{}
+	q.push(conn)
+	q.fail(io.EOF)
+
+	c, err := q.pop()
+	assert.Same(t, conn, c, "the ready conns come first")
+	assert.NoError(t, err)
+	c, err = q.pop()
+	assert.Nil(t, c)
+	assert.Equal(t, io.EOF, err, "only the latest error is kept")
+	c, err = q.pop()
+	assert.Nil(t, c)
+	assert.NoError(t, err)
+}
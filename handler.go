@@ -0,0 +1,52 @@
+package haijun_net
+
+// Action is an action that occurs after the completion of an event.
+type Action int
+
+const (
+	// None indicates that no action should occur following an event.
+	None Action = iota
+
+	// Close closes the connection.
+	Close
+
+	// Shutdown closes the connection once the data written so far is sent, the connection isn't read
+	// meanwhile. It's meant for OnTraffic replying before hanging up, OnOpen treats it as Close.
+	Shutdown
+)
+
+// EventHandler represents the callbacks of the event-driven mode, see HjListener.Serve.
+//
+// The callbacks run on the event loop unless Options.WorkerPoolSize is set, in which case
+// they run on the worker pool, the callbacks of one conn are always invoked one by one.
+type EventHandler interface {
+	// OnOpen fires when a new connection has been accepted, before it is registered to the poller.
+	OnOpen(c *HjConn) (action Action)
+
+	// OnTraffic fires when new data has been read into the inbound buffer of the connection,
+	// the data can be consumed by c.Read, c.Peek and c.Discard.
+	OnTraffic(c *HjConn) (action Action)
+
+	// OnClose fires when the connection has been closed, err is nil when it was closed
+	// by the peer or locally.
+	OnClose(c *HjConn, err error)
+}
+
+// BuiltinEventHandler is a built-in implementation for EventHandler which sets up each method with a default
+// implementation, you can compose it with your own implementation of EventHandler when you don't want to
+// implement all methods in EventHandler.
+type BuiltinEventHandler struct{}
+
+// OnOpen fires when a new connection has been accepted.
+func (*BuiltinEventHandler) OnOpen(_ *HjConn) (action Action) {
+	return
+}
+
+// OnTraffic fires when new data has been read into the inbound buffer of the connection.
+func (*BuiltinEventHandler) OnTraffic(_ *HjConn) (action Action) {
+	return
+}
+
+// OnClose fires when the connection has been closed.
+func (*BuiltinEventHandler) OnClose(_ *HjConn, _ error) {
+}
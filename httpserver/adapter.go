@@ -0,0 +1,130 @@
+package httpserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+)
+
+// Adapt returns a Handler serving the requests by h, so that the handlers written for net/http can be
+// served by the Server.
+//
+// Unlike net/http, the response is buffered and sent once h returns, so http.Flusher and http.Hijacker
+// aren't supported, and the request body mustn't be read after h returns.
+func Adapt(h http.Handler) Handler {
+	return HandlerFunc(func(w *ResponseWriter, r *Request) {
+		req, err := newHTTPRequest(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			w.AddHeader("Connection", "close")
+			return
+		}
+		rw := &responseWriter{w: w, header: make(http.Header)}
+		h.ServeHTTP(rw, req)
+		rw.WriteHeader(http.StatusOK)
+	})
+}
+
+func newHTTPRequest(r *Request) (*http.Request, error) {
+	uri := string(r.URI)
+	var (
+		u   *url.URL
+		err error
+	)
+	if uri == "*" {
+		u = &url.URL{Path: "*"}
+	} else if u, err = url.ParseRequestURI(uri); err != nil {
+		return nil, err
+	}
+
+	header := make(http.Header, len(r.Headers))
+	for _, h := range r.Headers {
+		header.Add(string(h.Key), string(h.Value))
+	}
+	req := &http.Request{
+		Method:        r.Method,
+		URL:           u,
+		Proto:         r.Proto,
+		ProtoMajor:    1,
+		ProtoMinor:    r.ProtoMinor,
+		Header:        header,
+		ContentLength: r.ContentLength,
+		Close:         r.Close,
+		Host:          u.Host,
+		RequestURI:    uri,
+		Body:          http.NoBody,
+	}
+	// 与 net/http 一致，Host 不出现在 Header 中
+	if req.Host == "" {
+		req.Host = header.Get("Host")
+	}
+	delete(header, "Host")
+	if r.ContentLength < 0 {
+		req.TransferEncoding = []string{"chunked"}
+	}
+	if len(r.Body) > 0 {
+		req.Body = ioutil.NopCloser(bytes.NewReader(r.Body))
+	}
+	if r.Conn != nil {
+		req.RemoteAddr = r.Conn.RemoteAddr().String()
+		if state, ok := r.Conn.ConnectionState(); ok {
+			req.TLS = &state
+		}
+	}
+	return req, nil
+}
+
+// responseWriter implements http.ResponseWriter on a ResponseWriter.
+type responseWriter struct {
+	w           *ResponseWriter
+	header      http.Header
+	wroteHeader bool
+}
+
+func (rw *responseWriter) Header() http.Header {
+	return rw.header
+}
+
+// WriteHeader copies the header fields to the response, the later changes of the header are ignored
+// as net/http does.
+func (rw *responseWriter) WriteHeader(status int) {
+	if rw.wroteHeader {
+		return
+	}
+	rw.wroteHeader = true
+	rw.w.WriteHeader(status)
+	keys := make([]string, 0, len(rw.header))
+	for k := range rw.header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range rw.header[k] {
+			rw.w.AddHeader(k, v)
+		}
+	}
+}
+
+// Write writes b to the response body, the Content-Type is detected from b if it isn't set before
+// the first Write.
+func (rw *responseWriter) Write(b []byte) (int, error) {
+	if !rw.wroteHeader {
+		if _, ok := rw.header["Content-Type"]; !ok && len(b) > 0 && rw.header.Get("Transfer-Encoding") == "" {
+			rw.header.Set("Content-Type", http.DetectContentType(b))
+		}
+		rw.WriteHeader(http.StatusOK)
+	}
+	return rw.w.Write(b)
+}
+
+// WriteString implements io.StringWriter.
+func (rw *responseWriter) WriteString(s string) (int, error) {
+	if !rw.wroteHeader {
+		return rw.Write([]byte(s))
+	}
+	return rw.w.WriteString(s)
+}
+
+var _ http.ResponseWriter = (*responseWriter)(nil)
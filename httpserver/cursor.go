@@ -0,0 +1,175 @@
+package httpserver
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/Ccheers/haijun-net/codec"
+)
+
+// errNotFound is returned by cursor.until when the delimiter isn't found within the max length.
+var errNotFound = errors.New("httpserver: delimiter not found")
+
+// cursor reads the data split into segments, e.g. the head and the tail returned by HjConn.Peek.
+type cursor struct {
+	segs [][]byte
+	i    int // segs[i][off] is the next byte
+	off  int
+	n    int // the number of bytes read
+}
+
+// avail returns the number of unread bytes.
+func (c *cursor) avail() int {
+	n := 0
+	for i, off := c.i, c.off; i < len(c.segs); i, off = i+1, 0 {
+		n += len(c.segs[i]) - off
+	}
+	return n
+}
+
+func (c *cursor) peekByte() (byte, bool) {
+	for i, off := c.i, c.off; i < len(c.segs); i, off = i+1, 0 {
+		if off < len(c.segs[i]) {
+			return c.segs[i][off], true
+		}
+	}
+	return 0, false
+}
+
+// skip skips n bytes, which must be available.
+func (c *cursor) skip(n int) {
+	c.n += n
+	for n > 0 {
+		k := len(c.segs[c.i]) - c.off
+		if n < k {
+			c.off += n
+			return
+		}
+		n -= k
+		c.i, c.off = c.i+1, 0
+	}
+}
+
+// until reads the data up to and including the first delim, which is searched within max bytes.
+// The data is returned in place, or copied into scratch when it spans two segments. It returns
+// errNotFound if delim isn't found within max bytes, or codec.ErrIncomplete if fewer are available.
+func (c *cursor) until(delim []byte, max int, scratch *[]byte) ([]byte, error) {
+	for c.i < len(c.segs) && c.off == len(c.segs[c.i]) {
+		c.i, c.off = c.i+1, 0
+	}
+	if c.i < len(c.segs) {
+		seg := c.segs[c.i][c.off:]
+		if len(seg) > max {
+			seg = seg[:max]
+		}
+		if j := bytes.Index(seg, delim); j >= 0 {
+			b := seg[: j+len(delim) : j+len(delim)]
+			c.skip(len(b))
+			return b, nil
+		}
+	}
+
+	buf := (*scratch)[:0]
+	for i, off := c.i, c.off; i < len(c.segs) && len(buf) < max; i, off = i+1, 0 {
+		seg := c.segs[i][off:]
+		if room := max - len(buf); len(seg) > room {
+			seg = seg[:room]
+		}
+		// 分隔符可能跨越两个分段
+		from := len(buf) - len(delim) + 1
+		if from < 0 {
+			from = 0
+		}
+		buf = append(buf, seg...)
+		if j := bytes.Index(buf[from:], delim); j >= 0 {
+			*scratch = buf
+			b := buf[: from+j+len(delim) : from+j+len(delim)]
+			c.skip(len(b))
+			return b, nil
+		}
+	}
+	*scratch = buf
+	if len(buf) >= max {
+		return nil, errNotFound
+	}
+	return nil, codec.ErrIncomplete
+}
+
+// index returns the offset of the first delim in the unread data, or -1 if it isn't found within max
+// bytes. The search starts from bytes after the cursor, so that the data searched before isn't searched
+// again, and the data isn't copied like until does.
+func (c *cursor) index(delim []byte, from, max int) int {
+	var tailBuf, winBuf [16]byte
+	k := len(delim) - 1
+	tail := tailBuf[:0] // 前面分段末尾的 k 个字节，分隔符可能跨越多个分段
+	pos := 0            // seg 相对于游标的偏移
+	for i, off := c.i, c.off; i < len(c.segs) && pos < max; i, off = i+1, 0 {
+		seg := c.segs[i][off:]
+		if pos+len(seg) <= from {
+			pos += len(seg)
+			continue
+		}
+		if pos < from {
+			seg, pos = seg[from-pos:], from
+		}
+		if len(seg) > max-pos {
+			seg = seg[:max-pos]
+		}
+		if len(tail) > 0 {
+			win := append(winBuf[:0], tail...)
+			if len(seg) > k {
+				win = append(win, seg[:k]...)
+			} else {
+				win = append(win, seg...)
+			}
+			if j := bytes.Index(win, delim); j >= 0 {
+				return pos - len(tail) + j
+			}
+		}
+		if j := bytes.Index(seg, delim); j >= 0 {
+			return pos + j
+		}
+		if len(seg) >= k {
+			tail = append(tail[:0], seg[len(seg)-k:]...)
+		} else if tail = append(tail, seg...); len(tail) > k {
+			tail = append(tailBuf[:0], tail[len(tail)-k:]...)
+		}
+		pos += len(seg)
+	}
+	return -1
+}
+
+// take reads n bytes, they're returned in place or copied into scratch when they span two segments.
+func (c *cursor) take(n int, scratch *[]byte) ([]byte, error) {
+	for c.i < len(c.segs) && c.off == len(c.segs[c.i]) {
+		c.i, c.off = c.i+1, 0
+	}
+	if c.i < len(c.segs) {
+		if seg := c.segs[c.i][c.off:]; len(seg) >= n {
+			c.skip(n)
+			return seg[:n:n], nil
+		}
+	}
+	if c.avail() < n {
+		return nil, codec.ErrIncomplete
+	}
+	*scratch = c.appendTo((*scratch)[:0], n)
+	return *scratch, nil
+}
+
+// appendTo reads n bytes, which must be available, and appends them to dst.
+func (c *cursor) appendTo(dst []byte, n int) []byte {
+	c.n += n
+	for n > 0 {
+		seg := c.segs[c.i][c.off:]
+		if len(seg) > n {
+			seg = seg[:n]
+		}
+		dst = append(dst, seg...)
+		n -= len(seg)
+		if c.off += len(seg); c.off == len(c.segs[c.i]) {
+			c.i, c.off = c.i+1, 0
+		}
+	}
+	return dst
+}
@@ -0,0 +1,521 @@
+// Package httpserver implements an HTTP/1.1 server on the event-driven API of haijun-net, it serves the
+// conns of HjListener on the event loops without a goroutine per conn.
+//
+// The requests are parsed incrementally from the inbound buffer of the conn and in place: the fields of
+// a Request reference the buffered data unless they span two blocks of the buffer, so they're only
+// valid until the handler returns. Keep-alive, pipelining, chunked request bodies and
+// Expect: 100-continue are supported. The responses are buffered and sent once the handler returns,
+// Adapt serves the handlers written for net/http.
+package httpserver
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+
+	hjnet "github.com/Ccheers/haijun-net"
+	"github.com/Ccheers/haijun-net/codec"
+)
+
+const (
+	// DefaultMaxHeaderBytes is the default max size of the request line and the headers.
+	DefaultMaxHeaderBytes = 1 << 20 // 1MB
+	// DefaultMaxBodySize is the default max size of a request body.
+	DefaultMaxBodySize = 4 << 20 // 4MB
+
+	// maxChunkLineLength is the max length of the size line of a chunk, extensions included.
+	maxChunkLineLength = 4096
+)
+
+// Header is a header field of a request.
+type Header struct {
+	Key   []byte
+	Value []byte
+}
+
+// Request is a request received by the Server. The byte slices reference the inbound buffer of
+// the conn and are only valid until the handler returns.
+type Request struct {
+	// Method is the request method, e.g. "GET".
+	Method string
+	// URI is the request target, e.g. "/index.html?q=1".
+	URI []byte
+	// Proto is "HTTP/1.0" or "HTTP/1.1", ProtoMinor is 0 or 1 accordingly.
+	Proto      string
+	ProtoMinor int
+	// Headers are the header fields in the order they were received, Host included.
+	Headers []Header
+	// Body is the request body, the chunked bodies are decoded.
+	Body []byte
+	// ContentLength is the value of the Content-Length header, or -1 when the body is chunked.
+	ContentLength int64
+	// Close reports whether the conn is closed after the response.
+	Close bool
+	// Conn is the conn the request is received from.
+	Conn *hjnet.HjConn
+
+	expectContinue bool
+}
+
+// HeaderValue returns the value of the first header field named key, which is case-insensitive,
+// or nil if there is none.
+func (r *Request) HeaderValue(key string) []byte {
+	for i := range r.Headers {
+		if equalFold(r.Headers[i].Key, key) {
+			return r.Headers[i].Value
+		}
+	}
+	return nil
+}
+
+// Path returns the part of URI before the query.
+func (r *Request) Path() []byte {
+	if i := bytes.IndexByte(r.URI, '?'); i >= 0 {
+		return r.URI[:i]
+	}
+	return r.URI
+}
+
+// Query returns the part of URI after '?', it's nil if there is no query.
+func (r *Request) Query() []byte {
+	if i := bytes.IndexByte(r.URI, '?'); i >= 0 {
+		return r.URI[i+1:]
+	}
+	return nil
+}
+
+func (r *Request) reset() {
+	for i := range r.Headers {
+		r.Headers[i] = Header{}
+	}
+	*r = Request{Headers: r.Headers[:0], Conn: r.Conn}
+}
+
+// statusError is a malformed or rejected request, the conn is closed after replying status.
+type statusError struct {
+	status int
+	msg    string
+}
+
+func (e *statusError) Error() string {
+	return "httpserver: " + e.msg
+}
+
+func errorf(status int, msg string) error {
+	return &statusError{status: status, msg: msg}
+}
+
+// parser parses the requests of a conn, its scratch buffers hold the data spanning two segments.
+type parser struct {
+	maxHeaderBytes int
+	maxBodySize    int
+
+	hdr  []byte
+	body []byte
+	line []byte
+
+	progress progress
+}
+
+// progress is how far the parser got in an incomplete request. The request is left in the inbound
+// buffer of the conn and parsed again when more data arrives, the parsing resumes where it stopped.
+type progress struct {
+	lead    int  // the bytes of the empty lines before the request line
+	scanned int  // the bytes after lead searched for the end of the header
+	body    int  // the offset of the body, zero until the header is parsed
+	chunks  int  // the bytes of the chunked body checked
+	size    int  // the size of the chunks checked
+	last    bool // whether the last chunk has been checked
+	trailer int  // the size of the trailer fields checked
+}
+
+// parse parses the next request, it returns codec.ErrIncomplete when the request isn't complete.
+// r.expectContinue is set when the headers are complete but the body isn't.
+//
+// After codec.ErrIncomplete, parse must be called again with the cursor at the start of the request
+// and the same r, which keeps the headers parsed so far.
+func (p *parser) parse(c *cursor, r *Request) error {
+	start := c.n
+	if p.progress.body == 0 {
+		if err := p.head(c, r); err != nil {
+			if err != codec.ErrIncomplete {
+				p.progress = progress{}
+			}
+			return err
+		}
+		p.progress.body = c.n - start
+	} else {
+		c.skip(p.progress.body)
+	}
+
+	var err error
+	if r.ContentLength == -1 {
+		// 先确认整个消息体已经到达，再复制解码，避免每次数据到达都重复复制
+		body := *c
+		c.skip(p.progress.chunks)
+		if err = p.checkChunks(c); err == nil {
+			end := *c
+			*c = body
+			r.Body = p.decodeChunks(c)
+			*c = end
+		}
+	} else if r.ContentLength > 0 {
+		r.Body, err = c.take(int(r.ContentLength), &p.body)
+	}
+	if err == codec.ErrIncomplete {
+		return err
+	}
+	p.progress = progress{}
+	r.expectContinue = false
+	return err
+}
+
+// started reports whether the header of an incomplete request has been parsed.
+func (p *parser) started() bool {
+	return p.progress.body > 0
+}
+
+// overflow returns the error replied to an incomplete request which doesn't fit in the inbound buffer.
+func (p *parser) overflow() error {
+	started := p.started()
+	p.progress = progress{}
+	if started {
+		return errorf(http.StatusRequestEntityTooLarge, "request body too large")
+	}
+	return errorf(http.StatusRequestHeaderFieldsTooLarge, "request header too large")
+}
+
+// head reads the request line and the header fields.
+func (p *parser) head(c *cursor, r *Request) error {
+	r.reset()
+	c.skip(p.progress.lead)
+	// 请求行之前的空行应当忽略，见 RFC 9112 2.2
+	for {
+		b, ok := c.peekByte()
+		if !ok {
+			return codec.ErrIncomplete
+		}
+		if b != '\r' && b != '\n' {
+			break
+		}
+		c.skip(1)
+		p.progress.lead++
+	}
+	i := c.index(crlfcrlf, p.progress.scanned, p.maxHeaderBytes)
+	if i < 0 {
+		n := c.avail()
+		if n >= p.maxHeaderBytes {
+			return errorf(http.StatusRequestHeaderFieldsTooLarge, "request header too large")
+		}
+		// 下次从可能是分隔符开头的位置接着查找
+		if n >= len(crlfcrlf) {
+			p.progress.scanned = n - len(crlfcrlf) + 1
+		}
+		return codec.ErrIncomplete
+	}
+	block, _ := c.take(i+len(crlfcrlf), &p.hdr)
+	return p.header(block[:len(block)-2], r)
+}
+
+// header parses the request line and the header fields of block, which is ended by the CRLF of
+// the last field.
+func (p *parser) header(block []byte, r *Request) error {
+	i := bytes.Index(block, crlf)
+	line, block := block[:i], block[i+2:]
+	if err := requestLine(line, r); err != nil {
+		return err
+	}
+
+	var hasLength, hasHost, keepAlive, closeConn, chunked bool
+	for len(block) > 0 {
+		i = bytes.Index(block, crlf)
+		line, block = block[:i], block[i+2:]
+		if line[0] == ' ' || line[0] == '\t' {
+			return errorf(http.StatusBadRequest, "obsolete line folding")
+		}
+		colon := bytes.IndexByte(line, ':')
+		if colon <= 0 || !isToken(line[:colon]) {
+			return errorf(http.StatusBadRequest, "malformed header field")
+		}
+		key, value := line[:colon], trimOWS(line[colon+1:])
+		if bytes.IndexByte(value, '\r') >= 0 || bytes.IndexByte(value, '\n') >= 0 {
+			return errorf(http.StatusBadRequest, "malformed header field")
+		}
+		r.Headers = append(r.Headers, Header{Key: key, Value: value})
+
+		switch {
+		case equalFold(key, "Content-Length"):
+			n, ok := parseLength(value)
+			if !ok || (hasLength && n != r.ContentLength) {
+				return errorf(http.StatusBadRequest, "invalid Content-Length")
+			}
+			hasLength, r.ContentLength = true, n
+		case equalFold(key, "Transfer-Encoding"):
+			if r.ProtoMinor == 0 {
+				return errorf(http.StatusBadRequest, "Transfer-Encoding in HTTP/1.0")
+			}
+			if !equalFold(value, "chunked") || chunked {
+				return errorf(http.StatusNotImplemented, "unsupported Transfer-Encoding")
+			}
+			chunked = true
+		case equalFold(key, "Connection"):
+			closeConn = closeConn || hasToken(value, "close")
+			keepAlive = keepAlive || hasToken(value, "keep-alive")
+		case equalFold(key, "Expect"):
+			if r.ProtoMinor == 0 {
+				break
+			}
+			if !equalFold(value, "100-continue") {
+				return errorf(http.StatusExpectationFailed, "unsupported expectation")
+			}
+			r.expectContinue = true
+		case equalFold(key, "Host"):
+			if hasHost {
+				return errorf(http.StatusBadRequest, "duplicate Host")
+			}
+			hasHost = true
+		}
+	}
+	// HTTP/1.0 默认关闭连接
+	r.Close = closeConn || (r.ProtoMinor == 0 && !keepAlive)
+	if r.ProtoMinor == 1 && !hasHost {
+		return errorf(http.StatusBadRequest, "missing Host")
+	}
+	if chunked {
+		// 同时带有两者时按分块解析，响应后关闭连接，见 RFC 9112 6.1
+		if hasLength {
+			r.Close = true
+		}
+		r.ContentLength = -1
+	} else if r.ContentLength > int64(p.maxBodySize) {
+		return errorf(http.StatusRequestEntityTooLarge, "request body too large")
+	}
+	return nil
+}
+
+func requestLine(line []byte, r *Request) error {
+	i := bytes.IndexByte(line, ' ')
+	j := bytes.LastIndexByte(line, ' ')
+	if i <= 0 || j <= i+1 || !isToken(line[:i]) {
+		return errorf(http.StatusBadRequest, "malformed request line")
+	}
+	r.Method, r.URI = methodString(line[:i]), line[i+1:j]
+	for _, b := range r.URI {
+		if b <= ' ' || b == 0x7f {
+			return errorf(http.StatusBadRequest, "malformed request target")
+		}
+	}
+	switch proto := line[j+1:]; string(proto) {
+	case "HTTP/1.1":
+		r.Proto, r.ProtoMinor = "HTTP/1.1", 1
+	case "HTTP/1.0":
+		r.Proto, r.ProtoMinor = "HTTP/1.0", 0
+	default:
+		if bytes.HasPrefix(proto, []byte("HTTP/")) {
+			return errorf(http.StatusHTTPVersionNotSupported, "unsupported HTTP version")
+		}
+		return errorf(http.StatusBadRequest, "malformed HTTP version")
+	}
+	return nil
+}
+
+// checkChunks checks that the chunked body and its trailer are complete, it resumes after the bytes
+// checked by the previous calls.
+func (p *parser) checkChunks(c *cursor) error {
+	pr := &p.progress
+	for !pr.last {
+		start := c.n
+		n, err := p.chunkSize(c)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			pr.last, pr.chunks = true, pr.chunks+c.n-start
+			break
+		}
+		if pr.size+n > p.maxBodySize {
+			return errorf(http.StatusRequestEntityTooLarge, "request body too large")
+		}
+		if c.avail() < n+2 {
+			return codec.ErrIncomplete
+		}
+		c.skip(n)
+		if end, _ := c.take(2, &p.line); !bytes.Equal(end, crlf) {
+			return errorf(http.StatusBadRequest, "chunk not ended by CRLF")
+		}
+		pr.size, pr.chunks = pr.size+n, pr.chunks+c.n-start
+	}
+	for {
+		start := c.n
+		line, err := c.until(crlf, p.maxHeaderBytes, &p.line)
+		if err != nil {
+			if err == errNotFound {
+				return errorf(http.StatusRequestHeaderFieldsTooLarge, "trailer too large")
+			}
+			return err
+		}
+		pr.chunks += c.n - start
+		if len(line) == 2 {
+			return nil
+		}
+		if pr.trailer += len(line); pr.trailer > p.maxHeaderBytes {
+			return errorf(http.StatusRequestHeaderFieldsTooLarge, "trailer too large")
+		}
+	}
+}
+
+// decodeChunks decodes the chunks checked by checkChunks and returns the body, the cursor is left
+// after the last chunk.
+func (p *parser) decodeChunks(c *cursor) []byte {
+	p.body = p.body[:0]
+	for {
+		n, _ := p.chunkSize(c)
+		if n == 0 {
+			return p.body
+		}
+		p.body = c.appendTo(p.body, n)
+		c.skip(2)
+	}
+}
+
+// chunkSize reads the size line of a chunk, the chunk extensions are ignored.
+func (p *parser) chunkSize(c *cursor) (int, error) {
+	line, err := c.until(crlf, maxChunkLineLength, &p.line)
+	if err != nil {
+		if err == errNotFound {
+			return 0, errorf(http.StatusBadRequest, "chunk size line too long")
+		}
+		return 0, err
+	}
+	line = line[:len(line)-2]
+	if i := bytes.IndexByte(line, ';'); i >= 0 {
+		line = line[:i]
+	}
+	n, ok := parseHex(trimOWS(line))
+	if !ok {
+		return 0, errorf(http.StatusBadRequest, "invalid chunk size")
+	}
+	return n, nil
+}
+
+var (
+	crlf     = []byte("\r\n")
+	crlfcrlf = []byte("\r\n\r\n")
+)
+
+// methodString returns the method without allocating for the common ones.
+func methodString(b []byte) string {
+	switch string(b) {
+	case http.MethodGet:
+		return http.MethodGet
+	case http.MethodHead:
+		return http.MethodHead
+	case http.MethodPost:
+		return http.MethodPost
+	case http.MethodPut:
+		return http.MethodPut
+	case http.MethodPatch:
+		return http.MethodPatch
+	case http.MethodDelete:
+		return http.MethodDelete
+	case http.MethodOptions:
+		return http.MethodOptions
+	}
+	return string(b)
+}
+
+// isToken reports whether b is a token of RFC 9110 5.6.2.
+func isToken(b []byte) bool {
+	if len(b) == 0 {
+		return false
+	}
+	for _, c := range b {
+		if c <= ' ' || c >= 0x7f || strings.IndexByte("\"(),/:;<=>?@[\\]{}", c) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+func trimOWS(b []byte) []byte {
+	for len(b) > 0 && (b[0] == ' ' || b[0] == '\t') {
+		b = b[1:]
+	}
+	for len(b) > 0 && (b[len(b)-1] == ' ' || b[len(b)-1] == '\t') {
+		b = b[:len(b)-1]
+	}
+	return b
+}
+
+// equalFold reports whether b equals the ASCII string s case-insensitively, without allocating.
+func equalFold(b []byte, s string) bool {
+	if len(b) != len(s) {
+		return false
+	}
+	for i := range b {
+		x, y := b[i], s[i]
+		if 'A' <= x && x <= 'Z' {
+			x += 'a' - 'A'
+		}
+		if 'A' <= y && y <= 'Z' {
+			y += 'a' - 'A'
+		}
+		if x != y {
+			return false
+		}
+	}
+	return true
+}
+
+// hasToken reports whether the comma-separated list v contains token case-insensitively.
+func hasToken(v []byte, token string) bool {
+	for len(v) > 0 {
+		i := bytes.IndexByte(v, ',')
+		if i < 0 {
+			i = len(v)
+		}
+		if equalFold(trimOWS(v[:i]), token) {
+			return true
+		}
+		if i == len(v) {
+			break
+		}
+		v = v[i+1:]
+	}
+	return false
+}
+
+func parseLength(b []byte) (int64, bool) {
+	if len(b) == 0 || len(b) > 18 {
+		return 0, false
+	}
+	var n int64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, false
+		}
+		n = n*10 + int64(c-'0')
+	}
+	return n, true
+}
+
+func parseHex(b []byte) (int, bool) {
+	if len(b) == 0 || len(b) > 8 {
+		return 0, false
+	}
+	n := 0
+	for _, c := range b {
+		switch {
+		case '0' <= c && c <= '9':
+			c -= '0'
+		case 'a' <= c && c <= 'f':
+			c -= 'a' - 10
+		case 'A' <= c && c <= 'F':
+			c -= 'A' - 10
+		default:
+			return 0, false
+		}
+		n = n<<4 | int(c)
+	}
+	return n, true
+}
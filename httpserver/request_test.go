@@ -0,0 +1,209 @@
+package httpserver
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Ccheers/haijun-net/codec"
+)
+
+func newParser() *parser {
+	return &parser{maxHeaderBytes: DefaultMaxHeaderBytes, maxBodySize: DefaultMaxBodySize}
+}
+
+// parseSplit parses data split into two segments at every offset, the results must be the same.
+func parseSplit(t *testing.T, data string, check func(r *Request, n int)) {
+	for k := 0; k <= len(data); k++ {
+		c := cursor{segs: [][]byte{[]byte(data[:k]), []byte(data[k:])}}
+		var r Request
+		require.NoError(t, newParser().parse(&c, &r), "split at %d", k)
+		check(&r, c.n)
+	}
+}
+
+func parseErr(data string) error {
+	var r Request
+	return newParser().parse(&cursor{segs: [][]byte{[]byte(data)}}, &r)
+}
+
+func statusOf(err error) int {
+	if e, ok := err.(*statusError); ok {
+		return e.status
+	}
+	return 0
+}
+
+func TestParser_Request(t *testing.T) {
+	data := "\r\nGET /index.html?q=1 HTTP/1.1\r\nHost: example.com\r\nX-Token:  abc \r\nAccept: */*\r\n\r\n"
+	parseSplit(t, data, func(r *Request, n int) {
+		assert.Equal(t, len(data), n)
+		assert.Equal(t, "GET", r.Method)
+		assert.Equal(t, "/index.html?q=1", string(r.URI))
+		assert.Equal(t, "/index.html", string(r.Path()))
+		assert.Equal(t, "q=1", string(r.Query()))
+		assert.Equal(t, "HTTP/1.1", r.Proto)
+		assert.Equal(t, 1, r.ProtoMinor)
+		assert.Len(t, r.Headers, 3)
+		assert.Equal(t, "abc", string(r.HeaderValue("x-token")))
+		assert.Equal(t, "example.com", string(r.HeaderValue("HOST")))
+		assert.Nil(t, r.HeaderValue("Cookie"))
+		assert.False(t, r.Close)
+		assert.Empty(t, r.Body)
+	})
+}
+
+func TestParser_ContentLength(t *testing.T) {
+	data := "POST /echo HTTP/1.1\r\nHost: a\r\nContent-Length: 11\r\n\r\nhello world"
+	parseSplit(t, data, func(r *Request, n int) {
+		assert.Equal(t, len(data), n)
+		assert.EqualValues(t, 11, r.ContentLength)
+		assert.Equal(t, "hello world", string(r.Body))
+	})
+	// 消息体未到齐
+	assert.Equal(t, codec.ErrIncomplete, parseErr(data[:len(data)-1]))
+}
+
+func TestParser_Chunked(t *testing.T) {
+	data := "POST /echo HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5;ext=1\r\nhello\r\n6\r\n world\r\n0\r\nX-Trailer: t\r\n\r\n"
+	parseSplit(t, data, func(r *Request, n int) {
+		assert.Equal(t, len(data), n)
+		assert.EqualValues(t, -1, r.ContentLength)
+		assert.Equal(t, "hello world", string(r.Body))
+	})
+	for i := 0; i < len(data); i++ {
+		assert.Equal(t, codec.ErrIncomplete, parseErr(data[:i]), "prefix %d", i)
+	}
+}
+
+func TestParser_KeepAlive(t *testing.T) {
+	cases := []struct {
+		req   string
+		close bool
+	}{
+		{"GET / HTTP/1.1\r\nHost: a\r\n\r\n", false},
+		{"GET / HTTP/1.1\r\nHost: a\r\nConnection: close\r\n\r\n", true},
+		{"GET / HTTP/1.0\r\n\r\n", true},
+		{"GET / HTTP/1.0\r\nConnection: Keep-Alive\r\n\r\n", false},
+		{"GET / HTTP/1.0\r\nConnection: keep-alive, close\r\n\r\n", true},
+	}
+	for _, c := range cases {
+		var r Request
+		require.NoError(t, newParser().parse(&cursor{segs: [][]byte{[]byte(c.req)}}, &r))
+		assert.Equal(t, c.close, r.Close, c.req)
+	}
+}
+
+func TestParser_ExpectContinue(t *testing.T) {
+	var r Request
+	c := cursor{segs: [][]byte{[]byte("PUT /f HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nContent-Length: 3\r\n\r\n")}}
+	assert.Equal(t, codec.ErrIncomplete, newParser().parse(&c, &r))
+	assert.True(t, r.expectContinue)
+
+	c = cursor{segs: [][]byte{[]byte("PUT /f HTTP/1.1\r\nHost: a\r\nExpect: 100-continue\r\nContent-Length: 3\r\n\r\nabc")}}
+	require.NoError(t, newParser().parse(&c, &r))
+	assert.False(t, r.expectContinue)
+	assert.Equal(t, "abc", string(r.Body))
+}
+
+func TestParser_Errors(t *testing.T) {
+	cases := []struct {
+		req    string
+		status int
+	}{
+		{"GET /\r\n\r\n", http.StatusBadRequest},
+		{"GET / HTTP/2.0\r\nHost: a\r\n\r\n", http.StatusHTTPVersionNotSupported},
+		{"GET / HTTP/1.1\r\n\r\n", http.StatusBadRequest},
+		{"GET / HTTP/1.1\r\nHost: a\r\nHost: b\r\n\r\n", http.StatusBadRequest},
+		{"GET / HTTP/1.1\r\nHost: a\r\nBad Key: v\r\n\r\n", http.StatusBadRequest},
+		{"GET / HTTP/1.1\r\nHost: a\r\nX: a\r\n b\r\n\r\n", http.StatusBadRequest},
+		{"GET / HTTP/1.1\r\nHost: a\r\nX: a\nb\r\n\r\n", http.StatusBadRequest},
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 1\r\nContent-Length: 2\r\n\r\n", http.StatusBadRequest},
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: -1\r\n\r\n", http.StatusBadRequest},
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: gzip\r\n\r\n", http.StatusNotImplemented},
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\nzz\r\n", http.StatusBadRequest},
+		{"POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n1\r\nab\r\n", http.StatusBadRequest},
+		{"POST / HTTP/1.1\r\nHost: a\r\nExpect: magic\r\n\r\n", http.StatusExpectationFailed},
+		{"POST / HTTP/1.1\r\nHost: a\r\nContent-Length: 99999999\r\n\r\n", http.StatusRequestEntityTooLarge},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.status, statusOf(parseErr(c.req)), c.req)
+	}
+}
+
+func TestParser_Limits(t *testing.T) {
+	p := &parser{maxHeaderBytes: 64, maxBodySize: 8}
+	var r Request
+	long := "GET / HTTP/1.1\r\nHost: a\r\nX: " + strings.Repeat("x", 64) + "\r\n\r\n"
+	err := p.parse(&cursor{segs: [][]byte{[]byte(long[:40]), []byte(long[40:])}}, &r)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, statusOf(err))
+	// 头部未到齐但已超出限制
+	err = p.parse(&cursor{segs: [][]byte{[]byte(long[:70])}}, &r)
+	assert.Equal(t, http.StatusRequestHeaderFieldsTooLarge, statusOf(err))
+
+	chunked := "POST / HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n5\r\n"
+	err = (&parser{maxHeaderBytes: 1024, maxBodySize: 8}).parse(&cursor{segs: [][]byte{[]byte(chunked)}}, &r)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, statusOf(err))
+}
+
+func TestParser_Resume(t *testing.T) {
+	reqs := []string{
+		"\r\nPOST /echo HTTP/1.1\r\nHost: a\r\nContent-Length: 11\r\n\r\nhello world",
+		"POST /echo HTTP/1.1\r\nHost: a\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n6;x\r\n world\r\n0\r\nX: y\r\n\r\n",
+	}
+	for _, data := range reqs {
+		// 数据逐字节到达，每次都从请求的开头重新调用，解析从上次停下的位置继续
+		p := newParser()
+		var r Request
+		var segs [][]byte
+		for i := 0; i < len(data); i++ {
+			segs = append(segs, []byte(data[i:i+1]))
+			c := cursor{segs: segs}
+			err := p.parse(&c, &r)
+			if i < len(data)-1 {
+				require.Equal(t, codec.ErrIncomplete, err, "%q at %d", data, i)
+				continue
+			}
+			require.NoError(t, err)
+			assert.Equal(t, len(data), c.n)
+			assert.Equal(t, "a", string(r.HeaderValue("Host")))
+			assert.Equal(t, "hello world", string(r.Body))
+		}
+		assert.False(t, p.started())
+		assert.Less(t, p.progress.scanned, 4)
+	}
+}
+
+func TestCursor_Index(t *testing.T) {
+	c := cursor{segs: [][]byte{[]byte("ab\r"), []byte("\n"), []byte("\r"), []byte("\ncd")}}
+	assert.Equal(t, 2, c.index(crlfcrlf, 0, 16))
+	assert.Equal(t, 2, c.index(crlfcrlf, 2, 16))
+	assert.Equal(t, -1, c.index(crlfcrlf, 3, 16))
+	assert.Equal(t, -1, c.index(crlfcrlf, 0, 5))
+	assert.Equal(t, 2, c.index(crlfcrlf, 0, 6))
+	c.skip(1)
+	assert.Equal(t, 1, c.index(crlfcrlf, 0, 16))
+	assert.Equal(t, 3, c.index(crlf, 2, 16))
+}
+
+func TestCursor_Until(t *testing.T) {
+	var scratch []byte
+	c := cursor{segs: [][]byte{[]byte("ab\r"), []byte("\ncd"), nil, []byte("\r\n")}}
+	b, err := c.until(crlf, 16, &scratch)
+	require.NoError(t, err)
+	assert.Equal(t, "ab\r\n", string(b))
+	b, err = c.until(crlf, 16, &scratch)
+	require.NoError(t, err)
+	assert.Equal(t, "cd\r\n", string(b))
+	assert.Equal(t, 8, c.n)
+	_, err = c.until(crlf, 16, &scratch)
+	assert.Equal(t, codec.ErrIncomplete, err)
+
+	c = cursor{segs: [][]byte{[]byte("abcdef"), []byte("gh\r\n")}}
+	_, err = c.until(crlf, 8, &scratch)
+	assert.Equal(t, errNotFound, err)
+}
@@ -0,0 +1,138 @@
+package httpserver
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ccheers/haijun-net/buffer"
+)
+
+// ResponseWriter buffers the response to a request, it's sent once the handler returns. The server
+// sets the Content-Length, Date and Connection header fields.
+type ResponseWriter struct {
+	status  int
+	header  []byte // 已经编码的头部字段
+	body    *buffer.LinkBuffer
+	hasDate bool
+	close   bool
+	upgrade Upgraded
+}
+
+// WriteHeader sets the status code of the response, it's 200 if WriteHeader isn't called. Only the
+// first call takes effect.
+func (w *ResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
+
+// AddHeader adds the header field key: value to the response, the CR and LF of value are replaced
+// by spaces. Content-Length and Transfer-Encoding are ignored. "Connection: close" closes the conn
+// after the response.
+func (w *ResponseWriter) AddHeader(key, value string) {
+	switch {
+	case strings.EqualFold(key, "Content-Length"), strings.EqualFold(key, "Transfer-Encoding"):
+		return
+	case strings.EqualFold(key, "Connection"):
+		if hasToken([]byte(value), "close") {
+			w.close = true
+			return
+		}
+	case strings.EqualFold(key, "Date"):
+		w.hasDate = true
+	}
+	if strings.ContainsAny(value, "\r\n") {
+		value = strings.NewReplacer("\r", " ", "\n", " ").Replace(value)
+	}
+	w.header = append(w.header, key...)
+	w.header = append(w.header, ':', ' ')
+	w.header = append(w.header, value...)
+	w.header = append(w.header, '\r', '\n')
+}
+
+// Write appends a copy of b to the response body.
+func (w *ResponseWriter) Write(b []byte) (int, error) {
+	return w.body.Write(b)
+}
+
+// WriteString appends s to the response body.
+func (w *ResponseWriter) WriteString(s string) (int, error) {
+	return w.body.WriteString(s)
+}
+
+// WriteNoCopy appends b to the response body without copying it, b mustn't be modified until the
+// response is sent, e.g. it's an immutable cached page. b mustn't reference the request.
+func (w *ResponseWriter) WriteNoCopy(b []byte) {
+	w.body.Append(b)
+}
+
+// Upgrade switches the conn to the protocol served by u once the response is sent, e.g. WebSocket.
+// The status is 101 Switching Protocols unless it's set, the header fields of the new protocol are
+// added by the caller. The requests pipelined after this one are passed to u as the data of the new
+// protocol.
+func (w *ResponseWriter) Upgrade(u Upgraded) {
+	w.upgrade = u
+	if w.status == 0 {
+		w.status = http.StatusSwitchingProtocols
+	}
+}
+
+func (w *ResponseWriter) reset() {
+	w.status, w.header, w.hasDate, w.close, w.upgrade = 0, w.header[:0], false, false, nil
+}
+
+// appendHeader appends the status line and the header fields of the response to r to dst.
+func (w *ResponseWriter) appendHeader(dst []byte, r *Request, closeConn bool) []byte {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	status := w.status
+	dst = append(dst, "HTTP/1.1 "...)
+	dst = strconv.AppendInt(dst, int64(status), 10)
+	dst = append(dst, ' ')
+	dst = append(dst, http.StatusText(status)...)
+	dst = append(dst, '\r', '\n')
+	if !w.hasDate {
+		dst = append(dst, "Date: "...)
+		dst = appendDate(dst)
+		dst = append(dst, '\r', '\n')
+	}
+	if bodyAllowed(status) {
+		dst = append(dst, "Content-Length: "...)
+		dst = strconv.AppendInt(dst, int64(w.body.Len()), 10)
+		dst = append(dst, '\r', '\n')
+	}
+	dst = append(dst, w.header...)
+	if closeConn {
+		dst = append(dst, "Connection: close\r\n"...)
+	} else if r.ProtoMinor == 0 {
+		dst = append(dst, "Connection: keep-alive\r\n"...)
+	}
+	return append(dst, '\r', '\n')
+}
+
+// bodyAllowed reports whether a response with status can have a body, see RFC 9110 6.4.1.
+func bodyAllowed(status int) bool {
+	return status >= 200 && status != http.StatusNoContent && status != http.StatusNotModified
+}
+
+type cachedDate struct {
+	unix int64
+	b    []byte
+}
+
+// date caches the Date header value, which changes once a second.
+var date atomic.Value // *cachedDate
+
+func appendDate(dst []byte) []byte {
+	now := time.Now()
+	d, ok := date.Load().(*cachedDate)
+	if !ok || d.unix != now.Unix() {
+		d = &cachedDate{unix: now.Unix(), b: now.UTC().AppendFormat(nil, http.TimeFormat)}
+		date.Store(d)
+	}
+	return append(dst, d.b...)
+}
@@ -0,0 +1,223 @@
+package httpserver
+
+import (
+	"net/http"
+
+	hjnet "github.com/Ccheers/haijun-net"
+	"github.com/Ccheers/haijun-net/buffer"
+	"github.com/Ccheers/haijun-net/codec"
+)
+
+// Handler handles the requests received by the Server, the response is written to w.
+type Handler interface {
+	ServeHTTP(w *ResponseWriter, r *Request)
+}
+
+// HandlerFunc is an adapter to use an ordinary function as a Handler.
+type HandlerFunc func(w *ResponseWriter, r *Request)
+
+// ServeHTTP calls f(w, r).
+func (f HandlerFunc) ServeHTTP(w *ResponseWriter, r *Request) {
+	f(w, r)
+}
+
+// Upgraded serves a conn switched to another protocol by ResponseWriter.Upgrade, it's bound to the
+// conn and its methods are called like those of hjnet.EventHandler.
+type Upgraded interface {
+	// OnUpgrade fires once the response is queued, buffered is the data received after the request,
+	// which is taken over by the Upgraded.
+	OnUpgrade(c *hjnet.HjConn, buffered *buffer.LinkBuffer) hjnet.Action
+	// OnTraffic fires when the conn receives data.
+	OnTraffic(c *hjnet.HjConn) hjnet.Action
+	// OnClose fires when the conn has been closed.
+	OnClose(c *hjnet.HjConn, err error)
+}
+
+// Server serves HTTP/1.1 on HjListener, it's the EventHandler passed to HjListener.Serve.
+//
+// The pipelined requests are handled one by one and their responses are sent together. A malformed
+// or oversized request is replied with an error status and the conn is closed once the reply is sent,
+// and so is a conn whose request or response asks for "Connection: close".
+//
+// An incomplete request is left in the inbound buffer of the conn, so the requests are bounded by
+// hjnet.Options.MaxReadBufferSize and the memory budget too, a request which doesn't fit in the buffer
+// is replied 431 or 413 like the requests exceeding MaxHeaderBytes or MaxBodySize.
+type Server struct {
+	hjnet.BuiltinEventHandler
+
+	// MaxHeaderBytes is the max size of the request line and the headers, DefaultMaxHeaderBytes if zero.
+	// It mustn't be modified after the Server starts serving, and neither must MaxBodySize.
+	MaxHeaderBytes int
+	// MaxBodySize is the max size of a request body, DefaultMaxBodySize if zero.
+	MaxBodySize int
+
+	handler Handler
+}
+
+// NewServer returns a Server passing the requests to handler.
+func NewServer(handler Handler) *Server {
+	return &Server{handler: handler}
+}
+
+// connState is the context of a conn served by the Server.
+type connState struct {
+	// parser keeps how far it got in an incomplete request, which is left in the inbound buffer
+	parser  parser
+	segs    [][]byte
+	out     *buffer.LinkBuffer
+	scratch []byte
+	req     Request
+	w       ResponseWriter
+	// continued is set once "100 Continue" is sent for the current request
+	continued bool
+	// upgraded serves the conn once it's switched to another protocol
+	upgraded Upgraded
+}
+
+// OnOpen sets up the state of the conn.
+func (s *Server) OnOpen(c *hjnet.HjConn) hjnet.Action {
+	st := &connState{out: buffer.NewLinkBuffer()}
+	st.parser.maxHeaderBytes, st.parser.maxBodySize = s.MaxHeaderBytes, s.MaxBodySize
+	if st.parser.maxHeaderBytes <= 0 {
+		st.parser.maxHeaderBytes = DefaultMaxHeaderBytes
+	}
+	if st.parser.maxBodySize <= 0 {
+		st.parser.maxBodySize = DefaultMaxBodySize
+	}
+	st.w.body = buffer.NewLinkBuffer()
+	st.req.Conn = c
+	c.SetContext(st)
+	return hjnet.None
+}
+
+// OnTraffic handles the requests buffered by the conn.
+func (s *Server) OnTraffic(c *hjnet.HjConn) hjnet.Action {
+	st, ok := c.Context().(*connState)
+	if !ok {
+		return hjnet.Close
+	}
+	if st.upgraded != nil {
+		return st.upgraded.OnTraffic(c)
+	}
+
+	// 不完整的请求留在连接的读缓冲区中，受读缓冲区上限和内存预算的约束，
+	// 数据到达后从上次解析到的位置继续
+	st.segs = c.PeekVectors(st.segs[:0], c.InboundBuffered())
+	cur := cursor{segs: st.segs}
+
+	action := hjnet.None
+	incomplete := false
+	for action == hjnet.None {
+		saved := cur
+		err := st.parser.parse(&cur, &st.req)
+		if err == codec.ErrIncomplete {
+			cur, incomplete = saved, true
+			if st.req.expectContinue && !st.continued {
+				st.continued = true
+				_, _ = st.out.WriteString("HTTP/1.1 100 Continue\r\n\r\n")
+			}
+			break
+		}
+		st.continued = false
+		if err != nil {
+			s.reject(st, err)
+			action = hjnet.Shutdown
+			break
+		}
+		if s.serve(st) {
+			action = hjnet.Shutdown
+		}
+		if st.w.upgrade != nil {
+			break
+		}
+	}
+	// 请求引用着缓冲区，处理完才能消费，解析了头部的不完整请求留到数据到达后继续
+	if !st.parser.started() {
+		st.req.reset()
+	}
+	for i := range st.segs {
+		st.segs[i] = nil
+	}
+	c.Discard(cur.n)
+	if incomplete && c.InboundFull() {
+		// 请求比读缓冲区的上限还大，永远无法接收完整
+		s.reject(st, st.parser.overflow())
+		action = hjnet.Shutdown
+	}
+
+	if st.out.Len() > 0 {
+		if _, err := c.WriteBuffer(st.out); err != nil {
+			st.out.Release()
+			return hjnet.Close
+		}
+	}
+	if u := st.w.upgrade; u != nil && action == hjnet.None {
+		return s.upgrade(c, st, u)
+	}
+	return action
+}
+
+// upgrade switches the conn to u, the buffers of HTTP are dropped since the conn won't serve HTTP anymore.
+func (s *Server) upgrade(c *hjnet.HjConn, st *connState, u Upgraded) hjnet.Action {
+	// 升级请求之后的数据属于新协议，都交给 u 接管
+	buffered, err := c.Next(c.InboundBuffered())
+	if err != nil {
+		buffered = buffer.NewLinkBuffer()
+	}
+	st.out.Release()
+	st.w.body.Release()
+	st.w.reset()
+	st.parser = parser{}
+	st.segs, st.scratch = nil, nil
+	st.upgraded = u
+	return u.OnUpgrade(c, buffered)
+}
+
+// OnClose releases the buffers of the conn.
+func (s *Server) OnClose(c *hjnet.HjConn, err error) {
+	if st, ok := c.Context().(*connState); ok {
+		if st.upgraded != nil {
+			st.upgraded.OnClose(c, err)
+		}
+		st.out.Release()
+		st.w.body.Release()
+		c.SetContext(nil)
+	}
+}
+
+// serve handles the request and queues the response, it reports whether the conn is to be closed.
+func (s *Server) serve(st *connState) bool {
+	st.w.reset()
+	s.handler.ServeHTTP(&st.w, &st.req)
+	closeConn := (st.req.Close || st.w.close) && st.w.upgrade == nil
+	st.finish(closeConn)
+	return closeConn
+}
+
+// reject replies the status of err to a request which can't be served.
+func (s *Server) reject(st *connState, err error) {
+	status := http.StatusBadRequest
+	if e, ok := err.(*statusError); ok {
+		status = e.status
+	}
+	st.w.reset()
+	st.w.body.Release()
+	st.w.WriteHeader(status)
+	st.w.AddHeader("Content-Type", "text/plain; charset=utf-8")
+	_, _ = st.w.WriteString(http.StatusText(status))
+	st.req.reset()
+	st.req.ProtoMinor = 1
+	st.finish(true)
+}
+
+// finish queues the response written by the handler.
+func (st *connState) finish(closeConn bool) {
+	w := &st.w
+	st.scratch = w.appendHeader(st.scratch[:0], &st.req, closeConn)
+	_, _ = st.out.Write(st.scratch)
+	if bodyAllowed(w.status) && st.req.Method != http.MethodHead {
+		st.out.AppendBuffer(w.body)
+	} else {
+		w.body.Release()
+	}
+}
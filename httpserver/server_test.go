@@ -0,0 +1,413 @@
+package httpserver
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	hjnet "github.com/Ccheers/haijun-net"
+)
+
+func testHandler() Handler {
+	return HandlerFunc(func(w *ResponseWriter, r *Request) {
+		switch string(r.Path()) {
+		case "/hello":
+			w.AddHeader("Content-Type", "text/plain")
+			_, _ = w.WriteString("hello " + string(r.Query()))
+		case "/echo":
+			w.AddHeader("X-Method", r.Method)
+			_, _ = w.Write(r.Body)
+		case "/close":
+			w.AddHeader("Connection", "close")
+			_, _ = w.WriteString("bye")
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	})
+}
+
+func serve(t testing.TB, srv *Server, opts ...hjnet.Option) *hjnet.HjListener {
+	l, err := hjnet.NewHjListener("127.0.0.1:0", opts...)
+	require.NoError(t, err)
+	hl := l.(*hjnet.HjListener)
+	go func() {
+		_ = hl.Serve(srv)
+	}()
+	t.Cleanup(func() { _ = hl.Close() })
+	return hl
+}
+
+// client is a minimal HTTP/1.1 client writing raw requests.
+type client struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t *testing.T, addr net.Addr) *client {
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+	t.Cleanup(func() { _ = conn.Close() })
+	return &client{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func (c *client) send(s string) {
+	_, err := c.conn.Write([]byte(s))
+	require.NoError(c.t, err)
+}
+
+func (c *client) read(method string) (*http.Response, string) {
+	resp, err := http.ReadResponse(c.r, &http.Request{Method: method})
+	require.NoError(c.t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(c.t, err)
+	return resp, string(body)
+}
+
+func (c *client) expectEOF() {
+	_, err := c.r.ReadByte()
+	assert.Equal(c.t, io.EOF, err)
+}
+
+func TestServer_KeepAlive(t *testing.T) {
+	l := serve(t, NewServer(testHandler()))
+	c := dial(t, l.Addr())
+	for i := 0; i < 3; i++ {
+		c.send(fmt.Sprintf("GET /hello?%d HTTP/1.1\r\nHost: test\r\n\r\n", i))
+		resp, body := c.read(http.MethodGet)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, fmt.Sprintf("hello %d", i), body)
+		assert.Equal(t, "text/plain", resp.Header.Get("Content-Type"))
+		assert.NotEmpty(t, resp.Header.Get("Date"))
+		assert.False(t, resp.Close)
+	}
+
+	c.send("GET /missing HTTP/1.1\r\nHost: test\r\n\r\n")
+	resp, _ := c.read(http.MethodGet)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+
+	c.send("GET /close HTTP/1.1\r\nHost: test\r\n\r\n")
+	resp, body := c.read(http.MethodGet)
+	assert.Equal(t, "bye", body)
+	assert.True(t, resp.Close)
+	c.expectEOF()
+}
+
+func TestServer_Pipelining(t *testing.T) {
+	l := serve(t, NewServer(testHandler()))
+	c := dial(t, l.Addr())
+	var reqs strings.Builder
+	for i := 0; i < 200; i++ {
+		if i%2 == 0 {
+			fmt.Fprintf(&reqs, "GET /hello?%d HTTP/1.1\r\nHost: test\r\n\r\n", i)
+		} else {
+			body := strconv.Itoa(i)
+			fmt.Fprintf(&reqs, "POST /echo HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n%s", len(body), body)
+		}
+	}
+	c.send(reqs.String())
+	for i := 0; i < 200; i++ {
+		resp, body := c.read(http.MethodGet)
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		if i%2 == 0 {
+			assert.Equal(t, fmt.Sprintf("hello %d", i), body)
+		} else {
+			assert.Equal(t, strconv.Itoa(i), body)
+			assert.Equal(t, http.MethodPost, resp.Header.Get("X-Method"))
+		}
+	}
+}
+
+func TestServer_LargeBody(t *testing.T) {
+	// 请求远大于初始的读缓冲区，不完整的请求留在缓冲区中，缓冲区随之增长
+	l := serve(t, &Server{handler: testHandler(), MaxBodySize: 8 << 20}, hjnet.WithReadBuffer(4096, 16<<20))
+	c := dial(t, l.Addr())
+	body := bytes.Repeat([]byte("0123456789abcdef"), 4<<16)
+	c.send(fmt.Sprintf("POST /echo HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n", len(body)))
+	go func() {
+		_, _ = c.conn.Write(body)
+	}()
+	resp, got := c.read(http.MethodPost)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, string(body), got)
+}
+
+func TestServer_RequestTooLarge(t *testing.T) {
+	budget := hjnet.NewMemoryBudget(0)
+	l := serve(t, NewServer(testHandler()), hjnet.WithReadBuffer(4096, 64<<10), hjnet.WithMemoryBudget(budget))
+
+	// 不完整的请求留在读缓冲区中，计入内存预算
+	c := dial(t, l.Addr())
+	c.send(fmt.Sprintf("POST /echo HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n", 48<<10))
+	c.send(strings.Repeat("x", 32<<10))
+	assert.Eventually(t, func() bool { return budget.Used() >= 32<<10 }, 5*time.Second, 10*time.Millisecond)
+	c.send(strings.Repeat("x", 16<<10))
+	resp, body := c.read(http.MethodPost)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Len(t, body, 48<<10)
+
+	// 放不进读缓冲区的请求被拒绝
+	cases := []struct {
+		req    string
+		status int
+	}{
+		{"GET / HTTP/1.1\r\nHost: test\r\nX: " + strings.Repeat("x", 128<<10), http.StatusRequestHeaderFieldsTooLarge},
+		{fmt.Sprintf("POST /echo HTTP/1.1\r\nHost: test\r\nContent-Length: %d\r\n\r\n%s", 128<<10, strings.Repeat("x", 128<<10)),
+			http.StatusRequestEntityTooLarge},
+		{"POST /echo HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n" + strings.Repeat("8000\r\n"+strings.Repeat("x", 32<<10)+"\r\n", 4),
+			http.StatusRequestEntityTooLarge},
+	}
+	for _, tc := range cases {
+		c := dial(t, l.Addr())
+		go func(req string) {
+			_, _ = c.conn.Write([]byte(req))
+		}(tc.req)
+		resp, _ := c.read(http.MethodGet)
+		assert.Equal(t, tc.status, resp.StatusCode)
+		assert.True(t, resp.Close)
+	}
+}
+
+func TestServer_Chunked(t *testing.T) {
+	l := serve(t, NewServer(testHandler()))
+	c := dial(t, l.Addr())
+	req := "POST /echo HTTP/1.1\r\nHost: test\r\nTransfer-Encoding: chunked\r\n\r\n" +
+		"5\r\nhello\r\n1;ext\r\n \r\nA\r\n0123456789\r\n0\r\nX-Trailer: t\r\n\r\n"
+	// 逐段到达
+	for i := 0; i < len(req); i += 7 {
+		end := i + 7
+		if end > len(req) {
+			end = len(req)
+		}
+		c.send(req[i:end])
+		time.Sleep(time.Millisecond)
+	}
+	resp, body := c.read(http.MethodPost)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello 0123456789", body)
+}
+
+func TestServer_ExpectContinue(t *testing.T) {
+	l := serve(t, NewServer(testHandler()))
+	c := dial(t, l.Addr())
+	c.send("PUT /echo HTTP/1.1\r\nHost: test\r\nExpect: 100-continue\r\nContent-Length: 5\r\n\r\n")
+	line, err := c.r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "HTTP/1.1 100 Continue\r\n", line)
+	line, err = c.r.ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "\r\n", line)
+
+	c.send("he")
+	time.Sleep(10 * time.Millisecond)
+	c.send("llo")
+	resp, body := c.read(http.MethodPut)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "hello", body)
+
+	// 消息体过大时直接拒绝，不发送 100 Continue
+	c.send("PUT /echo HTTP/1.1\r\nHost: test\r\nExpect: 100-continue\r\nContent-Length: 99999999\r\n\r\n")
+	resp, _ = c.read(http.MethodPut)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	c.expectEOF()
+}
+
+func TestServer_Reject(t *testing.T) {
+	l := serve(t, &Server{handler: testHandler(), MaxHeaderBytes: 256, MaxBodySize: 16})
+	cases := []struct {
+		req    string
+		status int
+	}{
+		{"GET / HTTP/1.1\r\nHost: test\r\nX: " + strings.Repeat("x", 256) + "\r\n\r\n", http.StatusRequestHeaderFieldsTooLarge},
+		{"POST /echo HTTP/1.1\r\nHost: test\r\nContent-Length: 17\r\n\r\n", http.StatusRequestEntityTooLarge},
+		{"BAD\r\n\r\n", http.StatusBadRequest},
+		{"GET / HTTP/1.1\r\n\r\n", http.StatusBadRequest},
+	}
+	for _, tc := range cases {
+		c := dial(t, l.Addr())
+		c.send(tc.req)
+		resp, _ := c.read(http.MethodGet)
+		assert.Equal(t, tc.status, resp.StatusCode, tc.req)
+		assert.True(t, resp.Close)
+		c.expectEOF()
+	}
+}
+
+func TestServer_HTTP10(t *testing.T) {
+	l := serve(t, NewServer(testHandler()))
+	c := dial(t, l.Addr())
+	c.send("GET /hello HTTP/1.0\r\nConnection: keep-alive\r\n\r\n")
+	resp, body := c.read(http.MethodGet)
+	assert.Equal(t, "hello ", body)
+	assert.Equal(t, "keep-alive", resp.Header.Get("Connection"))
+
+	c.send("GET /hello HTTP/1.0\r\n\r\n")
+	resp, _ = c.read(http.MethodGet)
+	assert.True(t, resp.Close)
+	c.expectEOF()
+}
+
+func TestServer_Head(t *testing.T) {
+	l := serve(t, NewServer(testHandler()))
+	c := dial(t, l.Addr())
+	c.send("HEAD /hello HTTP/1.1\r\nHost: test\r\n\r\nGET /hello HTTP/1.1\r\nHost: test\r\n\r\n")
+	resp, body := c.read(http.MethodHead)
+	assert.EqualValues(t, len("hello "), resp.ContentLength)
+	assert.Empty(t, body)
+	// HEAD 的响应没有消息体，下一个响应紧随其后
+	_, body = c.read(http.MethodGet)
+	assert.Equal(t, "hello ", body)
+}
+
+func TestAdapt(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/users/", func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/users/42", r.URL.Path)
+		assert.Equal(t, "1", r.URL.Query().Get("v"))
+		assert.Equal(t, "test-agent", r.UserAgent())
+		assert.NotEmpty(t, r.Host)
+		assert.Empty(t, r.Header.Get("Host"))
+		assert.NotEmpty(t, r.RemoteAddr)
+		w.Header().Set("X-User", "42")
+		_, _ = w.Write([]byte("<html><body>user</body></html>"))
+		// 写出之后修改头部不生效
+		w.Header().Set("X-Late", "1")
+	})
+	mux.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
+		body, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, "%s %d %v", body, r.ContentLength, r.TransferEncoding)
+	})
+	l := serve(t, NewServer(Adapt(mux)))
+	url := "http://" + l.Addr().String()
+	client := &http.Client{Timeout: 10 * time.Second}
+
+	req, err := http.NewRequest(http.MethodGet, url+"/users/42?v=1", nil)
+	require.NoError(t, err)
+	req.Header.Set("User-Agent", "test-agent")
+	resp, err := client.Do(req)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "<html><body>user</body></html>", string(body))
+	assert.Equal(t, "42", resp.Header.Get("X-User"))
+	assert.Empty(t, resp.Header.Get("X-Late"))
+	assert.Equal(t, "text/html; charset=utf-8", resp.Header.Get("Content-Type"))
+
+	resp, err = client.Post(url+"/upload", "text/plain", strings.NewReader("data"))
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+	assert.Equal(t, "data 4 []", string(body))
+
+	// 长度未知的请求以分块编码发送
+	resp, err = client.Post(url+"/upload", "text/plain", io.MultiReader(strings.NewReader("chunked"), strings.NewReader(" data")))
+	require.NoError(t, err)
+	body, err = ioutil.ReadAll(resp.Body)
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, "chunked data -1 [chunked]", string(body))
+
+	resp, err = client.Get(url + "/missing")
+	require.NoError(t, err)
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
+func TestAdapt_TLS(t *testing.T) {
+	// 借用 httptest 的证书和信任它的客户端
+	ts := httptest.NewTLSServer(http.NotFoundHandler())
+	config := &tls.Config{Certificates: ts.TLS.Certificates, NextProtos: []string{"http/1.1"}}
+	tr := ts.Client().Transport.(*http.Transport).Clone()
+	tr.TLSClientConfig.ServerName = "example.com"
+	tr.TLSClientConfig.NextProtos = []string{"http/1.1"}
+	client := &http.Client{Transport: tr, Timeout: 10 * time.Second}
+	ts.Close()
+
+	l := serve(t, NewServer(Adapt(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if assert.NotNil(t, r.TLS) {
+			_, _ = fmt.Fprintf(w, "%s %s", r.TLS.NegotiatedProtocol, r.TLS.ServerName)
+		}
+	}))), hjnet.WithTLS(config))
+	for i := 0; i < 3; i++ {
+		resp, err := client.Get("https://" + l.Addr().String() + "/")
+		require.NoError(t, err)
+		body, err := ioutil.ReadAll(resp.Body)
+		require.NoError(t, err)
+		_ = resp.Body.Close()
+		assert.Equal(t, "http/1.1 example.com", string(body))
+	}
+}
+
+func benchmarkServe(b *testing.B, addr net.Addr) {
+	req := []byte("GET /hello?bench HTTP/1.1\r\nHost: bench\r\n\r\n")
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		conn, err := net.Dial("tcp", addr.String())
+		if err != nil {
+			b.Error(err)
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		for pb.Next() {
+			if _, err = conn.Write(req); err != nil {
+				b.Error(err)
+				return
+			}
+			resp, err := http.ReadResponse(r, nil)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			_, _ = io.Copy(ioutil.Discard, resp.Body)
+			_ = resp.Body.Close()
+		}
+	})
+}
+
+func helloHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain")
+	_, _ = io.WriteString(w, "hello "+r.URL.RawQuery)
+}
+
+func BenchmarkServer(b *testing.B) {
+	l := serve(b, NewServer(testHandler()))
+	benchmarkServe(b, l.Addr())
+}
+
+func BenchmarkServer_Adapt(b *testing.B) {
+	l := serve(b, NewServer(Adapt(http.HandlerFunc(helloHTTP))))
+	benchmarkServe(b, l.Addr())
+}
+
+// BenchmarkNetHTTP serves the same handler by net/http on HjListener, with a goroutine per conn.
+func BenchmarkNetHTTP(b *testing.B) {
+	l, err := hjnet.NewHjListener("127.0.0.1:0")
+	require.NoError(b, err)
+	go func() {
+		_ = http.Serve(l, http.HandlerFunc(helloHTTP))
+	}()
+	b.Cleanup(func() { _ = l.Close() })
+	benchmarkServe(b, l.Addr())
+}
@@ -0,0 +1,121 @@
+package haijun_net
+
+import (
+	"errors"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrIdleTimeout is the reason of closing the conns without any activity for Options.IdleTimeout.
+	ErrIdleTimeout = errors.New("conn is idle for too long")
+	// ErrHeartbeatTimeout is the reason of closing the conns which didn't answer the ping in time.
+	ErrHeartbeatTimeout = errors.New("heartbeat timeout")
+
+	errHeartbeatPing     = errors.New("heartbeat: Ping is nil")
+	errHeartbeatInterval = errors.New("heartbeat: Interval must be positive")
+)
+
+const (
+	minIdleCheckInterval = 10 * time.Millisecond
+	maxIdleCheckInterval = time.Second
+)
+
+// Heartbeat is the application-level heartbeat for the protocols where TCP keepalive isn't enough,
+// such as detecting a peer which is alive but stuck.
+//
+// A conn which has received nothing for Interval is sent a ping by Ping, and it's closed with
+// ErrHeartbeatTimeout if nothing arrives within Timeout after the ping. Any inbound data counts as
+// the pong, the application consumes the pong like the other messages of its protocol.
+// Timeout defaults to Interval when it isn't positive.
+type Heartbeat struct {
+	Interval time.Duration
+	Timeout  time.Duration
+	// Ping writes a ping message to c, it's called on the event loop goroutine so it must not block,
+	// the conn is closed when it returns an error.
+	Ping func(c *HjConn) error
+}
+
+// validate checks that the heartbeat can ping the conns.
+func (hb *Heartbeat) validate() error {
+	if hb == nil {
+		return nil
+	}
+	if hb.Ping == nil {
+		return errHeartbeatPing
+	}
+	if hb.Interval <= 0 {
+		return errHeartbeatInterval
+	}
+	return nil
+}
+
+// idleCheckInterval returns how often the conns are checked, it's a fraction of the shortest timeout
+// so that a conn is closed not much later than it expires.
+func idleCheckInterval(opts *Options) time.Duration {
+	d := opts.IdleTimeout
+	if hb := opts.Heartbeat; hb != nil {
+		for _, v := range []time.Duration{hb.Interval, hb.Timeout} {
+			if v > 0 && (d <= 0 || v < d) {
+				d = v
+			}
+		}
+	}
+	d /= 4
+	if d < minIdleCheckInterval {
+		d = minIdleCheckInterval
+	}
+	if d > maxIdleCheckInterval {
+		d = maxIdleCheckInterval
+	}
+	return d
+}
+
+// checkIdle closes the idle conns and pings the silent conns, it runs on the timer of the event loop.
+func (m *connManager) checkIdle() {
+	now := time.Now().UnixNano()
+	m.Range(func(c *HjConn) bool {
+		lastRead := atomic.LoadInt64(&c.lastRead)
+		if created := c.createdAt.UnixNano(); lastRead < created {
+			lastRead = created
+		}
+		if hb := m.opts.Heartbeat; hb != nil && !m.heartbeat(c, hb, now, lastRead) {
+			return true
+		}
+		if m.opts.IdleTimeout > 0 {
+			active := lastRead
+			if lastWrite := atomic.LoadInt64(&c.lastWrite); lastWrite > active {
+				active = lastWrite
+			}
+			if time.Duration(now-active) >= m.opts.IdleTimeout {
+				m.opts.Logger.Debug("close idle conn", "fd", c.fd, "remote_addr", c.remoteAddr, "loop", m.idx)
+				_ = m.closeConn(c, ErrIdleTimeout)
+			}
+		}
+		return true
+	})
+}
+
+// heartbeat pings c or checks the pong, it reports whether c is still alive.
+func (m *connManager) heartbeat(c *HjConn, hb *Heartbeat, now, lastRead int64) bool {
+	pingAt := atomic.LoadInt64(&c.pingAt)
+	if pingAt != 0 {
+		if lastRead >= pingAt {
+			atomic.StoreInt64(&c.pingAt, 0)
+		} else if time.Duration(now-pingAt) >= hb.Timeout {
+			m.opts.Logger.Debug("heartbeat timeout", "fd", c.fd, "remote_addr", c.remoteAddr, "loop", m.idx)
+			_ = m.closeConn(c, ErrHeartbeatTimeout)
+			return false
+		}
+		return true
+	}
+	if time.Duration(now-lastRead) < hb.Interval {
+		return true
+	}
+	atomic.StoreInt64(&c.pingAt, now)
+	if err := hb.Ping(c); err != nil {
+		_ = m.closeConn(c, err)
+		return false
+	}
+	return true
+}
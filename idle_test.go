@@ -0,0 +1,108 @@
+package haijun_net
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type closeReasonHandler struct {
+	BuiltinEventHandler
+	reason chan error
+}
+
+func (h *closeReasonHandler) OnClose(_ *HjConn, err error) {
+	h.reason <- err
+}
+
+func TestWithIdleTimeout(t *testing.T) {
+	h := &closeReasonHandler{reason: make(chan error, 1)}
+	l := serveTest(t, h, WithIdleTimeout(100*time.Millisecond))
+	start := time.Now()
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = c.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	assert.Equal(t, ErrIdleTimeout, <-h.reason)
+}
+
+func TestWithHeartbeat(t *testing.T) {
+	h := &closeReasonHandler{reason: make(chan error, 1)}
+	var pings int32
+	l := serveTest(t, h, WithHeartbeat(Heartbeat{
+		Interval: 50 * time.Millisecond,
+		Timeout:  100 * time.Millisecond,
+		Ping: func(c *HjConn) error {
+			atomic.AddInt32(&pings, 1)
+			_, err := c.Write([]byte("p"))
+			return err
+		},
+	}))
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	// 回应 pong 的连接保持存活
+	buf := make([]byte, 1)
+	for i := 0; i < 3; i++ {
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = io.ReadFull(c, buf)
+		require.NoError(t, err)
+		_, err = c.Write([]byte("P"))
+		require.NoError(t, err)
+	}
+	select {
+	case err = <-h.reason:
+		t.Fatalf("conn closed: %v", err)
+	default:
+	}
+
+	// 不再回应后被关闭
+	for {
+		_ = c.SetReadDeadline(time.Now().Add(5 * time.Second))
+		if _, err = c.Read(buf); err != nil {
+			break
+		}
+	}
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, ErrHeartbeatTimeout, <-h.reason)
+	assert.GreaterOrEqual(t, atomic.LoadInt32(&pings), int32(4))
+}
+
+func TestWithHeartbeat_Invalid(t *testing.T) {
+	ping := func(c *HjConn) error { return nil }
+	_, err := NewHjListener("127.0.0.1:0", WithHeartbeat(Heartbeat{Interval: time.Second}))
+	assert.Equal(t, errHeartbeatPing, err)
+	_, err = NewHjListener("127.0.0.1:0", WithHeartbeat(Heartbeat{Timeout: time.Second, Ping: ping}))
+	assert.Equal(t, errHeartbeatInterval, err)
+
+	opts := loadOptions(WithHeartbeat(Heartbeat{Interval: time.Second, Ping: ping}))
+	assert.Equal(t, time.Second, opts.Heartbeat.Timeout)
+}
+
+func TestTimerQueue(t *testing.T) {
+	m := &connManager{opts: loadOptions()}
+	var fired []int
+	m.afterFunc(20*time.Millisecond, func() { fired = append(fired, 2) })
+	m.afterFunc(10*time.Millisecond, func() { fired = append(fired, 1) })
+	stopped := m.afterFunc(0, func() { fired = append(fired, 0) })
+	m.stopTimer(stopped)
+	tick := m.every(10*time.Millisecond, func() { fired = append(fired, 3) })
+
+	time.Sleep(25 * time.Millisecond)
+	m.runTimers()
+	assert.Equal(t, []int{1, 3, 2}, fired)
+	m.stopTimer(tick)
+	time.Sleep(15 * time.Millisecond)
+	m.runTimers()
+	assert.Equal(t, []int{1, 3, 2}, fired)
+}
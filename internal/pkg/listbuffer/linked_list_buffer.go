@@ -92,6 +92,7 @@ func (l *ListBuffer) PushBytesFront(p []byte) {
 	}
 	bb := bPool.Get()
 	_, _ = bb.Write(p)
+	bPool.Grown(bb)
 	l.PushFront(&ByteBuffer{Buf: bb})
 }
 
@@ -102,6 +103,7 @@ func (l *ListBuffer) PushBytesBack(p []byte) {
 	}
 	bb := bPool.Get()
 	_, _ = bb.Write(p)
+	bPool.Grown(bb)
 	l.PushBack(&ByteBuffer{Buf: bb})
 }
 
@@ -83,6 +83,11 @@ func (mb *Buffer) Writev(bs [][]byte) (int, error) {
 	return sum, nil
 }
 
+// Buffered returns the number of bytes in this buffer.
+func (mb *Buffer) Buffered() int {
+	return mb.ringBuffer.Length() + int(mb.listBuffer.Bytes())
+}
+
 // IsEmpty indicates whether this buffer is empty.
 func (mb *Buffer) IsEmpty() bool {
 	return mb.ringBuffer.IsEmpty() && mb.listBuffer.IsEmpty()
@@ -0,0 +1,70 @@
+// Package accounting tracks the bytes checked out of the buffer pools, so that the process has a global view
+// of the memory held by the buffers and can enforce a cap on it.
+package accounting
+
+import "sync/atomic"
+
+// Pool identifies a buffer pool.
+type Pool int
+
+const (
+	RingBuffer Pool = iota
+	ByteSlice
+	ByteBuffer
+
+	numPools
+)
+
+var poolNames = [numPools]string{"ringbuffer", "byteslice", "bytebuffer"}
+
+func (p Pool) String() string {
+	return poolNames[p]
+}
+
+// Pools lists all the pools.
+var Pools = []Pool{RingBuffer, ByteSlice, ByteBuffer}
+
+var (
+	inUse [numPools]int64
+	limit int64
+)
+
+// Acquire records that n bytes have been checked out of p.
+func Acquire(p Pool, n int) {
+	atomic.AddInt64(&inUse[p], int64(n))
+}
+
+// Release records that n bytes have been returned to p.
+func Release(p Pool, n int) {
+	atomic.AddInt64(&inUse[p], -int64(n))
+}
+
+// InUse returns the number of bytes checked out of p.
+func InUse(p Pool) int64 {
+	return atomic.LoadInt64(&inUse[p])
+}
+
+// Total returns the number of bytes checked out of all the pools.
+func Total() (n int64) {
+	for i := range inUse {
+		n += atomic.LoadInt64(&inUse[i])
+	}
+	return
+}
+
+// SetLimit sets up the cap of the bytes checked out of all the pools, zero means unlimited.
+// The pools never refuse to hand out a buffer, it's up to the callers to check Exceeded.
+func SetLimit(n int64) {
+	atomic.StoreInt64(&limit, n)
+}
+
+// Limit returns the cap set by SetLimit.
+func Limit() int64 {
+	return atomic.LoadInt64(&limit)
+}
+
+// Exceeded reports whether the bytes checked out reach the cap.
+func Exceeded() bool {
+	l := atomic.LoadInt64(&limit)
+	return l > 0 && Total() >= l
+}
@@ -0,0 +1,27 @@
+package accounting
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAccounting(t *testing.T) {
+	base := Total()
+	Acquire(RingBuffer, 100)
+	Acquire(ByteSlice, 50)
+	assert.Equal(t, base+150, Total())
+	assert.Equal(t, "byteslice", ByteSlice.String())
+
+	SetLimit(base + 200)
+	defer SetLimit(0)
+	assert.False(t, Exceeded())
+	Acquire(ByteBuffer, 50)
+	assert.True(t, Exceeded())
+
+	Release(RingBuffer, 100)
+	Release(ByteSlice, 50)
+	Release(ByteBuffer, 50)
+	assert.False(t, Exceeded())
+	assert.Equal(t, base, Total())
+}
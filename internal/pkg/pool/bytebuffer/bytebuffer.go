@@ -1,17 +1,53 @@
 package bytebuffer
 
-import "github.com/valyala/bytebufferpool"
+import (
+	"sync"
 
-// ByteBuffer is the alias of bytebufferpool.ByteBuffer.
-type ByteBuffer = bytebufferpool.ByteBuffer
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/accounting"
+	"github.com/valyala/bytebufferpool"
+)
+
+// maxPooledSize is the capacity beyond which a buffer put back is discarded, so that the memory grown
+// for a burst isn't handed out again.
+const maxPooledSize = 1 << 20 // 1MB
+
+// ByteBuffer is a bytebufferpool.ByteBuffer remembering the number of bytes accounted for it,
+// since a buffer grows while it's checked out.
+type ByteBuffer struct {
+	bytebufferpool.ByteBuffer
+	accounted int
+}
+
+var pool sync.Pool
 
 var (
 	// Get returns an empty byte buffer from the pool, exported from gnet/bytebuffer.
-	Get = bytebufferpool.Get
+	Get = func() *ByteBuffer {
+		b, _ := pool.Get().(*ByteBuffer)
+		if b == nil {
+			b = new(ByteBuffer)
+		}
+		b.accounted = cap(b.B)
+		accounting.Acquire(accounting.ByteBuffer, b.accounted)
+		return b
+	}
 	// Put returns byte buffer to the pool, exported from gnet/bytebuffer.
 	Put = func(b *ByteBuffer) {
 		if b != nil {
-			bytebufferpool.Put(b)
+			accounting.Release(accounting.ByteBuffer, b.accounted)
+			b.accounted = 0
+			if cap(b.B) > maxPooledSize {
+				return
+			}
+			b.Reset()
+			pool.Put(b)
 		}
 	}
 )
+
+// Grown updates the bytes accounted for b after it grows, b must be checked out by Get.
+func Grown(b *ByteBuffer) {
+	n := cap(b.B)
+	accounting.Acquire(accounting.ByteBuffer, n-b.accounted)
+	b.accounted = n
+}
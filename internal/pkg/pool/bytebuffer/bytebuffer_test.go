@@ -0,0 +1,28 @@
+package bytebuffer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/accounting"
+)
+
+func TestByteBuffer_Accounting(t *testing.T) {
+	base := accounting.InUse(accounting.ByteBuffer)
+
+	// 借出期间增长的部分由 Grown 计入，Put 时连同 Get 时计入的一起释放
+	b := Get()
+	_, _ = b.WriteString(strings.Repeat("x", 4096))
+	Grown(b)
+	assert.EqualValues(t, base+int64(cap(b.B)), accounting.InUse(accounting.ByteBuffer))
+	// 截短后容量变小，释放的仍然是计入的字节数
+	b.B = b.B[1024:]
+	Put(b)
+	assert.Equal(t, base, accounting.InUse(accounting.ByteBuffer))
+
+	// 不是从 Get 得到的缓冲区没有计入，也不会被释放
+	Put(&ByteBuffer{})
+	assert.Equal(t, base, accounting.InUse(accounting.ByteBuffer))
+}
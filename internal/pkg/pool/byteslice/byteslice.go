@@ -4,6 +4,9 @@ import (
 	"math"
 	"math/bits"
 	"sync"
+	"sync/atomic"
+
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/accounting"
 )
 
 var builtinPool Pool
@@ -11,6 +14,9 @@ var builtinPool Pool
 // Pool consists of 32 sync.Pool, representing byte slices of length from 0 to 32 in powers of 2.
 type Pool struct {
 	pools [32]sync.Pool
+
+	hits   uint64
+	misses uint64
 }
 
 // Get returns a byte slice with given length from the built-in pool.
@@ -33,25 +39,44 @@ func (p *Pool) Get(size int) []byte {
 	}
 	idx := index(uint32(size))
 	if v := p.pools[idx].Get(); v != nil {
+		atomic.AddUint64(&p.hits, 1)
 		bp := v.(*[]byte)
-		return (*bp)[:size]
+		// 池中可能有 Put 进来的其他容量的切片，只交出 1<<idx 的容量，Put 时按它释放
+		accounting.Acquire(accounting.ByteSlice, 1<<idx)
+		return (*bp)[: size : 1<<idx]
 	}
+	atomic.AddUint64(&p.misses, 1)
+	accounting.Acquire(accounting.ByteSlice, 1<<idx)
 	return make([]byte, 1<<idx)[:size]
 }
 
-// Put returns the byte slice to the pool.
+// Put returns the byte slice to the pool, only the slices got from Get should be put back.
+// The capacity of the slices got from Get is a power of 2 and it's released from the accounting,
+// a slice of another capacity isn't accounted since Get didn't hand it out.
 func (p *Pool) Put(buf []byte) {
 	size := cap(buf)
 	if size == 0 || size > math.MaxInt32 {
 		return
 	}
 	idx := index(uint32(size))
-	if size != 1<<idx { // this byte slice is not from Pool.Get(), put it into the previous interval of idx
+	if size == 1<<idx {
+		accounting.Release(accounting.ByteSlice, size)
+	} else { // this byte slice is not from Pool.Get(), put it into the previous interval of idx
 		idx--
 	}
 	p.pools[idx].Put(&buf)
 }
 
+// Stats returns the hits and misses of the built-in pool.
+func Stats() (hits, misses uint64) {
+	return builtinPool.Stats()
+}
+
+// Stats returns the number of Get calls served by the pool and the number of them allocating a new slice.
+func (p *Pool) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&p.hits), atomic.LoadUint64(&p.misses)
+}
+
 func index(n uint32) uint32 {
 	return uint32(bits.Len32(n - 1))
 }
@@ -0,0 +1,29 @@
+package byteslice
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/accounting"
+)
+
+func TestPool_Accounting(t *testing.T) {
+	var p Pool
+	base := accounting.InUse(accounting.ByteSlice)
+
+	b := p.Get(1000)
+	assert.Equal(t, 1024, cap(b))
+	assert.Equal(t, base+1024, accounting.InUse(accounting.ByteSlice))
+	p.Put(b)
+	assert.Equal(t, base, accounting.InUse(accounting.ByteSlice))
+
+	// 其他容量的切片不是 Get 交出的，放回时不释放；再被 Get 交出时只计入 2 的幂次的容量
+	p.Put(make([]byte, 1500))
+	assert.Equal(t, base, accounting.InUse(accounting.ByteSlice))
+	b = p.Get(1000)
+	assert.Equal(t, 1024, cap(b))
+	assert.Equal(t, base+1024, accounting.InUse(accounting.ByteSlice))
+	p.Put(b)
+	assert.Equal(t, base, accounting.InUse(accounting.ByteSlice))
+}
@@ -0,0 +1,193 @@
+package goroutine
+
+import (
+	"errors"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMaxWorkers is the default upper limit of goroutines running in a Pool.
+	DefaultMaxWorkers = 1024
+	// DefaultQueueSize is the default number of tasks that can wait for an idle worker.
+	DefaultQueueSize = 4096
+	// DefaultIdleTimeout is the default duration after which an idle worker exits.
+	DefaultIdleTimeout = 10 * time.Second
+)
+
+var (
+	// ErrPoolClosed will be returned when submitting a task to a released pool.
+	ErrPoolClosed = errors.New("goroutine pool has been released")
+	// ErrPoolOverload will be returned when all workers are busy and the task queue is full.
+	ErrPoolOverload = errors.New("goroutine pool is overloaded")
+)
+
+// Options configures a Pool.
+type Options struct {
+	// MaxWorkers is the maximum number of goroutines running tasks at the same time.
+	MaxWorkers int
+	// QueueSize is the number of tasks that can be queued while all workers are busy.
+	QueueSize int
+	// IdleTimeout is how long a worker waits for a new task before it exits.
+	IdleTimeout time.Duration
+	// PanicHandler is invoked with the recovered value and the stack when a task panics,
+	// the worker itself survives the panic.
+	PanicHandler func(v interface{}, stack []byte)
+}
+
+// Pool is a bounded goroutine pool, workers are spawned on demand up to MaxWorkers
+// and reaped after being idle for IdleTimeout.
+type Pool struct {
+	opts Options
+
+	tasks   chan func()
+	running int32 // 当前存活的 worker 数量
+	idle    int32 // 正在等待任务的 worker 数量
+	closed  int32
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// New instantiates a Pool with the given options, zero values are replaced by the defaults.
+func New(opts Options) *Pool {
+	if opts.MaxWorkers <= 0 {
+		opts.MaxWorkers = DefaultMaxWorkers
+	}
+	if opts.QueueSize < 0 {
+		opts.QueueSize = 0
+	} else if opts.QueueSize == 0 {
+		opts.QueueSize = DefaultQueueSize
+	}
+	if opts.IdleTimeout <= 0 {
+		opts.IdleTimeout = DefaultIdleTimeout
+	}
+	return &Pool{
+		opts:  opts,
+		tasks: make(chan func(), opts.QueueSize),
+		done:  make(chan struct{}),
+	}
+}
+
+// Submit hands the task to an idle worker, spawns a new worker or queues the task,
+// it never blocks and returns ErrPoolOverload when none of these is possible.
+func (p *Pool) Submit(task func()) error {
+	if atomic.LoadInt32(&p.closed) == 1 {
+		return ErrPoolClosed
+	}
+	// 没有空闲的 worker 时优先拉起新的 worker，避免任务在队列中等待
+	if atomic.LoadInt32(&p.idle) == 0 && p.spawn(task) {
+		return nil
+	}
+	select {
+	case p.tasks <- task:
+		if atomic.LoadInt32(&p.running) == 0 {
+			p.spawn(nil)
+		}
+		return nil
+	default:
+	}
+	if p.spawn(task) {
+		return nil
+	}
+	return ErrPoolOverload
+}
+
+// Running returns the number of live workers.
+func (p *Pool) Running() int {
+	return int(atomic.LoadInt32(&p.running))
+}
+
+// Idle returns the number of workers waiting for a task.
+func (p *Pool) Idle() int {
+	return int(atomic.LoadInt32(&p.idle))
+}
+
+// Waiting returns the number of queued tasks.
+func (p *Pool) Waiting() int {
+	return len(p.tasks)
+}
+
+// Cap returns the maximum number of workers.
+func (p *Pool) Cap() int {
+	return p.opts.MaxWorkers
+}
+
+// Release stops accepting tasks and waits for all workers to exit,
+// the tasks that are still queued are dropped.
+func (p *Pool) Release() {
+	if !atomic.CompareAndSwapInt32(&p.closed, 0, 1) {
+		return
+	}
+	close(p.done)
+	p.wg.Wait()
+}
+
+func (p *Pool) spawn(task func()) bool {
+	for {
+		n := atomic.LoadInt32(&p.running)
+		if int(n) >= p.opts.MaxWorkers {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&p.running, n, n+1) {
+			break
+		}
+	}
+	p.wg.Add(1)
+	go p.work(task)
+	return true
+}
+
+func (p *Pool) work(task func()) {
+	defer p.wg.Done()
+
+	timer := time.NewTimer(p.opts.IdleTimeout)
+	defer timer.Stop()
+	for {
+		if task != nil {
+			p.run(task)
+			task = nil
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(p.opts.IdleTimeout)
+
+		atomic.AddInt32(&p.idle, 1)
+		select {
+		case task = <-p.tasks:
+			atomic.AddInt32(&p.idle, -1)
+			continue
+		case <-timer.C:
+		case <-p.done:
+		}
+		atomic.AddInt32(&p.idle, -1)
+		atomic.AddInt32(&p.running, -1)
+		// 退出前再检查一次队列，和 Submit 中对 running 的检查配合，保证入队的任务不会无人处理
+		select {
+		case task = <-p.tasks:
+			if atomic.LoadInt32(&p.closed) == 0 {
+				atomic.AddInt32(&p.running, 1)
+				continue
+			}
+		default:
+		}
+		return
+	}
+}
+
+func (p *Pool) run(task func()) {
+	defer func() {
+		if v := recover(); v != nil {
+			if h := p.opts.PanicHandler; h != nil {
+				h(v, debug.Stack())
+			}
+		}
+	}()
+	task()
+}
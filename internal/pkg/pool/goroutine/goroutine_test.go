@@ -0,0 +1,86 @@
+package goroutine
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPool_Submit(t *testing.T) {
+	p := New(Options{MaxWorkers: 4, QueueSize: 16})
+	defer p.Release()
+
+	var (
+		wg  sync.WaitGroup
+		sum int64
+	)
+	for i := 1; i <= 100; i++ {
+		wg.Add(1)
+		i := i
+		for p.Submit(func() {
+			defer wg.Done()
+			atomic.AddInt64(&sum, int64(i))
+		}) == ErrPoolOverload {
+			time.Sleep(time.Millisecond)
+		}
+	}
+	wg.Wait()
+	assert.EqualValues(t, 5050, sum)
+	assert.LessOrEqual(t, p.Running(), 4)
+}
+
+func TestPool_Overload(t *testing.T) {
+	p := New(Options{MaxWorkers: 1, QueueSize: -1})
+	defer p.Release()
+
+	block := make(chan struct{})
+	assert.NoError(t, p.Submit(func() { <-block }))
+	assert.ErrorIs(t, p.Submit(func() {}), ErrPoolOverload)
+	close(block)
+}
+
+func TestPool_IdleReaping(t *testing.T) {
+	p := New(Options{MaxWorkers: 8, IdleTimeout: 20 * time.Millisecond})
+	defer p.Release()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		assert.NoError(t, p.Submit(func() {
+			time.Sleep(5 * time.Millisecond)
+			wg.Done()
+		}))
+	}
+	wg.Wait()
+	assert.Eventually(t, func() bool { return p.Running() == 0 }, time.Second, 10*time.Millisecond)
+
+	// 所有 worker 被回收后依然可以继续提交任务
+	done := make(chan struct{})
+	assert.NoError(t, p.Submit(func() { close(done) }))
+	<-done
+}
+
+func TestPool_PanicHandler(t *testing.T) {
+	recovered := make(chan interface{}, 1)
+	p := New(Options{MaxWorkers: 1, PanicHandler: func(v interface{}, stack []byte) {
+		assert.NotEmpty(t, stack)
+		recovered <- v
+	}})
+	defer p.Release()
+
+	assert.NoError(t, p.Submit(func() { panic("boom") }))
+	assert.Equal(t, "boom", <-recovered)
+
+	done := make(chan struct{})
+	assert.NoError(t, p.Submit(func() { close(done) }))
+	<-done
+}
+
+func TestPool_Release(t *testing.T) {
+	p := New(Options{})
+	p.Release()
+	assert.ErrorIs(t, p.Submit(func() {}), ErrPoolClosed)
+}
@@ -9,6 +9,7 @@ import (
 	"sync"
 	"sync/atomic"
 
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/accounting"
 	"github.com/Ccheers/haijun-net/internal/pkg/ringbuffer"
 )
 
@@ -20,6 +21,9 @@ const (
 
 	calibrateCallsThreshold = 42000
 	maxPercentile           = 0.95
+
+	// 校准之前还不知道常用的大小，超过它的缓冲区直接丢弃
+	uncalibratedMaxSize = 1 << 20 // 1MB
 )
 
 // RingBuffer is the alias of ringbuffer.RingBuffer.
@@ -37,7 +41,14 @@ type Pool struct {
 	defaultSize uint64
 	maxSize     uint64
 
+	hits     uint64 // 从池中取到可用缓冲区的次数
+	misses   uint64 // 需要重新分配缓冲区的次数
+	discards uint64 // 因为过大没有放回池中的次数
+
 	pool sync.Pool
+	// checkedOut maps the buffers checked out to the number of bytes accounted for them by Get,
+	// since a buffer grows while it's checked out.
+	checkedOut sync.Map
 }
 
 var builtinPool Pool
@@ -56,10 +67,12 @@ func Get() *RingBuffer { return builtinPool.Get() }
 func (p *Pool) Get() *RingBuffer {
 	v := p.pool.Get()
 	if v != nil {
-		return v.(*RingBuffer)
+		atomic.AddUint64(&p.hits, 1)
+		return p.checkOut(v.(*RingBuffer))
 	}
+	atomic.AddUint64(&p.misses, 1)
 	rb, _ := ringbuffer.New(int(atomic.LoadUint64(&p.defaultSize)))
-	return rb
+	return p.checkOut(rb)
 }
 
 // GetWithSize is like Get(), but with initial size.
@@ -71,14 +84,40 @@ func (p *Pool) GetWithSize(size int) *RingBuffer {
 	if v != nil {
 		rb := v.(*RingBuffer)
 		if rb.Len() >= size {
-			return rb
+			atomic.AddUint64(&p.hits, 1)
+			return p.checkOut(rb)
 		}
 		p.pool.Put(v)
 	}
+	atomic.AddUint64(&p.misses, 1)
 	rb, _ := ringbuffer.New(size)
+	return p.checkOut(rb)
+}
+
+// checkOut accounts the capacity of rb, the same amount is released when it's put back.
+func (p *Pool) checkOut(rb *RingBuffer) *RingBuffer {
+	n := rb.Cap()
+	p.checkedOut.Store(rb, n)
+	accounting.Acquire(accounting.RingBuffer, n)
 	return rb
 }
 
+// Stats returns the hits and misses of the built-in pool.
+func Stats() (hits, misses uint64) { return builtinPool.Stats() }
+
+// Stats returns the number of Get calls served by the pool and the number of them allocating a new buffer.
+func (p *Pool) Stats() (hits, misses uint64) {
+	return atomic.LoadUint64(&p.hits), atomic.LoadUint64(&p.misses)
+}
+
+// Discards returns the number of buffers the built-in pool discarded for being oversized.
+func Discards() uint64 { return builtinPool.Discards() }
+
+// Discards returns the number of buffers put to the pool and discarded for being oversized.
+func (p *Pool) Discards() uint64 {
+	return atomic.LoadUint64(&p.discards)
+}
+
 // Put returns byte buffer to the pool.
 //
 // ByteBuffer.B mustn't be touched after returning it to the pool.
@@ -88,18 +127,33 @@ func Put(b *RingBuffer) { builtinPool.Put(b) }
 // Put releases byte buffer obtained via Get to the pool.
 //
 // The buffer mustn't be accessed after returning to the pool.
+// It releases the bytes accounted by Get, the growth of the buffer while it was checked out isn't accounted.
+//
+// A buffer larger than the calibrated maxSize, or than 1MB before the pool is calibrated, is discarded,
+// so that the memory grown for a burst isn't handed out again.
 func (p *Pool) Put(b *RingBuffer) {
-	idx := index(b.Len())
+	if n, ok := p.checkedOut.LoadAndDelete(b); ok {
+		accounting.Release(accounting.RingBuffer, n.(int))
+	}
+	idx := index(b.Cap())
 
 	if atomic.AddUint64(&p.calls[idx], 1) > calibrateCallsThreshold {
 		p.calibrate()
 	}
 
 	maxSize := int(atomic.LoadUint64(&p.maxSize))
-	if maxSize == 0 || b.Cap() <= maxSize {
-		b.Reset()
-		p.pool.Put(b)
+	if maxSize == 0 {
+		maxSize = uncalibratedMaxSize
+	}
+	if b.Cap() > maxSize {
+		atomic.AddUint64(&p.discards, 1)
+		return
 	}
+	b.Reset()
+	// 上一个使用者的设置不能带给下一个使用者
+	b.SetMaxCap(0)
+	b.SetShrinkPolicy(ringbuffer.ShrinkPolicy{})
+	p.pool.Put(b)
 }
 
 func (p *Pool) calibrate() {
@@ -0,0 +1,59 @@
+package ringbuffer
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/accounting"
+	"github.com/Ccheers/haijun-net/internal/pkg/ringbuffer"
+)
+
+func TestPool_PutDiscardsOversized(t *testing.T) {
+	var p Pool
+
+	// 校准之前超过 1MB 的缓冲区不放回池中
+	rb := p.GetWithSize(1024)
+	_, _ = rb.WriteString(strings.Repeat("x", 2*uncalibratedMaxSize))
+	p.Put(rb)
+	assert.EqualValues(t, 1, p.Discards())
+
+	rb = p.GetWithSize(4096)
+	rb.SetMaxCap(4096)
+	rb.SetShrinkPolicy(ringbuffer.ShrinkPolicy{IdleReads: 1})
+	p.Put(rb)
+	assert.EqualValues(t, 1, p.Discards())
+	assert.Zero(t, rb.MaxCap())
+	assert.True(t, rb.IsEmpty())
+
+	// 校准之后按照常用的大小丢弃
+	small, _ := ringbuffer.New(1024)
+	for i := 0; i <= calibrateCallsThreshold; i++ {
+		p.Put(small)
+	}
+	assert.EqualValues(t, 1024, p.maxSize)
+	big, _ := ringbuffer.New(4096)
+	p.Put(big)
+	assert.EqualValues(t, 2, p.Discards())
+	p.Put(small)
+	assert.EqualValues(t, 2, p.Discards())
+}
+
+func TestPool_AccountingAfterGrow(t *testing.T) {
+	var p Pool
+	before := accounting.InUse(accounting.RingBuffer)
+
+	rb := p.GetWithSize(1024)
+	assert.EqualValues(t, before+1024, accounting.InUse(accounting.RingBuffer))
+	// 借出期间扩容，放回时只释放借出时计入的大小
+	_, _ = rb.WriteString(strings.Repeat("x", 8192))
+	assert.Greater(t, rb.Cap(), 1024)
+	p.Put(rb)
+	assert.Equal(t, before, accounting.InUse(accounting.RingBuffer))
+
+	// 不是从池中取出的缓冲区不影响计数
+	other, _ := ringbuffer.New(1024)
+	p.Put(other)
+	assert.Equal(t, before, accounting.InUse(accounting.RingBuffer))
+}
@@ -6,6 +6,7 @@ import (
 	"github.com/Ccheers/haijun-net/internal/pkg/bsconv"
 	"github.com/Ccheers/haijun-net/internal/pkg/math"
 	"github.com/Ccheers/haijun-net/internal/pkg/pool/bytebuffer"
+	"github.com/valyala/bytebufferpool"
 )
 
 const (
@@ -20,6 +21,19 @@ var MaxStreamBufferCap = 64 * 1024 // 64KB
 // ErrIsEmpty will be returned when trying to read an empty ring-buffer.
 var ErrIsEmpty = errors.New("ring-buffer is empty")
 
+// ErrIsFull will be returned when trying to write a ring-buffer which can't grow beyond its MaxCap.
+var ErrIsFull = errors.New("ring-buffer is full")
+
+// ShrinkPolicy tells a ring-buffer when to give back the memory it grew for a burst.
+type ShrinkPolicy struct {
+	// IdleReads is the number of reads in a row during which the buffered bytes stay within a quarter
+	// of the capacity, after which the buffer shrinks to the high-water mark of that period.
+	// Zero disables shrinking.
+	IdleReads int
+	// MinCap is the capacity the buffer never shrinks below, DefaultBufferSize if zero.
+	MinCap int
+}
+
 // RingBuffer is a circular buffer that implement io.ReadWriter interface.
 type RingBuffer struct {
 	bs      [][]byte
@@ -28,6 +42,11 @@ type RingBuffer struct {
 	r       int // next position to read
 	w       int // next position to write 游标 w 永远大于游标 r 如果出现 w < r 则表示缓冲区已经写了一圈
 	isEmpty bool
+
+	maxCap    int // 扩容的上限，0 表示不限制
+	shrink    ShrinkPolicy
+	peak      int // 上次收缩以来缓冲数据的最高水位
+	idleReads int // 连续的空闲读取次数
 }
 
 // EmptyRingBuffer can be used as a placeholder for those closed connections.
@@ -116,6 +135,7 @@ func (rb *RingBuffer) Discard(n int) {
 	} else {
 		rb.Reset()
 	}
+	rb.consumed()
 }
 
 // Read reads up to len(p) bytes into p. It returns the number of bytes read (0 <= n <= len(p)) and any error
@@ -137,6 +157,7 @@ func (rb *RingBuffer) Read(p []byte) (n int, err error) {
 	if rb.isEmpty {
 		return 0, ErrIsEmpty
 	}
+	defer rb.consumed()
 
 	if rb.w > rb.r {
 		n = rb.w - rb.r
@@ -185,6 +206,7 @@ func (rb *RingBuffer) ReadByte() (b byte, err error) {
 	if rb.r == rb.w {
 		rb.Reset()
 	}
+	rb.consumed()
 
 	return
 }
@@ -193,7 +215,7 @@ func (rb *RingBuffer) ReadByte() (b byte, err error) {
 // It returns the number of bytes written from p (n == len(p) > 0) and any error encountered that caused the write to
 // stop early.
 // If the length of p is greater than the writable capacity of this ring-buffer, it will allocate more memory to
-// this ring-buffer.
+// this ring-buffer, when it can't grow beyond MaxCap it writes what fits and returns ErrIsFull.
 // Write must not modify the slice data, even temporarily.
 func (rb *RingBuffer) Write(p []byte) (n int, err error) {
 	n = len(p)
@@ -203,7 +225,14 @@ func (rb *RingBuffer) Write(p []byte) (n int, err error) {
 
 	free := rb.Free()
 	if n > free {
-		rb.grow(rb.size + n - free)
+		_ = rb.grow(rb.size + n - free)
+		if free = rb.Free(); n > free {
+			n, err = free, ErrIsFull
+			p = p[:n]
+			if n == 0 {
+				return
+			}
+		}
 	}
 
 	if rb.w >= rb.r {
@@ -227,6 +256,7 @@ func (rb *RingBuffer) Write(p []byte) (n int, err error) {
 	}
 
 	rb.isEmpty = false
+	rb.mark()
 
 	return
 }
@@ -234,7 +264,9 @@ func (rb *RingBuffer) Write(p []byte) (n int, err error) {
 // WriteByte writes one byte into buffer.
 func (rb *RingBuffer) WriteByte(c byte) error {
 	if rb.Free() < 1 {
-		rb.grow(1)
+		if err := rb.grow(rb.size + 1); err != nil {
+			return err
+		}
 	}
 	rb.buf[rb.w] = c
 	rb.w++
@@ -243,6 +275,7 @@ func (rb *RingBuffer) WriteByte(c byte) error {
 		rb.w = 0
 	}
 	rb.isEmpty = false
+	rb.mark()
 
 	return nil
 }
@@ -328,7 +361,7 @@ func (rb *RingBuffer) ByteBuffer() *bytebuffer.ByteBuffer {
 // only copy the available data.
 func (rb *RingBuffer) WithByteBuffer(b []byte) *bytebuffer.ByteBuffer {
 	if rb.isEmpty {
-		return &bytebuffer.ByteBuffer{B: b}
+		return &bytebuffer.ByteBuffer{ByteBuffer: bytebufferpool.ByteBuffer{B: b}}
 	} else if rb.w == rb.r {
 		bb := bytebuffer.Get()
 		_, _ = bb.Write(rb.buf[rb.r:])
@@ -403,13 +436,98 @@ func (rb *RingBuffer) grow(newCap int) error {
 			}
 		}
 	}
+	if rb.maxCap > 0 && newCap > rb.maxCap {
+		newCap = rb.maxCap
+	}
+	if newCap <= rb.size {
+		return ErrIsFull
+	}
+	rb.realloc(newCap)
+	return nil
+}
+
+// MaxCap returns the capacity the buffer can't grow beyond, zero means unlimited.
+func (rb *RingBuffer) MaxCap() int {
+	return rb.maxCap
+}
+
+// SetMaxCap bounds the growth of the buffer to maxCap bytes, zero means unlimited.
+// A larger buffer shrinks to maxCap right away if its data fits.
+func (rb *RingBuffer) SetMaxCap(maxCap int) {
+	if maxCap < 0 {
+		maxCap = 0
+	}
+	rb.maxCap = maxCap
+	if maxCap > 0 && rb.size > maxCap && rb.Length() <= maxCap {
+		rb.realloc(maxCap)
+	}
+}
+
+// SetShrinkPolicy sets the policy deciding when the buffer shrinks, see ShrinkPolicy.
+func (rb *RingBuffer) SetShrinkPolicy(p ShrinkPolicy) {
+	rb.shrink = p
+	rb.peak = rb.Length()
+	rb.idleReads = 0
+}
+
+// Shrink shrinks the buffer to the high-water mark of its usage since the last shrink, rounded up to
+// a power of 2 and not below the MinCap of the shrink policy, and keeps the buffered data.
+func (rb *RingBuffer) Shrink() {
+	n := rb.peak
+	if length := rb.Length(); n < length {
+		n = length
+	}
+	minCap := rb.shrink.MinCap
+	if minCap <= 0 {
+		minCap = DefaultBufferSize
+	}
+	if n < minCap {
+		n = minCap
+	}
+	rb.peak = rb.Length()
+	rb.idleReads = 0
+	newCap, err := math.CeilToPowerOfTwo(n)
+	if err != nil || newCap >= rb.size {
+		return
+	}
+	rb.realloc(newCap)
+}
+
+// mark records the high-water mark after the buffer is written.
+func (rb *RingBuffer) mark() {
+	if n := rb.Length(); n > rb.peak {
+		rb.peak = n
+	}
+}
+
+// consumed applies the shrink policy after the buffer is read.
+func (rb *RingBuffer) consumed() {
+	if rb.shrink.IdleReads <= 0 {
+		return
+	}
+	if rb.peak > rb.size/4 {
+		// 这段时间用到了较多空间，从当前的数据量重新统计
+		rb.peak = rb.Length()
+		rb.idleReads = 0
+		return
+	}
+	if rb.idleReads++; rb.idleReads >= rb.shrink.IdleReads {
+		rb.Shrink()
+	}
+}
+
+func (rb *RingBuffer) realloc(newCap int) {
 	newBuf := make([]byte, newCap)
 	oldLen := rb.Length()
-	_, _ = rb.Read(newBuf)
+	// 不能用 Read 搬运数据，Read 会触发收缩策略
+	head, tail := rb.PeekAll()
+	copy(newBuf[copy(newBuf, head):], tail)
 	rb.buf = newBuf
 	rb.r = 0
 	rb.w = oldLen
+	if rb.w == newCap {
+		rb.w = 0
+	}
 	rb.size = newCap
-
-	return nil
+	rb.isEmpty = oldLen == 0
 }
@@ -318,3 +318,96 @@ func TestRingBuffer_ByteInterface(t *testing.T) {
 	assert.True(t, rb.IsEmpty(), "expect IsEmpty is true but got false")
 	assert.False(t, rb.IsFull(), "expect IsFull is false but got true")
 }
+
+func TestRingBuffer_MaxCap(t *testing.T) {
+	rb, _ := New(DefaultBufferSize)
+	rb.SetMaxCap(2 * DefaultBufferSize)
+	assert.EqualValues(t, 2*DefaultBufferSize, rb.MaxCap())
+
+	data := []byte(strings.Repeat("x", 3*DefaultBufferSize))
+	n, err := rb.Write(data)
+	assert.Equal(t, ErrIsFull, err)
+	assert.EqualValues(t, 2*DefaultBufferSize, n)
+	assert.EqualValues(t, 2*DefaultBufferSize, rb.Cap())
+	assert.True(t, rb.IsFull())
+
+	n, err = rb.Write(data)
+	assert.Equal(t, ErrIsFull, err)
+	assert.Zero(t, n)
+	assert.Equal(t, ErrIsFull, rb.WriteByte('a'))
+
+	// 读走一部分之后可以继续写入，数据保持完整
+	rb.Discard(DefaultBufferSize)
+	n, err = rb.WriteString("abc")
+	assert.NoError(t, err)
+	assert.EqualValues(t, 3, n)
+	assert.EqualValues(t, append(data[:DefaultBufferSize], "abc"...), rb.ByteBuffer().Bytes())
+
+	// 缩小上限时数据放得下就立即收缩
+	rb.SetMaxCap(DefaultBufferSize)
+	assert.EqualValues(t, 2*DefaultBufferSize, rb.Cap())
+	rb.Discard(DefaultBufferSize)
+	rb.SetMaxCap(DefaultBufferSize)
+	assert.EqualValues(t, DefaultBufferSize, rb.Cap())
+	assert.Equal(t, "abc", string(rb.ByteBuffer().Bytes()))
+	rb.SetMaxCap(-1)
+	assert.Zero(t, rb.MaxCap())
+}
+
+func TestRingBuffer_Shrink(t *testing.T) {
+	rb, _ := New(0)
+	rb.SetShrinkPolicy(ShrinkPolicy{IdleReads: 3})
+
+	// 突发流量把缓冲区撑大
+	burst := []byte(strings.Repeat("x", 64*DefaultBufferSize))
+	_, _ = rb.Write(burst)
+	assert.EqualValues(t, 64*DefaultBufferSize, rb.Cap())
+	p := make([]byte, len(burst))
+	n, _ := rb.Read(p)
+	assert.Equal(t, len(burst), n)
+
+	// 之后的流量很小，连续 3 次空闲读取后收缩到这段时间的最高水位
+	for i := 0; i < 2; i++ {
+		_, _ = rb.Write(burst[:3000])
+		_, _ = rb.Read(p)
+		assert.EqualValues(t, 64*DefaultBufferSize, rb.Cap())
+	}
+	_, _ = rb.WriteString("abc")
+	rb.Discard(1)
+	assert.EqualValues(t, 4*DefaultBufferSize, rb.Cap())
+	assert.Equal(t, "bc", string(rb.ByteBuffer().Bytes()))
+
+	// 用得较满时不收缩
+	_, _ = rb.Write(burst[:3*DefaultBufferSize])
+	for i := 0; i < 5; i++ {
+		b, _ := rb.ReadByte()
+		assert.NotZero(t, b)
+	}
+	assert.EqualValues(t, 4*DefaultBufferSize, rb.Cap())
+
+	// 不会收缩到 MinCap 以下
+	rb.Reset()
+	rb.SetShrinkPolicy(ShrinkPolicy{IdleReads: 1, MinCap: 2 * DefaultBufferSize})
+	_, _ = rb.WriteString("a")
+	_, _ = rb.ReadByte()
+	assert.EqualValues(t, 2*DefaultBufferSize, rb.Cap())
+	rb.Shrink()
+	assert.EqualValues(t, 2*DefaultBufferSize, rb.Cap())
+}
+
+func TestRingBuffer_NoShrinkPolicy(t *testing.T) {
+	rb, _ := New(0)
+	_, _ = rb.Write(make([]byte, 16*DefaultBufferSize))
+	p := make([]byte, 16*DefaultBufferSize)
+	for i := 0; i < 10; i++ {
+		_, _ = rb.Read(p)
+		_, _ = rb.WriteString("a")
+	}
+	assert.EqualValues(t, 16*DefaultBufferSize, rb.Cap())
+	// 第一次收缩时最高水位还是突发时的数据量
+	rb.Shrink()
+	assert.EqualValues(t, 16*DefaultBufferSize, rb.Cap())
+	rb.Shrink()
+	assert.EqualValues(t, DefaultBufferSize, rb.Cap())
+	assert.Equal(t, "a", string(rb.ByteBuffer().Bytes()))
+}
@@ -13,6 +13,7 @@ import (
 
 // CopyFromSocket copies data from a socket fd into ring-buffer.
 func (rb *RingBuffer) CopyFromSocket(fd int) (n int, err error) {
+	defer rb.mark()
 	if rb.r == rb.w {
 		if !rb.isEmpty {
 			return
@@ -56,16 +57,15 @@ func (rb *RingBuffer) Rewind() (n int) {
 		return
 	}
 	if rb.w == 0 {
-		if rb.r < rb.size-rb.r {
-			rb.grow(rb.size + rb.size - rb.r)
+		// 扩容到达 MaxCap 时退回到原地移动数据
+		if rb.r < rb.size-rb.r && rb.grow(rb.size+rb.size-rb.r) == nil {
 			return rb.size - rb.r
 		}
 		n = copy(rb.buf, rb.buf[rb.r:])
 		rb.r = 0
 		rb.w = n
 	} else if rb.size-rb.w < DefaultBufferSize {
-		if rb.r < rb.w-rb.r {
-			rb.grow(rb.size + rb.w - rb.r)
+		if rb.r < rb.w-rb.r && rb.grow(rb.size+rb.w-rb.r) == nil {
 			return rb.w - rb.r
 		}
 		n = copy(rb.buf, rb.buf[rb.r:rb.w])
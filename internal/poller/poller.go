@@ -44,6 +44,34 @@ type Poller interface {
 
 	ModRead(fd int) error
 	ModReadWrite(fd int) error
+	// Mod renews fd with the events of mode, mode may be zero to stop polling fd without removing it,
+	// the errors of fd are still reported.
+	Mod(fd int, mode PollMode) error
+
+	// Reopen replaces the epoll fd with a new one and registers all the fds again,
+	// it's used to restart the event loop after the poller fails.
+	Reopen() error
+	// Close closes the epoll fd.
+	Close() error
+
+	// Stats returns the number of system calls made by the poller.
+	Stats() Stats
+
+	// Mode returns the events fd is currently polled for.
+	Mode(fd int) (PollMode, error)
+
+	// Fd returns the epoll fd.
+	Fd() int
+	// EventListSize returns the current capacity of the event-list, which expands and shrinks with the load.
+	EventListSize() int
+	// Range calls f for each registered fd and its mode until f returns false.
+	Range(f func(fd int, mode PollMode) bool)
+}
+
+// Stats is the number of system calls made by a Poller.
+type Stats struct {
+	CtlCalls  uint64 // epoll_ctl
+	WaitCalls uint64 // epoll_wait
 }
 
 type PollMode uint32
@@ -67,10 +95,15 @@ var (
 )
 
 type pollerImpl struct {
-	pollFD    int // epoll fd
+	pollFD    int32 // epoll fd, it may be replaced by Reopen
 	eventList *eventList
+	// eventListSize mirrors eventList.size for the readers outside the polling goroutine
+	eventListSize int32
 
 	fdModes sync.Map
+
+	ctlCalls  uint64
+	waitCalls uint64
 }
 
 func (p *pollerImpl) getFdMode(fd int) (*PollMode, error) {
@@ -103,10 +136,13 @@ func (p *pollerImpl) setFdMode(fd int, mode PollMode) error {
 
 func NewPoller() (p Poller, err error) {
 	impl := new(pollerImpl)
-	if impl.pollFD, err = unix.EpollCreate1(unix.EPOLL_CLOEXEC); err != nil {
+	pollFD, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
 		return nil, os.NewSyscallError("epoll_create1", err)
 	}
+	impl.pollFD = int32(pollFD)
 	impl.eventList = newEventList(InitPollEventsCap)
+	impl.eventListSize = InitPollEventsCap
 	return impl, nil
 }
 
@@ -120,20 +156,18 @@ func (p *pollerImpl) Register(fd int, mode PollMode) error {
 		return errFdRegistered
 	}
 
-	var events = PollModeRead
+	var events PollMode = readEvents
 	if mode&PollModeWrite > 0 {
-		events = events | writeEvents
-	}
-	if events == 0 {
-		return errModeIsNone
+		events = readWriteEvents
 	}
 
-	err := os.NewSyscallError("epoll_ctl mod", unix.EpollCtl(p.pollFD, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: uint32(events)}))
+	err := os.NewSyscallError("epoll_ctl add", p.ctl(unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: uint32(events)}))
 	if err != nil {
 		return err
 	}
 
-	return p.setFdMode(fd, mode)
+	// 保存的是实际注册的事件，和 ModRead/ModReadWrite 保持一致
+	return p.setFdMode(fd, events)
 }
 
 // ModRead renews the given file-descriptor with readable event in the poller.
@@ -156,7 +190,7 @@ func (p *pollerImpl) ModRead(fd int) error {
 		atomic.StoreUint32((*uint32)(mode), readEvents)
 	}
 
-	return os.NewSyscallError("epoll_ctl mod", unix.EpollCtl(p.pollFD, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: uint32(*mode)}))
+	return os.NewSyscallError("epoll_ctl mod", p.ctl(unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: uint32(*mode)}))
 }
 
 // ModReadWrite renews the given file-descriptor with readable and writable events in the poller.
@@ -180,7 +214,30 @@ func (p *pollerImpl) ModReadWrite(fd int) error {
 		atomic.StoreUint32((*uint32)(mode), readWriteEvents)
 	}
 
-	return os.NewSyscallError("epoll_ctl mod", unix.EpollCtl(p.pollFD, unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: uint32(*mode)}))
+	return os.NewSyscallError("epoll_ctl mod", p.ctl(unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: uint32(*mode)}))
+}
+
+// Mod renews the given file-descriptor with the events of mode in the poller.
+func (p *pollerImpl) Mod(fd int, mode PollMode) error {
+	if fd <= 0 {
+		return errFdIsZero
+	}
+	m, err := p.getFdMode(fd)
+	if err != nil {
+		return err
+	}
+	var events uint32
+	if mode&PollModeRead != 0 {
+		events |= readEvents
+	}
+	if mode&PollModeWrite != 0 {
+		events |= writeEvents
+	}
+	if atomic.SwapUint32((*uint32)(m), events) == events {
+		// 已经是这个状态，无需变更
+		return nil
+	}
+	return os.NewSyscallError("epoll_ctl mod", p.ctl(unix.EPOLL_CTL_MOD, fd, &unix.EpollEvent{Fd: int32(fd), Events: events}))
 }
 
 func (p *pollerImpl) Remove(fd int) error {
@@ -191,11 +248,12 @@ func (p *pollerImpl) Remove(fd int) error {
 		return errFdUnRegister
 	}
 	p.fdModes.Delete(fd)
-	return os.NewSyscallError("epoll_ctl mod", unix.EpollCtl(p.pollFD, unix.EPOLL_CTL_DEL, fd, nil))
+	return os.NewSyscallError("epoll_ctl mod", p.ctl(unix.EPOLL_CTL_DEL, fd, nil))
 }
 
 func (p *pollerImpl) Wait() ([]unix.EpollEvent, error) {
-	n, err := unix.EpollWait(p.pollFD, p.eventList.events, 5)
+	atomic.AddUint64(&p.waitCalls, 1)
+	n, err := unix.EpollWait(p.fd(), p.eventList.events, 5)
 	if n == 0 || (n < 0 && err == unix.EINTR) {
 		return nil, nil
 	} else if err != nil {
@@ -203,12 +261,105 @@ func (p *pollerImpl) Wait() ([]unix.EpollEvent, error) {
 	}
 	if n == p.eventList.size {
 		p.eventList.expand()
+		atomic.StoreInt32(&p.eventListSize, int32(p.eventList.size))
 	} else if n < p.eventList.size>>1 {
 		p.eventList.shrink()
+		atomic.StoreInt32(&p.eventListSize, int32(p.eventList.size))
 	}
 	return p.eventList.events[:n], nil
 }
 
+// Reopen replaces the epoll fd with a new one and registers all the fds again with their current modes.
+func (p *pollerImpl) Reopen() error {
+	pollFD, err := unix.EpollCreate1(unix.EPOLL_CLOEXEC)
+	if err != nil {
+		return os.NewSyscallError("epoll_create1", err)
+	}
+	p.fdModes.Range(func(key, value interface{}) bool {
+		fd := key.(int)
+		events := atomic.LoadUint32((*uint32)(value.(*PollMode)))
+		err = unix.EpollCtl(pollFD, unix.EPOLL_CTL_ADD, fd, &unix.EpollEvent{Fd: int32(fd), Events: events})
+		if err != nil {
+			err = os.NewSyscallError("epoll_ctl add", err)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		_ = unix.Close(pollFD)
+		return err
+	}
+	if old := atomic.SwapInt32(&p.pollFD, int32(pollFD)); old >= 0 {
+		_ = unix.Close(int(old))
+	}
+	return nil
+}
+
+// Close closes the epoll fd.
+func (p *pollerImpl) Close() error {
+	// 置为 -1，避免 fd 被复用后再次被关闭
+	old := atomic.SwapInt32(&p.pollFD, -1)
+	if old < 0 {
+		return nil
+	}
+	return os.NewSyscallError("close", unix.Close(int(old)))
+}
+
+// Mode returns the events fd is currently polled for.
+func (p *pollerImpl) Mode(fd int) (PollMode, error) {
+	m, err := p.getFdMode(fd)
+	if err != nil {
+		return 0, err
+	}
+	events := atomic.LoadUint32((*uint32)(m))
+	var mode PollMode
+	if events&readEvents != 0 {
+		mode |= PollModeRead
+	}
+	if events&writeEvents != 0 {
+		mode |= PollModeWrite
+	}
+	return mode, nil
+}
+
+// Fd returns the epoll fd.
+func (p *pollerImpl) Fd() int {
+	return p.fd()
+}
+
+// EventListSize returns the current capacity of the event-list.
+func (p *pollerImpl) EventListSize() int {
+	return int(atomic.LoadInt32(&p.eventListSize))
+}
+
+// Range calls f for each registered fd and its mode until f returns false.
+func (p *pollerImpl) Range(f func(fd int, mode PollMode) bool) {
+	p.fdModes.Range(func(key, _ interface{}) bool {
+		mode, err := p.Mode(key.(int))
+		if err != nil {
+			return true
+		}
+		return f(key.(int), mode)
+	})
+}
+
+// Stats returns the number of system calls made by the poller.
+func (p *pollerImpl) Stats() Stats {
+	return Stats{
+		CtlCalls:  atomic.LoadUint64(&p.ctlCalls),
+		WaitCalls: atomic.LoadUint64(&p.waitCalls),
+	}
+}
+
+func (p *pollerImpl) ctl(op, fd int, event *unix.EpollEvent) error {
+	atomic.AddUint64(&p.ctlCalls, 1)
+	return unix.EpollCtl(p.fd(), op, fd, event)
+}
+
+func (p *pollerImpl) fd() int {
+	return int(atomic.LoadInt32(&p.pollFD))
+}
+
 type eventList struct {
 	size   int
 	events []unix.EpollEvent
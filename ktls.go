@@ -0,0 +1,429 @@
+package haijun_net
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	goio "io"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// 内核 TLS 的常量，见 linux/tls.h
+const (
+	tlsTX             = 1
+	tlsRX             = 2
+	tlsSetRecordType  = 1
+	tlsGetRecordType  = 2
+	tls12Version      = 0x0303
+	tls13Version      = 0x0304
+	tlsCipherAES128   = 51
+	tlsCipherAES256   = 52
+	tlsCipherChaCha20 = 54
+
+	recordTypeAlert           = 21
+	recordTypeApplicationData = 23
+	alertCloseNotify          = 0
+
+	// helloHeadSize is the size of the head of a hello message up to the end of its random: the record
+	// header, the handshake message header, the version and the random.
+	helloHeadSize = 5 + 4 + 2 + 32
+)
+
+var (
+	errKTLSNoKeys  = errors.New("ktls: the session keys weren't logged")
+	errKTLSState   = errors.New("ktls: the state of crypto/tls can't be read")
+	errKTLSPending = errors.New("ktls: the handshake records haven't been sent")
+	errKTLSCipher  = errors.New("ktls: unsupported cipher suite")
+	errKTLSWrite   = errors.New("ktls: crypto/tls can't write once the kernel encrypts")
+
+	// ktlsUnavailable is set once the kernel turns out to lack the tls ULP, the conns don't try it any more
+	ktlsUnavailable int32
+)
+
+// ktlsCipher describes the kernel crypto info of a cipher suite, see struct tls12_crypto_info_* of linux/tls.h.
+type ktlsCipher struct {
+	cipherType uint16
+	keySize    int
+	// ivSize is the size of the iv of the crypto info, which is the explicit nonce of TLS 1.2 AES-GCM,
+	// saltSize is the size of the implicit part of the nonce
+	ivSize   int
+	saltSize int
+	hash     func() hash.Hash
+}
+
+var (
+	ktlsAES128   = &ktlsCipher{cipherType: tlsCipherAES128, keySize: 16, ivSize: 8, saltSize: 4, hash: sha256.New}
+	ktlsAES256   = &ktlsCipher{cipherType: tlsCipherAES256, keySize: 32, ivSize: 8, saltSize: 4, hash: sha512.New384}
+	ktlsChaCha20 = &ktlsCipher{cipherType: tlsCipherChaCha20, keySize: 32, ivSize: 12, hash: sha256.New}
+)
+
+func ktlsCipherOf(suite uint16) *ktlsCipher {
+	switch suite {
+	case tls.TLS_AES_128_GCM_SHA256, tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256:
+		return ktlsAES128
+	case tls.TLS_AES_256_GCM_SHA384, tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+		tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384, tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384:
+		return ktlsAES256
+	case tls.TLS_CHACHA20_POLY1305_SHA256,
+		tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256, tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256:
+		return ktlsChaCha20
+	}
+	return nil
+}
+
+// ktlsKeys are the secrets of a session logged by crypto/tls: the master secret of TLS 1.2,
+// or the application traffic secrets of TLS 1.3.
+type ktlsKeys struct {
+	master        []byte
+	clientTraffic []byte
+	serverTraffic []byte
+}
+
+// ktlsKeyLog is the KeyLogWriter of the TLS config used with Options.KernelTLS, it keeps the secrets
+// by the client random until the handshake is done.
+type ktlsKeyLog struct {
+	next goio.Writer
+	keys sync.Map // string(client random) -> *ktlsKeys
+}
+
+// newKTLSConfig returns a copy of config which logs the secrets to the returned key log.
+func newKTLSConfig(config *tls.Config) (*tls.Config, *ktlsKeyLog) {
+	l := &ktlsKeyLog{next: config.KeyLogWriter}
+	config = config.Clone()
+	config.KeyLogWriter = l
+	return config, l
+}
+
+// Write parses a line of the NSS key log format: the label, the client random and the secret in hex.
+func (l *ktlsKeyLog) Write(line []byte) (int, error) {
+	if l.next != nil {
+		if _, err := l.next.Write(line); err != nil {
+			return 0, err
+		}
+	}
+	fields := bytes.Fields(line)
+	if len(fields) != 3 {
+		return len(line), nil
+	}
+	label := string(fields[0])
+	if label != "CLIENT_RANDOM" && label != "CLIENT_TRAFFIC_SECRET_0" && label != "SERVER_TRAFFIC_SECRET_0" {
+		return len(line), nil
+	}
+	random, err := hex.DecodeString(string(fields[1]))
+	if err != nil {
+		return len(line), nil
+	}
+	secret, err := hex.DecodeString(string(fields[2]))
+	if err != nil {
+		return len(line), nil
+	}
+	v, _ := l.keys.LoadOrStore(string(random), new(ktlsKeys))
+	keys := v.(*ktlsKeys)
+	switch label {
+	case "CLIENT_RANDOM":
+		keys.master = secret
+	case "CLIENT_TRAFFIC_SECRET_0":
+		keys.clientTraffic = secret
+	case "SERVER_TRAFFIC_SECRET_0":
+		keys.serverTraffic = secret
+	}
+	return len(line), nil
+}
+
+// take removes the secrets of the session with the client random and returns them.
+func (l *ktlsKeyLog) take(random []byte) *ktlsKeys {
+	if random == nil {
+		return nil
+	}
+	v, ok := l.keys.Load(string(random))
+	if !ok {
+		return nil
+	}
+	l.keys.Delete(string(random))
+	return v.(*ktlsKeys)
+}
+
+// appendHead appends the head of a TLS stream in p to head until it covers the random of the hello message.
+func appendHead(head, p []byte) []byte {
+	n := helloHeadSize - len(head)
+	if n <= 0 {
+		return head
+	}
+	if n > len(p) {
+		n = len(p)
+	}
+	return append(head, p[:n]...)
+}
+
+// helloRandom returns the random of the hello message of type msgType at the head of a TLS stream.
+func helloRandom(head []byte, msgType byte) []byte {
+	if len(head) < helloHeadSize || head[0] != 22 || head[5] != msgType {
+		return nil
+	}
+	return head[helloHeadSize-32 : helloHeadSize]
+}
+
+// ktlsCryptoInfo returns the crypto info of both directions of the server side of a TLS conn to install
+// by TLS_TX and TLS_RX, see struct tls12_crypto_info_* of linux/tls.h. The conn mustn't be used concurrently.
+func ktlsCryptoInfo(tc *tls.Conn, keys *ktlsKeys, clientRandom, serverRandom []byte) (tx, rx []byte, err error) {
+	state := tc.ConnectionState()
+	c := ktlsCipherOf(state.CipherSuite)
+	if c == nil {
+		return nil, nil, errKTLSCipher
+	}
+	outSeq, ok1 := tlsSeq(tc, "out")
+	inSeq, ok2 := tlsSeq(tc, "in")
+	if !ok1 || !ok2 {
+		return nil, nil, errKTLSState
+	}
+	switch state.Version {
+	case tls.VersionTLS13:
+		if keys.serverTraffic == nil || keys.clientTraffic == nil {
+			return nil, nil, errKTLSNoKeys
+		}
+		tx = c.info13(keys.serverTraffic, outSeq)
+		rx = c.info13(keys.clientTraffic, inSeq)
+	case tls.VersionTLS12:
+		if keys.master == nil || clientRandom == nil || serverRandom == nil {
+			return nil, nil, errKTLSNoKeys
+		}
+		// key_block = PRF(master_secret, "key expansion", server_random + client_random)，AEAD 没有 MAC 密钥
+		fixedIV := c.saltSize
+		if fixedIV == 0 {
+			fixedIV = c.ivSize
+		}
+		seed := append(append([]byte(nil), serverRandom...), clientRandom...)
+		block := prf12(c.hash, keys.master, "key expansion", seed, 2*c.keySize+2*fixedIV)
+		clientKey, block := block[:c.keySize], block[c.keySize:]
+		serverKey, block := block[:c.keySize], block[c.keySize:]
+		clientIV, serverIV := block[:fixedIV], block[fixedIV:]
+		tx = c.info(tls12Version, serverKey, serverIV, outSeq)
+		rx = c.info(tls12Version, clientKey, clientIV, inSeq)
+	default:
+		return nil, nil, errKTLSCipher
+	}
+	return tx, rx, nil
+}
+
+// info13 derives the key and the iv from a TLS 1.3 traffic secret, see RFC 8446 7.3.
+func (c *ktlsCipher) info13(secret []byte, seq [8]byte) []byte {
+	key := hkdfExpandLabel(c.hash, secret, "key", c.keySize)
+	iv := hkdfExpandLabel(c.hash, secret, "iv", 12)
+	return c.info(tls13Version, key, iv, seq)
+}
+
+// info encodes the crypto info, iv is the implicit nonce of the cipher: the salt of AES-GCM or the whole
+// nonce of ChaCha20-Poly1305. The explicit nonce of TLS 1.2 AES-GCM starts from seq like crypto/tls does,
+// TLS 1.3 has no explicit nonce and the kernel takes the tail of the static iv.
+func (c *ktlsCipher) info(version uint16, key, iv []byte, seq [8]byte) []byte {
+	b := make([]byte, 4, 4+c.ivSize+c.keySize+c.saltSize+8)
+	// struct tls_crypto_info 的字段是本机字节序
+	*(*uint16)(unsafe.Pointer(&b[0])) = version
+	*(*uint16)(unsafe.Pointer(&b[2])) = c.cipherType
+	switch {
+	case c.saltSize == 0:
+		b = append(b, iv...)
+	case version == tls13Version:
+		b = append(b, iv[c.saltSize:]...)
+	default:
+		b = append(b, seq[:]...)
+	}
+	b = append(b, key...)
+	b = append(b, iv[:c.saltSize]...)
+	return append(b, seq[:]...)
+}
+
+// hkdfExpandLabel is HKDF-Expand-Label of RFC 8446 7.1 with an empty context.
+func hkdfExpandLabel(h func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(length>>8), byte(length), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+	// HKDF-Expand，见 RFC 5869 2.3
+	var out, t []byte
+	mac := hmac.New(h, secret)
+	for i := byte(1); len(out) < length; i++ {
+		mac.Reset()
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(t[:0])
+		out = append(out, t...)
+	}
+	return out[:length]
+}
+
+// prf12 is the PRF of TLS 1.2, see RFC 5246 5.
+func prf12(h func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(h, secret)
+	mac.Write(seed)
+	a := mac.Sum(nil)
+	var out []byte
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(a[:0])
+	}
+	return out[:length]
+}
+
+// tlsSeq reads the sequence number of the records of a direction of a TLS conn, which crypto/tls doesn't
+// expose. ok is false if the field can't be found, e.g. crypto/tls has changed, then the conn stays
+// in userspace.
+func tlsSeq(tc *tls.Conn, dir string) (seq [8]byte, ok bool) {
+	v := reflect.ValueOf(tc).Elem().FieldByName(dir)
+	if !v.IsValid() {
+		return seq, false
+	}
+	v = v.FieldByName("seq")
+	if !v.IsValid() || v.Kind() != reflect.Array || v.Len() != len(seq) {
+		return seq, false
+	}
+	for i := range seq {
+		seq[i] = byte(v.Index(i).Uint())
+	}
+	return seq, true
+}
+
+// tlsBuffered reports whether crypto/tls holds the records it has read, in which case the kernel can't
+// take over the receiving side, because they would be lost.
+func tlsBuffered(tc *tls.Conn) bool {
+	v := reflect.ValueOf(tc).Elem()
+	for _, name := range []string{"rawInput", "hand"} {
+		// bytes.Buffer{buf []byte; off int}
+		b := v.FieldByName(name)
+		if !b.IsValid() {
+			return true
+		}
+		buf, off := b.FieldByName("buf"), b.FieldByName("off")
+		if !buf.IsValid() || !off.IsValid() || buf.Len() > int(off.Int()) {
+			return true
+		}
+	}
+	// bytes.Reader{s []byte; i int64}
+	r := v.FieldByName("input")
+	if !r.IsValid() {
+		return true
+	}
+	s, i := r.FieldByName("s"), r.FieldByName("i")
+	return !s.IsValid() || !i.IsValid() || int64(s.Len()) > i.Int()
+}
+
+// offloadTLS installs the keys of the conn into the kernel once its handshake is done, so the outbound
+// plaintext is encrypted by the kernel, and the inbound records are decrypted by it if crypto/tls holds none.
+// The conn stays in userspace when the kernel or the cipher suite isn't supported, or when its keys
+// weren't captured, which is counted apart since the kernel isn't even tried.
+func (m *connManager) offloadTLS(conn *HjConn, keys *ktlsKeys) {
+	t := conn.tls
+	if keys == nil {
+		m.metrics.ktlsConns("no_keys").Inc()
+		m.opts.Logger.Debug("ktls", "fd", conn.fd, "loop", m.idx, "error", errKTLSNoKeys)
+		return
+	}
+	mode := "none"
+	defer func() { m.metrics.ktlsConns(mode).Inc() }()
+	tx, rx, err := ktlsCryptoInfo(t.tc, keys, helloRandom(t.clientHead, 1), helloRandom(t.serverHead, 2))
+	if err != nil {
+		m.opts.Logger.Debug("ktls", "fd", conn.fd, "loop", m.idx, "error", err)
+		return
+	}
+	// 握手的最后几个记录可能还在发送缓冲区中，它们已经加密过
+	_ = m.write(conn)
+	conn.mu.Lock()
+	drained := conn.writeBuffer == nil || conn.writeBuffer.IsEmpty()
+	conn.mu.Unlock()
+	if !drained {
+		m.opts.Logger.Debug("ktls", "fd", conn.fd, "loop", m.idx, "error", errKTLSPending)
+		return
+	}
+	if atomic.LoadInt32(&ktlsUnavailable) == 1 {
+		return
+	}
+	if err = unix.SetsockoptString(conn.fd, unix.SOL_TCP, unix.TCP_ULP, "tls"); err != nil {
+		if err == unix.ENOENT {
+			// 内核没有 tls 模块
+			atomic.StoreInt32(&ktlsUnavailable, 1)
+			m.opts.Logger.Info("ktls isn't supported by the kernel, the conns stay in userspace", "error", err)
+			return
+		}
+		m.opts.Logger.Debug("ktls", "fd", conn.fd, "loop", m.idx, "error", os.NewSyscallError("setsockopt TCP_ULP", err))
+		return
+	}
+	// 设置失败时 socket 仍然是普通的 TCP socket
+	if err = unix.SetsockoptString(conn.fd, unix.SOL_TLS, tlsTX, string(tx)); err != nil {
+		m.opts.Logger.Debug("ktls", "fd", conn.fd, "loop", m.idx, "error", os.NewSyscallError("setsockopt TLS_TX", err))
+		return
+	}
+	t.kernelTX = true
+	mode = "tx"
+	if tlsBuffered(t.tc) {
+		return
+	}
+	if err = unix.SetsockoptString(conn.fd, unix.SOL_TLS, tlsRX, string(rx)); err != nil {
+		m.opts.Logger.Debug("ktls", "fd", conn.fd, "loop", m.idx, "error", os.NewSyscallError("setsockopt TLS_RX", err))
+		return
+	}
+	t.kernelRX = true
+	mode = "tx_rx"
+}
+
+// readKernelTLS reads the plaintext of the records decrypted by the kernel. It returns 0 and no error when
+// the peer has sent close_notify, and an error for the other control records, such as a TLS 1.3 KeyUpdate,
+// because the keys held by the kernel can't be updated.
+func readKernelTLS(fd int, p []byte) (int, error) {
+	var oob [32]byte
+	n, oobn, _, _, err := unix.Recvmsg(fd, p, oob[:], 0)
+	if err != nil {
+		return n, err
+	}
+	msgs, err := unix.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return 0, err
+	}
+	for _, msg := range msgs {
+		if msg.Header.Level != unix.SOL_TLS || msg.Header.Type != tlsGetRecordType || len(msg.Data) == 0 {
+			continue
+		}
+		switch typ := msg.Data[0]; {
+		case typ == recordTypeApplicationData:
+		case typ == recordTypeAlert && n >= 2 && p[1] == alertCloseNotify:
+			return 0, nil
+		default:
+			return 0, fmt.Errorf("ktls: unexpected record of type %d", typ)
+		}
+	}
+	return n, nil
+}
+
+// closeNotifyKernel sends close_notify through the kernel, it's called once the outbound data is sent.
+func (t *tlsTransport) closeNotifyKernel() {
+	if !t.kernelTX {
+		return
+	}
+	oob := make([]byte, unix.CmsgSpace(1))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = unix.SOL_TLS
+	h.Type = tlsSetRecordType
+	h.SetLen(unix.CmsgLen(1))
+	oob[unix.CmsgLen(0)] = recordTypeAlert
+	_, _ = unix.SendmsgN(t.hc.fd, []byte{1, alertCloseNotify}, oob, nil, unix.MSG_DONTWAIT)
+}
@@ -0,0 +1,274 @@
+package haijun_net
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unsafe"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var ktlsSuites = map[string]*tls.Config{
+	"tls12 aes128": {MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}},
+	"tls12 aes256": {MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}},
+	"tls13":        {MinVersion: tls.VersionTLS13},
+}
+
+func TestKTLS_Echo(t *testing.T) {
+	ca := newTestCA(t)
+	config := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server", "server.test")}}
+	l := serveTest(t, new(tlsEchoHandler), WithTLS(config), WithKernelTLS())
+
+	suites := map[string]*tls.Config{
+		// 内核不支持 CBC，留在用户态
+		"tls12 cbc": {MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA}},
+	}
+	for name, suite := range ktlsSuites {
+		suites[name] = suite
+	}
+	for name, suite := range suites {
+		t.Run(name, func(t *testing.T) {
+			cfg := ca.clientConfig("server.test")
+			cfg.MinVersion, cfg.MaxVersion, cfg.CipherSuites = suite.MinVersion, suite.MaxVersion, suite.CipherSuites
+			c := tlsDial(t, l.Addr(), cfg)
+
+			msg := make([]byte, 256<<10)
+			_, _ = rand.Read(msg)
+			go func() { _, _ = c.Write(msg) }()
+			got := make([]byte, len(msg))
+			_, err := io.ReadFull(c, got)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(msg, got))
+
+			// 内核发送的 close_notify 之后是正常的 EOF
+			_, err = c.Write([]byte("bye\n"))
+			require.NoError(t, err)
+			b, err := ioutil.ReadAll(c)
+			require.NoError(t, err)
+			assert.Equal(t, "bye\n", string(b))
+		})
+	}
+
+	em := l.manager.metrics
+	offloaded := em.ktlsConns("tx").Value() + em.ktlsConns("tx_rx").Value()
+	t.Logf("ktls: tx_rx %d, tx %d, none %d", em.ktlsConns("tx_rx").Value(), em.ktlsConns("tx").Value(), em.ktlsConns("none").Value())
+	if atomic.LoadInt32(&ktlsUnavailable) == 1 {
+		assert.EqualValues(t, len(suites), em.ktlsConns("none").Value())
+	} else {
+		assert.EqualValues(t, len(ktlsSuites), offloaded)
+		assert.EqualValues(t, 1, em.ktlsConns("none").Value())
+	}
+}
+
+func TestKTLS_NoKeys(t *testing.T) {
+	ca := newTestCA(t)
+	cert := ca.issue(t, "server", "server.test")
+	// GetConfigForClient 返回的配置不记录密钥，连接留在用户态
+	config := &tls.Config{GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		return &tls.Config{Certificates: []tls.Certificate{cert}}, nil
+	}}
+	l := serveTest(t, new(tlsEchoHandler), WithTLS(config), WithKernelTLS())
+	c := tlsDial(t, l.Addr(), ca.clientConfig("server.test"))
+	_, err := c.Write([]byte("bye\n"))
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(c)
+	require.NoError(t, err)
+	assert.Equal(t, "bye\n", string(b))
+
+	em := l.manager.metrics
+	assert.EqualValues(t, 1, em.ktlsConns("no_keys").Value())
+	assert.Zero(t, em.ktlsConns("none").Value())
+}
+
+func TestKTLS_WriteAfterOffload(t *testing.T) {
+	// 内核接管加密后 crypto/tls 自己发出的记录会被加密两次，只能出错
+	tr := &tlsTransport{kernelTX: true}
+	_, err := tr.Write([]byte{recordTypeAlert, 3, 3, 0, 2, 1, alertCloseNotify})
+	assert.Equal(t, errKTLSWrite, err)
+}
+
+// recordingConn records the heads of the TLS streams like tlsTransport does.
+type recordingConn struct {
+	net.Conn
+	in, out []byte
+}
+
+func (c *recordingConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.in = appendHead(c.in, p[:n])
+	return n, err
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.out = appendHead(c.out, p)
+	return c.Conn.Write(p)
+}
+
+// kernelCrypto encrypts and decrypts the records with a crypto info like the kernel does.
+type kernelCrypto struct {
+	version  uint16
+	aead     cipher.AEAD
+	iv, salt []byte
+	seq      uint64
+}
+
+func newKernelCrypto(t *testing.T, info []byte) *kernelCrypto {
+	version := *(*uint16)(unsafe.Pointer(&info[0]))
+	keySize := map[uint16]int{tlsCipherAES128: 16, tlsCipherAES256: 32}[*(*uint16)(unsafe.Pointer(&info[2]))]
+	if keySize == 0 {
+		t.Skip("the cipher isn't AES-GCM")
+	}
+	require.Len(t, info, 4+8+keySize+4+8)
+	key := info[12 : 12+keySize]
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	aead, err := cipher.NewGCM(block)
+	require.NoError(t, err)
+	k := &kernelCrypto{version: version, aead: aead, iv: info[4:12], salt: info[12+keySize : 16+keySize]}
+	k.seq = binary.BigEndian.Uint64(info[16+keySize:])
+	if version == tls12Version {
+		// 显式 nonce 从序列号开始
+		assert.Equal(t, k.seq, binary.BigEndian.Uint64(k.iv))
+	}
+	return k
+}
+
+func (k *kernelCrypto) nonce(explicit []byte) []byte {
+	nonce := append(append([]byte(nil), k.salt...), k.iv...)
+	if k.version == tls12Version {
+		return append(nonce[:4], explicit...)
+	}
+	for i := 0; i < 8; i++ {
+		nonce[4+i] ^= byte(k.seq >> (56 - 8*i))
+	}
+	return nonce
+}
+
+func (k *kernelCrypto) seal(data []byte) []byte {
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], k.seq)
+	defer func() { k.seq++ }()
+	if k.version == tls13Version {
+		n := len(data) + 1 + k.aead.Overhead()
+		header := []byte{recordTypeApplicationData, 3, 3, byte(n >> 8), byte(n)}
+		return k.aead.Seal(header, k.nonce(nil), append(data, recordTypeApplicationData), header)
+	}
+	n := 8 + len(data) + k.aead.Overhead()
+	record := append([]byte{recordTypeApplicationData, 3, 3, byte(n >> 8), byte(n)}, seq[:]...)
+	aad := append(seq[:], recordTypeApplicationData, 3, 3, byte(len(data)>>8), byte(len(data)))
+	return k.aead.Seal(record, k.nonce(seq[:]), data, aad)
+}
+
+func (k *kernelCrypto) open(t *testing.T, r io.Reader) []byte {
+	header := make([]byte, 5)
+	_, err := io.ReadFull(r, header)
+	require.NoError(t, err)
+	require.EqualValues(t, recordTypeApplicationData, header[0])
+	payload := make([]byte, int(header[3])<<8|int(header[4]))
+	_, err = io.ReadFull(r, payload)
+	require.NoError(t, err)
+
+	var seq [8]byte
+	binary.BigEndian.PutUint64(seq[:], k.seq)
+	defer func() { k.seq++ }()
+	if k.version == tls13Version {
+		plain, err := k.aead.Open(nil, k.nonce(nil), payload, header)
+		require.NoError(t, err)
+		require.EqualValues(t, recordTypeApplicationData, plain[len(plain)-1])
+		return plain[:len(plain)-1]
+	}
+	n := len(payload) - 8 - k.aead.Overhead()
+	aad := append(seq[:], recordTypeApplicationData, 3, 3, byte(n>>8), byte(n))
+	plain, err := k.aead.Open(nil, k.nonce(payload[:8]), payload[8:], aad)
+	require.NoError(t, err)
+	return plain
+}
+
+// TestKTLS_CryptoInfo checks the crypto info installed into the kernel by encrypting and decrypting
+// the records with it in place of the kernel, the peer is crypto/tls.
+func TestKTLS_CryptoInfo(t *testing.T) {
+	ca := newTestCA(t)
+	for name, suite := range ktlsSuites {
+		t.Run(name, func(t *testing.T) {
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			require.NoError(t, err)
+			defer ln.Close()
+			raw, err := net.Dial("tcp", ln.Addr().String())
+			require.NoError(t, err)
+			defer raw.Close()
+			accepted, err := ln.Accept()
+			require.NoError(t, err)
+			defer accepted.Close()
+			require.NoError(t, raw.SetDeadline(time.Now().Add(10*time.Second)))
+			require.NoError(t, accepted.SetDeadline(time.Now().Add(10*time.Second)))
+
+			var keyLog bytes.Buffer
+			config, l := newKTLSConfig(&tls.Config{
+				Certificates: []tls.Certificate{ca.issue(t, "server", "server.test")},
+				KeyLogWriter: &keyLog,
+			})
+			sc := &recordingConn{Conn: accepted}
+			server := tls.Server(sc, config)
+			cfg := ca.clientConfig("server.test")
+			cfg.MinVersion, cfg.MaxVersion, cfg.CipherSuites = suite.MinVersion, suite.MaxVersion, suite.CipherSuites
+			client := tls.Client(raw, cfg)
+
+			// 先在用户态收发一次，序列号不再是 0
+			written := make(chan error, 1)
+			go func() {
+				_, err := client.Write([]byte("hello"))
+				written <- err
+			}()
+			buf := make([]byte, 5)
+			_, err = io.ReadFull(server, buf)
+			require.NoError(t, err)
+			require.NoError(t, <-written)
+			_, err = server.Write([]byte("hi"))
+			require.NoError(t, err)
+			_, err = io.ReadFull(client, buf[:2])
+			require.NoError(t, err)
+			assert.NotZero(t, keyLog.Len(), "the keys are logged to the original KeyLogWriter too")
+
+			clientRandom, serverRandom := helloRandom(sc.in, 1), helloRandom(sc.out, 2)
+			require.NotNil(t, clientRandom)
+			require.NotNil(t, serverRandom)
+			keys := l.take(clientRandom)
+			require.NotNil(t, keys)
+			assert.Nil(t, l.take(clientRandom))
+			tx, rx, err := ktlsCryptoInfo(server, keys, clientRandom, serverRandom)
+			require.NoError(t, err)
+
+			// 由"内核"接管两个方向
+			kernelTX, kernelRX := newKernelCrypto(t, tx), newKernelCrypto(t, rx)
+			for _, msg := range []string{"from the kernel", "and again"} {
+				_, err = accepted.Write(kernelTX.seal([]byte(msg)))
+				require.NoError(t, err)
+				got := make([]byte, len(msg))
+				_, err = io.ReadFull(client, got)
+				require.NoError(t, err)
+				assert.Equal(t, msg, string(got))
+			}
+			for _, msg := range []string{"to the kernel", "and again"} {
+				_, err = client.Write([]byte(msg))
+				require.NoError(t, err)
+				assert.Equal(t, msg, string(kernelRX.open(t, accepted)))
+			}
+		})
+	}
+}
+
+func TestKTLS_UnsupportedCipher(t *testing.T) {
+	_, _, err := ktlsCryptoInfo(tls.Client(nil, &tls.Config{}), &ktlsKeys{}, nil, nil)
+	assert.Equal(t, errKTLSCipher, err)
+}
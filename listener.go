@@ -1,29 +1,56 @@
 package haijun_net
 
 import (
-	"log"
+	"errors"
 	"net"
 	"os"
 	"runtime"
+	"sync"
 	"sync/atomic"
 
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/accounting"
 	"github.com/Ccheers/haijun-net/internal/poller"
 	"github.com/Ccheers/haijun-net/internal/socket"
+	"github.com/Ccheers/haijun-net/metrics"
 	"golang.org/x/sys/unix"
 )
 
 type Listener = net.Listener
 
+var errServing = errors.New("listener is already serving")
+
 type HjListener struct {
 	listenFd int
 	tcpAddr  *net.TCPAddr
+	opts     *Options
 
 	poller     poller.Poller
 	hasNewConn uint32
-	wakeChan   chan struct{}
+	// unregisterPoller removes the syscall metrics of poller from the registry, see engineMetrics.pollerSyscalls.
+	unregisterPoller func()
+	wakeChan         chan struct{}
+
+	// manager runs the event loop of the conns accepted by this listener.
+	manager *connManager
+	handler EventHandler
+	// ready holds the conns passing the gate, see Options.FirstByteTimeout.
+	ready readyQueue
+
+	closed int32
+	done   chan struct{}
+	// fdMu guards listenFd against being closed during an accept, otherwise the accept may take a conn
+	// of another listener reusing the fd number.
+	fdMu sync.RWMutex
 }
 
-func NewHjListener(addr string) (Listener, error) {
+func NewHjListener(addr string, opts ...Option) (Listener, error) {
+	options := loadOptions(opts...)
+	if err := options.validateTLS(); err != nil {
+		return nil, err
+	}
+	if err := options.Heartbeat.validate(); err != nil {
+		return nil, err
+	}
 
 	// 获取是tcp的listenFd
 	listenFd, err := unix.Socket(unix.AF_INET, unix.SOCK_STREAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_TCP)
@@ -32,13 +59,21 @@ func NewHjListener(addr string) (Listener, error) {
 		err = os.NewSyscallError("socket", err)
 		return nil, err
 	}
-	if err := os.NewSyscallError("set sock opt int", unix.SetsockoptInt(listenFd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)); err != nil {
+	var pollers []poller.Poller
+	// fail 关闭出错之前已经打开的 fd 和 poller
+	fail := func(err error) (Listener, error) {
+		for _, p := range pollers {
+			_ = p.Close()
+		}
+		_ = unix.Close(listenFd)
 		return nil, err
 	}
-
+	if err := os.NewSyscallError("set sock opt int", unix.SetsockoptInt(listenFd, unix.SOL_SOCKET, unix.SO_REUSEADDR, 1)); err != nil {
+		return fail(err)
+	}
 	tcpAddr, err := net.ResolveTCPAddr("tcp", addr)
 	if err != nil {
-		return nil, os.NewSyscallError("resove err", err)
+		return fail(os.NewSyscallError("resove err", err))
 	}
 	ip := tcpAddr.IP.To4()
 	sa := &unix.SockaddrInet4{
@@ -48,65 +83,149 @@ func NewHjListener(addr string) (Listener, error) {
 	// 绑定的端口
 	err = unix.Bind(listenFd, sa)
 	if err != nil {
-		return nil, os.NewSyscallError("socket bind err", err)
+		return fail(os.NewSyscallError("socket bind err", err))
 	}
 
-	var n int
+	n := unix.SOMAXCONN
 	if n > 1<<16-1 {
 		n = 1<<16 - 1
 	}
 	// 监听服务
 	err = unix.Listen(listenFd, n)
 	if err != nil {
-		return nil, os.NewSyscallError("listen err", err)
+		return fail(os.NewSyscallError("listen err", err))
+	}
+	// 端口为 0 时由内核分配，需要取回实际监听的地址
+	if tcpAddr.Port == 0 {
+		lsa, err := unix.Getsockname(listenFd)
+		if err != nil {
+			return fail(os.NewSyscallError("getsockname", err))
+		}
+		tcpAddr = socket.SockaddrToTCPOrUnixAddr(lsa).(*net.TCPAddr)
 	}
 	p, err := poller.NewPoller()
 	if err != nil {
-		return nil, err
+		return fail(err)
 	}
+	pollers = append(pollers, p)
+	connPoller, err := poller.NewPoller()
+	if err != nil {
+		return fail(err)
+	}
+	pollers = append(pollers, connPoller)
+	if err = p.Register(listenFd, poller.PollModeRead); err != nil {
+		return fail(err)
+	}
+	em := newEngineMetrics(options.Metrics)
+	unregisterPoller := em.pollerSyscalls(p)
 	l := &HjListener{
-		listenFd: listenFd,
-		tcpAddr:  tcpAddr,
-		poller:   p,
-		wakeChan: make(chan struct{}, 1),
+		listenFd:         listenFd,
+		tcpAddr:          tcpAddr,
+		opts:             options,
+		poller:           p,
+		unregisterPoller: unregisterPoller,
+		wakeChan:         make(chan struct{}, 1),
+		manager:          newConnManager(connPoller, options, em),
+		done:             make(chan struct{}),
 	}
+	options.Logger.Info("register listen fd", "fd", listenFd, "addr", tcpAddr)
+	go l.manager.serve()
 	l.Run()
 	return l, nil
 }
 
+// Run starts the goroutine waiting for the new conns, it's restarted when the poller fails,
+// see Options.PanicPolicy.
 func (h *HjListener) Run() {
-	log.Println("register listenFd")
-	err := h.poller.Register(h.listenFd, poller.PollModeRead)
-	if err != nil {
-		panic(err)
-	}
-	go func() {
-		//defer func() {
-		//	if err := recover(); err != nil {
-		//		log.Println(errors.New(fmt.Sprintf("%v", err)))
-		//	}
-		//}()
-		for {
-			events, err := h.poller.Wait()
-			if err != nil {
-				panic(err)
-			}
-			if len(events) == 0 {
-				runtime.Gosched()
-				continue
-			}
-			for _, event := range events {
-				if int(event.Fd) == h.listenFd {
-					if atomic.CompareAndSwapUint32(&h.hasNewConn, 0, 1) {
-						h.wakeChan <- struct{}{}
+	go supervise(h.opts, h.poller, h.wait, func() bool {
+		return atomic.LoadInt32(&h.closed) == 1
+	}, "listen_fd", h.listenFd)
+}
+
+func (h *HjListener) wait() error {
+	for atomic.LoadInt32(&h.closed) == 0 {
+		events, err := h.poller.Wait()
+		if err != nil {
+			return err
+		}
+		if len(events) == 0 {
+			runtime.Gosched()
+			continue
+		}
+		for _, event := range events {
+			if int(event.Fd) == h.listenFd {
+				if atomic.CompareAndSwapUint32(&h.hasNewConn, 0, 1) {
+					select {
+					case h.wakeChan <- struct{}{}:
+					case <-h.done:
 					}
 				}
 			}
 		}
-	}()
+	}
+	return nil
 }
 
 func (h *HjListener) Accept() (net.Conn, error) {
+	if h.handler != nil {
+		return nil, errServing
+	}
+	if h.opts.gated() {
+		return h.acceptGated()
+	}
+	nfd, sa, err := h.accept()
+	if err != nil {
+		return nil, err
+	}
+	conn := newHjConn(nfd, h.Addr(), socket.SockaddrToTCPOrUnixAddr(sa), h.manager)
+	if err = h.manager.RegisterConn(conn); err != nil {
+		h.manager.metrics.rejected.Inc()
+		_ = unix.Close(nfd)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Serve runs the listener in event-driven mode: it accepts the conns in a loop and drives them
+// by the callbacks of handler instead of handing them to Accept, it returns when the listener is closed.
+func (h *HjListener) Serve(handler EventHandler) error {
+	if h.handler != nil {
+		return errServing
+	}
+	h.handler = handler
+	for {
+		nfd, sa, err := h.accept()
+		if err != nil {
+			if atomic.LoadInt32(&h.closed) == 1 {
+				return nil
+			}
+			return err
+		}
+		conn := newHjConn(nfd, h.Addr(), socket.SockaddrToTCPOrUnixAddr(sa), h.manager)
+		conn.handler = handler
+		if h.opts.gated() {
+			err = h.manager.registerPending(conn)
+		} else {
+			err = h.manager.openConn(conn)
+		}
+		if err != nil {
+			h.manager.metrics.rejected.Inc()
+			_ = h.manager.closeConn(conn, err)
+		}
+	}
+}
+
+// ListenAndServe listens on the TCP network address addr and then calls Serve with handler.
+func ListenAndServe(addr string, handler EventHandler, opts ...Option) error {
+	l, err := NewHjListener(addr, opts...)
+	if err != nil {
+		return err
+	}
+	return l.(*HjListener).Serve(handler)
+}
+
+// accept waits for a new conn and returns its non-blocking fd.
+func (h *HjListener) accept() (int, unix.Sockaddr, error) {
 	var (
 		nfd int
 		sa  unix.Sockaddr
@@ -115,35 +234,88 @@ func (h *HjListener) Accept() (net.Conn, error) {
 
 	for {
 		if atomic.LoadUint32(&h.hasNewConn) != 1 {
-			<-h.wakeChan
+			select {
+			case <-h.wakeChan:
+			case <-h.done:
+				return 0, nil, net.ErrClosed
+			}
+		}
+		h.fdMu.RLock()
+		if atomic.LoadInt32(&h.closed) == 1 {
+			h.fdMu.RUnlock()
+			return 0, nil, net.ErrClosed
 		}
 		nfd, sa, err = unix.Accept(h.listenFd)
+		h.fdMu.RUnlock()
 		if err != nil && err != unix.EAGAIN {
-			return nil, err
+			switch err {
+			case unix.EINTR, unix.ECONNABORTED:
+				continue
+			}
+			h.manager.metrics.rejected.Inc()
+			return 0, nil, os.NewSyscallError("accept", err)
+		}
+		if nfd > 0 && accounting.Exceeded() {
+			// 缓冲池占用的内存超过上限，拒绝新的连接
+			h.manager.metrics.rejected.Inc()
+			h.manager.metrics.poolRejected.Inc()
+			h.opts.Logger.Warn("reject conn, pool memory limit exceeded", "fd", nfd,
+				"remote_addr", socket.SockaddrToTCPOrUnixAddr(sa), "in_use", accounting.Total())
+			_ = unix.Close(nfd)
+			continue
 		}
 		if nfd > 0 {
-			log.Println("accept new conn", nfd)
+			h.manager.metrics.accepted.Inc()
+			h.opts.Logger.Debug("accept new conn", "fd", nfd, "remote_addr", socket.SockaddrToTCPOrUnixAddr(sa), "loop", h.manager.idx)
+			if h.opts.Observer != nil {
+				h.opts.Observer.OnAccept(nfd, socket.SockaddrToTCPOrUnixAddr(sa))
+			}
 			break
 		}
 		atomic.StoreUint32(&h.hasNewConn, 0)
 	}
 	err = unix.SetNonblock(nfd, true)
 	if err != nil {
-		return nil, os.NewSyscallError("block err", err)
+		h.manager.metrics.rejected.Inc()
+		_ = unix.Close(nfd)
+		return 0, nil, os.NewSyscallError("block err", err)
 	}
 
-	netAddr := socket.SockaddrToTCPOrUnixAddr(sa)
 	if err = os.NewSyscallError("setsockopt", unix.SetsockoptInt(nfd, unix.IPPROTO_TCP, unix.TCP_KEEPINTVL, 5)); err != nil {
-		return nil, err
+		h.manager.metrics.rejected.Inc()
+		_ = unix.Close(nfd)
+		return 0, nil, err
 	}
-
-	return NewHjConn(nfd, h.Addr(), netAddr)
+	return nfd, sa, nil
 }
 
 func (h *HjListener) Close() error {
+	if !atomic.CompareAndSwapInt32(&h.closed, 0, 1) {
+		return nil
+	}
+	close(h.done)
+	_ = h.poller.Close()
+	h.unregisterPoller()
+	// 已经接受的连接不受影响，事件循环在它们都关闭后退出
+	h.manager.stop()
+	// 等待进行中的 accept 返回，fd 关闭后可能立即被复用
+	h.fdMu.Lock()
+	defer h.fdMu.Unlock()
 	return os.NewSyscallError("unix close", unix.Close(h.listenFd))
 }
 
+// RangeConns calls f for each live conn accepted by the listener until f returns false,
+// it's meant for debugging, such as dumping c.Stats() of the slow clients.
+func (h *HjListener) RangeConns(f func(c *HjConn) bool) {
+	h.manager.Range(f)
+}
+
+// Metrics returns the registry of the metrics maintained by the listener and its conns,
+// see metrics.Handler for exposing them to Prometheus.
+func (h *HjListener) Metrics() *metrics.Registry {
+	return h.opts.Metrics
+}
+
 func (h *HjListener) Addr() net.Addr {
 	return h.tcpAddr
 }
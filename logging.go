@@ -0,0 +1,171 @@
+package haijun_net
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Logger is the leveled and structured logger used by the engine,
+// keysAndValues are alternating keys and values, such as "fd", 8, "loop", 0.
+type Logger interface {
+	Debug(msg string, keysAndValues ...interface{})
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+// LogLevel is the level of a log entry.
+type LogLevel int
+
+const (
+	LogLevelDebug LogLevel = iota
+	LogLevelInfo
+	LogLevelWarn
+	LogLevelError
+)
+
+func (l LogLevel) String() string {
+	switch l {
+	case LogLevelDebug:
+		return "DEBUG"
+	case LogLevelInfo:
+		return "INFO"
+	case LogLevelWarn:
+		return "WARN"
+	case LogLevelError:
+		return "ERROR"
+	}
+	return fmt.Sprintf("LEVEL(%d)", int(l))
+}
+
+// nopLogger is the default logger, which drops everything.
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+func (nopLogger) Info(string, ...interface{})  {}
+func (nopLogger) Warn(string, ...interface{})  {}
+func (nopLogger) Error(string, ...interface{}) {}
+
+// NewStdLogger adapts the standard library's logger, the entries below level are dropped.
+// Each entry is printed as a single line: "LEVEL msg key=value key=value".
+func NewStdLogger(l *log.Logger, level LogLevel) Logger {
+	if l == nil {
+		l = log.Default()
+	}
+	return &stdLogger{l: l, level: level}
+}
+
+type stdLogger struct {
+	l     *log.Logger
+	level LogLevel
+}
+
+func (s *stdLogger) Debug(msg string, keysAndValues ...interface{}) {
+	s.print(LogLevelDebug, msg, keysAndValues)
+}
+
+func (s *stdLogger) Info(msg string, keysAndValues ...interface{}) {
+	s.print(LogLevelInfo, msg, keysAndValues)
+}
+
+func (s *stdLogger) Warn(msg string, keysAndValues ...interface{}) {
+	s.print(LogLevelWarn, msg, keysAndValues)
+}
+
+func (s *stdLogger) Error(msg string, keysAndValues ...interface{}) {
+	s.print(LogLevelError, msg, keysAndValues)
+}
+
+func (s *stdLogger) print(level LogLevel, msg string, keysAndValues []interface{}) {
+	if level < s.level {
+		return
+	}
+	_ = s.l.Output(3, level.String()+" "+msg+formatFields(keysAndValues))
+}
+
+// SugaredLogger is the zap-shaped logger, *zap.SugaredLogger implements it.
+type SugaredLogger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
+// NewSugaredLogger adapts a zap-shaped logger, the fields are passed through as they are.
+func NewSugaredLogger(l SugaredLogger) Logger {
+	return sugaredLogger{l}
+}
+
+type sugaredLogger struct {
+	l SugaredLogger
+}
+
+func (s sugaredLogger) Debug(msg string, keysAndValues ...interface{}) {
+	s.l.Debugw(msg, keysAndValues...)
+}
+
+func (s sugaredLogger) Info(msg string, keysAndValues ...interface{}) {
+	s.l.Infow(msg, keysAndValues...)
+}
+
+func (s sugaredLogger) Warn(msg string, keysAndValues ...interface{}) {
+	s.l.Warnw(msg, keysAndValues...)
+}
+
+func (s sugaredLogger) Error(msg string, keysAndValues ...interface{}) {
+	s.l.Errorw(msg, keysAndValues...)
+}
+
+// FormatLogger is the logrus-shaped logger, *logrus.Logger, *logrus.Entry and *zap.SugaredLogger implement it.
+type FormatLogger interface {
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Warnf(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// NewFormatLogger adapts a logrus-shaped logger, the fields are appended to the message as "key=value".
+func NewFormatLogger(l FormatLogger) Logger {
+	return formatLogger{l}
+}
+
+type formatLogger struct {
+	l FormatLogger
+}
+
+func (f formatLogger) Debug(msg string, keysAndValues ...interface{}) {
+	f.l.Debugf("%s%s", msg, formatFields(keysAndValues))
+}
+
+func (f formatLogger) Info(msg string, keysAndValues ...interface{}) {
+	f.l.Infof("%s%s", msg, formatFields(keysAndValues))
+}
+
+func (f formatLogger) Warn(msg string, keysAndValues ...interface{}) {
+	f.l.Warnf("%s%s", msg, formatFields(keysAndValues))
+}
+
+func (f formatLogger) Error(msg string, keysAndValues ...interface{}) {
+	f.l.Errorf("%s%s", msg, formatFields(keysAndValues))
+}
+
+// formatFields formats the key-value pairs as " key=value key=value",
+// a key without value is paired with "MISSING".
+func formatFields(keysAndValues []interface{}) string {
+	if len(keysAndValues) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	for i := 0; i < len(keysAndValues); i += 2 {
+		sb.WriteByte(' ')
+		fmt.Fprint(&sb, keysAndValues[i])
+		sb.WriteByte('=')
+		if i+1 < len(keysAndValues) {
+			fmt.Fprint(&sb, keysAndValues[i+1])
+		} else {
+			sb.WriteString("MISSING")
+		}
+	}
+	return sb.String()
+}
@@ -0,0 +1,82 @@
+package haijun_net
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewStdLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := NewStdLogger(log.New(&buf, "", 0), LogLevelInfo)
+	l.Debug("dropped", "fd", 1)
+	l.Info("accept new conn", "fd", 8, "remote_addr", "127.0.0.1:1234")
+	l.Error("odd", "key")
+	assert.Equal(t, "INFO accept new conn fd=8 remote_addr=127.0.0.1:1234\nERROR odd key=MISSING\n", buf.String())
+}
+
+type recordLogger struct {
+	mu      sync.Mutex
+	entries []string
+}
+
+func (r *recordLogger) record(level, msg string) {
+	r.mu.Lock()
+	r.entries = append(r.entries, level+" "+msg)
+	r.mu.Unlock()
+}
+
+func (r *recordLogger) Debugw(msg string, kv ...interface{}) { r.record("debug", msg+formatFields(kv)) }
+func (r *recordLogger) Infow(msg string, kv ...interface{})  { r.record("info", msg+formatFields(kv)) }
+func (r *recordLogger) Warnw(msg string, kv ...interface{})  { r.record("warn", msg+formatFields(kv)) }
+func (r *recordLogger) Errorw(msg string, kv ...interface{}) { r.record("error", msg+formatFields(kv)) }
+
+func (r *recordLogger) Debugf(f string, args ...interface{}) {
+	r.record("debug", fmt.Sprintf(f, args...))
+}
+func (r *recordLogger) Infof(f string, args ...interface{}) {
+	r.record("info", fmt.Sprintf(f, args...))
+}
+func (r *recordLogger) Warnf(f string, args ...interface{}) {
+	r.record("warn", fmt.Sprintf(f, args...))
+}
+func (r *recordLogger) Errorf(f string, args ...interface{}) {
+	r.record("error", fmt.Sprintf(f, args...))
+}
+
+func (r *recordLogger) contains(s string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, e := range r.entries {
+		if strings.Contains(e, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestLoggerAdapters(t *testing.T) {
+	r := &recordLogger{}
+	NewSugaredLogger(r).Warn("sugared", "loop", 0)
+	NewFormatLogger(r).Error("format", "fd", 3)
+	assert.Equal(t, []string{"warn sugared loop=0", "error format fd=3"}, r.entries)
+}
+
+func TestWithLogger(t *testing.T) {
+	r := &recordLogger{}
+	l := serveTest(t, &echoHandler{}, WithLogger(NewSugaredLogger(r)))
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	assert.True(t, r.contains("info register listen fd"))
+	assert.Eventually(t, func() bool { return r.contains("debug accept new conn") }, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,261 @@
+package haijun_net
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ccheers/haijun-net/buffer"
+	"github.com/Ccheers/haijun-net/internal/pkg/math"
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/accounting"
+	"github.com/Ccheers/haijun-net/internal/pkg/ringbuffer"
+	"github.com/Ccheers/haijun-net/metrics"
+)
+
+// SetPoolMemoryLimit sets up the process-wide limit of the bytes checked out of the buffer pools,
+// zero means unlimited. While the limit is exceeded, the listeners reject the new conns and the event loops
+// defer reading the conns which need a new buffer. The bytes checked out are exposed as the metric
+// haijun_pool_inuse_bytes.
+func SetPoolMemoryLimit(n int64) {
+	accounting.SetLimit(n)
+}
+
+// PoolMemoryInUse returns the number of bytes checked out of the buffer pools by the whole process.
+func PoolMemoryInUse() int64 {
+	return accounting.Total()
+}
+
+// ErrMemoryBudget is returned by Write when the outbound data would exceed Options.MemoryBudget.
+var ErrMemoryBudget = errors.New("memory budget of the conn buffers exceeded")
+
+const (
+	// minBufferSize is the smallest buffer allocated for a conn.
+	minBufferSize = ringbuffer.DefaultBufferSize
+	// bufferIdleTime is how long an empty inbound buffer is kept after the last read.
+	bufferIdleTime = time.Second
+	// memoryRetryInterval is how long reading a conn is paused when the budget is exhausted.
+	memoryRetryInterval = 10 * time.Millisecond
+)
+
+// MemoryBudget limits the memory of the conn buffers, that is the capacity of the inbound buffers and
+// the data waiting in the outbound buffers. It's safe for concurrent use so one budget can be shared
+// by several listeners as a global limit, see Options.MemoryBudget.
+type MemoryBudget struct {
+	limit int64 // zero means unlimited
+	used  int64
+
+	// gauges counts the listeners reporting the budget into each registry, so that a registry shared
+	// by the listeners of one budget reports it once.
+	mu     sync.Mutex
+	gauges map[*metrics.Registry]*budgetGauge
+}
+
+type budgetGauge struct {
+	refs       int
+	unregister func()
+}
+
+// NewMemoryBudget returns a budget of limit bytes, zero means unlimited.
+func NewMemoryBudget(limit int64) *MemoryBudget {
+	return &MemoryBudget{limit: limit, gauges: make(map[*metrics.Registry]*budgetGauge)}
+}
+
+// Limit returns the number of bytes the budget allows.
+func (b *MemoryBudget) Limit() int64 {
+	return b.limit
+}
+
+// Used returns the number of bytes taken from the budget by all the listeners sharing it.
+func (b *MemoryBudget) Used() int64 {
+	return atomic.LoadInt64(&b.used)
+}
+
+// register reports the budget as the metric haijun_buffer_memory_budget_bytes of r until
+// the returned func is called.
+func (b *MemoryBudget) register(r *metrics.Registry) (unregister func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	g := b.gauges[r]
+	if g == nil {
+		g = &budgetGauge{unregister: r.GaugeFunc(metricsNamespace+"buffer_memory_budget_bytes",
+			"Memory budget of the connection buffers.", func() float64 { return float64(b.limit) })}
+		b.gauges[r] = g
+	}
+	g.refs++
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if g.refs--; g.refs == 0 {
+			g.unregister()
+			delete(b.gauges, r)
+		}
+	}
+}
+
+// memoryBudget accounts the memory of the conn buffers of one listener against the MemoryBudget
+// it shares with the other listeners.
+type memoryBudget struct {
+	budget *MemoryBudget // nil means unlimited
+	used   int64
+
+	usedGauge *metrics.Gauge
+	exceeded  func(op string) *metrics.Counter
+	// unregister removes the budget from the registry, see MemoryBudget.register.
+	unregister func()
+}
+
+func newMemoryBudget(budget *MemoryBudget, em *engineMetrics) *memoryBudget {
+	r := em.registry
+	b := &memoryBudget{
+		budget:    budget,
+		usedGauge: r.Gauge(metricsNamespace+"buffer_memory_bytes", "Number of bytes held by the connection buffers."),
+		exceeded: func(op string) *metrics.Counter {
+			return r.Counter(metricsNamespace+"buffer_memory_exceeded_total",
+				"Number of buffer allocations rejected by the memory budget.", metrics.Label{Name: "op", Value: op})
+		},
+		unregister: func() {},
+	}
+	if budget != nil && budget.limit > 0 {
+		b.unregister = budget.register(r)
+	}
+	return b
+}
+
+// reserve takes n bytes from the budget, it reports false without taking anything when the budget
+// would be exceeded.
+func (b *memoryBudget) reserve(n int, op string) bool {
+	if b.budget == nil || b.budget.limit <= 0 {
+		b.add(n)
+		return true
+	}
+	for {
+		used := atomic.LoadInt64(&b.budget.used)
+		if used+int64(n) > b.budget.limit {
+			b.exceeded(op).Inc()
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&b.budget.used, used, used+int64(n)) {
+			atomic.AddInt64(&b.used, int64(n))
+			b.usedGauge.Add(int64(n))
+			return true
+		}
+	}
+}
+
+// add takes n bytes from the budget unconditionally, n is negative when the memory is given back.
+func (b *memoryBudget) add(n int) {
+	if b.budget != nil {
+		atomic.AddInt64(&b.budget.used, int64(n))
+	}
+	atomic.AddInt64(&b.used, int64(n))
+	b.usedGauge.Add(int64(n))
+}
+
+// Used returns the number of bytes accounted by this listener.
+func (b *memoryBudget) Used() int64 {
+	return atomic.LoadInt64(&b.used)
+}
+
+// close stops reporting the budget, it's called once the event loop exits.
+func (b *memoryBudget) close() {
+	b.unregister()
+}
+
+// adaptiveSize returns the size of a buffer for the observed traffic hint, between minBufferSize and max.
+func adaptiveSize(hint, max int) int {
+	size := minBufferSize
+	if hint > size {
+		if c, err := math.CeilToPowerOfTwo(hint); err == nil {
+			size = c
+		}
+	}
+	if size > max {
+		size = max
+	}
+	return size
+}
+
+// allocReadBuffer allocates the inbound buffer of the conn on its first read, sized by the traffic
+// observed before its last buffer was released. It must be called with conn.mu held.
+func (m *connManager) allocReadBuffer(conn *HjConn) bool {
+	if accounting.Exceeded() {
+		m.metrics.poolBackpressure.Inc()
+		return false
+	}
+	size := adaptiveSize(conn.readHint, m.opts.readBufferSize())
+	if !m.memory.reserve(size, "read") {
+		return false
+	}
+	conn.readBuffer = buffer.NewLinkBufferSize(size)
+	conn.readLimit = size
+	return true
+}
+
+// growReadBuffer raises the limit of the full inbound buffer of the conn, it reports false when
+// the limit can't grow. It must be called with conn.mu held.
+func (m *connManager) growReadBuffer(conn *HjConn) bool {
+	old := conn.readLimit
+	size := m.opts.growReadBuffer(old)
+	if size == 0 {
+		return false
+	}
+	if accounting.Exceeded() {
+		m.metrics.poolBackpressure.Inc()
+		return false
+	}
+	if !m.memory.reserve(size-old, "read") {
+		return false
+	}
+	conn.readLimit = size
+	return true
+}
+
+// releaseReadBuffer returns the memory of the inbound buffer of the conn to the pool,
+// it must be called with conn.mu held.
+func (m *connManager) releaseReadBuffer(conn *HjConn) {
+	conn.readHint, conn.readPeak = conn.readPeak, 0
+	m.memory.add(-conn.readLimit)
+	conn.readBuffer.Release()
+	conn.readBuffer = nil
+	conn.readLimit = 0
+}
+
+// newWriteBuffer allocates the outbound buffer of the conn on the first write after it was drained,
+// sized by the outbound traffic observed before. It must be called with conn.mu held.
+func (m *connManager) newWriteBuffer(conn *HjConn, n int) {
+	hint := conn.writeHint
+	if n > hint {
+		hint = n
+	}
+	conn.writeBuffer = buffer.NewLinkBufferSize(adaptiveSize(hint, ringbuffer.MaxStreamBufferCap))
+}
+
+// releaseWriteBuffer returns the drained outbound buffer of the conn to the pool,
+// it must be called with conn.mu held.
+func (m *connManager) releaseWriteBuffer(conn *HjConn) {
+	conn.writeHint, conn.writePeak = conn.writePeak, 0
+	conn.writeBuffer.Release()
+	conn.writeBuffer = nil
+}
+
+// reapBuffers releases the empty inbound buffers of the conns which haven't read anything for
+// bufferIdleTime, so that the idle conns hold no buffer. It runs on the timer of the event loop.
+func (m *connManager) reapBuffers() {
+	now := time.Now().UnixNano()
+	m.Range(func(c *HjConn) bool {
+		lastRead := atomic.LoadInt64(&c.lastRead)
+		if created := c.createdAt.UnixNano(); lastRead < created {
+			lastRead = created
+		}
+		if time.Duration(now-lastRead) < bufferIdleTime {
+			return true
+		}
+		c.mu.Lock()
+		if c.readBuffer != nil && c.readBuffer.IsEmpty() && !c.isClosed() {
+			m.releaseReadBuffer(c)
+		}
+		c.mu.Unlock()
+		return true
+	})
+}
@@ -0,0 +1,175 @@
+package haijun_net
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/accounting"
+	"github.com/Ccheers/haijun-net/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdaptiveSize(t *testing.T) {
+	assert.Equal(t, minBufferSize, adaptiveSize(0, 64<<10))
+	assert.Equal(t, 8<<10, adaptiveSize(5000, 64<<10))
+	assert.Equal(t, 64<<10, adaptiveSize(1<<20, 64<<10))
+}
+
+func TestHjConn_LazyBuffers(t *testing.T) {
+	l, err := NewHjListener("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	hl := l.(*HjListener)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	c, err := l.Accept()
+	require.NoError(t, err)
+	defer c.Close()
+	conn := c.(*HjConn)
+
+	hasBuffers := func() (read, write bool) {
+		conn.mu.Lock()
+		defer conn.mu.Unlock()
+		return conn.readBuffer != nil, conn.writeBuffer != nil
+	}
+	read, write := hasBuffers()
+	assert.False(t, read)
+	assert.False(t, write)
+	assert.Zero(t, hl.manager.memory.Used())
+
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(conn, make([]byte, 5))
+	require.NoError(t, err)
+	read, _ = hasBuffers()
+	assert.True(t, read)
+	assert.Greater(t, hl.manager.memory.Used(), int64(0))
+
+	_, err = conn.Write([]byte("world"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(client, make([]byte, 5))
+	require.NoError(t, err)
+
+	// 发送完的写缓冲区立即释放，空闲的读缓冲区由定时器回收
+	assert.Eventually(t, func() bool {
+		read, write := hasBuffers()
+		return !read && !write
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Zero(t, hl.manager.memory.Used())
+}
+
+func TestWithMemoryBudget(t *testing.T) {
+	l, err := NewHjListener("127.0.0.1:0", WithMemoryBudget(NewMemoryBudget(8<<10)))
+	require.NoError(t, err)
+	defer l.Close()
+	hl := l.(*HjListener)
+
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	c, err := l.Accept()
+	require.NoError(t, err)
+	defer c.Close()
+
+	_, err = c.Write(bytes.Repeat([]byte("x"), 16<<10))
+	assert.Equal(t, ErrMemoryBudget, err)
+	n, err := c.Write(bytes.Repeat([]byte("x"), 4<<10))
+	require.NoError(t, err)
+	_, err = io.ReadFull(client, make([]byte, n))
+	require.NoError(t, err)
+
+	var buf bytes.Buffer
+	require.NoError(t, hl.Metrics().WritePrometheus(&buf))
+	assert.True(t, strings.Contains(buf.String(), `haijun_buffer_memory_exceeded_total{op="write"} 1`), buf.String())
+	assert.True(t, strings.Contains(buf.String(), "haijun_buffer_memory_budget_bytes 8192"), buf.String())
+}
+
+func TestMemoryBudget_Shared(t *testing.T) {
+	budget := NewMemoryBudget(8 << 10)
+	registry := metrics.NewRegistry()
+	l1, err := NewHjListener("127.0.0.1:0", WithMemoryBudget(budget), WithMetrics(registry))
+	require.NoError(t, err)
+	l2, err := NewHjListener("127.0.0.1:0", WithMemoryBudget(budget), WithMetrics(registry))
+	require.NoError(t, err)
+
+	// 第一个监听器的连接占用的读缓冲区也计入共享的预算
+	client1, err := net.Dial("tcp", l1.Addr().String())
+	require.NoError(t, err)
+	defer client1.Close()
+	c1, err := l1.Accept()
+	require.NoError(t, err)
+	_, err = client1.Write([]byte("hello"))
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool { return c1.(*HjConn).InboundBuffered() == 5 }, 5*time.Second, 10*time.Millisecond)
+	used := budget.Used()
+	assert.Greater(t, used, int64(0))
+	assert.Equal(t, used, l1.(*HjListener).manager.memory.Used())
+
+	client2, err := net.Dial("tcp", l2.Addr().String())
+	require.NoError(t, err)
+	defer client2.Close()
+	c2, err := l2.Accept()
+	require.NoError(t, err)
+	_, err = c2.Write(make([]byte, 8<<10-used+1))
+	assert.Equal(t, ErrMemoryBudget, err)
+
+	// 共享同一个 registry 的监听器只报告一次预算，全部关闭后不再报告
+	var buf bytes.Buffer
+	require.NoError(t, registry.WritePrometheus(&buf))
+	assert.True(t, strings.Contains(buf.String(), "haijun_buffer_memory_budget_bytes 8192"), buf.String())
+	require.NoError(t, c1.Close())
+	require.NoError(t, c2.Close())
+	require.NoError(t, l1.Close())
+	require.NoError(t, l2.Close())
+	assert.Eventually(t, func() bool {
+		return !registry.Has("haijun_buffer_memory_budget_bytes")
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSetPoolMemoryLimit(t *testing.T) {
+	accounting.Acquire(accounting.ByteSlice, 1)
+	defer accounting.Release(accounting.ByteSlice, 1)
+	SetPoolMemoryLimit(1)
+	defer SetPoolMemoryLimit(0)
+
+	l, err := NewHjListener("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	hl := l.(*HjListener)
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		c, err := l.Accept()
+		if err == nil {
+			accepted <- c
+		}
+	}()
+
+	// 超过上限时新连接被直接关闭
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_ = client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, err = client.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+
+	SetPoolMemoryLimit(0)
+	client2, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client2.Close()
+	c := <-accepted
+	defer c.Close()
+	assert.Equal(t, client2.LocalAddr().String(), c.RemoteAddr().String())
+
+	var buf bytes.Buffer
+	require.NoError(t, hl.Metrics().WritePrometheus(&buf))
+	assert.True(t, strings.Contains(buf.String(), `haijun_pool_memory_exceeded_total{action="reject"} 1`), buf.String())
+	assert.True(t, strings.Contains(buf.String(), `haijun_pool_inuse_bytes{pool="byteslice"}`), buf.String())
+}
@@ -0,0 +1,171 @@
+package haijun_net
+
+import (
+	"strconv"
+
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/accounting"
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/byteslice"
+	rbPool "github.com/Ccheers/haijun-net/internal/pkg/pool/ringbuffer"
+	"github.com/Ccheers/haijun-net/internal/poller"
+	"github.com/Ccheers/haijun-net/metrics"
+)
+
+const metricsNamespace = "haijun_"
+
+// udpBatchBuckets are the upper bounds of the buckets of the UDP batch sizes.
+var udpBatchBuckets = []float64{1, 2, 4, 8, 16, 32, 64, 128, 256, 512, 1024}
+
+// engineMetrics are the metrics maintained by the engine, see Options.Metrics.
+type engineMetrics struct {
+	registry *metrics.Registry
+
+	accepted *metrics.Counter
+	closed   *metrics.Counter
+	rejected *metrics.Counter
+
+	readBytes    *metrics.Counter
+	writtenBytes *metrics.Counter
+	readCalls    *metrics.Counter
+	writevCalls  *metrics.Counter
+	readEAGAIN   *metrics.Counter
+	writeEAGAIN  *metrics.Counter
+
+	outboundBytes *metrics.Gauge
+
+	// the actions taken when the memory checked out of the buffer pools exceeds the process-wide limit
+	poolRejected     *metrics.Counter
+	poolBackpressure *metrics.Counter
+
+	tlsHandshake        func(result string) *metrics.Counter
+	tlsHandshakeSeconds *metrics.Histogram
+	ktlsConns           func(mode string) *metrics.Counter
+
+	recvfromCalls *metrics.Counter
+	sendtoCalls   *metrics.Counter
+	udpPacketsIn  *metrics.Counter
+	udpPacketsOut *metrics.Counter
+	udpBytesIn    *metrics.Counter
+	udpBytesOut   *metrics.Counter
+	recvmmsgCalls *metrics.Counter
+	sendmmsgCalls *metrics.Counter
+	udpBatchIn    *metrics.Histogram
+	udpBatchOut   *metrics.Histogram
+}
+
+// loopMetrics are the metrics of one event loop.
+type loopMetrics struct {
+	activeConns *metrics.Gauge
+	iteration   *metrics.Histogram
+	// remove deletes the metrics of the loop once it's stopped
+	remove func()
+}
+
+func newEngineMetrics(r *metrics.Registry) *engineMetrics {
+	syscall := func(name string) *metrics.Counter {
+		return r.Counter(metricsNamespace+"syscalls_total", "Number of system calls made by the engine.",
+			metrics.Label{Name: "syscall", Value: name})
+	}
+	eagain := func(op string) *metrics.Counter {
+		return r.Counter(metricsNamespace+"eagain_total", "Number of reads and writes returning EAGAIN.",
+			metrics.Label{Name: "op", Value: op})
+	}
+	em := &engineMetrics{
+		registry:      r,
+		accepted:      r.Counter(metricsNamespace+"conns_accepted_total", "Number of accepted connections."),
+		closed:        r.Counter(metricsNamespace+"conns_closed_total", "Number of closed connections."),
+		rejected:      r.Counter(metricsNamespace+"conns_rejected_total", "Number of connections failed to be accepted or registered."),
+		readBytes:     r.Counter(metricsNamespace+"read_bytes_total", "Number of bytes read from the connections."),
+		writtenBytes:  r.Counter(metricsNamespace+"written_bytes_total", "Number of bytes written to the connections."),
+		readCalls:     syscall("read"),
+		writevCalls:   syscall("writev"),
+		readEAGAIN:    eagain("read"),
+		writeEAGAIN:   eagain("write"),
+		outboundBytes: r.Gauge(metricsNamespace+"outbound_buffered_bytes", "Number of bytes waiting in the outbound buffers."),
+	}
+	poolExceeded := func(action string) *metrics.Counter {
+		return r.Counter(metricsNamespace+"pool_memory_exceeded_total",
+			"Number of times the memory limit of the buffer pools was hit, by the action taken.",
+			metrics.Label{Name: "action", Value: action})
+	}
+	em.poolRejected = poolExceeded("reject")
+	em.poolBackpressure = poolExceeded("backpressure")
+	em.tlsHandshake = func(result string) *metrics.Counter {
+		return r.Counter(metricsNamespace+"tls_handshakes_total", "Number of TLS handshakes, by result: full, resumed or error.",
+			metrics.Label{Name: "result", Value: result})
+	}
+	em.tlsHandshakeSeconds = r.Histogram(metricsNamespace+"tls_handshake_seconds", "Time spent by the successful TLS handshakes.",
+		metrics.DefaultLatencyBuckets)
+	udp := func(name, help, direction string) *metrics.Counter {
+		return r.Counter(metricsNamespace+name, help, metrics.Label{Name: "direction", Value: direction})
+	}
+	em.recvfromCalls = syscall("recvfrom")
+	em.sendtoCalls = syscall("sendto")
+	em.udpPacketsIn = udp("udp_packets_total", "Number of UDP datagrams received and sent.", "in")
+	em.udpPacketsOut = udp("udp_packets_total", "Number of UDP datagrams received and sent.", "out")
+	em.udpBytesIn = udp("udp_bytes_total", "Number of bytes of the UDP datagrams received and sent.", "in")
+	em.udpBytesOut = udp("udp_bytes_total", "Number of bytes of the UDP datagrams received and sent.", "out")
+	em.recvmmsgCalls = syscall("recvmmsg")
+	em.sendmmsgCalls = syscall("sendmmsg")
+	batch := func(direction string) *metrics.Histogram {
+		return r.Histogram(metricsNamespace+"udp_batch_size", "Number of UDP datagrams received by a recvmmsg or sent by a sendmmsg.",
+			udpBatchBuckets, metrics.Label{Name: "direction", Value: direction})
+	}
+	em.udpBatchIn = batch("in")
+	em.udpBatchOut = batch("out")
+	em.ktlsConns = func(mode string) *metrics.Counter {
+		return r.Counter(metricsNamespace+"ktls_conns_total",
+			"Number of TLS conns by the kernel TLS offload: tx_rx, tx, or none and no_keys when they stay in userspace.",
+			metrics.Label{Name: "mode", Value: mode})
+	}
+
+	// 缓冲池是进程级别的，同一个 registry 只注册一次
+	const poolGets = metricsNamespace + "buffer_pool_gets_total"
+	if !r.Has(poolGets) {
+		pool := func(name, result string, fn func() uint64) {
+			r.CounterFunc(poolGets, "Number of buffers got from the pools, by whether they were reused.", fn,
+				metrics.Label{Name: "pool", Value: name}, metrics.Label{Name: "result", Value: result})
+		}
+		pool("ringbuffer", "hit", func() uint64 { hits, _ := rbPool.Stats(); return hits })
+		pool("ringbuffer", "miss", func() uint64 { _, misses := rbPool.Stats(); return misses })
+		pool("byteslice", "hit", func() uint64 { hits, _ := byteslice.Stats(); return hits })
+		pool("byteslice", "miss", func() uint64 { _, misses := byteslice.Stats(); return misses })
+		r.CounterFunc(metricsNamespace+"buffer_pool_discards_total", "Number of oversized buffers discarded instead of pooled.",
+			rbPool.Discards, metrics.Label{Name: "pool", Value: "ringbuffer"})
+
+		for _, p := range accounting.Pools {
+			p := p
+			r.GaugeFunc(metricsNamespace+"pool_inuse_bytes", "Number of bytes checked out of the buffer pools.",
+				func() float64 { return float64(accounting.InUse(p)) }, metrics.Label{Name: "pool", Value: p.String()})
+		}
+		r.GaugeFunc(metricsNamespace+"pool_memory_limit_bytes", "Limit of the bytes checked out of the buffer pools, zero means unlimited.",
+			func() float64 { return float64(accounting.Limit()) })
+	}
+	return em
+}
+
+// pollerSyscalls reports the epoll_ctl and epoll_wait calls of p, until the returned function is called
+// after p is closed.
+func (em *engineMetrics) pollerSyscalls(p poller.Poller) (unregister func()) {
+	ctl := em.registry.CounterFunc(metricsNamespace+"syscalls_total", "", func() uint64 { return p.Stats().CtlCalls },
+		metrics.Label{Name: "syscall", Value: "epoll_ctl"})
+	wait := em.registry.CounterFunc(metricsNamespace+"syscalls_total", "", func() uint64 { return p.Stats().WaitCalls },
+		metrics.Label{Name: "syscall", Value: "epoll_wait"})
+	return func() {
+		ctl()
+		wait()
+	}
+}
+
+func (em *engineMetrics) loop(idx int) *loopMetrics {
+	label := metrics.Label{Name: "loop", Value: strconv.Itoa(idx)}
+	const active, iteration = metricsNamespace + "conns_active", metricsNamespace + "loop_iteration_seconds"
+	return &loopMetrics{
+		activeConns: em.registry.Gauge(active, "Number of connections registered to the event loop.", label),
+		iteration: em.registry.Histogram(iteration, "Time spent processing the events of one poller wakeup.",
+			metrics.DefaultLatencyBuckets, label),
+		remove: func() {
+			em.registry.Remove(active, label)
+			em.registry.Remove(iteration, label)
+		},
+	}
+}
@@ -0,0 +1,381 @@
+// Package metrics is a small registry of counters, gauges and histograms which can be
+// rendered in the Prometheus text exposition format without the Prometheus client library.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Type is the type of a metric family.
+type Type int
+
+const (
+	TypeCounter Type = iota
+	TypeGauge
+	TypeHistogram
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeCounter:
+		return "counter"
+	case TypeGauge:
+		return "gauge"
+	case TypeHistogram:
+		return "histogram"
+	}
+	return "untyped"
+}
+
+// DefaultLatencyBuckets are the upper bounds in seconds of the buckets used for the loop latencies,
+// from 10µs to 100ms.
+var DefaultLatencyBuckets = []float64{0.00001, 0.00005, 0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.1}
+
+// Label is a name-value pair which distinguishes the metrics of one family.
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Counter is a monotonically increasing value.
+type Counter struct {
+	v uint64
+}
+
+// Inc increases the counter by 1.
+func (c *Counter) Inc() {
+	atomic.AddUint64(&c.v, 1)
+}
+
+// Add increases the counter by n.
+func (c *Counter) Add(n uint64) {
+	atomic.AddUint64(&c.v, n)
+}
+
+// Value returns the current value.
+func (c *Counter) Value() uint64 {
+	return atomic.LoadUint64(&c.v)
+}
+
+// Gauge is a value that can go up and down.
+type Gauge struct {
+	v int64
+}
+
+// Set sets the gauge to v.
+func (g *Gauge) Set(v int64) {
+	atomic.StoreInt64(&g.v, v)
+}
+
+// Add adds n, which may be negative, to the gauge.
+func (g *Gauge) Add(n int64) {
+	atomic.AddInt64(&g.v, n)
+}
+
+// Inc increases the gauge by 1.
+func (g *Gauge) Inc() {
+	atomic.AddInt64(&g.v, 1)
+}
+
+// Dec decreases the gauge by 1.
+func (g *Gauge) Dec() {
+	atomic.AddInt64(&g.v, -1)
+}
+
+// Value returns the current value.
+func (g *Gauge) Value() int64 {
+	return atomic.LoadInt64(&g.v)
+}
+
+// Histogram counts the observed values in buckets with fixed upper bounds.
+type Histogram struct {
+	upperBounds []float64
+	counts      []uint64 // the last one is the +Inf bucket
+	count       uint64
+	sumBits     uint64
+}
+
+// NewHistogram returns a Histogram with the given upper bounds, which must be sorted in increasing order.
+func NewHistogram(upperBounds []float64) *Histogram {
+	return &Histogram{
+		upperBounds: upperBounds,
+		counts:      make([]uint64, len(upperBounds)+1),
+	}
+}
+
+// Observe adds v to the histogram.
+func (h *Histogram) Observe(v float64) {
+	i := sort.SearchFloat64s(h.upperBounds, v)
+	atomic.AddUint64(&h.counts[i], 1)
+	atomic.AddUint64(&h.count, 1)
+	for {
+		old := atomic.LoadUint64(&h.sumBits)
+		sum := math.Float64bits(math.Float64frombits(old) + v)
+		if atomic.CompareAndSwapUint64(&h.sumBits, old, sum) {
+			return
+		}
+	}
+}
+
+// ObserveDuration adds d in seconds to the histogram.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// Snapshot returns the cumulative counts of the buckets.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	s := HistogramSnapshot{
+		Buckets: make([]Bucket, len(h.counts)),
+		Count:   atomic.LoadUint64(&h.count),
+		Sum:     math.Float64frombits(atomic.LoadUint64(&h.sumBits)),
+	}
+	var cum uint64
+	for i := range h.counts {
+		cum += atomic.LoadUint64(&h.counts[i])
+		upper := math.Inf(1)
+		if i < len(h.upperBounds) {
+			upper = h.upperBounds[i]
+		}
+		s.Buckets[i] = Bucket{UpperBound: upper, Count: cum}
+	}
+	return s
+}
+
+// HistogramSnapshot is the state of a histogram at some point.
+type HistogramSnapshot struct {
+	// Buckets are cumulative, the last one is the +Inf bucket.
+	Buckets []Bucket
+	Count   uint64
+	Sum     float64
+}
+
+// Bucket is a cumulative bucket of a histogram.
+type Bucket struct {
+	UpperBound float64
+	Count      uint64
+}
+
+// Family is the snapshot of the metrics sharing one name.
+type Family struct {
+	Name    string
+	Help    string
+	Type    Type
+	Samples []Sample
+}
+
+// Sample is the snapshot of one metric, Histogram is set for the histograms and Value for the others.
+type Sample struct {
+	Labels    []Label
+	Value     float64
+	Histogram *HistogramSnapshot
+}
+
+type metric struct {
+	labels    []Label
+	counter   *Counter
+	gauge     *Gauge
+	histogram *Histogram
+	funcs     []*metricFunc
+}
+
+// metricFunc wraps a function registered by CounterFunc or GaugeFunc, so that it can be found to unregister.
+type metricFunc struct {
+	fn func() float64
+}
+
+func (m *metric) value() float64 {
+	switch {
+	case m.counter != nil:
+		return float64(m.counter.Value())
+	case m.gauge != nil:
+		return float64(m.gauge.Value())
+	}
+	var sum float64
+	for _, f := range m.funcs {
+		sum += f.fn()
+	}
+	return sum
+}
+
+type family struct {
+	name    string
+	help    string
+	typ     Type
+	metrics map[string]*metric
+}
+
+// Registry holds the metrics, the metrics are created on first use and looked up by name and labels,
+// so the callers asking for the same metric share it.
+type Registry struct {
+	mu       sync.RWMutex
+	families map[string]*family
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{families: make(map[string]*family)}
+}
+
+// Counter returns the counter with the given name and labels, creating it if needed.
+func (r *Registry) Counter(name, help string, labels ...Label) *Counter {
+	m := r.getOrCreate(name, help, TypeCounter, labels, func(m *metric) { m.counter = new(Counter) })
+	return m.counter
+}
+
+// Gauge returns the gauge with the given name and labels, creating it if needed.
+func (r *Registry) Gauge(name, help string, labels ...Label) *Gauge {
+	m := r.getOrCreate(name, help, TypeGauge, labels, func(m *metric) { m.gauge = new(Gauge) })
+	return m.gauge
+}
+
+// Histogram returns the histogram with the given name and labels, creating it with upperBounds if needed.
+func (r *Registry) Histogram(name, help string, upperBounds []float64, labels ...Label) *Histogram {
+	m := r.getOrCreate(name, help, TypeHistogram, labels, func(m *metric) { m.histogram = NewHistogram(upperBounds) })
+	return m.histogram
+}
+
+// CounterFunc registers a counter whose value is returned by fn, and returns a function unregistering fn.
+// The functions registered more than once with the same name and labels are summed up,
+// so that several engines can report into one registry.
+func (r *Registry) CounterFunc(name, help string, fn func() uint64, labels ...Label) (unregister func()) {
+	return r.addFunc(name, help, TypeCounter, func() float64 { return float64(fn()) }, labels)
+}
+
+// GaugeFunc registers a gauge whose value is returned by fn, see CounterFunc for the duplicates.
+func (r *Registry) GaugeFunc(name, help string, fn func() float64, labels ...Label) (unregister func()) {
+	return r.addFunc(name, help, TypeGauge, fn, labels)
+}
+
+func (r *Registry) addFunc(name, help string, typ Type, fn func() float64, labels []Label) func() {
+	f := &metricFunc{fn: fn}
+	r.mu.Lock()
+	m := r.getOrCreateLocked(name, help, typ, labels, func(m *metric) {})
+	m.funcs = append(m.funcs, f)
+	r.mu.Unlock()
+	return func() {
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for i, g := range m.funcs {
+			if g == f {
+				m.funcs = append(m.funcs[:i:i], m.funcs[i+1:]...)
+				// 最后一个函数注销后不再报告这个指标
+				if fam, ok := r.families[name]; ok && len(m.funcs) == 0 && fam.metrics[labelsKey(labels)] == m {
+					r.remove(name, labels)
+				}
+				return
+			}
+		}
+	}
+}
+
+// Remove deletes the metric with the given name and labels, e.g. the one of a stopped event loop.
+// The Counters, Gauges and Histograms got before keep working but they aren't reported anymore.
+func (r *Registry) Remove(name string, labels ...Label) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.remove(name, labels)
+}
+
+func (r *Registry) remove(name string, labels []Label) {
+	f, ok := r.families[name]
+	if !ok {
+		return
+	}
+	delete(f.metrics, labelsKey(labels))
+	if len(f.metrics) == 0 {
+		delete(r.families, name)
+	}
+}
+
+// Has reports whether a metric with the given name has been registered.
+func (r *Registry) Has(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	_, ok := r.families[name]
+	return ok
+}
+
+func (r *Registry) getOrCreate(name, help string, typ Type, labels []Label, init func(m *metric)) *metric {
+	key := labelsKey(labels)
+	r.mu.RLock()
+	if f, ok := r.families[name]; ok && f.typ == typ {
+		if m, ok := f.metrics[key]; ok {
+			r.mu.RUnlock()
+			return m
+		}
+	}
+	r.mu.RUnlock()
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.getOrCreateLocked(name, help, typ, labels, init)
+}
+
+func (r *Registry) getOrCreateLocked(name, help string, typ Type, labels []Label, init func(m *metric)) *metric {
+	key := labelsKey(labels)
+	f, ok := r.families[name]
+	if !ok {
+		f = &family{name: name, help: help, typ: typ, metrics: make(map[string]*metric)}
+		r.families[name] = f
+	} else if f.typ != typ {
+		panic(fmt.Sprintf("metrics: %s is registered as a %s, not a %s", name, f.typ, typ))
+	}
+	m, ok := f.metrics[key]
+	if !ok {
+		m = &metric{labels: append([]Label(nil), labels...)}
+		init(m)
+		f.metrics[key] = m
+	}
+	return m
+}
+
+// Snapshot returns the current values of all the metrics, sorted by name and labels.
+func (r *Registry) Snapshot() []Family {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	families := make([]Family, 0, len(r.families))
+	for _, f := range r.families {
+		keys := make([]string, 0, len(f.metrics))
+		for key := range f.metrics {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		fam := Family{Name: f.name, Help: f.help, Type: f.typ, Samples: make([]Sample, 0, len(keys))}
+		for _, key := range keys {
+			m := f.metrics[key]
+			s := Sample{Labels: m.labels}
+			if m.histogram != nil {
+				hs := m.histogram.Snapshot()
+				s.Histogram = &hs
+			} else {
+				s.Value = m.value()
+			}
+			fam.Samples = append(fam.Samples, s)
+		}
+		families = append(families, fam)
+	}
+	sort.Slice(families, func(i, j int) bool { return families[i].Name < families[j].Name })
+	return families
+}
+
+func labelsKey(labels []Label) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	for _, l := range labels {
+		sb.WriteString(l.Name)
+		sb.WriteByte(0)
+		sb.WriteString(l.Value)
+		sb.WriteByte(0)
+	}
+	return sb.String()
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry_WritePrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("conns_total", "Number of conns.").Add(3)
+	r.Gauge("active", "Active conns.", Label{Name: "loop", Value: "1"}).Set(2)
+	r.Gauge("active", "", Label{Name: "loop", Value: "0"}).Inc()
+	r.CounterFunc("calls_total", "Calls.", func() uint64 { return 4 }, Label{Name: "syscall", Value: "read"})
+	r.CounterFunc("calls_total", "Calls.", func() uint64 { return 6 }, Label{Name: "syscall", Value: "read"})
+	h := r.Histogram("latency_seconds", "Latency.", []float64{0.1, 1})
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.Observe(5)
+
+	var buf bytes.Buffer
+	assert.NoError(t, r.WritePrometheus(&buf))
+	assert.Equal(t, `# HELP active Active conns.
+# TYPE active gauge
+active{loop="0"} 1
+active{loop="1"} 2
+# HELP calls_total Calls.
+# TYPE calls_total counter
+calls_total{syscall="read"} 10
+# HELP conns_total Number of conns.
+# TYPE conns_total counter
+conns_total 3
+# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 1
+latency_seconds_bucket{le="1"} 2
+latency_seconds_bucket{le="+Inf"} 3
+latency_seconds_sum 5.55
+latency_seconds_count 3
+`, buf.String())
+}
+
+func TestRegistry_SameMetric(t *testing.T) {
+	r := NewRegistry()
+	c := r.Counter("c", "", Label{Name: "a", Value: "b"})
+	assert.Same(t, c, r.Counter("c", "", Label{Name: "a", Value: "b"}))
+	assert.NotSame(t, c, r.Counter("c", ""))
+	assert.Panics(t, func() { r.Gauge("c", "") })
+}
+
+func TestRegistry_Remove(t *testing.T) {
+	r := NewRegistry()
+	label := Label{Name: "loop", Value: "0"}
+	r.Gauge("active", "", label).Set(1)
+	unregister1 := r.CounterFunc("calls", "", func() uint64 { return 1 })
+	unregister2 := r.CounterFunc("calls", "", func() uint64 { return 2 })
+
+	var buf bytes.Buffer
+	assert.NoError(t, r.WritePrometheus(&buf))
+	assert.Contains(t, buf.String(), "active{loop=\"0\"} 1\n")
+	assert.Contains(t, buf.String(), "calls 3\n")
+
+	r.Remove("active", label)
+	unregister1()
+	buf.Reset()
+	assert.NoError(t, r.WritePrometheus(&buf))
+	assert.NotContains(t, buf.String(), "active")
+	assert.Contains(t, buf.String(), "calls 2\n")
+
+	unregister2()
+	buf.Reset()
+	assert.NoError(t, r.WritePrometheus(&buf))
+	assert.Empty(t, buf.String())
+	r.Remove("missing")
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("escaped", "a \\ b\nc", Label{Name: "v", Value: "\"q\"\n"}).Inc()
+
+	w := httptest.NewRecorder()
+	Handler(r).ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, ContentType, w.Header().Get("Content-Type"))
+	assert.Equal(t, "# HELP escaped a \\\\ b\\nc\n# TYPE escaped counter\nescaped{v=\"\\\"q\\\"\\n\"} 1\n", w.Body.String())
+}
@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the content type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// WritePrometheus writes all the metrics in the Prometheus text exposition format.
+func (r *Registry) WritePrometheus(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range r.Snapshot() {
+		if f.Help != "" {
+			bw.WriteString("# HELP ")
+			bw.WriteString(f.Name)
+			bw.WriteByte(' ')
+			bw.WriteString(helpEscaper.Replace(f.Help))
+			bw.WriteByte('\n')
+		}
+		bw.WriteString("# TYPE ")
+		bw.WriteString(f.Name)
+		bw.WriteByte(' ')
+		bw.WriteString(f.Type.String())
+		bw.WriteByte('\n')
+
+		for _, s := range f.Samples {
+			if s.Histogram == nil {
+				writeSample(bw, f.Name, s.Labels, nil, s.Value)
+				continue
+			}
+			for _, b := range s.Histogram.Buckets {
+				le := &Label{Name: "le", Value: formatFloat(b.UpperBound)}
+				writeSample(bw, f.Name+"_bucket", s.Labels, le, float64(b.Count))
+			}
+			writeSample(bw, f.Name+"_sum", s.Labels, nil, s.Histogram.Sum)
+			writeSample(bw, f.Name+"_count", s.Labels, nil, float64(s.Histogram.Count))
+		}
+	}
+	return bw.Flush()
+}
+
+// Handler returns an http.Handler which serves the metrics of r in the Prometheus text exposition format.
+func Handler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", ContentType)
+		_ = r.WritePrometheus(w)
+	})
+}
+
+func writeSample(w *bufio.Writer, name string, labels []Label, extra *Label, v float64) {
+	w.WriteString(name)
+	if len(labels) > 0 || extra != nil {
+		w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, l)
+		}
+		if extra != nil {
+			if len(labels) > 0 {
+				w.WriteByte(',')
+			}
+			writeLabel(w, *extra)
+		}
+		w.WriteByte('}')
+	}
+	w.WriteByte(' ')
+	w.WriteString(formatFloat(v))
+	w.WriteByte('\n')
+}
+
+func writeLabel(w *bufio.Writer, l Label) {
+	w.WriteString(l.Name)
+	w.WriteString(`="`)
+	w.WriteString(labelEscaper.Replace(l.Value))
+	w.WriteByte('"')
+}
+
+var (
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+	labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,65 @@
+package haijun_net
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Ccheers/haijun-net/metrics"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHjListener_Metrics(t *testing.T) {
+	l := serveTest(t, &echoHandler{})
+	echoRoundTrip(t, l.Addr(), "hello", 2)
+
+	em := l.manager.metrics
+	assert.Eventually(t, func() bool { return em.closed.Value() == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.EqualValues(t, 1, em.accepted.Value())
+	assert.EqualValues(t, 10, em.readBytes.Value())
+	assert.EqualValues(t, 10, em.writtenBytes.Value())
+	assert.EqualValues(t, 0, em.outboundBytes.Value())
+	assert.EqualValues(t, 0, l.manager.loopMetrics.activeConns.Value())
+
+	var buf bytes.Buffer
+	require.NoError(t, l.Metrics().WritePrometheus(&buf))
+	for _, line := range []string{
+		"haijun_conns_accepted_total 1",
+		`haijun_syscalls_total{syscall="writev"} 2`,
+		fmt.Sprintf(`haijun_conns_active{loop="%d"} 0`, l.manager.idx),
+		`haijun_buffer_pool_gets_total{pool="ringbuffer",result="hit"}`,
+		`haijun_buffer_pool_discards_total{pool="ringbuffer"}`,
+		fmt.Sprintf(`haijun_loop_iteration_seconds_count{loop="%d"}`, l.manager.idx),
+	} {
+		assert.True(t, strings.Contains(buf.String(), line), "missing %q", line)
+	}
+}
+
+func TestHjListener_MetricsRemovedOnClose(t *testing.T) {
+	r := metrics.NewRegistry()
+	l1 := serveTest(t, &echoHandler{}, WithMetrics(r))
+	l2 := serveTest(t, &echoHandler{}, WithMetrics(r))
+	assert.NotEqual(t, l1.manager.idx, l2.manager.idx, "the loops sharing a registry have their own series")
+
+	write := func() string {
+		var buf bytes.Buffer
+		require.NoError(t, r.WritePrometheus(&buf))
+		return buf.String()
+	}
+	loop1 := fmt.Sprintf(`haijun_conns_active{loop="%d"}`, l1.manager.idx)
+	loop2 := fmt.Sprintf(`haijun_conns_active{loop="%d"}`, l2.manager.idx)
+	assert.Contains(t, write(), loop1)
+	assert.Contains(t, write(), loop2)
+
+	require.NoError(t, l1.Close())
+	assert.Eventually(t, func() bool { return !strings.Contains(write(), loop1) }, 5*time.Second, 10*time.Millisecond)
+	assert.Contains(t, write(), loop2)
+	require.NoError(t, l2.Close())
+	assert.Eventually(t, func() bool {
+		out := write()
+		return !strings.Contains(out, loop2) && !strings.Contains(out, `syscall="epoll_wait"`)
+	}, 5*time.Second, 10*time.Millisecond, "the poller syscalls are unregistered")
+}
@@ -0,0 +1,84 @@
+package haijun_net
+
+import "net"
+
+// Observer receives the lifecycle and I/O events of the conns, it's meant for tracing and auditing,
+// such as starting a span on accept and ending it on close.
+//
+// The I/O hooks OnReadable, OnRead, OnFlush and OnEAGAIN are called on the event loop goroutine.
+// The others are called on the goroutine causing the event:
+//   - OnAccept and OnRegister on the goroutine accepting the conn, that is the caller of Serve or Accept,
+//     or a goroutine of the listener when Accept holds the conns until their first bytes arrive;
+//   - OnWriteQueued on the goroutine calling Write;
+//   - OnClose on the goroutine closing the conn, that is the event loop when the conn is closed by the peer,
+//     by a timeout or by an error, and the caller of Close otherwise, e.g. a handler on the worker pool;
+//   - OnError on the event loop, or on the worker pool for the panics recovered there.
+//
+// So the hooks of one conn may run concurrently, the implementations must be safe for concurrent use.
+// They must return quickly and must not block, any work that takes time should be handed over to another
+// goroutine. The hooks are never called while the conn is locked, so it's safe to call c.Stats in them.
+//
+// Nothing is called and nothing is allocated for the hooks when Options.Observer is nil.
+type Observer interface {
+	// OnAccept fires when a new conn has been accepted, before the HjConn is created.
+	OnAccept(fd int, remoteAddr net.Addr)
+
+	// OnRegister fires when the conn has been registered to the poller of the event loop, the loop may
+	// already be handling its events.
+	OnRegister(c *HjConn)
+
+	// OnReadable fires when the poller reports that the conn is readable.
+	OnReadable(c *HjConn)
+
+	// OnRead fires when n bytes have been read from the socket into the inbound buffer.
+	OnRead(c *HjConn, n int)
+
+	// OnWriteQueued fires when n bytes have been appended to the outbound buffer by Write.
+	OnWriteQueued(c *HjConn, n int)
+
+	// OnFlush fires when n bytes of the outbound buffer have been written to the socket,
+	// pending is the number of bytes still waiting in the buffer.
+	OnFlush(c *HjConn, n, pending int)
+
+	// OnEAGAIN fires when a read or a write of the socket returns EAGAIN, op is "read" or "write".
+	OnEAGAIN(c *HjConn, op string)
+
+	// OnClose fires when the conn has been closed, reason is nil when it was closed by the peer or locally.
+	// Unlike EventHandler.OnClose, it isn't deferred to the event loop.
+	OnClose(c *HjConn, reason error)
+
+	// OnError fires when an error that can't be returned to the caller occurs, c is nil when
+	// the error isn't bound to a conn, such as a failure of the poller.
+	OnError(c *HjConn, err error)
+}
+
+// BuiltinObserver is a built-in implementation for Observer which does nothing, you can compose it with
+// your own implementation of Observer when you only care about some of the events.
+type BuiltinObserver struct{}
+
+// OnAccept fires when a new conn has been accepted.
+func (*BuiltinObserver) OnAccept(_ int, _ net.Addr) {}
+
+// OnRegister fires when the conn has been registered to the poller.
+func (*BuiltinObserver) OnRegister(_ *HjConn) {}
+
+// OnReadable fires when the conn is readable.
+func (*BuiltinObserver) OnReadable(_ *HjConn) {}
+
+// OnRead fires when bytes have been read from the socket.
+func (*BuiltinObserver) OnRead(_ *HjConn, _ int) {}
+
+// OnWriteQueued fires when bytes have been appended to the outbound buffer.
+func (*BuiltinObserver) OnWriteQueued(_ *HjConn, _ int) {}
+
+// OnFlush fires when bytes have been written to the socket.
+func (*BuiltinObserver) OnFlush(_ *HjConn, _, _ int) {}
+
+// OnEAGAIN fires when a read or a write of the socket returns EAGAIN.
+func (*BuiltinObserver) OnEAGAIN(_ *HjConn, _ string) {}
+
+// OnClose fires when the conn has been closed.
+func (*BuiltinObserver) OnClose(_ *HjConn, _ error) {}
+
+// OnError fires when an error occurs.
+func (*BuiltinObserver) OnError(_ *HjConn, _ error) {}
@@ -0,0 +1,85 @@
+package haijun_net
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordObserver struct {
+	BuiltinObserver
+
+	mu     sync.Mutex
+	events map[string]int
+	read   int
+	queued int
+	flush  int
+}
+
+func (r *recordObserver) record(event string) {
+	r.mu.Lock()
+	if r.events == nil {
+		r.events = make(map[string]int)
+	}
+	r.events[event]++
+	r.mu.Unlock()
+}
+
+func (r *recordObserver) count(event string) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.events[event]
+}
+
+func (r *recordObserver) OnAccept(_ int, _ net.Addr) { r.record("accept") }
+func (r *recordObserver) OnRegister(_ *HjConn)       { r.record("register") }
+func (r *recordObserver) OnReadable(_ *HjConn)       { r.record("readable") }
+func (r *recordObserver) OnClose(_ *HjConn, _ error) { r.record("close") }
+
+func (r *recordObserver) OnRead(c *HjConn, n int) {
+	r.mu.Lock()
+	r.read += n
+	r.mu.Unlock()
+}
+
+func (r *recordObserver) OnWriteQueued(c *HjConn, n int) {
+	r.mu.Lock()
+	r.queued += n
+	r.mu.Unlock()
+}
+
+func (r *recordObserver) OnFlush(c *HjConn, n, _ int) {
+	// 钩子调用时连接未加锁
+	_ = c.Stats()
+	r.mu.Lock()
+	r.flush += n
+	r.mu.Unlock()
+}
+
+func TestWithObserver(t *testing.T) {
+	o := &recordObserver{}
+	l := serveTest(t, &echoHandler{}, WithObserver(o))
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+
+	_, err = c.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(c, make([]byte, 5))
+	require.NoError(t, err)
+	require.NoError(t, c.Close())
+
+	assert.Eventually(t, func() bool { return o.count("close") == 1 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 1, o.count("accept"))
+	assert.Equal(t, 1, o.count("register"))
+	assert.GreaterOrEqual(t, o.count("readable"), 2)
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	assert.Equal(t, 5, o.read)
+	assert.Equal(t, 5, o.queued)
+	assert.Equal(t, 5, o.flush)
+}
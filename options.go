@@ -0,0 +1,331 @@
+package haijun_net
+
+import (
+	"crypto/tls"
+	"time"
+
+	"github.com/Ccheers/haijun-net/internal/pkg/ringbuffer"
+	"github.com/Ccheers/haijun-net/metrics"
+)
+
+// Option is a function that will set up options.
+type Option func(opts *Options)
+
+// Options are configurations for the listener and the conns it accepts.
+type Options struct {
+	// WorkerPoolSize is the maximum number of goroutines running the event callbacks,
+	// the callbacks run on the event loop directly when it is zero.
+	// The callbacks of one conn never run concurrently, no matter how large the pool is.
+	WorkerPoolSize int
+
+	// WorkerQueueSize is the number of callbacks that can wait for an idle worker.
+	WorkerQueueSize int
+
+	// WorkerIdleTimeout is how long an idle worker lives before it exits.
+	WorkerIdleTimeout time.Duration
+
+	// ErrorHandler receives the errors that can't be returned to the caller, such as the panics recovered
+	// from the event loops and the callbacks (as *PanicError) and the failures of the pollers.
+	// The errors are logged by Logger at the error level when it is nil.
+	ErrorHandler func(err error)
+
+	// PanicPolicy decides whether a panic is recovered or crashes the process.
+	PanicPolicy PanicPolicy
+
+	// Logger is the logger of the engine, nothing is logged when it is nil.
+	Logger Logger
+
+	// Metrics is the registry the engine reports its metrics into, a new registry is created when it is nil,
+	// several listeners can share one registry to aggregate their metrics.
+	Metrics *metrics.Registry
+
+	// IdleTimeout is how long a conn lives without any read or write, the idle conns are closed with
+	// ErrIdleTimeout. The conns never time out when it is zero.
+	IdleTimeout time.Duration
+
+	// Heartbeat probes the conns which are silent for a while, see Heartbeat.
+	Heartbeat *Heartbeat
+
+	// FirstByteTimeout is how long a new conn may take to send its first bytes, the conns sending nothing
+	// in time are closed with ErrFirstByteTimeout. When it or MinReadRate is set, the engine holds the new
+	// conns until their first bytes arrive instead of handing them to Accept or OnOpen immediately,
+	// so it must not be used with the protocols where the server speaks first.
+	FirstByteTimeout time.Duration
+
+	// MinReadRate is the minimum rate the clients must send at while a request is being received, that is
+	// before the conn is handed to Accept or OnOpen, or while OnTraffic leaves an incomplete request in
+	// the inbound buffer. The rate is checked every MinReadRate.Interval and the slower conns are closed
+	// with ErrReadTooSlow.
+	MinReadRate *ReadRate
+
+	// ConnReadLimit and ConnWriteLimit are the bandwidth of each conn, they can be changed at runtime
+	// by HjConn.SetReadLimit and HjConn.SetWriteLimit.
+	ConnReadLimit  Limit
+	ConnWriteLimit Limit
+
+	// ReadBucket and WriteBucket are the bandwidth shared by all the conns, a bucket may be shared by
+	// several listeners too, its limit can be changed at runtime by TokenBucket.SetLimit.
+	// The event loop stops polling the conns for readable while the inbound bucket is empty,
+	// and defers flushing the conns while the outbound bucket is empty.
+	ReadBucket  *TokenBucket
+	WriteBucket *TokenBucket
+
+	// ReadBufferSize is the normal size of the inbound buffer of each conn, it's 64KB when it is zero.
+	// The buffer is allocated smaller according to the traffic observed on the conn, and grows up to
+	// ReadBufferSize when it is full.
+	ReadBufferSize int
+
+	// MaxReadBufferSize is the size up to which the inbound buffer grows when it is full, so that a frame
+	// larger than ReadBufferSize can be buffered whole, the buffer doesn't grow when it isn't larger than
+	// ReadBufferSize. The event loop stops polling a conn for readable while its inbound buffer is full
+	// and resumes once the application consumes some data.
+	MaxReadBufferSize int
+
+	// MemoryBudget limits the bytes held by the buffers of the conns, a budget may be shared by several
+	// listeners to bound the memory of the whole process, nil means unlimited. The event loop defers reading
+	// the conns while the budget is exhausted, and Write returns ErrMemoryBudget.
+	// The buffers are allocated on the first use and released when they are drained, so an idle conn
+	// costs no buffer at all.
+	MemoryBudget *MemoryBudget
+
+	// Observer receives the lifecycle and I/O events of the conns, see Observer.
+	Observer Observer
+
+	// TLSConfig makes the listener terminate TLS, the conns are handed to Accept or OnOpen once their
+	// handshakes complete, and the data read and written by the application is plaintext. ALPN is negotiated
+	// by NextProtos, the certificate is selected by SNI among Certificates, or by GetCertificate such as
+	// CertStore.GetCertificate, and the sessions are resumed by the session tickets unless they are disabled.
+	// The config mustn't be modified after the listener is created.
+	TLSConfig *tls.Config
+
+	// TLSHandshakeTimeout is how long a TLS handshake may take, the conns not done in time are closed with
+	// ErrTLSHandshakeTimeout. It's 10 seconds when it is zero.
+	TLSHandshakeTimeout time.Duration
+
+	// MaxTLSHandshakes is the number of TLS handshakes running at once, each of them takes a goroutine since
+	// crypto/tls can't suspend a handshake. The handshakes beyond it wait for a running one to finish, their
+	// ciphertext is buffered meanwhile and TLSHandshakeTimeout still applies. It's 1024 when it is zero.
+	MaxTLSHandshakes int
+
+	// KernelTLS installs the session keys of the TLS conns into the kernel (kTLS) once their handshakes
+	// complete, the kernel then encrypts the data sent by writev, and decrypts the data received if crypto/tls
+	// holds no record read ahead. It needs the tls module of Linux and a cipher suite of AES-GCM or
+	// ChaCha20-Poly1305, the conns stay in userspace otherwise, see the metric haijun_ktls_conns_total.
+	// The keys are captured by the KeyLogWriter of a copy of TLSConfig, so they can't be captured if
+	// GetConfigForClient returns another config, such conns are counted as no_keys. A TLS 1.3 KeyUpdate
+	// from the peer closes the conn when the kernel decrypts, and so does one requesting an update in
+	// return when only the kernel encrypts, since the keys held by the kernel can't be updated.
+	KernelTLS bool
+
+	// UDPLoops is the number of event loops serving the address bound by ListenUDP, each loop polls its own
+	// socket bound to the address with SO_REUSEPORT, and the kernel spreads the datagrams among the sockets
+	// by the hash of their addresses. It's 1 when it is zero.
+	UDPLoops int
+
+	// UDPBatchSize is the number of datagrams read by one recvmmsg in the event-driven mode of HjPacketConn,
+	// their buffers are taken from the byte slice pool for each wakeup and put back after the handler
+	// returns. It's 32 when it is zero, and 1 reads the datagrams one by one with recvfrom.
+	UDPBatchSize int
+}
+
+func loadOptions(options ...Option) *Options {
+	opts := new(Options)
+	for _, option := range options {
+		option(opts)
+	}
+	if opts.Logger == nil {
+		opts.Logger = nopLogger{}
+	}
+	if opts.Metrics == nil {
+		opts.Metrics = metrics.NewRegistry()
+	}
+	if hb := opts.Heartbeat; hb != nil && hb.Timeout <= 0 {
+		// 超时为 0 会在发出 ping 后立即关闭连接
+		heartbeat := *hb
+		heartbeat.Timeout = heartbeat.Interval
+		opts.Heartbeat = &heartbeat
+	}
+	return opts
+}
+
+// WithOptions sets up all options.
+func WithOptions(options Options) Option {
+	return func(opts *Options) {
+		*opts = options
+	}
+}
+
+// WithWorkerPool makes the engine dispatch the event callbacks to a bounded goroutine pool,
+// so that a blocking handler won't stall the event loop.
+func WithWorkerPool(size, queueSize int) Option {
+	return func(opts *Options) {
+		opts.WorkerPoolSize = size
+		opts.WorkerQueueSize = queueSize
+	}
+}
+
+// WithWorkerIdleTimeout sets up the duration after which an idle worker exits.
+func WithWorkerIdleTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.WorkerIdleTimeout = timeout
+	}
+}
+
+// WithErrorHandler sets up the handler of the errors reported by the event loops.
+func WithErrorHandler(handler func(err error)) Option {
+	return func(opts *Options) {
+		opts.ErrorHandler = handler
+	}
+}
+
+// WithPanicPolicy sets up the panic policy.
+func WithPanicPolicy(policy PanicPolicy) Option {
+	return func(opts *Options) {
+		opts.PanicPolicy = policy
+	}
+}
+
+// WithLogger sets up the logger, see NewStdLogger, NewSugaredLogger and NewFormatLogger for the adapters.
+func WithLogger(logger Logger) Option {
+	return func(opts *Options) {
+		opts.Logger = logger
+	}
+}
+
+// WithIdleTimeout sets up the duration after which the idle conns are closed.
+func WithIdleTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.IdleTimeout = timeout
+	}
+}
+
+// WithHeartbeat sets up the application-level heartbeat of the conns, NewHjListener fails when
+// heartbeat has no Ping or no Interval.
+func WithHeartbeat(heartbeat Heartbeat) Option {
+	return func(opts *Options) {
+		opts.Heartbeat = &heartbeat
+	}
+}
+
+// WithFirstByteTimeout sets up the duration within which the new conns must send their first bytes.
+func WithFirstByteTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.FirstByteTimeout = timeout
+	}
+}
+
+// WithMinReadRate sets up the minimum rate of the clients sending a request, bytes per interval.
+func WithMinReadRate(bytes int, interval time.Duration) Option {
+	return func(opts *Options) {
+		opts.MinReadRate = &ReadRate{Bytes: bytes, Interval: interval}
+	}
+}
+
+// WithConnBandwidth sets up the bandwidth of each conn, a zero Rate means unlimited.
+func WithConnBandwidth(read, write Limit) Option {
+	return func(opts *Options) {
+		opts.ConnReadLimit = read
+		opts.ConnWriteLimit = write
+	}
+}
+
+// WithBandwidth sets up the bandwidth shared by all the conns, a nil bucket means unlimited.
+func WithBandwidth(read, write *TokenBucket) Option {
+	return func(opts *Options) {
+		opts.ReadBucket = read
+		opts.WriteBucket = write
+	}
+}
+
+// WithReadBuffer sets up the normal and the maximum size of the inbound buffer of each conn.
+func WithReadBuffer(size, maxSize int) Option {
+	return func(opts *Options) {
+		opts.ReadBufferSize = size
+		opts.MaxReadBufferSize = maxSize
+	}
+}
+
+func (o *Options) readBufferSize() int {
+	if o.ReadBufferSize > 0 {
+		return o.ReadBufferSize
+	}
+	return ringbuffer.MaxStreamBufferCap
+}
+
+// growReadBuffer returns the size the full inbound buffer of size grows to, or zero when it can't grow.
+func (o *Options) growReadBuffer(size int) int {
+	max := o.MaxReadBufferSize
+	if n := o.readBufferSize(); n > max {
+		max = n
+	}
+	if size >= max {
+		return 0
+	}
+	if size *= 2; size > max {
+		size = max
+	}
+	return size
+}
+
+// WithMemoryBudget sets up the budget of the bytes held by the buffers of the conns, a nil budget means unlimited.
+func WithMemoryBudget(budget *MemoryBudget) Option {
+	return func(opts *Options) {
+		opts.MemoryBudget = budget
+	}
+}
+
+// WithObserver sets up the observer of the conns, see Observer.
+func WithObserver(observer Observer) Option {
+	return func(opts *Options) {
+		opts.Observer = observer
+	}
+}
+
+// WithMetrics sets up the registry of the metrics, see metrics.Handler for exposing it.
+func WithMetrics(registry *metrics.Registry) Option {
+	return func(opts *Options) {
+		opts.Metrics = registry
+	}
+}
+
+// WithTLS makes the listener terminate TLS with config, see Options.TLSConfig.
+func WithTLS(config *tls.Config) Option {
+	return func(opts *Options) {
+		opts.TLSConfig = config
+	}
+}
+
+// WithTLSHandshakeTimeout sets up the duration within which the TLS handshakes must complete.
+func WithTLSHandshakeTimeout(timeout time.Duration) Option {
+	return func(opts *Options) {
+		opts.TLSHandshakeTimeout = timeout
+	}
+}
+
+// WithMaxTLSHandshakes sets up the number of TLS handshakes running at once, see Options.MaxTLSHandshakes.
+func WithMaxTLSHandshakes(n int) Option {
+	return func(opts *Options) {
+		opts.MaxTLSHandshakes = n
+	}
+}
+
+// WithUDPLoops sets up the number of event loops serving a UDP address, see Options.UDPLoops.
+func WithUDPLoops(n int) Option {
+	return func(opts *Options) {
+		opts.UDPLoops = n
+	}
+}
+
+// WithUDPBatchSize sets up the number of datagrams read by one recvmmsg, see Options.UDPBatchSize.
+func WithUDPBatchSize(n int) Option {
+	return func(opts *Options) {
+		opts.UDPBatchSize = n
+	}
+}
+
+// WithKernelTLS offloads the TLS conns to the kernel after their handshakes, see Options.KernelTLS.
+func WithKernelTLS() Option {
+	return func(opts *Options) {
+		opts.KernelTLS = true
+	}
+}
@@ -0,0 +1,107 @@
+package haijun_net
+
+import (
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/Ccheers/haijun-net/internal/poller"
+)
+
+// PanicPolicy decides what happens when an event loop or an event callback panics.
+type PanicPolicy int
+
+const (
+	// PanicPolicyRecover recovers the panic, closes the offending conn, reports a *PanicError
+	// to the error handler and keeps the event loop running, it's the default policy.
+	PanicPolicyRecover PanicPolicy = iota
+
+	// PanicPolicyCrash lets the panic crash the process, it's meant for debug builds.
+	PanicPolicyCrash
+)
+
+const (
+	minRestartBackoff = 10 * time.Millisecond
+	maxRestartBackoff = time.Second
+)
+
+// PanicError is reported to the error handler when a panic is recovered from an event loop or an event callback.
+type PanicError struct {
+	// Value is the value passed to panic.
+	Value interface{}
+	// Stack is the stack of the goroutine that panicked.
+	Stack []byte
+	// Conn is the conn being processed when the panic happened, it's nil if the panic is not related to a conn.
+	Conn *HjConn
+}
+
+func (e *PanicError) Error() string {
+	if e.Conn != nil {
+		return fmt.Sprintf("panic on conn %d: %v\n%s", e.Conn.fd, e.Value, e.Stack)
+	}
+	return fmt.Sprintf("panic: %v\n%s", e.Value, e.Stack)
+}
+
+// reportError hands err to the error handler of the options.
+func reportError(opts *Options, err error) {
+	if opts.Observer != nil {
+		var conn *HjConn
+		if pe, ok := err.(*PanicError); ok {
+			conn = pe.Conn
+		}
+		opts.Observer.OnError(conn, err)
+	}
+	if opts.ErrorHandler != nil {
+		opts.ErrorHandler(err)
+		return
+	}
+	opts.Logger.Error("event loop error", "error", err)
+}
+
+// supervise runs loop and restarts it after it panics or fails, until stopped reports true.
+// A failed loop reopens the poller before restarting, since the epoll fd may be broken.
+// fields are the key-value pairs identifying the loop in the logs.
+func supervise(opts *Options, p poller.Poller, loop func() error, stopped func() bool, fields ...interface{}) {
+	backoff := minRestartBackoff
+	for {
+		start := time.Now()
+		err := runSupervised(opts, loop)
+		if stopped() {
+			return
+		}
+		if err == nil {
+			return
+		}
+		if opts.PanicPolicy == PanicPolicyCrash {
+			panic(err)
+		}
+		reportError(opts, err)
+		if _, ok := err.(*PanicError); !ok {
+			if err := p.Reopen(); err != nil {
+				reportError(opts, err)
+			}
+		}
+
+		// 循环稳定运行过一段时间后重置退避时间
+		if time.Since(start) > maxRestartBackoff {
+			backoff = minRestartBackoff
+		}
+		opts.Logger.Warn("restart event loop", append(fields, "backoff", backoff)...)
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > maxRestartBackoff {
+			backoff = maxRestartBackoff
+		}
+	}
+}
+
+func runSupervised(opts *Options, loop func() error) (err error) {
+	if opts.PanicPolicy == PanicPolicyCrash {
+		return loop()
+	}
+	defer func() {
+		if v := recover(); v != nil {
+			err = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	return loop()
+}
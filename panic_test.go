@@ -0,0 +1,84 @@
+package haijun_net
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type panicHandler struct {
+	echoHandler
+}
+
+func (h *panicHandler) OnTraffic(c *HjConn) Action {
+	head, _ := c.Peek(5)
+	if string(head) == "panic" {
+		panic("boom")
+	}
+	return h.echoHandler.OnTraffic(c)
+}
+
+func TestConnManager_RecoverPanic(t *testing.T) {
+	for _, opts := range [][]Option{nil, {WithWorkerPool(4, 16)}} {
+		errs := make(chan error, 4)
+		opts = append(opts, WithErrorHandler(func(err error) { errs <- err }))
+		l := serveTest(t, &panicHandler{}, opts...)
+
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		_, err = c.Write([]byte("panic"))
+		require.NoError(t, err)
+
+		select {
+		case err := <-errs:
+			pe, ok := err.(*PanicError)
+			require.True(t, ok, "unexpected error %v", err)
+			assert.Equal(t, "boom", pe.Value)
+			assert.NotEmpty(t, pe.Stack)
+			assert.NotNil(t, pe.Conn)
+		case <-time.After(5 * time.Second):
+			t.Fatal("panic is not reported")
+		}
+		// 只关闭出问题的连接，其他连接不受影响
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = c.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err)
+		_ = c.Close()
+
+		echoRoundTrip(t, l.Addr(), "hello", 2)
+	}
+}
+
+func TestConnManager_RestartLoop(t *testing.T) {
+	errs := make(chan error, 4)
+	l := serveTest(t, &echoHandler{}, WithErrorHandler(func(err error) { errs <- err }))
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("ping"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(c, make([]byte, 4))
+	require.NoError(t, err)
+
+	// 关闭 epoll fd 模拟 poller 故障，事件循环应当重建 poller 并继续服务已有的连接
+	require.NoError(t, l.manager.poller.Close())
+	select {
+	case err := <-errs:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("poller failure is not reported")
+	}
+
+	require.NoError(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+	_, err = c.Write([]byte("pong"))
+	require.NoError(t, err)
+	buf := make([]byte, 4)
+	_, err = io.ReadFull(c, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(buf))
+}
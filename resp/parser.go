@@ -0,0 +1,424 @@
+package resp
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/Ccheers/haijun-net/codec"
+)
+
+// DefaultLimits are the limits used for the zero fields of Parser.Limits, they follow the defaults of Redis.
+var DefaultLimits = Limits{
+	MaxBulkLength:   512 << 20, // 512MB
+	MaxArrayLength:  1 << 20,
+	MaxDepth:        32,
+	MaxInlineLength: 64 << 10, // 64KB
+}
+
+// Limits bound the values accepted by the parser, so that a peer can't make it buffer unbounded data.
+type Limits struct {
+	// MaxBulkLength is the max length of a bulk string.
+	MaxBulkLength int
+	// MaxArrayLength is the max number of elements of an aggregate value, or of the args of a command.
+	MaxArrayLength int
+	// MaxDepth is the max nesting depth of the aggregate values.
+	MaxDepth int
+	// MaxInlineLength is the max length of an inline command or of a line of a simple value.
+	MaxInlineLength int
+}
+
+// maxHeaderLength is the max length of the line of a length, e.g. "*3" or "$5".
+const maxHeaderLength = 32
+
+// Parser parses RESP values and commands in place, the zero Parser uses DefaultLimits.
+// It's safe for concurrent use.
+type Parser struct {
+	Limits Limits
+}
+
+func (p *Parser) limits() Limits {
+	l := p.Limits
+	if l.MaxBulkLength <= 0 {
+		l.MaxBulkLength = DefaultLimits.MaxBulkLength
+	}
+	if l.MaxArrayLength <= 0 {
+		l.MaxArrayLength = DefaultLimits.MaxArrayLength
+	}
+	if l.MaxDepth <= 0 {
+		l.MaxDepth = DefaultLimits.MaxDepth
+	}
+	if l.MaxInlineLength <= 0 {
+		l.MaxInlineLength = DefaultLimits.MaxInlineLength
+	}
+	return l
+}
+
+// Parse parses the next value of the data split into segs, e.g. the head and the tail returned by
+// HjConn.Peek. It returns the value and the number of bytes it takes, or codec.ErrIncomplete when the
+// value isn't complete. The strings of the value reference segs unless they span two segments.
+func (p *Parser) Parse(segs ...[]byte) (v Value, n int, err error) {
+	c := cursor{segs: segs}
+	l := p.limits()
+	v, err = c.value(&l, 0)
+	if err != nil {
+		return Value{}, 0, err
+	}
+	return v, c.n, nil
+}
+
+// ParseCommand parses the next command of the data split into segs, which is a multi-bulk array of
+// bulk strings, or an inline command whose args are separated by spaces. It appends the args to dst
+// and returns them with the number of bytes the command takes, or codec.ErrIncomplete. The args
+// reference segs unless they span two segments. An empty command has no args.
+func (p *Parser) ParseCommand(dst [][]byte, segs ...[]byte) (args [][]byte, n int, err error) {
+	c := cursor{segs: segs}
+	l := p.limits()
+	args, err = c.command(&l, dst)
+	if err != nil {
+		return dst, 0, err
+	}
+	return args, c.n, nil
+}
+
+// Read reads the next value from s, it blocks until the value is complete. The value is copied out of
+// the buffer of s, so it remains valid afterwards.
+func (p *Parser) Read(s *codec.Stream) (Value, error) {
+	for {
+		head, tail := s.Peek(s.InboundBuffered())
+		v, n, err := p.Parse(head, tail)
+		switch err {
+		case nil:
+			v = v.Clone()
+			s.Discard(n)
+			return v, nil
+		case codec.ErrIncomplete:
+			if err = s.Fill(); err != nil {
+				if err == io.EOF && s.InboundBuffered() > 0 {
+					err = io.ErrUnexpectedEOF
+				}
+				return Value{}, err
+			}
+		default:
+			return Value{}, err
+		}
+	}
+}
+
+// Clone returns a deep copy of v which doesn't reference the parsed data.
+func (v Value) Clone() Value {
+	if v.Str != nil {
+		v.Str = append([]byte{}, v.Str...)
+	}
+	v.Elems = cloneValues(v.Elems)
+	v.Attrs = cloneValues(v.Attrs)
+	return v
+}
+
+func cloneValues(vs []Value) []Value {
+	if vs == nil {
+		return nil
+	}
+	c := make([]Value, len(vs))
+	for i, v := range vs {
+		c[i] = v.Clone()
+	}
+	return c
+}
+
+// appendFields appends the space-separated fields of line to dst.
+func appendFields(dst [][]byte, line []byte) [][]byte {
+	for len(line) > 0 {
+		i := bytes.IndexAny(line, " \t")
+		if i < 0 {
+			return append(dst, line)
+		}
+		if i > 0 {
+			dst = append(dst, line[:i:i])
+		}
+		line = line[i+1:]
+	}
+	return dst
+}
+
+// cursor reads the data split into segments.
+type cursor struct {
+	segs [][]byte
+	i    int // segs[i][off] is the next byte
+	off  int
+	n    int // the number of bytes read
+}
+
+// skip skips n bytes, which must be available.
+func (c *cursor) skip(n int) {
+	c.n += n
+	for n > 0 {
+		k := len(c.segs[c.i]) - c.off
+		if n < k {
+			c.off += n
+			return
+		}
+		n -= k
+		c.i, c.off = c.i+1, 0
+	}
+}
+
+func (c *cursor) peekByte() (byte, bool) {
+	for i, off := c.i, c.off; i < len(c.segs); i, off = i+1, 0 {
+		if off < len(c.segs[i]) {
+			return c.segs[i][off], true
+		}
+	}
+	return 0, false
+}
+
+// line reads a line ended by CRLF and returns it without the CRLF, the line is copied only when it
+// spans two segments.
+func (c *cursor) line(max int) ([]byte, error) {
+	var line []byte
+	copied := false
+	for i, off := c.i, c.off; i < len(c.segs); i, off = i+1, 0 {
+		seg := c.segs[i][off:]
+		j := bytes.IndexByte(seg, '\n')
+		if j < 0 {
+			if len(line)+len(seg) > max+1 {
+				return nil, fmt.Errorf("%w: line too long", ErrProtocol)
+			}
+			if len(seg) > 0 {
+				line, copied = append(line, seg...), true
+			}
+			continue
+		}
+		if copied {
+			line = append(line, seg[:j+1]...)
+		} else {
+			line = seg[: j+1 : j+1]
+		}
+		c.i, c.off = i, off+j+1
+		c.n += len(line)
+		if len(line) > max+2 {
+			return nil, fmt.Errorf("%w: line too long", ErrProtocol)
+		}
+		if len(line) < 2 || line[len(line)-2] != '\r' {
+			return nil, fmt.Errorf("%w: invalid line", ErrProtocol)
+		}
+		return line[: len(line)-2 : len(line)-2], nil
+	}
+	return nil, codec.ErrIncomplete
+}
+
+// bulk reads n bytes followed by CRLF, the bytes are copied only when they span two segments.
+func (c *cursor) bulk(n int) ([]byte, error) {
+	for c.i < len(c.segs) && c.off == len(c.segs[c.i]) {
+		c.i, c.off = c.i+1, 0
+	}
+	if c.i < len(c.segs) {
+		if seg := c.segs[c.i][c.off:]; len(seg) >= n+2 {
+			if seg[n] != '\r' || seg[n+1] != '\n' {
+				return nil, fmt.Errorf("%w: bulk string not ended by CRLF", ErrProtocol)
+			}
+			c.off += n + 2
+			c.n += n + 2
+			return seg[:n:n], nil
+		}
+	}
+
+	avail := 0
+	for i, off := c.i, c.off; i < len(c.segs) && avail < n+2; i, off = i+1, 0 {
+		avail += len(c.segs[i]) - off
+	}
+	if avail < n+2 {
+		return nil, codec.ErrIncomplete
+	}
+	b := make([]byte, n+2)
+	for m := 0; m < len(b); {
+		k := copy(b[m:], c.segs[c.i][c.off:])
+		m += k
+		if c.off += k; c.off == len(c.segs[c.i]) {
+			c.i, c.off = c.i+1, 0
+		}
+	}
+	c.n += n + 2
+	if b[n] != '\r' || b[n+1] != '\n' {
+		return nil, fmt.Errorf("%w: bulk string not ended by CRLF", ErrProtocol)
+	}
+	return b[:n:n], nil
+}
+
+// command reads a command, the cursor isn't rewound on errors.
+func (c *cursor) command(l *Limits, dst [][]byte) ([][]byte, error) {
+	left := int64(-1)
+	return c.resumeCommand(l, dst, &left)
+}
+
+// resumeCommand reads the rest of a command and appends its args to args, left is the number of args
+// of a multi-bulk command still to read, or -1 when nothing has been read. On codec.ErrIncomplete,
+// args and left hold the progress and the cursor is after the last complete arg, the cursor isn't
+// rewound on the other errors.
+func (c *cursor) resumeCommand(l *Limits, args [][]byte, left *int64) ([][]byte, error) {
+	if *left < 0 {
+		if b, ok := c.peekByte(); !ok {
+			return args, codec.ErrIncomplete
+		} else if b != byte(Array) {
+			line, err := c.line(l.MaxInlineLength)
+			if err != nil {
+				return args, err
+			}
+			return appendFields(args, line), nil
+		}
+		line, err := c.line(maxHeaderLength)
+		if err != nil {
+			return args, err
+		}
+		n, err := parseInt(line[1:])
+		if err != nil {
+			return args, err
+		}
+		if n > int64(l.MaxArrayLength) {
+			return args, fmt.Errorf("%w: too many args", ErrProtocol)
+		}
+		*left = n
+	}
+	for ; *left > 0; *left-- {
+		saved := *c
+		b, err := c.arg(l)
+		if err != nil {
+			if err == codec.ErrIncomplete {
+				*c = saved
+			}
+			return args, err
+		}
+		args = append(args, b)
+	}
+	return args, nil
+}
+
+// arg reads a bulk string arg of a command.
+func (c *cursor) arg(l *Limits) ([]byte, error) {
+	line, err := c.line(maxHeaderLength)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 || line[0] != byte(BulkString) {
+		return nil, fmt.Errorf("%w: expected '$'", ErrProtocol)
+	}
+	size, err := parseInt(line[1:])
+	if err != nil {
+		return nil, err
+	}
+	if size < 0 || size > int64(l.MaxBulkLength) {
+		return nil, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+	}
+	return c.bulk(int(size))
+}
+
+func (c *cursor) value(l *Limits, depth int) (v Value, err error) {
+	line, err := c.line(l.MaxInlineLength)
+	if err != nil {
+		return v, err
+	}
+	if len(line) == 0 {
+		return v, fmt.Errorf("%w: empty line", ErrProtocol)
+	}
+	v.Type = Type(line[0])
+	body := line[1:]
+	switch v.Type {
+	case SimpleString, Error, Double, BigNumber:
+		v.Str = body
+	case Integer:
+		v.Int, err = parseInt(body)
+	case Null:
+		v.IsNull = true
+	case Boolean:
+		switch string(body) {
+		case "t":
+			v.Int = 1
+		case "f":
+		default:
+			err = fmt.Errorf("%w: invalid boolean", ErrProtocol)
+		}
+	case BulkString, BulkError, VerbatimString:
+		var size int64
+		if size, err = parseInt(body); err != nil {
+			return v, err
+		}
+		if size == -1 && v.Type == BulkString {
+			v.IsNull = true
+			return v, nil
+		}
+		if size < 0 || size > int64(l.MaxBulkLength) {
+			return v, fmt.Errorf("%w: invalid bulk length", ErrProtocol)
+		}
+		v.Str, err = c.bulk(int(size))
+	case Array, Set, Push, Map, Attribute:
+		var count int64
+		if count, err = parseInt(body); err != nil {
+			return v, err
+		}
+		if count == -1 && v.Type == Array {
+			v.IsNull = true
+			return v, nil
+		}
+		if v.Type == Map || v.Type == Attribute {
+			count *= 2
+		}
+		if count < 0 || count > int64(l.MaxArrayLength) {
+			return v, fmt.Errorf("%w: invalid aggregate length", ErrProtocol)
+		}
+		if depth >= l.MaxDepth {
+			return v, fmt.Errorf("%w: values nested too deep", ErrProtocol)
+		}
+		// 长度由对端声明，按实际解析出的元素扩容
+		v.Elems = make([]Value, 0, min(int(count), 16))
+		for i := int64(0); i < count; i++ {
+			var e Value
+			if e, err = c.value(l, depth+1); err != nil {
+				return v, err
+			}
+			v.Elems = append(v.Elems, e)
+		}
+		if v.Type == Attribute {
+			attrs := v.Elems
+			if v, err = c.value(l, depth); err != nil {
+				return v, err
+			}
+			v.Attrs = attrs
+		}
+	default:
+		err = fmt.Errorf("%w: unknown type %q", ErrProtocol, line[0])
+	}
+	return v, err
+}
+
+// parseInt parses a decimal integer without allocating.
+func parseInt(b []byte) (int64, error) {
+	neg := false
+	if len(b) > 0 && (b[0] == '-' || b[0] == '+') {
+		neg = b[0] == '-'
+		b = b[1:]
+	}
+	if len(b) == 0 || len(b) > 19 {
+		return 0, fmt.Errorf("%w: invalid integer", ErrProtocol)
+	}
+	var n int64
+	for _, c := range b {
+		if c < '0' || c > '9' {
+			return 0, fmt.Errorf("%w: invalid integer", ErrProtocol)
+		}
+		n = n*10 + int64(c-'0')
+		if n < 0 {
+			return 0, fmt.Errorf("%w: invalid integer", ErrProtocol)
+		}
+	}
+	if neg {
+		n = -n
+	}
+	return n, nil
+}
+
+func min(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
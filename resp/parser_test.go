@@ -0,0 +1,193 @@
+package resp
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Ccheers/haijun-net/codec"
+)
+
+func TestParser_Parse(t *testing.T) {
+	for _, tc := range []struct {
+		input string
+		want  Value
+	}{
+		{"+OK\r\n", Value{Type: SimpleString, Str: []byte("OK")}},
+		{"-ERR bad\r\n", Value{Type: Error, Str: []byte("ERR bad")}},
+		{":-42\r\n", Value{Type: Integer, Int: -42}},
+		{"$5\r\nhe\r\no\r\n", Value{Type: BulkString, Str: []byte("he\r\no")}},
+		{"$0\r\n\r\n", Value{Type: BulkString, Str: []byte{}}},
+		{"$-1\r\n", Value{Type: BulkString, IsNull: true}},
+		{"*-1\r\n", Value{Type: Array, IsNull: true}},
+		{"*2\r\n$1\r\na\r\n:1\r\n", Value{Type: Array, Elems: []Value{
+			{Type: BulkString, Str: []byte("a")}, {Type: Integer, Int: 1},
+		}}},
+		{"_\r\n", Value{Type: Null, IsNull: true}},
+		{"#t\r\n", Value{Type: Boolean, Int: 1}},
+		{"#f\r\n", Value{Type: Boolean}},
+		{",3.14\r\n", Value{Type: Double, Str: []byte("3.14")}},
+		{"(3492890328409238509324850943850943825024385\r\n", Value{Type: BigNumber, Str: []byte("3492890328409238509324850943850943825024385")}},
+		{"!3\r\nbad\r\n", Value{Type: BulkError, Str: []byte("bad")}},
+		{"=8\r\ntxt:Some\r\n", Value{Type: VerbatimString, Str: []byte("txt:Some")}},
+		{"%1\r\n+k\r\n:1\r\n", Value{Type: Map, Elems: []Value{
+			{Type: SimpleString, Str: []byte("k")}, {Type: Integer, Int: 1},
+		}}},
+		{"~1\r\n#t\r\n", Value{Type: Set, Elems: []Value{{Type: Boolean, Int: 1}}}},
+		{">2\r\n+message\r\n$2\r\nhi\r\n", Value{Type: Push, Elems: []Value{
+			{Type: SimpleString, Str: []byte("message")}, {Type: BulkString, Str: []byte("hi")},
+		}}},
+		{"|1\r\n+ttl\r\n:3600\r\n:2\r\n", Value{Type: Integer, Int: 2, Attrs: []Value{
+			{Type: SimpleString, Str: []byte("ttl")}, {Type: Integer, Int: 3600},
+		}}},
+	} {
+		var p Parser
+		v, n, err := p.Parse([]byte(tc.input + "+next\r\n"))
+		require.NoError(t, err, tc.input)
+		assert.Equal(t, len(tc.input), n, tc.input)
+		assert.Equal(t, tc.want, v.Clone(), tc.input)
+
+		// 任意位置切成两段都能解析，任何前缀都是不完整的
+		for i := 1; i < len(tc.input); i++ {
+			v, n, err = p.Parse([]byte(tc.input[:i]), []byte(tc.input[i:]))
+			require.NoError(t, err, "%q at %d", tc.input, i)
+			assert.Equal(t, len(tc.input), n)
+			assert.Equal(t, tc.want, v.Clone(), tc.input)
+
+			_, _, err = p.Parse([]byte(tc.input[:i]))
+			assert.Equal(t, codec.ErrIncomplete, err, "%q at %d", tc.input, i)
+		}
+	}
+}
+
+func TestParser_ZeroCopy(t *testing.T) {
+	var p Parser
+	data := []byte("*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n")
+	args, n, err := p.ParseCommand(nil, data)
+	require.NoError(t, err)
+	assert.Equal(t, len(data), n)
+	require.Len(t, args, 2)
+	// 参数直接引用输入的数据
+	data[len(data)-5] = 'K'
+	assert.Equal(t, "Key", string(args[1]))
+	assert.Equal(t, 3, cap(args[1]))
+
+	v, _, err := p.Parse(data)
+	require.NoError(t, err)
+	data[8] = 'g'
+	assert.Equal(t, "gET", v.Elems[0].String())
+}
+
+func TestParser_ParseCommand(t *testing.T) {
+	var p Parser
+	args, n, err := p.ParseCommand(nil, []byte("SET  k\tv\r\nrest"))
+	require.NoError(t, err)
+	assert.Equal(t, 10, n)
+	assert.Equal(t, [][]byte{[]byte("SET"), []byte("k"), []byte("v")}, args)
+
+	args, n, err = p.ParseCommand(nil, []byte("\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Empty(t, args)
+
+	args, _, err = p.ParseCommand(nil, []byte("*1\r\n$4\r"), []byte("\nPING\r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("PING")}, args)
+
+	for _, input := range []string{"", "PIN", "*2\r\n$3\r\nGET\r\n", "*2\r\n$3\r\nGET\r\n$3\r\nke"} {
+		_, _, err = p.ParseCommand(nil, []byte(input))
+		assert.Equal(t, codec.ErrIncomplete, err, input)
+	}
+}
+
+func TestCursor_ResumeCommand(t *testing.T) {
+	l := (&Parser{}).limits()
+	wire := AppendCommand(nil, "SET", "key", "value")
+	left := int64(-1)
+	var args [][]byte
+	parsed := 0
+	// 数据逐字节到达，每次从上次完整读到的参数之后继续
+	for i := 1; i < len(wire); i++ {
+		c := cursor{segs: [][]byte{wire[:i]}}
+		c.skip(parsed)
+		var err error
+		args, err = c.resumeCommand(&l, args, &left)
+		require.Equal(t, codec.ErrIncomplete, err)
+		parsed = c.n
+	}
+	assert.Equal(t, [][]byte{[]byte("SET"), []byte("key")}, args)
+	assert.EqualValues(t, 1, left)
+
+	c := cursor{segs: [][]byte{wire}}
+	c.skip(parsed)
+	args, err := c.resumeCommand(&l, args, &left)
+	require.NoError(t, err)
+	assert.Equal(t, [][]byte{[]byte("SET"), []byte("key"), []byte("value")}, args)
+	assert.Equal(t, len(wire), c.n)
+}
+
+func TestParser_Errors(t *testing.T) {
+	p := Parser{Limits: Limits{MaxBulkLength: 4, MaxArrayLength: 2, MaxDepth: 2, MaxInlineLength: 8}}
+	for _, input := range []string{
+		"?\r\n",
+		"\r\n",
+		"+OK\n",
+		":12a\r\n",
+		":99999999999999999999\r\n",
+		"#x\r\n",
+		"$5\r\nhello\r\n",
+		"$-2\r\n",
+		"$2\r\nabc\r\n",
+		"*3\r\n:1\r\n:2\r\n:3\r\n",
+		"*1\r\n*1\r\n*1\r\n:1\r\n",
+		"+too long line\r\n",
+		"+too long line without end",
+	} {
+		_, _, err := p.Parse([]byte(input))
+		assert.True(t, errors.Is(err, ErrProtocol), "%q: %v", input, err)
+	}
+	for _, input := range []string{
+		"*3\r\n$1\r\na\r\n$1\r\nb\r\n$1\r\nc\r\n",
+		"*1\r\n:1\r\n",
+		"*1\r\n$5\r\nhello\r\n",
+		"*1\r\n$-1\r\n",
+		"too long inline command\r\n",
+	} {
+		_, _, err := p.ParseCommand(nil, []byte(input))
+		assert.True(t, errors.Is(err, ErrProtocol), "%q: %v", input, err)
+	}
+}
+
+func TestParser_Read(t *testing.T) {
+	var p Parser
+	s := codec.NewStream(strings.NewReader("$5\r\nhello\r\n:1\r\n$3\r\nab"))
+	v, err := p.Read(s)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", v.String())
+	v, err = p.Read(s)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, v.Int)
+	_, err = p.Read(s)
+	assert.Error(t, err)
+
+	s = codec.NewStream(strings.NewReader("?\r\n"))
+	_, err = p.Read(s)
+	assert.True(t, errors.Is(err, ErrProtocol))
+}
+
+func TestValue(t *testing.T) {
+	f, err := Value{Type: Double, Str: []byte("inf")}.Float()
+	require.NoError(t, err)
+	assert.True(t, f > 0 && f*2 == f)
+	f, err = Value{Type: Double, Str: []byte("-inf")}.Float()
+	require.NoError(t, err)
+	assert.True(t, f < 0 && f*2 == f)
+	f, err = Value{Type: Double, Str: []byte("1.5")}.Float()
+	require.NoError(t, err)
+	assert.Equal(t, 1.5, f)
+	assert.True(t, Value{Type: BulkError}.IsError())
+	assert.False(t, Value{Type: Boolean}.Bool())
+}
@@ -0,0 +1,235 @@
+package resp
+
+import (
+	"strings"
+	"sync"
+
+	hjnet "github.com/Ccheers/haijun-net"
+	"github.com/Ccheers/haijun-net/buffer"
+	"github.com/Ccheers/haijun-net/codec"
+)
+
+// Command is a command received by the Server.
+type Command struct {
+	// Args are the name and the args of the command, they reference the inbound buffer of the conn
+	// and are only valid until the handler returns.
+	Args [][]byte
+	// Conn is the conn the command is received from.
+	Conn *hjnet.HjConn
+}
+
+// Name returns the upper-case name of the command.
+func (c *Command) Name() string {
+	return strings.ToUpper(string(c.Args[0]))
+}
+
+// Handler handles the commands received by the Server, the replies are written to w.
+type Handler interface {
+	ServeRESP(w *Writer, cmd *Command)
+}
+
+// HandlerFunc is an adapter to use an ordinary function as a Handler.
+type HandlerFunc func(w *Writer, cmd *Command)
+
+// ServeRESP calls f(w, cmd).
+func (f HandlerFunc) ServeRESP(w *Writer, cmd *Command) {
+	f(w, cmd)
+}
+
+// ServeMux routes the commands to the handlers registered by their names, which are case-insensitive.
+type ServeMux struct {
+	mu       sync.RWMutex
+	handlers map[string]Handler
+}
+
+// NewServeMux returns an empty ServeMux.
+func NewServeMux() *ServeMux {
+	return &ServeMux{handlers: make(map[string]Handler)}
+}
+
+// Handle registers the handler of the command name.
+func (m *ServeMux) Handle(name string, handler Handler) {
+	m.mu.Lock()
+	m.handlers[strings.ToUpper(name)] = handler
+	m.mu.Unlock()
+}
+
+// HandleFunc registers the handler function of the command name.
+func (m *ServeMux) HandleFunc(name string, handler func(w *Writer, cmd *Command)) {
+	m.Handle(name, HandlerFunc(handler))
+}
+
+// ServeRESP dispatches the command to its handler, an error is replied to the unknown commands.
+func (m *ServeMux) ServeRESP(w *Writer, cmd *Command) {
+	m.mu.RLock()
+	// 大多数客户端发送大写的命令名，先按原样查找避免转换
+	h, ok := m.handlers[string(cmd.Args[0])]
+	if !ok {
+		h, ok = m.handlers[cmd.Name()]
+	}
+	m.mu.RUnlock()
+	if !ok {
+		w.WriteError("ERR unknown command '" + printable(cmd.Args[0]) + "'")
+		return
+	}
+	h.ServeRESP(w, cmd)
+}
+
+// Server serves RESP on HjListener, it's the EventHandler passed to HjListener.Serve.
+//
+// The pipelined commands are handled one by one and their replies are sent together. HELLO is
+// handled by the Server to switch the protocol version of the conn, the conns start with RESP2.
+//
+// An incomplete command is left in the inbound buffer of the conn, so the commands are bounded by
+// hjnet.Options.MaxReadBufferSize and the memory budget too, the conn is closed when a command doesn't
+// fit in the buffer.
+type Server struct {
+	hjnet.BuiltinEventHandler
+
+	// Limits bound the commands accepted, the conn is closed when a command exceeds them.
+	// It mustn't be modified after the Server starts serving.
+	Limits Limits
+
+	handler Handler
+}
+
+// NewServer returns a Server passing the commands to handler, which is usually a ServeMux.
+func NewServer(handler Handler) *Server {
+	return &Server{handler: handler}
+}
+
+// connState is the context of a conn served by the Server.
+type connState struct {
+	proto int
+	// an incomplete command is left in the inbound buffer of the conn, args holds the args read so far,
+	// which take parsed bytes, and left is the number of args still to read, see cursor.resumeCommand
+	parsed int
+	left   int64
+	args   [][]byte
+	segs   [][]byte
+	out    *buffer.LinkBuffer
+	w      Writer
+	cmd    Command
+}
+
+// OnOpen sets up the state of the conn.
+func (s *Server) OnOpen(c *hjnet.HjConn) hjnet.Action {
+	st := &connState{proto: 2, left: -1, out: buffer.NewLinkBuffer()}
+	st.w.buf = st.out
+	st.cmd.Conn = c
+	c.SetContext(st)
+	return hjnet.None
+}
+
+// OnTraffic handles the commands buffered by the conn.
+func (s *Server) OnTraffic(c *hjnet.HjConn) hjnet.Action {
+	st, ok := c.Context().(*connState)
+	if !ok {
+		return hjnet.Close
+	}
+	l := (&Parser{Limits: s.Limits}).limits()
+
+	// 不完整的命令留在连接的读缓冲区中，受读缓冲区上限和内存预算的约束，
+	// 数据到达后从上次解析到的位置继续
+	st.segs = c.PeekVectors(st.segs[:0], c.InboundBuffered())
+	cur := cursor{segs: st.segs}
+	cur.skip(st.parsed)
+
+	action := hjnet.None
+	done := 0 // 已经处理完的命令占用的字节数
+	incomplete := false
+	for {
+		args, err := cur.resumeCommand(&l, st.args, &st.left)
+		st.args = args
+		if err == codec.ErrIncomplete {
+			st.parsed, incomplete = cur.n-done, true
+			break
+		}
+		if err != nil {
+			action = hjnet.Close
+			break
+		}
+		if len(args) > 0 {
+			st.cmd.Args = args
+			st.w.proto = st.proto
+			s.serve(st)
+		}
+		// 命令的参数引用着缓冲区，处理完才能消费
+		for i := range st.args {
+			st.args[i] = nil
+		}
+		st.args, st.left, st.parsed = st.args[:0], -1, 0
+		st.cmd.Args = nil
+		done = cur.n
+	}
+	for i := range st.segs {
+		st.segs[i] = nil
+	}
+	c.Discard(done)
+	if incomplete && c.InboundFull() {
+		// 命令比读缓冲区的上限还大，永远无法接收完整
+		action = hjnet.Close
+	}
+
+	if st.out.Len() > 0 {
+		if _, err := c.WriteBuffer(st.out); err != nil {
+			st.out.Release()
+			return hjnet.Close
+		}
+	}
+	return action
+}
+
+// OnClose releases the buffers of the conn.
+func (s *Server) OnClose(c *hjnet.HjConn, _ error) {
+	if st, ok := c.Context().(*connState); ok {
+		st.out.Release()
+		c.SetContext(nil)
+	}
+}
+
+func (s *Server) serve(st *connState) {
+	cmd := &st.cmd
+	if len(cmd.Args[0]) == 5 && strings.EqualFold(string(cmd.Args[0]), "HELLO") {
+		s.hello(st)
+		return
+	}
+	s.handler.ServeRESP(&st.w, cmd)
+}
+
+// hello negotiates the protocol version: HELLO [protover].
+func (s *Server) hello(st *connState) {
+	w, args := &st.w, st.cmd.Args
+	if len(args) > 1 {
+		switch string(args[1]) {
+		case "2":
+			st.proto = 2
+		case "3":
+			st.proto = 3
+		default:
+			w.WriteError("NOPROTO unsupported protocol version")
+			return
+		}
+	}
+	w.proto = st.proto
+	w.WriteMap(3)
+	w.WriteBulkString("server")
+	w.WriteBulkString("haijun-net")
+	w.WriteBulkString("proto")
+	w.WriteInt(int64(st.proto))
+	w.WriteBulkString("id")
+	w.WriteInt(int64(st.cmd.Conn.ID()))
+}
+
+// printable returns b for an error message, which can't contain CR or LF.
+func printable(b []byte) string {
+	if len(b) > 128 {
+		b = b[:128]
+	}
+	return strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' {
+			return ' '
+		}
+		return r
+	}, string(b))
+}
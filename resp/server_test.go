@@ -0,0 +1,210 @@
+package resp
+
+import (
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	hjnet "github.com/Ccheers/haijun-net"
+	"github.com/Ccheers/haijun-net/codec"
+)
+
+// client is a minimal in-process Redis client.
+type client struct {
+	t      *testing.T
+	conn   net.Conn
+	s      *codec.Stream
+	parser Parser
+}
+
+func dial(t *testing.T, addr string) *client {
+	conn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(5*time.Second)))
+	c := &client{t: t, conn: conn, s: codec.NewStream(conn)}
+	t.Cleanup(func() {
+		_ = conn.Close()
+		c.s.Release()
+	})
+	return c
+}
+
+func (c *client) send(p []byte) {
+	_, err := c.conn.Write(p)
+	require.NoError(c.t, err)
+}
+
+func (c *client) read() Value {
+	v, err := c.parser.Read(c.s)
+	require.NoError(c.t, err)
+	return v
+}
+
+func (c *client) do(args ...string) Value {
+	c.send(AppendCommand(nil, args...))
+	return c.read()
+}
+
+type store struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func newTestServer(t *testing.T, limits Limits, opts ...hjnet.Option) *hjnet.HjListener {
+	st := &store{data: make(map[string][]byte)}
+	mux := NewServeMux()
+	mux.HandleFunc("get", func(w *Writer, cmd *Command) {
+		if len(cmd.Args) != 2 {
+			w.WriteError("ERR wrong number of arguments for 'get' command")
+			return
+		}
+		st.mu.Lock()
+		v, ok := st.data[string(cmd.Args[1])]
+		st.mu.Unlock()
+		if !ok {
+			w.WriteNull()
+			return
+		}
+		// 存储的值不会被修改，不需要复制
+		w.WriteBulkNoCopy(v)
+	})
+	mux.HandleFunc("SET", func(w *Writer, cmd *Command) {
+		if len(cmd.Args) != 3 {
+			w.WriteError("ERR wrong number of arguments for 'set' command")
+			return
+		}
+		// 参数在处理函数返回后失效，需要复制
+		v := append([]byte{}, cmd.Args[2]...)
+		st.mu.Lock()
+		st.data[string(cmd.Args[1])] = v
+		st.mu.Unlock()
+		w.WriteOK()
+	})
+	mux.HandleFunc("PING", func(w *Writer, cmd *Command) {
+		w.WriteSimpleString("PONG")
+	})
+	mux.HandleFunc("EXISTS", func(w *Writer, cmd *Command) {
+		st.mu.Lock()
+		_, ok := st.data[string(cmd.Args[1])]
+		st.mu.Unlock()
+		w.WriteBool(ok)
+	})
+
+	l, err := hjnet.NewHjListener("127.0.0.1:0", opts...)
+	require.NoError(t, err)
+	hl := l.(*hjnet.HjListener)
+	srv := NewServer(mux)
+	srv.Limits = limits
+	go func() {
+		_ = hl.Serve(srv)
+	}()
+	t.Cleanup(func() { _ = hl.Close() })
+	return hl
+}
+
+func TestServer(t *testing.T) {
+	l := newTestServer(t, Limits{})
+	c := dial(t, l.Addr().String())
+
+	assert.Equal(t, "PONG", c.do("PING").String())
+	assert.True(t, c.do("GET", "k").IsNull)
+	assert.Equal(t, "OK", c.do("set", "k", "v\r\n1").String())
+	assert.Equal(t, "v\r\n1", c.do("get", "k").String())
+	assert.EqualValues(t, 1, c.do("EXISTS", "k").Int)
+
+	v := c.do("GET")
+	assert.True(t, v.IsError())
+	assert.Equal(t, "ERR unknown command 'FLUSH  ALL'", c.do("FLUSH\r\nALL").String())
+
+	// 内联命令
+	c.send([]byte("PING\r\n\r\nGET k\r\n"))
+	assert.Equal(t, "PONG", c.read().String())
+	assert.Equal(t, "v\r\n1", c.read().String())
+}
+
+func TestServer_Hello(t *testing.T) {
+	l := newTestServer(t, Limits{})
+	c := dial(t, l.Addr().String())
+
+	v := c.do("HELLO")
+	assert.Equal(t, Array, v.Type)
+	assert.EqualValues(t, 2, v.Elems[3].Int)
+
+	v = c.do("HELLO", "3")
+	require.Equal(t, Map, v.Type)
+	assert.Equal(t, "haijun-net", v.Elems[1].String())
+	assert.EqualValues(t, 3, v.Elems[3].Int)
+	assert.Equal(t, Null, c.do("GET", "missing").Type)
+	assert.Equal(t, Boolean, c.do("EXISTS", "missing").Type)
+
+	assert.Equal(t, "NOPROTO unsupported protocol version", c.do("HELLO", "4").String())
+	assert.Equal(t, Null, c.do("GET", "missing").Type)
+}
+
+func TestServer_Pipelining(t *testing.T) {
+	l := newTestServer(t, Limits{})
+	c := dial(t, l.Addr().String())
+
+	var p []byte
+	const n = 1000
+	for i := 0; i < n; i++ {
+		p = AppendCommand(p, "SET", "k", strings.Repeat("v", i))
+		p = AppendCommand(p, "GET", "k")
+	}
+	// 分成小块发送，命令会跨越多次读取
+	go func() {
+		for i := 0; i < len(p); i += 4000 {
+			_, _ = c.conn.Write(p[i:min(i+4000, len(p))])
+		}
+	}()
+	for i := 0; i < n; i++ {
+		assert.Equal(t, "OK", c.read().String())
+		assert.Equal(t, strings.Repeat("v", i), c.read().String())
+	}
+}
+
+func TestServer_LargeValue(t *testing.T) {
+	// 命令比连接初始的读缓冲区大得多，读缓冲区扩容到能容纳整个命令
+	l := newTestServer(t, Limits{}, hjnet.WithReadBuffer(4096, 2<<20))
+	c := dial(t, l.Addr().String())
+
+	value := strings.Repeat("0123456789", 100000)
+	go c.send(AppendCommand(nil, "SET", "big", value))
+	assert.Equal(t, "OK", c.read().String())
+	assert.Equal(t, value, c.do("GET", "big").String())
+}
+
+func TestServer_IncompleteCommand(t *testing.T) {
+	budget := hjnet.NewMemoryBudget(0)
+	l := newTestServer(t, Limits{}, hjnet.WithReadBuffer(4096, 64<<10), hjnet.WithMemoryBudget(budget))
+	c := dial(t, l.Addr().String())
+
+	// 不完整的命令留在读缓冲区中，计入内存预算
+	cmd := AppendCommand(nil, "SET", "k", strings.Repeat("v", 32<<10))
+	c.send(cmd[:len(cmd)-100])
+	assert.Eventually(t, func() bool { return budget.Used() >= 32<<10 }, 5*time.Second, 10*time.Millisecond)
+	c.send(cmd[len(cmd)-100:])
+	assert.Equal(t, "OK", c.read().String())
+
+	// 比读缓冲区的上限还大的命令导致连接被关闭
+	go func() { _, _ = c.conn.Write(AppendCommand(nil, "SET", "k", strings.Repeat("v", 128<<10))) }()
+	_, err := c.parser.Read(c.s)
+	assert.Error(t, err)
+	assert.False(t, os.IsTimeout(err), "%v", err)
+}
+
+func TestServer_ProtocolError(t *testing.T) {
+	l := newTestServer(t, Limits{MaxBulkLength: 16})
+	c := dial(t, l.Addr().String())
+	assert.Equal(t, "PONG", c.do("PING").String())
+
+	c.send(AppendCommand(nil, "SET", "k", strings.Repeat("v", 17)))
+	_, err := c.parser.Read(c.s)
+	assert.Error(t, err)
+}
@@ -0,0 +1,82 @@
+// Package resp implements the Redis serialization protocol, RESP2 and RESP3, on the buffers of haijun-net,
+// and a Server routing the commands of a Redis-compatible service served by HjListener.
+//
+// The parser reads the inbound data in place: the strings of the parsed values and commands reference
+// the buffered data unless they span two blocks of the buffer, so they're only valid until the data
+// is consumed, i.e. until the handler returns.
+package resp
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Type is the type of a RESP value, the first byte of its encoding.
+type Type byte
+
+// The RESP2 types.
+const (
+	SimpleString Type = '+'
+	Error        Type = '-'
+	Integer      Type = ':'
+	BulkString   Type = '$'
+	Array        Type = '*'
+)
+
+// The types added by RESP3.
+const (
+	Null           Type = '_'
+	Boolean        Type = '#'
+	Double         Type = ','
+	BigNumber      Type = '('
+	BulkError      Type = '!'
+	VerbatimString Type = '='
+	Map            Type = '%'
+	Set            Type = '~'
+	Push           Type = '>'
+	Attribute      Type = '|'
+)
+
+// ErrProtocol is returned when the data doesn't follow RESP, the errors returned for it wrap ErrProtocol.
+var ErrProtocol = errors.New("resp: protocol error")
+
+// Value is a RESP value.
+type Value struct {
+	Type Type
+	// Str is the content of the strings and the errors, and the text of the doubles and the big numbers.
+	Str []byte
+	// Int is the value of the integers, and 1 or 0 for the booleans.
+	Int int64
+	// Elems are the elements of the aggregate types, the keys and the values of a map are interleaved.
+	Elems []Value
+	// Attrs are the attributes sent before the value, the keys and the values are interleaved.
+	Attrs []Value
+	// IsNull reports whether the value is the RESP3 null or the RESP2 null bulk string or array.
+	IsNull bool
+}
+
+// String returns Str as a string.
+func (v Value) String() string {
+	return string(v.Str)
+}
+
+// Float returns the value of a double.
+func (v Value) Float() (float64, error) {
+	switch string(v.Str) {
+	case "inf":
+		return strconv.ParseFloat("+Inf", 64)
+	case "-inf":
+		return strconv.ParseFloat("-Inf", 64)
+	}
+	return strconv.ParseFloat(string(v.Str), 64)
+}
+
+// Bool returns the value of a boolean.
+func (v Value) Bool() bool {
+	return v.Int != 0
+}
+
+// IsError reports whether the value is a simple or a bulk error.
+func (v Value) IsError() bool {
+	return v.Type == Error || v.Type == BulkError
+}
@@ -0,0 +1,247 @@
+package resp
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/Ccheers/haijun-net/buffer"
+)
+
+// Writer writes RESP values to a LinkBuffer, which can be sent by HjConn.WriteBuffer. The RESP3 types
+// are written as their RESP2 equivalents when the protocol version is 2.
+type Writer struct {
+	buf     *buffer.LinkBuffer
+	proto   int
+	scratch [32]byte
+}
+
+// NewWriter returns a Writer writing the version proto of RESP, 2 or 3, to buf.
+func NewWriter(buf *buffer.LinkBuffer, proto int) *Writer {
+	return &Writer{buf: buf, proto: proto}
+}
+
+// Buffer returns the buffer the values are written to.
+func (w *Writer) Buffer() *buffer.LinkBuffer {
+	return w.buf
+}
+
+// Protocol returns the version of RESP written by w.
+func (w *Writer) Protocol() int {
+	return w.proto
+}
+
+func (w *Writer) header(t Type, n int64) {
+	b := append(w.scratch[:0], byte(t))
+	b = strconv.AppendInt(b, n, 10)
+	_, _ = w.buf.Write(append(b, '\r', '\n'))
+}
+
+func (w *Writer) line(t Type, s string) {
+	_, _ = w.buf.Write([]byte{byte(t)})
+	_, _ = w.buf.WriteString(s)
+	_, _ = w.buf.Write([]byte{'\r', '\n'})
+}
+
+// WriteOK writes the simple string "OK".
+func (w *Writer) WriteOK() {
+	w.line(SimpleString, "OK")
+}
+
+// WriteSimpleString writes s as a simple string, s mustn't contain CR or LF.
+func (w *Writer) WriteSimpleString(s string) {
+	w.line(SimpleString, s)
+}
+
+// WriteError writes msg as an error, msg mustn't contain CR or LF. By convention it starts with
+// an upper-case error code, e.g. "ERR unknown command".
+func (w *Writer) WriteError(msg string) {
+	w.line(Error, msg)
+}
+
+// WriteInt writes n as an integer.
+func (w *Writer) WriteInt(n int64) {
+	w.header(Integer, n)
+}
+
+// WriteBulk writes a copy of b as a bulk string.
+func (w *Writer) WriteBulk(b []byte) {
+	w.header(BulkString, int64(len(b)))
+	_, _ = w.buf.Write(b)
+	_, _ = w.buf.Write([]byte{'\r', '\n'})
+}
+
+// WriteBulkString writes s as a bulk string.
+func (w *Writer) WriteBulkString(s string) {
+	w.header(BulkString, int64(len(s)))
+	_, _ = w.buf.WriteString(s)
+	_, _ = w.buf.Write([]byte{'\r', '\n'})
+}
+
+// WriteBulkNoCopy writes b as a bulk string without copying it, b mustn't be modified until the
+// buffer is sent, e.g. it's the value of an immutable cache entry.
+func (w *Writer) WriteBulkNoCopy(b []byte) {
+	w.header(BulkString, int64(len(b)))
+	w.buf.Append(b)
+	_, _ = w.buf.Write([]byte{'\r', '\n'})
+}
+
+// WriteNull writes the null, which is the null bulk string in RESP2.
+func (w *Writer) WriteNull() {
+	if w.proto < 3 {
+		_, _ = w.buf.WriteString("$-1\r\n")
+		return
+	}
+	_, _ = w.buf.WriteString("_\r\n")
+}
+
+// WriteArray writes the header of an array of n elements, which must be written next.
+func (w *Writer) WriteArray(n int) {
+	w.header(Array, int64(n))
+}
+
+// WriteMap writes the header of a map of n pairs, whose keys and values must be written next.
+// It's an array of 2n elements in RESP2.
+func (w *Writer) WriteMap(n int) {
+	if w.proto < 3 {
+		w.header(Array, int64(2*n))
+		return
+	}
+	w.header(Map, int64(n))
+}
+
+// WriteSet writes the header of a set of n elements, it's an array in RESP2.
+func (w *Writer) WriteSet(n int) {
+	if w.proto < 3 {
+		w.header(Array, int64(n))
+		return
+	}
+	w.header(Set, int64(n))
+}
+
+// WritePush writes the header of a push of n elements, it's an array in RESP2.
+func (w *Writer) WritePush(n int) {
+	if w.proto < 3 {
+		w.header(Array, int64(n))
+		return
+	}
+	w.header(Push, int64(n))
+}
+
+// WriteDouble writes f as a double, it's a bulk string in RESP2.
+func (w *Writer) WriteDouble(f float64) {
+	var s string
+	switch {
+	case math.IsInf(f, 1):
+		s = "inf"
+	case math.IsInf(f, -1):
+		s = "-inf"
+	default:
+		s = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	if w.proto < 3 {
+		w.WriteBulkString(s)
+		return
+	}
+	w.line(Double, s)
+}
+
+// WriteBool writes b as a boolean, it's the integer 1 or 0 in RESP2.
+func (w *Writer) WriteBool(b bool) {
+	if w.proto < 3 {
+		if b {
+			w.WriteInt(1)
+		} else {
+			w.WriteInt(0)
+		}
+		return
+	}
+	if b {
+		w.line(Boolean, "t")
+	} else {
+		w.line(Boolean, "f")
+	}
+}
+
+// WriteValue writes v and its elements.
+func (w *Writer) WriteValue(v Value) {
+	if len(v.Attrs) > 0 && w.proto >= 3 {
+		w.header(Attribute, int64(len(v.Attrs)/2))
+		for _, a := range v.Attrs {
+			w.WriteValue(a)
+		}
+	}
+	switch v.Type {
+	case SimpleString, Error, BigNumber:
+		if v.Type == BigNumber && w.proto < 3 {
+			w.WriteBulk(v.Str)
+			return
+		}
+		w.line(v.Type, string(v.Str))
+	case Integer:
+		w.WriteInt(v.Int)
+	case Double:
+		if w.proto < 3 {
+			w.WriteBulk(v.Str)
+			return
+		}
+		w.line(Double, string(v.Str))
+	case Boolean:
+		w.WriteBool(v.Bool())
+	case Null:
+		w.WriteNull()
+	case BulkString, BulkError, VerbatimString:
+		if v.IsNull {
+			w.WriteNull()
+			return
+		}
+		t := v.Type
+		if w.proto < 3 {
+			if t == BulkError {
+				// RESP2 没有 bulk error，换行会破坏简单错误的格式
+				w.line(Error, string(v.Str))
+				return
+			}
+			t = BulkString
+		}
+		w.header(t, int64(len(v.Str)))
+		_, _ = w.buf.Write(v.Str)
+		_, _ = w.buf.Write([]byte{'\r', '\n'})
+	case Array, Set, Push, Map:
+		if v.IsNull {
+			if w.proto < 3 {
+				_, _ = w.buf.WriteString("*-1\r\n")
+			} else {
+				w.WriteNull()
+			}
+			return
+		}
+		switch v.Type {
+		case Set:
+			w.WriteSet(len(v.Elems))
+		case Push:
+			w.WritePush(len(v.Elems))
+		case Map:
+			w.WriteMap(len(v.Elems) / 2)
+		default:
+			w.WriteArray(len(v.Elems))
+		}
+		for _, e := range v.Elems {
+			w.WriteValue(e)
+		}
+	}
+}
+
+// AppendCommand appends the command made of args to dst as a multi-bulk array, it's what the clients send.
+func AppendCommand(dst []byte, args ...string) []byte {
+	dst = append(dst, byte(Array))
+	dst = strconv.AppendInt(dst, int64(len(args)), 10)
+	dst = append(dst, '\r', '\n')
+	for _, arg := range args {
+		dst = append(dst, byte(BulkString))
+		dst = strconv.AppendInt(dst, int64(len(arg)), 10)
+		dst = append(dst, '\r', '\n')
+		dst = append(dst, arg...)
+		dst = append(dst, '\r', '\n')
+	}
+	return dst
+}
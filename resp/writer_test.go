@@ -0,0 +1,101 @@
+package resp
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/Ccheers/haijun-net/buffer"
+)
+
+func written(w *Writer) string {
+	defer w.Buffer().Release()
+	return string(bytes.Join(w.Buffer().Bytes(), nil))
+}
+
+func TestWriter(t *testing.T) {
+	for _, tc := range []struct {
+		write      func(w *Writer)
+		resp2, res string
+	}{
+		{func(w *Writer) { w.WriteOK() }, "+OK\r\n", "+OK\r\n"},
+		{func(w *Writer) { w.WriteSimpleString("PONG") }, "+PONG\r\n", "+PONG\r\n"},
+		{func(w *Writer) { w.WriteError("ERR bad") }, "-ERR bad\r\n", "-ERR bad\r\n"},
+		{func(w *Writer) { w.WriteInt(-3) }, ":-3\r\n", ":-3\r\n"},
+		{func(w *Writer) { w.WriteBulk([]byte("a\r\nb")) }, "$4\r\na\r\nb\r\n", "$4\r\na\r\nb\r\n"},
+		{func(w *Writer) { w.WriteBulkString("") }, "$0\r\n\r\n", "$0\r\n\r\n"},
+		{func(w *Writer) { w.WriteBulkNoCopy([]byte("v")) }, "$1\r\nv\r\n", "$1\r\nv\r\n"},
+		{func(w *Writer) { w.WriteNull() }, "$-1\r\n", "_\r\n"},
+		{func(w *Writer) { w.WriteArray(0) }, "*0\r\n", "*0\r\n"},
+		{func(w *Writer) { w.WriteMap(1) }, "*2\r\n", "%1\r\n"},
+		{func(w *Writer) { w.WriteSet(2) }, "*2\r\n", "~2\r\n"},
+		{func(w *Writer) { w.WritePush(2) }, "*2\r\n", ">2\r\n"},
+		{func(w *Writer) { w.WriteDouble(1.5) }, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{func(w *Writer) { w.WriteDouble(math.Inf(-1)) }, "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{func(w *Writer) { w.WriteDouble(math.Inf(1)) }, "$3\r\ninf\r\n", ",inf\r\n"},
+		{func(w *Writer) { w.WriteBool(true) }, ":1\r\n", "#t\r\n"},
+		{func(w *Writer) { w.WriteBool(false) }, ":0\r\n", "#f\r\n"},
+	} {
+		w := NewWriter(buffer.NewLinkBuffer(), 2)
+		tc.write(w)
+		assert.Equal(t, tc.resp2, written(w))
+		w = NewWriter(buffer.NewLinkBuffer(), 3)
+		assert.Equal(t, 3, w.Protocol())
+		tc.write(w)
+		assert.Equal(t, tc.res, written(w))
+	}
+}
+
+func TestWriter_WriteValue(t *testing.T) {
+	for _, input := range []string{
+		"+OK\r\n",
+		"-ERR x\r\n",
+		":7\r\n",
+		"$3\r\nabc\r\n",
+		"*2\r\n$1\r\na\r\n*1\r\n:1\r\n",
+		"_\r\n",
+		"#t\r\n",
+		",2.5\r\n",
+		"(12345678901234567890\r\n",
+		"!3\r\nbad\r\n",
+		"=8\r\ntxt:Some\r\n",
+		"%1\r\n+k\r\n:1\r\n",
+		"~1\r\n#f\r\n",
+		">1\r\n+hi\r\n",
+		"|1\r\n+ttl\r\n:3600\r\n:2\r\n",
+	} {
+		var p Parser
+		v, _, err := p.Parse([]byte(input))
+		require.NoError(t, err)
+		w := NewWriter(buffer.NewLinkBuffer(), 3)
+		w.WriteValue(v)
+		assert.Equal(t, input, written(w))
+
+		// RESP2 的输出可以被解析
+		w = NewWriter(buffer.NewLinkBuffer(), 2)
+		w.WriteValue(v)
+		out := written(w)
+		_, n, err := p.Parse([]byte(out))
+		require.NoError(t, err, out)
+		assert.Equal(t, len(out), n)
+	}
+}
+
+func TestWriter_WriteNullValue(t *testing.T) {
+	for _, v := range []Value{{Type: BulkString, IsNull: true}, {Type: Array, IsNull: true}} {
+		w := NewWriter(buffer.NewLinkBuffer(), 2)
+		w.WriteValue(v)
+		assert.Equal(t, string(v.Type)+"-1\r\n", written(w))
+		// RESP3 只有一种 null
+		w = NewWriter(buffer.NewLinkBuffer(), 3)
+		w.WriteValue(v)
+		assert.Equal(t, "_\r\n", written(w))
+	}
+}
+
+func TestAppendCommand(t *testing.T) {
+	assert.Equal(t, "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", string(AppendCommand(nil, "GET", "k")))
+}
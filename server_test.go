@@ -0,0 +1,282 @@
+package haijun_net
+
+import (
+	"bufio"
+	"io"
+	"io/ioutil"
+	"net"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type echoHandler struct {
+	BuiltinEventHandler
+
+	delay    time.Duration
+	inflight sync.Map // *HjConn -> *int32
+	overlap  int32
+}
+
+func (h *echoHandler) OnOpen(c *HjConn) Action {
+	h.inflight.Store(c, new(int32))
+	return None
+}
+
+func (h *echoHandler) OnTraffic(c *HjConn) Action {
+	v, _ := h.inflight.Load(c)
+	counter := v.(*int32)
+	if atomic.AddInt32(counter, 1) > 1 {
+		atomic.StoreInt32(&h.overlap, 1)
+	}
+	defer atomic.AddInt32(counter, -1)
+
+	time.Sleep(h.delay)
+	buf := make([]byte, c.InboundBuffered())
+	n, _ := c.Read(buf)
+	_, _ = c.Write(buf[:n])
+	return None
+}
+
+func serveTest(t *testing.T, handler EventHandler, opts ...Option) *HjListener {
+	l, err := NewHjListener("127.0.0.1:0", opts...)
+	require.NoError(t, err)
+	hl := l.(*HjListener)
+	go func() {
+		assert.NoError(t, hl.Serve(handler))
+	}()
+	t.Cleanup(func() { _ = hl.Close() })
+	return hl
+}
+
+func echoRoundTrip(t *testing.T, addr net.Addr, msg string, times int) {
+	c, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for i := 0; i < times; i++ {
+		_, err = c.Write([]byte(msg))
+		require.NoError(t, err)
+		buf := make([]byte, len(msg))
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+		_, err = io.ReadFull(r, buf)
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(buf))
+	}
+}
+
+func TestHjListener_Accept(t *testing.T) {
+	l, err := NewHjListener("127.0.0.1:0")
+	require.NoError(t, err)
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				_, _ = io.Copy(c, c)
+			}()
+		}
+	}()
+	echoRoundTrip(t, l.Addr(), "hello", 3)
+}
+
+func TestHjListener_Serve(t *testing.T) {
+	l := serveTest(t, &echoHandler{})
+	echoRoundTrip(t, l.Addr(), "hello", 3)
+}
+
+func TestHjListener_ServeWorkerPool(t *testing.T) {
+	h := &echoHandler{delay: 20 * time.Millisecond}
+	l := serveTest(t, h, WithWorkerPool(8, 64))
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			echoRoundTrip(t, l.Addr(), "ping", 5)
+		}()
+	}
+	wg.Wait()
+	// 阻塞的回调在工作池中并发执行，不会拖慢整个事件循环
+	assert.Less(t, time.Since(start), 8*5*20*time.Millisecond)
+	assert.EqualValues(t, 0, atomic.LoadInt32(&h.overlap), "callbacks of one conn ran concurrently")
+}
+
+func TestHjListener_CloseStopsLoop(t *testing.T) {
+	l, err := NewHjListener("127.0.0.1:0")
+	require.NoError(t, err)
+	hl := l.(*HjListener)
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	c, err := l.Accept()
+	require.NoError(t, err)
+	require.NoError(t, l.Close())
+
+	// 关闭监听后已接受的连接仍然可用
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	_, err = io.ReadFull(c, make([]byte, 5))
+	require.NoError(t, err)
+	assert.Greater(t, hl.manager.poller.Fd(), 0)
+
+	// 最后一个连接关闭后事件循环退出
+	require.NoError(t, c.Close())
+	assert.Eventually(t, func() bool { return hl.manager.poller.Fd() < 0 }, 5*time.Second, 10*time.Millisecond)
+}
+
+// engineGoroutines returns the stacks of the goroutines started by the engine.
+func engineGoroutines() []string {
+	buf := make([]byte, 1<<20)
+	var stacks []string
+	for _, g := range strings.Split(string(buf[:runtime.Stack(buf, true)]), "\n\n") {
+		if strings.Contains(g, "haijun-net") && !strings.Contains(g, "testing.tRunner") && !strings.Contains(g, "engineGoroutines") {
+			stacks = append(stacks, g)
+		}
+	}
+	return stacks
+}
+
+func TestHjListener_CloseReleasesWorkers(t *testing.T) {
+	l, err := NewHjListener("127.0.0.1:0", WithWorkerPool(4, 16))
+	require.NoError(t, err)
+	hl := l.(*HjListener)
+	served := make(chan error, 1)
+	go func() { served <- hl.Serve(&echoHandler{}) }()
+	echoRoundTrip(t, l.Addr(), "hello", 2)
+	assert.NotEmpty(t, engineGoroutines())
+	require.NoError(t, l.Close())
+	require.NoError(t, <-served)
+
+	// 事件循环退出后释放工作池，不留下任何 goroutine
+	assert.Eventually(t, func() bool { return hl.manager.poller.Fd() < 0 }, 5*time.Second, 10*time.Millisecond)
+	assert.Zero(t, hl.manager.workers.Running())
+	assert.Eventually(t, func() bool { return len(engineGoroutines()) == 0 }, 5*time.Second, 10*time.Millisecond,
+		"leaked goroutines")
+	assert.Empty(t, engineGoroutines())
+}
+
+type replyCloseHandler struct {
+	BuiltinEventHandler
+
+	reply []byte
+}
+
+func (h *replyCloseHandler) OnTraffic(c *HjConn) Action {
+	c.Discard(c.InboundBuffered())
+	_, _ = c.Write(h.reply)
+	return Shutdown
+}
+
+func TestHjListener_ShutdownFlushesOutbound(t *testing.T) {
+	// 回复远大于 socket 缓冲区，必须经过多次写事件才能发送完
+	reply := make([]byte, 8<<20)
+	for i := range reply {
+		reply[i] = byte(i)
+	}
+	for _, opts := range [][]Option{nil, {WithWorkerPool(4, 16)}} {
+		l := serveTest(t, &replyCloseHandler{reply: reply}, opts...)
+		c, err := net.Dial("tcp", l.Addr().String())
+		require.NoError(t, err)
+		_, err = c.Write([]byte("bye"))
+		require.NoError(t, err)
+		require.NoError(t, c.SetReadDeadline(time.Now().Add(10*time.Second)))
+		got, err := io.ReadAll(c)
+		require.NoError(t, err)
+		assert.Equal(t, reply, got)
+		_ = c.Close()
+	}
+}
+
+type blockingHandler struct {
+	BuiltinEventHandler
+
+	entered, release chan struct{}
+	closed           chan struct{}
+	inTraffic        int32
+	overlap          int32
+}
+
+func (h *blockingHandler) OnTraffic(c *HjConn) Action {
+	atomic.StoreInt32(&h.inTraffic, 1)
+	defer atomic.StoreInt32(&h.inTraffic, 0)
+	close(h.entered)
+	<-h.release
+	// 缓冲区仍然可用
+	_, _ = c.Read(make([]byte, c.InboundBuffered()))
+	return None
+}
+
+func (h *blockingHandler) OnClose(c *HjConn, err error) {
+	if atomic.LoadInt32(&h.inTraffic) == 1 {
+		atomic.StoreInt32(&h.overlap, 1)
+	}
+	close(h.closed)
+}
+
+func TestHjListener_CloseDuringOnTraffic(t *testing.T) {
+	h := &blockingHandler{entered: make(chan struct{}), release: make(chan struct{}), closed: make(chan struct{})}
+	l := serveTest(t, h)
+	var conn *HjConn
+	client, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	_, err = client.Write([]byte("hello"))
+	require.NoError(t, err)
+	select {
+	case <-h.entered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnTraffic isn't called")
+	}
+	l.manager.connMap.Range(func(_, v interface{}) bool {
+		conn = v.(*HjConn)
+		return false
+	})
+	require.NotNil(t, conn)
+
+	// 在其他 goroutine 中关闭，OnClose 要等 OnTraffic 返回
+	require.NoError(t, conn.Close())
+	select {
+	case <-h.closed:
+		t.Fatal("OnClose runs while OnTraffic is running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(h.release)
+	select {
+	case <-h.closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose isn't called")
+	}
+	assert.EqualValues(t, 0, atomic.LoadInt32(&h.overlap))
+}
+
+func TestNewHjListener_ErrorClosesFds(t *testing.T) {
+	busy, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer busy.Close()
+
+	fds := func() int {
+		entries, err := ioutil.ReadDir("/proc/self/fd")
+		require.NoError(t, err)
+		return len(entries)
+	}
+	before := fds()
+	for i := 0; i < 10; i++ {
+		// 端口已被占用，bind 失败
+		_, err = NewHjListener(busy.Addr().String())
+		require.Error(t, err)
+	}
+	assert.Equal(t, before, fds())
+}
@@ -0,0 +1,224 @@
+package haijun_net
+
+import (
+	"math"
+	"math/bits"
+	"sync"
+	"time"
+
+	"github.com/Ccheers/haijun-net/internal/poller"
+)
+
+// Limit is the bandwidth of a token bucket.
+type Limit struct {
+	// Rate is the number of bytes per second, zero means unlimited.
+	Rate int
+	// Burst is the maximum number of bytes transferred at once, it's Rate when it is zero.
+	Burst int
+}
+
+func (l Limit) burst() float64 {
+	if l.Burst > 0 {
+		return float64(l.Burst)
+	}
+	return float64(l.Rate)
+}
+
+// TokenBucket limits the bandwidth of the conns, it's safe for concurrent use so one bucket can be shared
+// by all the conns as a global limit, see Options.ReadBucket and Options.WriteBucket.
+type TokenBucket struct {
+	mu     sync.Mutex
+	limit  Limit
+	tokens float64
+	last   time.Time
+}
+
+// NewTokenBucket returns a full bucket of limit.
+func NewTokenBucket(limit Limit) *TokenBucket {
+	return &TokenBucket{limit: limit, tokens: limit.burst(), last: time.Now()}
+}
+
+// SetLimit changes the limit at runtime, the tokens already in the bucket are kept up to the new burst.
+func (b *TokenBucket) SetLimit(limit Limit) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.advance(time.Now())
+	b.limit = limit
+	if burst := limit.burst(); b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// Limit returns the current limit.
+func (b *TokenBucket) Limit() Limit {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.limit
+}
+
+// advance refills the bucket for the time elapsed since the last refill.
+func (b *TokenBucket) advance(now time.Time) {
+	if elapsed := now.Sub(b.last); elapsed > 0 {
+		b.tokens = math.Min(b.limit.burst(), b.tokens+elapsed.Seconds()*float64(b.limit.Rate))
+		b.last = now
+	}
+}
+
+// available returns the number of bytes that can be transferred now, or the delay until
+// there is any when it's zero.
+func (b *TokenBucket) available(now time.Time) (int, time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.limit.Rate <= 0 {
+		return math.MaxInt32, 0
+	}
+	b.advance(now)
+	if b.tokens >= 1 {
+		return int(b.tokens), 0
+	}
+	return 0, time.Duration((1 - b.tokens) / float64(b.limit.Rate) * float64(time.Second))
+}
+
+// consume takes n tokens, the bucket goes into debt when other conns sharing it have taken the tokens
+// in the meantime, and the debt is repaid before any conn transfers again.
+func (b *TokenBucket) consume(n int) {
+	b.mu.Lock()
+	if b.limit.Rate > 0 {
+		b.tokens -= float64(n)
+	}
+	b.mu.Unlock()
+}
+
+// quota returns the number of bytes allowed by all the buckets, or the delay until
+// all of them allow some bytes when it's zero, nil buckets are skipped.
+func quota(now time.Time, buckets ...*TokenBucket) (n int, wait time.Duration) {
+	n = math.MaxInt32
+	for _, b := range buckets {
+		if b == nil {
+			continue
+		}
+		avail, delay := b.available(now)
+		if avail < n {
+			n = avail
+		}
+		if delay > wait {
+			wait = delay
+		}
+	}
+	return
+}
+
+// consume takes n tokens from all the buckets, nil buckets are skipped.
+func consume(n int, buckets ...*TokenBucket) {
+	for _, b := range buckets {
+		if b != nil {
+			b.consume(n)
+		}
+	}
+}
+
+// pause reasons of the read and write interests of a conn
+const (
+	pauseShaping uint8 = 1 << iota
+	pauseBufferFull
+	pauseMemory
+	// the conn is closed once its outbound data is sent, see shutdown
+	pauseClosing
+	// the data received during the TLS handshake has filled the inbound buffer, see readTLS
+	pauseHandshake
+
+	pauseReasons = iota
+)
+
+// resumeTimers are the timers resuming a conn, one per pause reason, so that a pause for one reason
+// doesn't prevent the conn from being resumed from another one.
+type resumeTimers [pauseReasons]*loopTimer
+
+// slot returns the timer of reason.
+func (ts *resumeTimers) slot(reason uint8) **loopTimer {
+	return &ts[bits.TrailingZeros8(reason)]
+}
+
+// updateInterest renews the events the conn is polled for, it must be called with conn.mu held.
+// The conn is polled for readable unless reading is paused, and for writable when there is outbound data
+// and writing isn't paused.
+func (m *connManager) updateInterest(conn *HjConn) error {
+	var mode poller.PollMode
+	if conn.readPaused == 0 {
+		mode |= poller.PollModeRead
+	}
+	if conn.writePaused == 0 && conn.writeBuffer != nil && !conn.writeBuffer.IsEmpty() {
+		mode |= poller.PollModeWrite
+	}
+	return m.poller.Mod(conn.fd, mode)
+}
+
+// readingPaused reports whether reading the conn is paused for any reason.
+func (h *HjConn) readingPaused() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.readPaused != 0
+}
+
+// pauseRead stops reading the conn for d because of reason, or until it's resumed explicitly when d is zero,
+// it must be called on the event loop with conn.mu held.
+func (m *connManager) pauseRead(conn *HjConn, reason uint8, d time.Duration) {
+	conn.readPaused |= reason
+	_ = m.updateInterest(conn)
+	if d > 0 {
+		m.resumeAfter(conn, conn.readResume.slot(reason), &conn.readPaused, reason, d)
+	}
+}
+
+// pauseWrite stops writing the conn for d because of reason, it must be called on the event loop
+// with conn.mu held.
+func (m *connManager) pauseWrite(conn *HjConn, reason uint8, d time.Duration) {
+	conn.writePaused |= reason
+	_ = m.updateInterest(conn)
+	m.resumeAfter(conn, conn.writeResume.slot(reason), &conn.writePaused, reason, d)
+}
+
+// resumeAfter clears reason from paused after d, unless the timer of reason is already running.
+func (m *connManager) resumeAfter(conn *HjConn, timer **loopTimer, paused *uint8, reason uint8, d time.Duration) {
+	if *timer != nil {
+		return
+	}
+	*timer = m.afterFunc(d, func() {
+		*timer = nil
+		m.resume(conn, paused, reason)
+	})
+}
+
+func (m *connManager) resume(conn *HjConn, paused *uint8, reason uint8) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+	*paused &^= reason
+	if !conn.isClosed() {
+		_ = m.updateInterest(conn)
+	}
+}
+
+// SetReadLimit changes the inbound bandwidth of the conn at runtime, a zero Rate removes the limit.
+func (h *HjConn) SetReadLimit(limit Limit) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.readBucket = setBucketLimit(h.readBucket, limit)
+}
+
+// SetWriteLimit changes the outbound bandwidth of the conn at runtime, a zero Rate removes the limit.
+func (h *HjConn) SetWriteLimit(limit Limit) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.writeBucket = setBucketLimit(h.writeBucket, limit)
+}
+
+func setBucketLimit(b *TokenBucket, limit Limit) *TokenBucket {
+	if limit.Rate <= 0 {
+		return nil
+	}
+	if b == nil {
+		return NewTokenBucket(limit)
+	}
+	b.SetLimit(limit)
+	return b
+}
@@ -0,0 +1,113 @@
+package haijun_net
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Ccheers/haijun-net/internal/poller"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+)
+
+func TestTokenBucket(t *testing.T) {
+	b := NewTokenBucket(Limit{Rate: 1000, Burst: 100})
+	now := time.Now()
+	n, wait := quota(now, b, nil)
+	assert.Equal(t, 100, n)
+	assert.Zero(t, wait)
+
+	b.consume(150)
+	n, wait = quota(now, b)
+	assert.Equal(t, 0, n)
+	// 欠下的 50 个令牌要先还清
+	assert.InDelta(t, 51*time.Millisecond, wait, float64(2*time.Millisecond))
+
+	n, _ = quota(now.Add(100*time.Millisecond), b)
+	assert.Equal(t, 50, n)
+
+	b.SetLimit(Limit{Rate: 1000, Burst: 10})
+	n, _ = quota(now.Add(time.Second), b)
+	assert.Equal(t, 10, n)
+
+	b.SetLimit(Limit{})
+	b.consume(1 << 20)
+	n, wait = quota(now, b)
+	assert.Greater(t, n, 1<<20)
+	assert.Zero(t, wait)
+}
+
+func shapingRoundTrip(t *testing.T, addr net.Addr, size int) time.Duration {
+	c, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	defer c.Close()
+
+	msg := bytes.Repeat([]byte("x"), size)
+	start := time.Now()
+	go func() { _, _ = c.Write(msg) }()
+	_ = c.SetReadDeadline(time.Now().Add(10 * time.Second))
+	_, err = io.ReadFull(c, make([]byte, size))
+	require.NoError(t, err)
+	return time.Since(start)
+}
+
+func TestWithConnBandwidth(t *testing.T) {
+	// 突发 16KB 之后每秒 64KB，64KB 至少需要 0.75s
+	limit := Limit{Rate: 64 << 10, Burst: 16 << 10}
+	l := serveTest(t, &echoHandler{}, WithConnBandwidth(limit, Limit{}))
+	assert.GreaterOrEqual(t, shapingRoundTrip(t, l.Addr(), 64<<10), 700*time.Millisecond)
+
+	l = serveTest(t, &echoHandler{}, WithConnBandwidth(Limit{}, limit))
+	assert.GreaterOrEqual(t, shapingRoundTrip(t, l.Addr(), 64<<10), 700*time.Millisecond)
+}
+
+func TestWithBandwidth_SetLimit(t *testing.T) {
+	in := NewTokenBucket(Limit{Rate: 1, Burst: 1024})
+	l := serveTest(t, &echoHandler{}, WithBandwidth(in, nil))
+
+	// 两个连接共享 1KB 的突发，之后被全局限速卡住，放开限速后立即完成
+	go func() {
+		time.Sleep(300 * time.Millisecond)
+		in.SetLimit(Limit{})
+	}()
+	done := make(chan time.Duration, 2)
+	for i := 0; i < 2; i++ {
+		go func() { done <- shapingRoundTrip(t, l.Addr(), 4<<10) }()
+	}
+	for i := 0; i < 2; i++ {
+		d := <-done
+		assert.GreaterOrEqual(t, d, 250*time.Millisecond)
+		assert.Less(t, d, 5*time.Second)
+	}
+}
+
+func TestPauseRead_ResumesEachReason(t *testing.T) {
+	p, err := poller.NewPoller()
+	require.NoError(t, err)
+	defer p.Close()
+	fds, err := unix.Socketpair(unix.AF_UNIX, unix.SOCK_STREAM, 0)
+	require.NoError(t, err)
+	defer unix.Close(fds[0])
+	defer unix.Close(fds[1])
+	require.NoError(t, p.Register(fds[0], poller.PollModeRead))
+
+	m := &connManager{poller: p, opts: loadOptions()}
+	conn := &HjConn{fd: fds[0]}
+	// 限速的定时器还没到期时又因为内存暂停，两个原因都要按时恢复
+	conn.mu.Lock()
+	m.pauseRead(conn, pauseShaping, 10*time.Millisecond)
+	m.pauseRead(conn, pauseMemory, 20*time.Millisecond)
+	m.pauseWrite(conn, pauseShaping, 10*time.Millisecond)
+	conn.mu.Unlock()
+
+	time.Sleep(15 * time.Millisecond)
+	m.runTimers()
+	assert.Equal(t, pauseMemory, conn.readPaused)
+	assert.Zero(t, conn.writePaused)
+	time.Sleep(10 * time.Millisecond)
+	m.runTimers()
+	assert.Zero(t, conn.readPaused)
+}
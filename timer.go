@@ -0,0 +1,80 @@
+package haijun_net
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// loopTimer is a timer run by the event loop, see connManager.afterFunc.
+type loopTimer struct {
+	when   time.Time
+	period time.Duration // 大于 0 时为周期定时器
+	f      func()
+	index  int // index in the heap, -1 when it's not scheduled
+}
+
+// timerQueue is the timer facility of an event loop, the timers are checked in every iteration of the loop,
+// so their resolution is bounded by the timeout of the poller.
+type timerQueue struct {
+	mu     sync.Mutex
+	timers timerHeap
+}
+
+func (q *timerQueue) add(t *loopTimer) {
+	q.mu.Lock()
+	heap.Push(&q.timers, t)
+	q.mu.Unlock()
+}
+
+func (q *timerQueue) stop(t *loopTimer) {
+	q.mu.Lock()
+	if t.index >= 0 {
+		heap.Remove(&q.timers, t.index)
+	}
+	t.period = 0
+	q.mu.Unlock()
+}
+
+// expired pops the timers expired at now, the periodic timers are scheduled again.
+func (q *timerQueue) expired(now time.Time, buf []*loopTimer) []*loopTimer {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.timers) > 0 && !q.timers[0].when.After(now) {
+		t := q.timers[0]
+		buf = append(buf, t)
+		if t.period > 0 {
+			t.when = now.Add(t.period)
+			heap.Fix(&q.timers, 0)
+		} else {
+			heap.Pop(&q.timers)
+		}
+	}
+	return buf
+}
+
+type timerHeap []*loopTimer
+
+func (h timerHeap) Len() int           { return len(h) }
+func (h timerHeap) Less(i, j int) bool { return h[i].when.Before(h[j].when) }
+func (h timerHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *timerHeap) Push(x interface{}) {
+	t := x.(*loopTimer)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *timerHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	t := old[n-1]
+	old[n-1] = nil
+	t.index = -1
+	*h = old[:n-1]
+	return t
+}
@@ -0,0 +1,562 @@
+package haijun_net
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	goio "io"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ccheers/haijun-net/buffer"
+)
+
+var (
+	// ErrTLSHandshakeTimeout is the reason of closing the conns which don't finish the TLS handshake within
+	// Options.TLSHandshakeTimeout.
+	ErrTLSHandshakeTimeout = errors.New("tls handshake timeout")
+
+	errTLSHandshaking = errors.New("tls handshake isn't complete")
+	errNoCertificates = errors.New("tls: neither Certificates, GetCertificate nor GetConfigForClient is set")
+)
+
+const (
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultMaxTLSHandshakes    = 1024
+	// tlsRecordSize is the max plaintext of a TLS record, the data written by WriteBuffer is encrypted
+	// in pieces of this size so that every record is full.
+	tlsRecordSize = 16 << 10
+	// tlsReadSize is the max ciphertext read from the socket at once.
+	tlsReadSize = 64 << 10
+)
+
+// wouldBlock is returned by tlsTransport.Read when all the ciphertext fed by the event loop has been
+// consumed. It's temporary, so crypto/tls keeps the partial record and goes on with it on the next Read.
+type wouldBlock struct{}
+
+func (wouldBlock) Error() string   { return "tls transport would block" }
+func (wouldBlock) Timeout() bool   { return true }
+func (wouldBlock) Temporary() bool { return true }
+
+// tlsTransport terminates TLS for a conn: it's the net.Conn under the crypto/tls conn, the ciphertext read
+// by the event loop is fed to it and the ciphertext written by crypto/tls is queued to the outbound buffer.
+//
+// crypto/tls can't suspend a handshake, so the handshake runs on a goroutine which waits for the ciphertext
+// fed by the event loop and never touches the socket, at most Options.MaxTLSHandshakes of them run at once.
+// After that the records are decrypted on the event loop into the inbound buffer, and the data written
+// to the conn is encrypted on the goroutine calling Write, nothing blocks.
+type tlsTransport struct {
+	hc    *HjConn
+	tc    *tls.Conn
+	start time.Time
+	timer *loopTimer
+
+	mu   sync.Mutex
+	cond sync.Cond
+	// in is the ciphertext which hasn't been consumed by crypto/tls: a copy during the handshake,
+	// and the data just read by the event loop after it
+	in          []byte
+	handshaking bool
+	// eof is set when the peer closes the conn during the handshake, it's handled after the handshake
+	// so that the data sent before is delivered
+	eof    bool
+	closed bool
+
+	// established is set to 1 on the event loop once the conn is handed off after the handshake
+	established int32
+	// kernelTX and kernelRX are set when the kernel takes over the encryption or the decryption, see
+	// Options.KernelTLS, they are set before the conn is handed off and never change after it
+	kernelTX bool
+	kernelRX bool
+	// clientHead and serverHead are the heads of the hello messages, kTLS needs their randoms
+	clientHead []byte
+	serverHead []byte
+}
+
+func newTLSTransport(hc *HjConn, config *tls.Config) *tlsTransport {
+	t := &tlsTransport{hc: hc, handshaking: true, start: time.Now()}
+	t.cond.L = &t.mu
+	t.tc = tls.Server(t, config)
+	return t
+}
+
+// Read passes the ciphertext to crypto/tls, it waits for the event loop during the handshake,
+// and returns wouldBlock after it.
+func (t *tlsTransport) Read(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for len(t.in) == 0 {
+		if t.closed || t.eof {
+			return 0, goio.EOF
+		}
+		if !t.handshaking {
+			return 0, wouldBlock{}
+		}
+		t.cond.Wait()
+	}
+	n := copy(p, t.in)
+	t.in = t.in[n:]
+	return n, nil
+}
+
+// Write queues the ciphertext written by crypto/tls to the outbound buffer, the memory budget has been
+// checked against the plaintext by HjConn.Write.
+func (t *tlsTransport) Write(b []byte) (int, error) {
+	if t.kernelTX {
+		// crypto/tls 自己发出的记录，如回应 KeyUpdate 的 KeyUpdate，会被内核再加密一次，
+		// 内核的密钥也无法更新，只能让 crypto/tls 出错并关闭连接
+		return 0, errKTLSWrite
+	}
+	h := t.hc
+	if h.manager.keyLog != nil && len(t.serverHead) < helloHeadSize {
+		t.serverHead = appendHead(t.serverHead, b)
+	}
+	h.mu.Lock()
+	if h.released || h.isClosed() {
+		h.mu.Unlock()
+		return 0, net.ErrClosed
+	}
+	h.manager.memory.add(len(b))
+	if h.writeBuffer == nil {
+		h.manager.newWriteBuffer(h, len(b))
+	}
+	n, _ := h.writeBuffer.Write(b)
+	err := h.queued(n)
+	h.mu.Unlock()
+	if o := h.manager.opts.Observer; o != nil && n > 0 {
+		o.OnWriteQueued(h, n)
+	}
+	return n, err
+}
+
+// Close wakes up the handshake waiting for data, it's called when the conn is closed.
+func (t *tlsTransport) Close() error {
+	t.mu.Lock()
+	t.closed = true
+	t.in = nil
+	t.cond.Broadcast()
+	t.mu.Unlock()
+	return nil
+}
+
+func (t *tlsTransport) LocalAddr() net.Addr                { return t.hc.LocalAddr() }
+func (t *tlsTransport) RemoteAddr() net.Addr               { return t.hc.RemoteAddr() }
+func (t *tlsTransport) SetDeadline(_ time.Time) error      { return nil }
+func (t *tlsTransport) SetReadDeadline(_ time.Time) error  { return nil }
+func (t *tlsTransport) SetWriteDeadline(_ time.Time) error { return nil }
+
+// feed passes the ciphertext read by the event loop to the handshake, it reports false when the handshake
+// is over, in which case the caller decrypts p by decrypt.
+func (t *tlsTransport) feed(p []byte) (fed bool, buffered int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.handshaking {
+		return false, 0
+	}
+	t.in = append(t.in, p...)
+	if t.hc.manager.keyLog != nil {
+		t.clientHead = appendHead(t.clientHead, p)
+	}
+	t.cond.Signal()
+	return true, len(t.in)
+}
+
+// feedEOF passes the EOF of the peer to the handshake, it reports false when the handshake is over.
+func (t *tlsTransport) feedEOF() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if !t.handshaking {
+		return false
+	}
+	t.eof = true
+	t.cond.Signal()
+	return true
+}
+
+// write encrypts b and queues the records to the outbound buffer.
+func (t *tlsTransport) write(b []byte) (int, error) {
+	if atomic.LoadInt32(&t.established) == 0 {
+		return 0, errTLSHandshaking
+	}
+	m := t.hc.manager
+	// 按明文大小检查预算，密文在排队时计入
+	if !m.memory.reserve(len(b), "write") {
+		return 0, ErrMemoryBudget
+	}
+	defer m.memory.add(-len(b))
+	return t.tc.Write(b)
+}
+
+// writeBuffer encrypts the data of b in full records, b is left empty.
+func (t *tlsTransport) writeBuffer(b *buffer.LinkBuffer) (n int, err error) {
+	for !b.IsEmpty() && err == nil {
+		size := b.Len()
+		if size > tlsRecordSize {
+			size = tlsRecordSize
+		}
+		var p []byte
+		if p, err = b.Peek(size); err != nil {
+			break
+		}
+		var w int
+		w, err = t.write(p)
+		n += w
+		_ = b.Skip(size)
+	}
+	b.Release()
+	return n, err
+}
+
+// decrypt decrypts the records of p and those left by the handshake into the inbound buffer, it reports
+// whether any plaintext was produced. It returns io.EOF when the peer has sent close_notify.
+func (t *tlsTransport) decrypt(p []byte, plain []byte) (bool, error) {
+	t.mu.Lock()
+	if len(p) > 0 {
+		t.in = p
+	}
+	t.mu.Unlock()
+	defer func() {
+		// 不持有事件循环的缓冲区
+		t.mu.Lock()
+		t.in = nil
+		t.mu.Unlock()
+	}()
+
+	produced := false
+	for {
+		n, err := t.tc.Read(plain)
+		if n > 0 {
+			t.hc.appendInbound(plain[:n])
+			produced = true
+		}
+		if err != nil {
+			if _, ok := err.(wouldBlock); ok {
+				err = nil
+			}
+			return produced, err
+		}
+	}
+}
+
+// closeNotify sends close_notify before the conn is shut down, so that the peer can tell it from
+// a truncation attack. The kernel sends it by closeNotifyKernel instead.
+func (t *tlsTransport) closeNotify() {
+	if atomic.LoadInt32(&t.established) == 1 && !t.kernelTX {
+		_ = t.tc.CloseWrite()
+	}
+}
+
+// appendInbound appends the plaintext decrypted by the event loop to the inbound buffer.
+func (h *HjConn) appendInbound(p []byte) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.released || h.isClosed() {
+		return
+	}
+	if h.readBuffer == nil && !h.manager.allocReadBuffer(h) {
+		// 明文已经从 crypto/tls 取出，超出预算也只能缓存
+		h.manager.memory.add(minBufferSize)
+		h.readBuffer = buffer.NewLinkBufferSize(minBufferSize)
+		h.readLimit = minBufferSize
+	}
+	_, _ = h.readBuffer.Write(p)
+	if l := h.readBuffer.Len(); l > h.readPeak {
+		h.readPeak = l
+	}
+}
+
+// ConnectionState returns the state of the TLS conn, such as the protocol negotiated by ALPN and the server
+// name sent by the client, ok is false if the conn doesn't use TLS. It's available since OnOpen, or once
+// the conn is returned by Accept.
+func (h *HjConn) ConnectionState() (state tls.ConnectionState, ok bool) {
+	if h.tls == nil || atomic.LoadInt32(&h.tls.established) == 0 {
+		return tls.ConnectionState{}, false
+	}
+	return h.tls.tc.ConnectionState(), true
+}
+
+// startTLS starts the handshake of the conn, it's called before the conn is registered.
+func (m *connManager) startTLS(conn *HjConn) {
+	t := newTLSTransport(conn, m.tlsConfig)
+	conn.tls = t
+	t.timer = m.afterFunc(m.opts.tlsHandshakeTimeout(), func() {
+		if atomic.LoadInt32(&t.established) == 0 && !conn.isClosed() {
+			m.opts.Logger.Debug("tls handshake timeout", "fd", conn.fd, "remote_addr", conn.remoteAddr, "loop", m.idx)
+			// 关闭后握手随即失败，结果由 tlsHandshakeDone 统计
+			_ = m.closeConn(conn, ErrTLSHandshakeTimeout)
+		}
+	})
+	m.handshakeMu.Lock()
+	if m.handshaking >= m.opts.maxTLSHandshakes() {
+		// 等待进行中的握手结束，期间收到的密文缓存在 t.in 中
+		m.waitingHandshakes = append(m.waitingHandshakes, conn)
+		m.handshakeMu.Unlock()
+		return
+	}
+	m.handshaking++
+	m.handshakeMu.Unlock()
+	go m.handshake(conn)
+}
+
+// handshake runs the handshake of conn, and then those of the conns waiting for a free slot.
+func (m *connManager) handshake(conn *HjConn) {
+	for conn != nil {
+		c := conn
+		err := c.tls.tc.Handshake()
+		// 回到事件循环中交付连接，保证回调不会并发执行
+		m.afterFunc(0, func() { m.tlsHandshakeDone(c, err) })
+		conn = m.nextHandshake()
+	}
+}
+
+// nextHandshake returns the conn waiting longest for its handshake, or frees the slot if none is waiting.
+// The conns closed meanwhile are returned too, their handshakes fail at once.
+func (m *connManager) nextHandshake() *HjConn {
+	m.handshakeMu.Lock()
+	defer m.handshakeMu.Unlock()
+	if len(m.waitingHandshakes) == 0 {
+		m.handshaking--
+		return nil
+	}
+	conn := m.waitingHandshakes[0]
+	m.waitingHandshakes[0] = nil
+	m.waitingHandshakes = m.waitingHandshakes[1:]
+	return conn
+}
+
+// tlsHandshakeDone hands the conn off once its handshake is over, it runs on the event loop.
+func (m *connManager) tlsHandshakeDone(conn *HjConn, err error) {
+	t := conn.tls
+	m.stopTimer(t.timer)
+	var keys *ktlsKeys
+	if m.keyLog != nil {
+		// 握手失败时也要取出，不留在内存中
+		keys = m.keyLog.take(helloRandom(t.clientHead, 1))
+	}
+	if err != nil {
+		m.opts.Logger.Debug("tls handshake", "fd", conn.fd, "remote_addr", conn.remoteAddr, "loop", m.idx, "error", err)
+		m.metrics.tlsHandshake("error").Inc()
+		_ = m.closeConn(conn, err)
+		return
+	}
+	result := "full"
+	if t.tc.ConnectionState().DidResume {
+		result = "resumed"
+	}
+	m.metrics.tlsHandshake(result).Inc()
+	m.metrics.tlsHandshakeSeconds.ObserveDuration(time.Since(t.start))
+	if conn.isClosed() {
+		return
+	}
+
+	t.mu.Lock()
+	t.handshaking = false
+	t.mu.Unlock()
+	atomic.StoreInt32(&t.established, 1)
+	// 握手期间到达的应用数据留在 crypto/tls 和 t.in 中，对端已经关闭时 decrypt 返回 EOF
+	produced, err := t.decrypt(nil, m.tlsPlain())
+	if err == nil && m.keyLog != nil {
+		m.offloadTLS(conn, keys)
+	}
+	conn.mu.Lock()
+	if conn.readPaused&pauseHandshake != 0 && !conn.isClosed() {
+		conn.readPaused &^= pauseHandshake
+		_ = m.updateInterest(conn)
+	}
+	conn.mu.Unlock()
+	if !m.handOff(conn) {
+		return
+	}
+	if produced {
+		m.notifyReadable(conn)
+	}
+	if err != nil {
+		if err == goio.EOF {
+			err = nil
+		}
+		_ = m.closeConn(conn, err)
+	}
+}
+
+// readTLS handles the ciphertext p read from the conn.
+func (m *connManager) readTLS(conn *HjConn, p []byte) error {
+	t := conn.tls
+	fed, buffered := t.feed(p)
+	if fed {
+		conn.mu.Lock()
+		if buffered >= conn.readLimit && !conn.isClosed() {
+			// 握手未完成时 crypto/tls 不会读取应用数据，暂停读取直到握手完成
+			m.pauseRead(conn, pauseHandshake, 0)
+		}
+		conn.mu.Unlock()
+		return nil
+	}
+	produced, err := t.decrypt(p, m.tlsPlain())
+	if produced {
+		m.notifyReadable(conn)
+	}
+	return err
+}
+
+// tlsEOF defers the EOF of the conn until its handshake is over, it reports false when the handshake
+// is over and the conn should be closed now.
+func (m *connManager) tlsEOF(conn *HjConn) bool {
+	if !conn.tls.feedEOF() {
+		return false
+	}
+	conn.mu.Lock()
+	if !conn.isClosed() {
+		// 水平触发下 EOF 会一直可读
+		m.pauseRead(conn, pauseHandshake, 0)
+	}
+	conn.mu.Unlock()
+	return true
+}
+
+// tlsReadBuffer returns the buffer the ciphertext is read into, it's shared by the conns of the event loop.
+func (m *connManager) tlsReadBuffer() []byte {
+	if m.tlsIn == nil {
+		m.tlsIn = make([]byte, tlsReadSize)
+	}
+	return m.tlsIn
+}
+
+// tlsPlain returns the buffer the records are decrypted into, it's shared by the conns of the event loop.
+func (m *connManager) tlsPlain() []byte {
+	if m.tlsOut == nil {
+		m.tlsOut = make([]byte, tlsRecordSize)
+	}
+	return m.tlsOut
+}
+
+// validateTLS checks that the TLS config can serve a handshake.
+func (o *Options) validateTLS() error {
+	c := o.TLSConfig
+	if c == nil {
+		return nil
+	}
+	if len(c.Certificates) == 0 && c.GetCertificate == nil && c.GetConfigForClient == nil {
+		return errNoCertificates
+	}
+	return nil
+}
+
+func (o *Options) maxTLSHandshakes() int {
+	if o.MaxTLSHandshakes > 0 {
+		return o.MaxTLSHandshakes
+	}
+	return defaultMaxTLSHandshakes
+}
+
+func (o *Options) tlsHandshakeTimeout() time.Duration {
+	if o.TLSHandshakeTimeout > 0 {
+		return o.TLSHandshakeTimeout
+	}
+	return defaultTLSHandshakeTimeout
+}
+
+// CertStore holds the certificates of a TLS server and selects them by the server name the client asks for
+// (SNI). The certificates can be replaced at runtime, e.g. when they are renewed, the new handshakes use them
+// right away while the established conns are kept. Use it by setting tls.Config.GetCertificate to
+// CertStore.GetCertificate, the session tickets issued before a reload are still accepted after it.
+type CertStore struct {
+	v atomic.Value // *certSet
+}
+
+// CertFile is the pair of PEM files of a certificate, see CertStore.LoadFiles.
+type CertFile struct {
+	Cert string
+	Key  string
+}
+
+type certSet struct {
+	all []*tls.Certificate
+	// byName maps a lower case DNS name, or a wildcard such as "*.example.com", to its certificates
+	byName map[string][]*tls.Certificate
+}
+
+// NewCertStore returns a CertStore holding certs, see Set.
+func NewCertStore(certs ...tls.Certificate) (*CertStore, error) {
+	s := new(CertStore)
+	if err := s.Set(certs...); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// Set replaces the certificates. A certificate is selected for the names of its leaf, the first one is
+// used when the client sends no server name or none of them matches.
+func (s *CertStore) Set(certs ...tls.Certificate) error {
+	if len(certs) == 0 {
+		return errors.New("tls: no certificate")
+	}
+	set := &certSet{byName: make(map[string][]*tls.Certificate)}
+	for i := range certs {
+		cert := certs[i]
+		if len(cert.Certificate) == 0 {
+			return errors.New("tls: empty certificate")
+		}
+		leaf := cert.Leaf
+		if leaf == nil {
+			var err error
+			if leaf, err = x509.ParseCertificate(cert.Certificate[0]); err != nil {
+				return fmt.Errorf("tls: parse certificate: %w", err)
+			}
+			cert.Leaf = leaf
+		}
+		set.all = append(set.all, &cert)
+		names := leaf.DNSNames
+		if len(names) == 0 && leaf.Subject.CommonName != "" {
+			names = []string{leaf.Subject.CommonName}
+		}
+		for _, name := range names {
+			name = strings.ToLower(name)
+			set.byName[name] = append(set.byName[name], &cert)
+		}
+	}
+	s.v.Store(set)
+	return nil
+}
+
+// LoadFiles loads the certificates from the PEM files and replaces the current ones with them, the current
+// ones are kept if any file fails to load. It's meant to be called when the files are renewed, e.g. on SIGHUP.
+func (s *CertStore) LoadFiles(files ...CertFile) error {
+	certs := make([]tls.Certificate, 0, len(files))
+	for _, f := range files {
+		cert, err := tls.LoadX509KeyPair(f.Cert, f.Key)
+		if err != nil {
+			return err
+		}
+		certs = append(certs, cert)
+	}
+	return s.Set(certs...)
+}
+
+// GetCertificate selects the certificate for the handshake, it's meant to be tls.Config.GetCertificate.
+// Among the certificates of the server name, the first one supported by the client is selected.
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	set, _ := s.v.Load().(*certSet)
+	if set == nil {
+		return nil, errors.New("tls: no certificate")
+	}
+	name := strings.TrimSuffix(strings.ToLower(hello.ServerName), ".")
+	candidates := set.byName[name]
+	if len(candidates) == 0 {
+		if i := strings.IndexByte(name, '.'); i > 0 {
+			candidates = set.byName["*"+name[i:]]
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = set.all
+	}
+	for _, cert := range candidates {
+		if hello.SupportsCertificate(cert) == nil {
+			return cert, nil
+		}
+	}
+	return candidates[0], nil
+}
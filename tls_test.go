@@ -0,0 +1,406 @@
+package haijun_net
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testCA issues the certificates of the TLS tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pool *x509.CertPool
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testCA{cert: cert, key: key, pool: pool}
+}
+
+func (ca *testCA) issue(t *testing.T, cn string, names ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: cn},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func (ca *testCA) clientConfig(serverName string) *tls.Config {
+	return &tls.Config{RootCAs: ca.pool, ServerName: serverName}
+}
+
+func tlsDial(t *testing.T, addr net.Addr, config *tls.Config) *tls.Conn {
+	c, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", addr.String(), config)
+	require.NoError(t, err)
+	require.NoError(t, c.SetDeadline(time.Now().Add(10*time.Second)))
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// tlsEchoHandler echoes the data and records the TLS state seen by OnOpen.
+type tlsEchoHandler struct {
+	BuiltinEventHandler
+
+	mu     sync.Mutex
+	states []tls.ConnectionState
+}
+
+func (h *tlsEchoHandler) OnOpen(c *HjConn) Action {
+	state, ok := c.ConnectionState()
+	if ok {
+		h.mu.Lock()
+		h.states = append(h.states, state)
+		h.mu.Unlock()
+	}
+	return None
+}
+
+func (h *tlsEchoHandler) OnTraffic(c *HjConn) Action {
+	b, err := c.Next(c.InboundBuffered())
+	if err != nil {
+		return Close
+	}
+	data, _ := b.Peek(b.Len())
+	bye := bytes.HasSuffix(data, []byte("bye\n"))
+	_, _ = c.WriteBuffer(b)
+	if bye {
+		return Shutdown
+	}
+	return None
+}
+
+func (h *tlsEchoHandler) lastState() tls.ConnectionState {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.states[len(h.states)-1]
+}
+
+func TestTLS_Echo(t *testing.T) {
+	ca := newTestCA(t)
+	store, err := NewCertStore(ca.issue(t, "default", "default.test"))
+	require.NoError(t, err)
+	config := &tls.Config{GetCertificate: store.GetCertificate, NextProtos: []string{"h2", "http/1.1"}}
+
+	for name, opts := range map[string][]Option{
+		"loop":         {WithTLS(config)},
+		"worker pool":  {WithTLS(config), WithWorkerPool(4, 64)},
+		"small buffer": {WithTLS(config), WithReadBuffer(4096, 0)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			h := new(tlsEchoHandler)
+			l := serveTest(t, h, opts...)
+
+			cfg := ca.clientConfig("default.test")
+			cfg.NextProtos = []string{"http/1.1"}
+			c := tlsDial(t, l.Addr(), cfg)
+			assert.Equal(t, "http/1.1", c.ConnectionState().NegotiatedProtocol)
+
+			msg := make([]byte, 1<<20)
+			_, _ = rand.Read(msg)
+			go func() {
+				_, _ = c.Write(msg)
+			}()
+			got := make([]byte, len(msg))
+			_, err := io.ReadFull(c, got)
+			require.NoError(t, err)
+			assert.True(t, bytes.Equal(msg, got))
+
+			state := h.lastState()
+			assert.True(t, state.HandshakeComplete)
+			assert.Equal(t, "default.test", state.ServerName)
+			assert.Equal(t, "http/1.1", state.NegotiatedProtocol)
+		})
+	}
+}
+
+func TestTLS_SNI(t *testing.T) {
+	ca := newTestCA(t)
+	store, err := NewCertStore(
+		ca.issue(t, "default", "default.test"),
+		ca.issue(t, "a", "a.test"),
+		ca.issue(t, "wildcard", "*.b.test"),
+	)
+	require.NoError(t, err)
+	l := serveTest(t, new(tlsEchoHandler), WithTLS(&tls.Config{GetCertificate: store.GetCertificate}))
+
+	for name, want := range map[string]string{
+		"a.test":     "a",
+		"A.TEST":     "a",
+		"x.b.test":   "wildcard",
+		"x.y.b.test": "default",
+		"other.test": "default",
+	} {
+		cfg := ca.clientConfig(name)
+		cfg.InsecureSkipVerify = true
+		c := tlsDial(t, l.Addr(), cfg)
+		assert.Equal(t, want, c.ConnectionState().PeerCertificates[0].Subject.CommonName, name)
+	}
+}
+
+func TestTLS_Resumption(t *testing.T) {
+	ca := newTestCA(t)
+	config := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server", "server.test")}}
+	h := new(tlsEchoHandler)
+	l := serveTest(t, h, WithTLS(config))
+
+	for _, version := range []uint16{tls.VersionTLS12, tls.VersionTLS13} {
+		cfg := ca.clientConfig("server.test")
+		cfg.MaxVersion = version
+		cfg.ClientSessionCache = tls.NewLRUClientSessionCache(4)
+		for i, resumed := range []bool{false, true} {
+			c := tlsDial(t, l.Addr(), cfg)
+			// TLS 1.3 的会话票据在握手之后随数据到达
+			_, err := c.Write([]byte("ping\n"))
+			require.NoError(t, err)
+			_, err = bufio.NewReader(c).ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, resumed, c.ConnectionState().DidResume, "version %x conn %d", version, i)
+			assert.Equal(t, resumed, h.lastState().DidResume)
+			_ = c.Close()
+		}
+	}
+	em := l.manager.metrics
+	assert.EqualValues(t, 2, em.tlsHandshake("full").Value())
+	assert.EqualValues(t, 2, em.tlsHandshake("resumed").Value())
+}
+
+func TestTLS_CertReload(t *testing.T) {
+	ca := newTestCA(t)
+	store, err := NewCertStore(ca.issue(t, "old", "server.test"))
+	require.NoError(t, err)
+	l := serveTest(t, new(tlsEchoHandler), WithTLS(&tls.Config{GetCertificate: store.GetCertificate}))
+
+	old := tlsDial(t, l.Addr(), ca.clientConfig("server.test"))
+	assert.Equal(t, "old", old.ConnectionState().PeerCertificates[0].Subject.CommonName)
+
+	// 从文件重新加载，失败时保留原来的证书
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.Error(t, store.LoadFiles(CertFile{Cert: certFile, Key: keyFile}))
+	writeKeyPair(t, ca.issue(t, "new", "server.test"), certFile, keyFile)
+	require.NoError(t, store.LoadFiles(CertFile{Cert: certFile, Key: keyFile}))
+
+	c := tlsDial(t, l.Addr(), ca.clientConfig("server.test"))
+	assert.Equal(t, "new", c.ConnectionState().PeerCertificates[0].Subject.CommonName)
+
+	// 已经建立的连接不受影响
+	_, err = old.Write([]byte("still here\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(old).ReadString('\n')
+	require.NoError(t, err)
+	assert.Equal(t, "still here\n", line)
+}
+
+func writeKeyPair(t *testing.T, cert tls.Certificate, certFile, keyFile string) {
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	require.NoError(t, err)
+	require.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]}), 0o600))
+	require.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key}), 0o600))
+}
+
+func TestTLS_CloseNotify(t *testing.T) {
+	ca := newTestCA(t)
+	config := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server", "server.test")}}
+	l := serveTest(t, new(tlsEchoHandler), WithTLS(config))
+
+	c := tlsDial(t, l.Addr(), ca.clientConfig("server.test"))
+	_, err := c.Write([]byte("bye\n"))
+	require.NoError(t, err)
+	b, err := ioutil.ReadAll(c)
+	// close_notify 之后是正常的 EOF
+	require.NoError(t, err)
+	assert.Equal(t, "bye\n", string(b))
+}
+
+func TestTLS_HandshakeFailures(t *testing.T) {
+	ca := newTestCA(t)
+	config := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server", "server.test")}}
+	h := new(tlsEchoHandler)
+	l := serveTest(t, h, WithTLS(config), WithTLSHandshakeTimeout(200*time.Millisecond))
+
+	// 不是 TLS 的数据
+	c, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	_, err = c.Write([]byte("GET / HTTP/1.1\r\nHost: x\r\n\r\n"))
+	require.NoError(t, err)
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = ioutil.ReadAll(c)
+	assert.NoError(t, err)
+
+	// 握手超时
+	start := time.Now()
+	idle, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+	require.NoError(t, idle.SetReadDeadline(time.Now().Add(5*time.Second)))
+	_, err = idle.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+	assert.Less(t, int64(time.Since(start)), int64(2*time.Second))
+
+	// 不信任的证书
+	_, err = tls.Dial("tcp", l.Addr().String(), &tls.Config{ServerName: "server.test"})
+	assert.Error(t, err)
+
+	h.mu.Lock()
+	assert.Empty(t, h.states)
+	h.mu.Unlock()
+	assert.Eventually(t, func() bool { return l.manager.metrics.tlsHandshake("error").Value() == 3 },
+		5*time.Second, 10*time.Millisecond)
+
+	_, err = NewHjListener("127.0.0.1:0", WithTLS(&tls.Config{}))
+	assert.Error(t, err)
+}
+
+func TestTLS_MaxHandshakes(t *testing.T) {
+	ca := newTestCA(t)
+	config := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server", "server.test")}}
+	l := serveTest(t, new(tlsEchoHandler), WithTLS(config), WithMaxTLSHandshakes(1))
+	m := l.manager
+
+	// 不发送数据的连接占住唯一的握手
+	idle, err := net.Dial("tcp", l.Addr().String())
+	require.NoError(t, err)
+	defer idle.Close()
+	handshakes := func() (running, waiting int) {
+		m.handshakeMu.Lock()
+		defer m.handshakeMu.Unlock()
+		return m.handshaking, len(m.waitingHandshakes)
+	}
+	assert.Eventually(t, func() bool { running, _ := handshakes(); return running == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	done := make(chan error, 1)
+	go func() {
+		c, err := tls.DialWithDialer(&net.Dialer{Timeout: 5 * time.Second}, "tcp", l.Addr().String(),
+			ca.clientConfig("server.test"))
+		if err == nil {
+			_ = c.Close()
+		}
+		done <- err
+	}()
+	assert.Eventually(t, func() bool { _, waiting := handshakes(); return waiting == 1 }, 5*time.Second, 10*time.Millisecond)
+	select {
+	case err = <-done:
+		t.Fatalf("handshake beyond the limit completed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// 占用的握手失败后等待的握手继续进行
+	require.NoError(t, idle.Close())
+	select {
+	case err = <-done:
+		assert.NoError(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("the waiting handshake doesn't complete")
+	}
+	assert.Eventually(t, func() bool { running, waiting := handshakes(); return running == 0 && waiting == 0 },
+		5*time.Second, 10*time.Millisecond)
+}
+
+func TestTLS_Accept(t *testing.T) {
+	ca := newTestCA(t)
+	config := &tls.Config{Certificates: []tls.Certificate{ca.issue(t, "server", "server.test")}}
+	ln, err := NewHjListener("127.0.0.1:0", WithTLS(config))
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		for {
+			c, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer c.Close()
+				state, ok := c.(*HjConn).ConnectionState()
+				if !ok || !state.HandshakeComplete {
+					return
+				}
+				r := bufio.NewReader(c)
+				for {
+					line, err := r.ReadString('\n')
+					if err != nil {
+						return
+					}
+					_, _ = c.Write([]byte(line))
+				}
+			}()
+		}
+	}()
+
+	c := tlsDial(t, ln.Addr(), ca.clientConfig("server.test"))
+	r := bufio.NewReader(c)
+	for i := 0; i < 10; i++ {
+		_, err = c.Write([]byte("hello\n"))
+		require.NoError(t, err)
+		line, err := r.ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, "hello\n", line)
+	}
+}
+
+func TestCertStore(t *testing.T) {
+	ca := newTestCA(t)
+	_, err := NewCertStore()
+	assert.Error(t, err)
+	_, err = NewCertStore(tls.Certificate{})
+	assert.Error(t, err)
+
+	store, err := NewCertStore(ca.issue(t, "cn-only"), ca.issue(t, "a", "a.test", "*.a.test"))
+	require.NoError(t, err)
+	for name, want := range map[string]string{
+		"":           "cn-only",
+		"cn-only":    "cn-only",
+		"a.test.":    "a",
+		"www.a.test": "a",
+		"unknown":    "cn-only",
+	} {
+		cert, err := store.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		require.NoError(t, err)
+		assert.Equal(t, want, cert.Leaf.Subject.CommonName, name)
+	}
+}
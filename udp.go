@@ -0,0 +1,771 @@
+package haijun_net
+
+import (
+	"errors"
+	"net"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Ccheers/haijun-net/internal/poller"
+	"github.com/Ccheers/haijun-net/internal/socket"
+	"github.com/Ccheers/haijun-net/metrics"
+	"golang.org/x/sys/unix"
+)
+
+// PacketHandler represents the callbacks of the event-driven mode of a HjPacketConn, see HjPacketConn.Serve.
+type PacketHandler interface {
+	// OnPacket fires when a datagram has been received from the address from, p is only valid until
+	// OnPacket returns. It runs on the event loop of the socket receiving the datagram, so it mustn't
+	// block, the replies can be sent by c.WriteTo.
+	OnPacket(c *HjPacketConn, p []byte, from net.Addr)
+}
+
+var (
+	errWriteToConnected = errors.New("use of WriteTo with pre-connected connection")
+	errMissingAddress   = errors.New("missing address")
+)
+
+const (
+	// maxDatagramSize is the size of the buffer the datagrams are read into in the event-driven mode,
+	// it holds the largest UDP payload.
+	maxDatagramSize = 64 << 10
+	// maxPacketsPerEvent bounds the datagrams read in one wakeup, so that the timers and Close
+	// aren't starved by a flood.
+	maxPacketsPerEvent = 256
+	// udpPollInterval bounds a poll of a writer waiting for the send buffer, so that it sees Close and
+	// the deadlines set meanwhile.
+	udpPollInterval = 10 * time.Millisecond
+)
+
+// HjPacketConn is a UDP socket served by event loops, it implements net.PacketConn, and net.Conn when it's
+// connected by DialUDP. The datagrams are read by ReadFrom, or passed to a PacketHandler by Serve.
+//
+// The address bound by ListenUDP may be served by several sockets bound with SO_REUSEPORT, each one
+// polled by its own event loop, see Options.UDPLoops.
+type HjPacketConn struct {
+	network string
+	family  int
+	laddr   *net.UDPAddr
+	// raddr is the peer of a connected socket
+	raddr   *net.UDPAddr
+	opts    *Options
+	metrics *engineMetrics
+	shards  []*udpShard
+	// next spreads the writes among the shards
+	next uint32
+
+	serving int32
+	handler PacketHandler
+
+	// readable wakes up ReadFrom waiting for the sockets, it's signaled by the loops
+	readable      chan struct{}
+	readDeadline  deadline
+	writeDeadline deadline
+
+	closed int32
+	done   chan struct{}
+	// fdMu guards the fds against being closed while they're used, see HjListener.fdMu.
+	fdMu sync.RWMutex
+}
+
+// udpShard is a socket of a HjPacketConn and its event loop.
+type udpShard struct {
+	c      *HjPacketConn
+	idx    int
+	fd     int
+	poller poller.Poller
+	buf    []byte // 事件模式下读取数据报的缓冲区，只在事件循环中使用
+	// unregisterPoller removes the syscall metrics of poller from the registry, see engineMetrics.pollerSyscalls.
+	unregisterPoller func()
+
+	mu sync.Mutex
+	// readPaused is set while no one reads the socket in blocking mode, otherwise the level-triggered
+	// readable event would spin the loop
+	readPaused bool
+	// err is the error reported by EPOLLERR, e.g. ECONNREFUSED of a connected socket, it's returned
+	// by the next ReadFrom
+	err error
+
+	// batch and msgs are the headers and the messages of recvmmsg in the event-driven mode, only used in the loop
+	batch *mmsgBatch
+	msgs  []Message
+	bufs  [][]byte
+
+	packets uint64 // 收到的数据报数量
+}
+
+// ListenUDP listens on the UDP address addr, network is "udp", "udp4" or "udp6". The socket isn't connected,
+// the datagrams are sent by WriteTo. "udp" listens on both IPv4 and IPv6 when addr has no host.
+func ListenUDP(network, addr string, opts ...Option) (*HjPacketConn, error) {
+	options := loadOptions(opts...)
+	laddr, err := net.ResolveUDPAddr(network, addr)
+	if err != nil {
+		return nil, err
+	}
+	c := newPacketConn(network, udpFamily(network, laddr.IP), options)
+	loops := options.UDPLoops
+	if loops < 1 {
+		loops = 1
+	}
+	for i := 0; i < loops; i++ {
+		fd, err := udpSocket(c.family, network == "udp6", loops > 1)
+		if err != nil {
+			c.release()
+			return nil, err
+		}
+		c.shards = append(c.shards, &udpShard{c: c, idx: i, fd: fd})
+		sa, err := udpSockaddr(c.family, laddr)
+		if err != nil {
+			c.release()
+			return nil, err
+		}
+		if err = unix.Bind(fd, sa); err != nil {
+			c.release()
+			return nil, os.NewSyscallError("bind", err)
+		}
+		if i == 0 {
+			// 端口为 0 时由内核分配，其余的 socket 绑定同一个端口
+			if laddr, err = localUDPAddr(fd); err != nil {
+				c.release()
+				return nil, err
+			}
+		}
+	}
+	c.laddr = laddr
+	if err = c.start(); err != nil {
+		return nil, err
+	}
+	options.Logger.Info("listen udp", "addr", laddr, "loops", loops)
+	return c, nil
+}
+
+// DialUDP connects a UDP socket to the address raddr, network is "udp", "udp4" or "udp6". The connected
+// socket only exchanges datagrams with raddr, they are sent by Write, or WriteTo with a nil address.
+func DialUDP(network, raddr string, opts ...Option) (*HjPacketConn, error) {
+	options := loadOptions(opts...)
+	addr, err := net.ResolveUDPAddr(network, raddr)
+	if err != nil {
+		return nil, err
+	}
+	c := newPacketConn(network, udpFamily(network, addr.IP), options)
+	fd, err := udpSocket(c.family, network == "udp6", false)
+	if err != nil {
+		return nil, err
+	}
+	c.shards = []*udpShard{{c: c, fd: fd}}
+	sa, err := udpSockaddr(c.family, addr)
+	if err != nil {
+		c.release()
+		return nil, err
+	}
+	if err = unix.Connect(fd, sa); err != nil {
+		c.release()
+		return nil, os.NewSyscallError("connect", err)
+	}
+	if c.laddr, err = localUDPAddr(fd); err != nil {
+		c.release()
+		return nil, err
+	}
+	c.raddr = addr
+	if err = c.start(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func newPacketConn(network string, family int, opts *Options) *HjPacketConn {
+	return &HjPacketConn{
+		network:  network,
+		family:   family,
+		opts:     opts,
+		metrics:  newEngineMetrics(opts.Metrics),
+		readable: make(chan struct{}, 1),
+		done:     make(chan struct{}),
+	}
+}
+
+// udpFamily returns the address family of the sockets of network, "udp" uses IPv4 for the IPv4 addresses,
+// and IPv6 otherwise, which accepts IPv4 too when the address is unspecified.
+func udpFamily(network string, ip net.IP) int {
+	switch network {
+	case "udp4":
+		return unix.AF_INET
+	case "udp6":
+		return unix.AF_INET6
+	}
+	if ip != nil && ip.To4() != nil && !ip.Equal(net.IPv4zero) {
+		return unix.AF_INET
+	}
+	return unix.AF_INET6
+}
+
+func udpSocket(family int, ipv6only, reusePort bool) (int, error) {
+	fd, err := unix.Socket(family, unix.SOCK_DGRAM|unix.SOCK_NONBLOCK|unix.SOCK_CLOEXEC, unix.IPPROTO_UDP)
+	if err != nil {
+		return 0, os.NewSyscallError("socket", err)
+	}
+	if family == unix.AF_INET6 {
+		v6only := 0
+		if ipv6only {
+			v6only = 1
+		}
+		if err = unix.SetsockoptInt(fd, unix.IPPROTO_IPV6, unix.IPV6_V6ONLY, v6only); err != nil {
+			_ = unix.Close(fd)
+			return 0, os.NewSyscallError("setsockopt IPV6_V6ONLY", err)
+		}
+	}
+	if reusePort {
+		if err = unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_REUSEPORT, 1); err != nil {
+			_ = unix.Close(fd)
+			return 0, os.NewSyscallError("setsockopt SO_REUSEPORT", err)
+		}
+	}
+	return fd, nil
+}
+
+// udpSockaddr converts addr to the sockaddr of family, the IPv4 addresses are mapped into IPv6.
+func udpSockaddr(family int, addr *net.UDPAddr) (unix.Sockaddr, error) {
+	if family == unix.AF_INET {
+		sa := &unix.SockaddrInet4{Port: addr.Port}
+		if addr.IP != nil {
+			ip := addr.IP.To4()
+			if ip == nil {
+				return nil, &net.AddrError{Err: "non-IPv4 address", Addr: addr.IP.String()}
+			}
+			copy(sa.Addr[:], ip)
+		}
+		return sa, nil
+	}
+	sa := &unix.SockaddrInet6{Port: addr.Port}
+	if addr.IP != nil && !addr.IP.Equal(net.IPv4zero) {
+		ip := addr.IP.To16()
+		if ip == nil {
+			return nil, &net.AddrError{Err: "non-IPv6 address", Addr: addr.IP.String()}
+		}
+		copy(sa.Addr[:], ip)
+	}
+	if addr.Zone != "" {
+		if ifi, err := net.InterfaceByName(addr.Zone); err == nil {
+			sa.ZoneId = uint32(ifi.Index)
+		} else if id, err := strconv.Atoi(addr.Zone); err == nil {
+			sa.ZoneId = uint32(id)
+		}
+	}
+	return sa, nil
+}
+
+func localUDPAddr(fd int) (*net.UDPAddr, error) {
+	sa, err := unix.Getsockname(fd)
+	if err != nil {
+		return nil, os.NewSyscallError("getsockname", err)
+	}
+	addr, _ := socket.SockaddrToUDPAddr(sa).(*net.UDPAddr)
+	return addr, nil
+}
+
+// start registers the sockets to their pollers and starts the event loops.
+func (c *HjPacketConn) start() error {
+	for _, s := range c.shards {
+		p, err := poller.NewPoller()
+		if err != nil {
+			c.release()
+			return err
+		}
+		s.poller = p
+		s.unregisterPoller = c.metrics.pollerSyscalls(p)
+		if err = p.Register(s.fd, poller.PollModeRead); err != nil {
+			c.release()
+			return err
+		}
+	}
+	for _, s := range c.shards {
+		go s.serve()
+	}
+	return nil
+}
+
+// release closes the sockets and the pollers of a HjPacketConn failing to start.
+func (c *HjPacketConn) release() {
+	for _, s := range c.shards {
+		_ = unix.Close(s.fd)
+		if s.poller != nil {
+			_ = s.poller.Close()
+			s.unregisterPoller()
+		}
+	}
+}
+
+// Serve runs the socket in event-driven mode: the event loops pass the datagrams to handler.OnPacket instead
+// of handing them to ReadFrom, it returns when the socket is closed.
+func (c *HjPacketConn) Serve(handler PacketHandler) error {
+	if !atomic.CompareAndSwapInt32(&c.serving, 0, 1) {
+		return errServing
+	}
+	c.handler = handler
+	atomic.StoreInt32(&c.serving, 2)
+	for _, s := range c.shards {
+		// 阻塞模式下可能暂停了读事件
+		s.resumeRead()
+	}
+	<-c.done
+	return nil
+}
+
+func (c *HjPacketConn) packetHandler() PacketHandler {
+	if atomic.LoadInt32(&c.serving) != 2 {
+		return nil
+	}
+	return c.handler
+}
+
+// ReadFrom reads a datagram into p and returns the address it came from, it blocks until a datagram arrives,
+// the read deadline expires or the socket is closed. The datagrams larger than p are truncated.
+func (c *HjPacketConn) ReadFrom(p []byte) (n int, addr net.Addr, err error) {
+	if atomic.LoadInt32(&c.serving) != 0 {
+		return 0, nil, c.opError("read", errServing)
+	}
+	for {
+		if c.isClosed() {
+			return 0, nil, c.opError("read", net.ErrClosed)
+		}
+		if c.readDeadline.expired() {
+			return 0, nil, c.opError("read", os.ErrDeadlineExceeded)
+		}
+		for _, s := range c.shards {
+			n, addr, err = s.recvfrom(p)
+			if err == nil {
+				// 可能还有数据，唤醒其他等待的读者
+				notify(c.readable)
+				return n, addr, nil
+			}
+			if err != unix.EAGAIN {
+				return 0, nil, c.opError("read", err)
+			}
+		}
+		for _, s := range c.shards {
+			s.resumeRead()
+		}
+		if err = c.wait(c.readable, &c.readDeadline); err != nil {
+			return 0, nil, c.opError("read", err)
+		}
+	}
+}
+
+// Read reads a datagram from the peer of a connected socket, see DialUDP.
+func (c *HjPacketConn) Read(p []byte) (int, error) {
+	n, _, err := c.ReadFrom(p)
+	return n, err
+}
+
+// WriteTo sends p to addr, which must be a *net.UDPAddr, or nil if the socket is connected. It blocks while
+// the send buffer of the socket is full, until the write deadline expires.
+func (c *HjPacketConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	sa, err := c.destination(addr)
+	if err != nil {
+		return 0, c.opError("write", err)
+	}
+	return c.write(p, sa)
+}
+
+// destination returns the sockaddr of the destination addr of a datagram, it's nil if the socket is connected.
+func (c *HjPacketConn) destination(addr net.Addr) (unix.Sockaddr, error) {
+	if c.raddr != nil {
+		if addr != nil {
+			return nil, errWriteToConnected
+		}
+		return nil, nil
+	}
+	if addr == nil {
+		return nil, errMissingAddress
+	}
+	ua, ok := addr.(*net.UDPAddr)
+	if !ok {
+		return nil, &net.AddrError{Err: "unexpected address type", Addr: addr.String()}
+	}
+	return udpSockaddr(c.family, ua)
+}
+
+// Write sends p to the peer of a connected socket, see DialUDP.
+func (c *HjPacketConn) Write(p []byte) (int, error) {
+	if c.raddr == nil {
+		return 0, c.opError("write", errMissingAddress)
+	}
+	return c.write(p, nil)
+}
+
+func (c *HjPacketConn) write(p []byte, sa unix.Sockaddr) (int, error) {
+	s := c.shards[int(atomic.AddUint32(&c.next, 1))%len(c.shards)]
+	for {
+		if c.isClosed() {
+			return 0, c.opError("write", net.ErrClosed)
+		}
+		if c.writeDeadline.expired() {
+			return 0, c.opError("write", os.ErrDeadlineExceeded)
+		}
+		err := s.sendto(p, sa)
+		if err == nil {
+			return len(p), nil
+		}
+		if err != unix.EAGAIN {
+			return 0, c.opError("write", err)
+		}
+		// 发送缓冲区已满，等待可写
+		if err = s.waitWritable(); err != nil {
+			return 0, c.opError("write", err)
+		}
+	}
+}
+
+// wait waits for ch until the deadline d expires or the socket is closed, d may be changed meanwhile.
+func (c *HjPacketConn) wait(ch <-chan struct{}, d *deadline) error {
+	for {
+		t, changed := d.get()
+		var timer *time.Timer
+		var timeout <-chan time.Time
+		if !t.IsZero() {
+			wait := time.Until(t)
+			if wait <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			timer = time.NewTimer(wait)
+			timeout = timer.C
+		}
+		var err error
+		select {
+		case <-ch:
+		case <-c.done:
+			err = net.ErrClosed
+		case <-changed:
+			err = errDeadlineChanged
+		case <-timeout:
+			err = os.ErrDeadlineExceeded
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		if err != errDeadlineChanged {
+			return err
+		}
+	}
+}
+
+var errDeadlineChanged = errors.New("deadline changed")
+
+func (c *HjPacketConn) opError(op string, err error) error {
+	if errno, ok := err.(unix.Errno); ok {
+		name := "recvfrom"
+		if op == "write" {
+			name = "sendto"
+		}
+		err = os.NewSyscallError(name, errno)
+	}
+	e := &net.OpError{Op: op, Net: c.network, Source: c.laddr, Err: err}
+	if c.raddr != nil {
+		e.Addr = c.raddr
+	}
+	return e
+}
+
+func (c *HjPacketConn) isClosed() bool {
+	return atomic.LoadInt32(&c.closed) == 1
+}
+
+// Close closes the sockets, the blocked ReadFrom and WriteTo return net.ErrClosed, and the event loops exit.
+func (c *HjPacketConn) Close() error {
+	if !atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		return nil
+	}
+	close(c.done)
+	c.fdMu.Lock()
+	defer c.fdMu.Unlock()
+	var err error
+	for _, s := range c.shards {
+		if e := unix.Close(s.fd); e != nil && err == nil {
+			err = os.NewSyscallError("close", e)
+		}
+	}
+	return err
+}
+
+// LocalAddr returns the address the socket is bound to.
+func (c *HjPacketConn) LocalAddr() net.Addr {
+	return c.laddr
+}
+
+// RemoteAddr returns the peer of a connected socket, it's nil if the socket isn't connected.
+func (c *HjPacketConn) RemoteAddr() net.Addr {
+	if c.raddr == nil {
+		return nil
+	}
+	return c.raddr
+}
+
+// SetDeadline sets up the read and write deadlines, see net.Conn.
+func (c *HjPacketConn) SetDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// SetReadDeadline sets up the deadline of ReadFrom, it takes effect on the calls already blocked too.
+func (c *HjPacketConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets up the deadline of WriteTo, it takes effect on the calls already blocked too.
+func (c *HjPacketConn) SetWriteDeadline(t time.Time) error {
+	c.writeDeadline.set(t)
+	return nil
+}
+
+// Metrics returns the registry of the metrics maintained by the socket.
+func (c *HjPacketConn) Metrics() *metrics.Registry {
+	return c.opts.Metrics
+}
+
+func (s *udpShard) serve() {
+	supervise(s.c.opts, s.poller, s.run, s.c.isClosed, "udp_fd", s.fd, "loop", s.idx)
+	_ = s.poller.Close()
+	s.unregisterPoller()
+}
+
+func (s *udpShard) run() error {
+	for !s.c.isClosed() {
+		events, err := s.poller.Wait()
+		if err != nil {
+			return err
+		}
+		for _, event := range events {
+			s.handleEvent(event)
+		}
+	}
+	return nil
+}
+
+func (s *udpShard) handleEvent(event unix.EpollEvent) {
+	c := s.c
+	if event.Events&poller.ErrEvents != 0 && event.Events&unix.EPOLLIN == 0 {
+		// 取出 ICMP 等错误交给下一次读取，否则水平触发会一直报告
+		if errno, err := unix.GetsockoptInt(s.fd, unix.SOL_SOCKET, unix.SO_ERROR); err == nil && errno != 0 {
+			s.mu.Lock()
+			s.err = unix.Errno(errno)
+			s.mu.Unlock()
+		}
+	}
+	if event.Events&poller.InEvents == 0 {
+		return
+	}
+	if h := c.packetHandler(); h != nil {
+		if size := c.batchSize(); size > 1 {
+			s.readBatches(h, size)
+		} else {
+			s.readPackets(h)
+		}
+		return
+	}
+	s.mu.Lock()
+	s.readPaused = true
+	s.updateMode()
+	s.mu.Unlock()
+	notify(c.readable)
+}
+
+// readPackets passes the datagrams received by the socket to h.
+func (s *udpShard) readPackets(h PacketHandler) {
+	if s.buf == nil {
+		s.buf = make([]byte, maxDatagramSize)
+	}
+	for i := 0; i < maxPacketsPerEvent; i++ {
+		n, from, err := s.recvfrom(s.buf)
+		switch err {
+		case nil:
+			s.onPacket(h, s.buf[:n], from)
+		case unix.EAGAIN:
+			return
+		default:
+			if err == net.ErrClosed {
+				return
+			}
+			// 例如连接的 socket 收到的 ICMP 错误，不影响后续的数据报
+			s.c.opts.Logger.Debug("udp read", "fd", s.fd, "loop", s.idx, "error", err)
+		}
+	}
+}
+
+func (s *udpShard) onPacket(h PacketHandler, p []byte, from net.Addr) {
+	defer s.recoverHandler()
+	h.OnPacket(s.c, p, from)
+}
+
+// recoverHandler reports the panic of a PacketHandler, it must be deferred directly.
+func (s *udpShard) recoverHandler() {
+	if s.c.opts.PanicPolicy == PanicPolicyCrash {
+		return
+	}
+	if v := recover(); v != nil {
+		reportError(s.c.opts, &PanicError{Value: v, Stack: debug.Stack()})
+	}
+}
+
+// recvfrom reads a datagram from the socket, it returns the error reported by EPOLLERR first.
+func (s *udpShard) recvfrom(p []byte) (int, net.Addr, error) {
+	c := s.c
+	if err := s.takeErr(); err != nil {
+		return 0, nil, err
+	}
+	c.fdMu.RLock()
+	if c.isClosed() {
+		c.fdMu.RUnlock()
+		return 0, nil, net.ErrClosed
+	}
+	c.metrics.recvfromCalls.Inc()
+	n, sa, err := unix.Recvfrom(s.fd, p, 0)
+	c.fdMu.RUnlock()
+	if err != nil {
+		if err == unix.EAGAIN {
+			c.metrics.readEAGAIN.Inc()
+		}
+		return 0, nil, err
+	}
+	atomic.AddUint64(&s.packets, 1)
+	c.metrics.udpPacketsIn.Inc()
+	c.metrics.udpBytesIn.Add(uint64(n))
+	if c.raddr != nil && sa == nil {
+		return n, c.raddr, nil
+	}
+	return n, socket.SockaddrToUDPAddr(sa), nil
+}
+
+// takeErr returns and clears the error reported by EPOLLERR.
+func (s *udpShard) takeErr() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.err
+	s.err = nil
+	return err
+}
+
+func (s *udpShard) sendto(p []byte, sa unix.Sockaddr) error {
+	c := s.c
+	c.fdMu.RLock()
+	defer c.fdMu.RUnlock()
+	if c.isClosed() {
+		return net.ErrClosed
+	}
+	c.metrics.sendtoCalls.Inc()
+	var err error
+	if sa == nil {
+		// 已连接的 socket 发往对端
+		_, err = unix.Write(s.fd, p)
+	} else {
+		err = unix.Sendto(s.fd, p, 0, sa)
+	}
+	if err != nil {
+		if err == unix.EAGAIN {
+			c.metrics.writeEAGAIN.Inc()
+		}
+		return err
+	}
+	c.metrics.udpPacketsOut.Inc()
+	c.metrics.udpBytesOut.Add(uint64(len(p)))
+	return nil
+}
+
+func (s *udpShard) resumeRead() {
+	s.mu.Lock()
+	if s.readPaused {
+		s.readPaused = false
+		s.updateMode()
+	}
+	s.mu.Unlock()
+}
+
+// waitWritable waits until the socket is writable, the write deadline expires or the socket is closed. It polls
+// the socket by itself instead of waiting for the event loop, since the handlers write on the loop too.
+func (s *udpShard) waitWritable() error {
+	c := s.c
+	for {
+		timeout := udpPollInterval
+		if t, _ := c.writeDeadline.get(); !t.IsZero() {
+			wait := time.Until(t)
+			if wait <= 0 {
+				return os.ErrDeadlineExceeded
+			}
+			if wait < timeout {
+				timeout = wait
+			}
+		}
+		c.fdMu.RLock()
+		if c.isClosed() {
+			c.fdMu.RUnlock()
+			return net.ErrClosed
+		}
+		fds := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLOUT}}
+		n, err := unix.Poll(fds, int((timeout+time.Millisecond-1)/time.Millisecond))
+		c.fdMu.RUnlock()
+		if err != nil && err != unix.EINTR {
+			return os.NewSyscallError("poll", err)
+		}
+		if n > 0 {
+			return nil
+		}
+	}
+}
+
+// updateMode renews the events the socket is polled for, it must be called with s.mu held.
+func (s *udpShard) updateMode() {
+	var mode poller.PollMode
+	if !s.readPaused {
+		mode = poller.PollModeRead
+	}
+	s.c.fdMu.RLock()
+	if !s.c.isClosed() {
+		_ = s.poller.Mod(s.fd, mode)
+	}
+	s.c.fdMu.RUnlock()
+}
+
+// notify wakes up a waiter of ch without blocking.
+func notify(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// deadline is the deadline of the blocking calls, it can be changed while they wait.
+type deadline struct {
+	mu      sync.Mutex
+	t       time.Time
+	changed chan struct{} // closed when t changes
+}
+
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	d.t = t
+	if d.changed != nil {
+		close(d.changed)
+		d.changed = nil
+	}
+	d.mu.Unlock()
+}
+
+func (d *deadline) get() (time.Time, <-chan struct{}) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.changed == nil {
+		d.changed = make(chan struct{})
+	}
+	return d.t, d.changed
+}
+
+func (d *deadline) expired() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return !d.t.IsZero() && !time.Now().Before(d.t)
+}
@@ -0,0 +1,361 @@
+package haijun_net
+
+import (
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"unsafe"
+
+	"github.com/Ccheers/haijun-net/internal/pkg/pool/byteslice"
+	"github.com/Ccheers/haijun-net/internal/socket"
+	"golang.org/x/sys/unix"
+)
+
+// defaultUDPBatchSize is the number of datagrams read by one recvmmsg when Options.UDPBatchSize is zero.
+const defaultUDPBatchSize = 32
+
+// Message is a datagram read by ReadBatch or sent by WriteBatch.
+type Message struct {
+	// Buf is the buffer the datagram is read into, or the payload of the datagram to send.
+	Buf []byte
+	// N is the size of the datagram read into Buf, the datagram is Buf[:N], the datagrams larger than Buf
+	// are truncated.
+	N int
+	// Addr is the source of the datagram read, or the destination of the datagram to send, which must be nil
+	// if the socket is connected.
+	Addr net.Addr
+}
+
+// BatchPacketHandler is implemented by the PacketHandlers receiving the datagrams in batches, the event loops
+// call OnPackets with the datagrams read by each recvmmsg instead of calling OnPacket for each one.
+type BatchPacketHandler interface {
+	// OnPackets fires when datagrams have been received, ms and their buffers are only valid until it returns,
+	// the replies can be sent together by c.WriteBatch.
+	OnPackets(c *HjPacketConn, ms []Message)
+}
+
+// mmsghdr is struct mmsghdr of recvmmsg(2) and sendmmsg(2).
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// mmsgBatch holds the headers of the messages of a recvmmsg or sendmmsg.
+type mmsgBatch struct {
+	hdrs  []mmsghdr
+	iovs  []unix.Iovec
+	names []unix.RawSockaddrAny
+}
+
+var mmsgBatchPool = sync.Pool{New: func() interface{} { return new(mmsgBatch) }}
+
+// reset prepares the headers of n messages of one buffer each.
+func (b *mmsgBatch) reset(n int) {
+	if cap(b.hdrs) < n {
+		b.hdrs, b.iovs, b.names = make([]mmsghdr, n), make([]unix.Iovec, n), make([]unix.RawSockaddrAny, n)
+	}
+	b.hdrs, b.iovs, b.names = b.hdrs[:n], b.iovs[:n], b.names[:n]
+	for i := range b.hdrs {
+		b.iovs[i] = unix.Iovec{}
+		b.hdrs[i] = mmsghdr{}
+		b.hdrs[i].hdr.Iov = &b.iovs[i]
+		b.hdrs[i].hdr.SetIovlen(1)
+	}
+}
+
+func (b *mmsgBatch) setBuffer(i int, p []byte) {
+	if len(p) > 0 {
+		b.iovs[i].Base = &p[0]
+	}
+	b.iovs[i].SetLen(len(p))
+}
+
+// setName points the header i to the sockaddr i, which receives the source of the datagram if sa is nil.
+func (b *mmsgBatch) setName(i int, sa unix.Sockaddr) {
+	hdr := &b.hdrs[i].hdr
+	hdr.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+	if sa == nil {
+		hdr.Namelen = unix.SizeofSockaddrAny
+		return
+	}
+	hdr.Namelen = putRawSockaddr(&b.names[i], sa)
+}
+
+func getMmsgBatch() *mmsgBatch {
+	return mmsgBatchPool.Get().(*mmsgBatch)
+}
+
+func putMmsgBatch(b *mmsgBatch) {
+	// 不再引用调用者的缓冲区
+	iovs := b.iovs[:cap(b.iovs)]
+	for i := range iovs {
+		iovs[i] = unix.Iovec{}
+	}
+	mmsgBatchPool.Put(b)
+}
+
+// batchSize returns the number of datagrams read by one recvmmsg in the event-driven mode.
+func (c *HjPacketConn) batchSize() int {
+	size := c.opts.UDPBatchSize
+	if size == 0 {
+		size = defaultUDPBatchSize
+	}
+	if size > maxPacketsPerEvent {
+		size = maxPacketsPerEvent
+	}
+	return size
+}
+
+// ReadBatch reads up to len(ms) datagrams into the buffers of ms with one recvmmsg, and returns the number of
+// the datagrams read. It blocks like ReadFrom until at least one datagram arrives.
+func (c *HjPacketConn) ReadBatch(ms []Message) (int, error) {
+	if atomic.LoadInt32(&c.serving) != 0 {
+		return 0, c.opError("read", errServing)
+	}
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	b := getMmsgBatch()
+	defer putMmsgBatch(b)
+	for {
+		if c.isClosed() {
+			return 0, c.opError("read", net.ErrClosed)
+		}
+		if c.readDeadline.expired() {
+			return 0, c.opError("read", os.ErrDeadlineExceeded)
+		}
+		for _, s := range c.shards {
+			n, err := s.recvmmsg(b, ms)
+			if err == nil {
+				notify(c.readable)
+				return n, nil
+			}
+			if err != unix.EAGAIN {
+				return 0, c.opError("read", err)
+			}
+		}
+		for _, s := range c.shards {
+			s.resumeRead()
+		}
+		if err := c.wait(c.readable, &c.readDeadline); err != nil {
+			return 0, c.opError("read", err)
+		}
+	}
+}
+
+// WriteBatch sends the datagrams of ms with sendmmsg, Addr of each message is the destination like the address
+// of WriteTo. It blocks while the send buffer of the socket is full, until the write deadline expires, and
+// returns the number of the datagrams sent, which is less than len(ms) only with an error.
+func (c *HjPacketConn) WriteBatch(ms []Message) (int, error) {
+	if len(ms) == 0 {
+		return 0, nil
+	}
+	b := getMmsgBatch()
+	defer putMmsgBatch(b)
+	b.reset(len(ms))
+	for i := range ms {
+		sa, err := c.destination(ms[i].Addr)
+		if err != nil {
+			return 0, c.opError("write", err)
+		}
+		if sa != nil {
+			b.setName(i, sa)
+		}
+		b.setBuffer(i, ms[i].Buf)
+	}
+
+	s := c.shards[int(atomic.AddUint32(&c.next, 1))%len(c.shards)]
+	sent := 0
+	for sent < len(ms) {
+		if c.isClosed() {
+			return sent, c.opError("write", net.ErrClosed)
+		}
+		if c.writeDeadline.expired() {
+			return sent, c.opError("write", os.ErrDeadlineExceeded)
+		}
+		n, err := s.sendmmsg(b.hdrs[sent:], ms[sent:])
+		sent += n
+		if err == nil {
+			continue
+		}
+		if err != unix.EAGAIN {
+			return sent, c.opError("write", err)
+		}
+		if err = s.waitWritable(); err != nil {
+			return sent, c.opError("write", err)
+		}
+	}
+	return sent, nil
+}
+
+// readBatches passes the datagrams received by the socket to h, they are read by recvmmsg into the buffers
+// taken from the pool for this wakeup.
+func (s *udpShard) readBatches(h PacketHandler, size int) {
+	if s.batch == nil || len(s.msgs) != size {
+		s.batch, s.msgs, s.bufs = new(mmsgBatch), make([]Message, size), make([][]byte, size)
+	}
+	for i := range s.bufs {
+		s.bufs[i] = byteslice.Get(maxDatagramSize)
+	}
+	defer func() {
+		for i := range s.bufs {
+			byteslice.Put(s.bufs[i])
+			s.bufs[i], s.msgs[i] = nil, Message{}
+		}
+	}()
+	for read := 0; read < maxPacketsPerEvent; {
+		// 处理函数可能修改了 msgs
+		for i := range s.msgs {
+			s.msgs[i] = Message{Buf: s.bufs[i]}
+		}
+		n, err := s.recvmmsg(s.batch, s.msgs)
+		switch err {
+		case nil:
+			read += n
+			s.onPackets(h, s.msgs[:n])
+			if n < len(s.msgs) {
+				// 已经读完
+				return
+			}
+		case unix.EAGAIN:
+			return
+		default:
+			if err == net.ErrClosed {
+				return
+			}
+			read++
+			s.c.opts.Logger.Debug("udp read", "fd", s.fd, "loop", s.idx, "error", err)
+		}
+	}
+}
+
+func (s *udpShard) onPackets(h PacketHandler, ms []Message) {
+	bh, ok := h.(BatchPacketHandler)
+	if !ok {
+		for i := range ms {
+			s.onPacket(h, ms[i].Buf[:ms[i].N], ms[i].Addr)
+		}
+		return
+	}
+	defer s.recoverHandler()
+	bh.OnPackets(s.c, ms)
+}
+
+// recvmmsg reads up to len(ms) datagrams into the buffers of ms, it returns the error reported by EPOLLERR first.
+func (s *udpShard) recvmmsg(b *mmsgBatch, ms []Message) (int, error) {
+	c := s.c
+	if err := s.takeErr(); err != nil {
+		return 0, err
+	}
+	b.reset(len(ms))
+	for i := range ms {
+		b.setBuffer(i, ms[i].Buf)
+		if c.raddr == nil {
+			b.setName(i, nil)
+		}
+	}
+	c.fdMu.RLock()
+	if c.isClosed() {
+		c.fdMu.RUnlock()
+		return 0, net.ErrClosed
+	}
+	c.metrics.recvmmsgCalls.Inc()
+	r, _, errno := unix.Syscall6(unix.SYS_RECVMMSG, uintptr(s.fd), uintptr(unsafe.Pointer(&b.hdrs[0])), uintptr(len(ms)), 0, 0, 0)
+	c.fdMu.RUnlock()
+	if errno != 0 {
+		if errno == unix.EAGAIN {
+			c.metrics.readEAGAIN.Inc()
+		}
+		return 0, errno
+	}
+	n := int(r)
+	var bytes uint64
+	for i := 0; i < n; i++ {
+		ms[i].N = int(b.hdrs[i].len)
+		bytes += uint64(ms[i].N)
+		if c.raddr != nil {
+			ms[i].Addr = c.raddr
+		} else {
+			ms[i].Addr = socket.SockaddrToUDPAddr(rawSockaddr(&b.names[i]))
+		}
+	}
+	atomic.AddUint64(&s.packets, uint64(n))
+	c.metrics.udpPacketsIn.Add(uint64(n))
+	c.metrics.udpBytesIn.Add(bytes)
+	c.metrics.udpBatchIn.Observe(float64(n))
+	return n, nil
+}
+
+// sendmmsg sends the messages prepared in hdrs, it returns the number of the messages sent.
+func (s *udpShard) sendmmsg(hdrs []mmsghdr, ms []Message) (int, error) {
+	c := s.c
+	c.fdMu.RLock()
+	if c.isClosed() {
+		c.fdMu.RUnlock()
+		return 0, net.ErrClosed
+	}
+	c.metrics.sendmmsgCalls.Inc()
+	r, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(s.fd), uintptr(unsafe.Pointer(&hdrs[0])), uintptr(len(hdrs)), 0, 0, 0)
+	c.fdMu.RUnlock()
+	if errno != 0 {
+		if errno == unix.EAGAIN {
+			c.metrics.writeEAGAIN.Inc()
+		}
+		return 0, errno
+	}
+	n := int(r)
+	var bytes uint64
+	for i := 0; i < n; i++ {
+		bytes += uint64(len(ms[i].Buf))
+	}
+	c.metrics.udpPacketsOut.Add(uint64(n))
+	c.metrics.udpBytesOut.Add(bytes)
+	c.metrics.udpBatchOut.Observe(float64(n))
+	return n, nil
+}
+
+// putRawSockaddr encodes sa into raw and returns the length of the encoded sockaddr.
+func putRawSockaddr(raw *unix.RawSockaddrAny, sa unix.Sockaddr) uint32 {
+	*raw = unix.RawSockaddrAny{}
+	switch sa := sa.(type) {
+	case *unix.SockaddrInet4:
+		r := (*unix.RawSockaddrInet4)(unsafe.Pointer(raw))
+		r.Family = unix.AF_INET
+		putPort(&r.Port, sa.Port)
+		r.Addr = sa.Addr
+		return unix.SizeofSockaddrInet4
+	case *unix.SockaddrInet6:
+		r := (*unix.RawSockaddrInet6)(unsafe.Pointer(raw))
+		r.Family = unix.AF_INET6
+		putPort(&r.Port, sa.Port)
+		r.Addr = sa.Addr
+		r.Scope_id = sa.ZoneId
+		return unix.SizeofSockaddrInet6
+	}
+	return 0
+}
+
+// rawSockaddr decodes the sockaddr received by recvmmsg, it's nil if the family isn't IPv4 or IPv6.
+func rawSockaddr(raw *unix.RawSockaddrAny) unix.Sockaddr {
+	switch raw.Addr.Family {
+	case unix.AF_INET:
+		r := (*unix.RawSockaddrInet4)(unsafe.Pointer(raw))
+		return &unix.SockaddrInet4{Port: port(&r.Port), Addr: r.Addr}
+	case unix.AF_INET6:
+		r := (*unix.RawSockaddrInet6)(unsafe.Pointer(raw))
+		return &unix.SockaddrInet6{Port: port(&r.Port), ZoneId: r.Scope_id, Addr: r.Addr}
+	}
+	return nil
+}
+
+// 端口是网络字节序
+func putPort(p *uint16, port int) {
+	b := (*[2]byte)(unsafe.Pointer(p))
+	b[0], b[1] = byte(port>>8), byte(port)
+}
+
+func port(p *uint16) int {
+	b := (*[2]byte)(unsafe.Pointer(p))
+	return int(b[0])<<8 | int(b[1])
+}
@@ -0,0 +1,157 @@
+package haijun_net
+
+import (
+	"fmt"
+	"net"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/Ccheers/haijun-net/internal/socket"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUDP_ReadBatchWriteBatch(t *testing.T) {
+	server := listenUDPTest(t, "udp", "127.0.0.1:0")
+	client, err := DialUDP("udp", server.LocalAddr().String())
+	require.NoError(t, err)
+	defer client.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	require.NoError(t, server.SetDeadline(deadline))
+	require.NoError(t, client.SetDeadline(deadline))
+
+	const count = 10
+	ms := make([]Message, count)
+	for i := range ms {
+		ms[i].Buf = []byte(fmt.Sprintf("request %d", i))
+	}
+	n, err := client.WriteBatch(ms)
+	require.NoError(t, err)
+	assert.Equal(t, count, n)
+	assert.EqualValues(t, 1, client.metrics.sendmmsgCalls.Value())
+	assert.EqualValues(t, count, client.metrics.udpBatchOut.Snapshot().Sum)
+
+	// 回复每一个请求
+	var got []string
+	in := make([]Message, 4)
+	for i := range in {
+		in[i].Buf = make([]byte, 64)
+	}
+	for len(got) < count {
+		n, err := server.ReadBatch(in)
+		require.NoError(t, err)
+		replies := make([]Message, n)
+		for i, m := range in[:n] {
+			got = append(got, string(m.Buf[:m.N]))
+			assert.Equal(t, client.LocalAddr().(*net.UDPAddr).Port, m.Addr.(*net.UDPAddr).Port)
+			replies[i] = Message{Buf: append([]byte("reply to "), m.Buf[:m.N]...), Addr: m.Addr}
+		}
+		_, err = server.WriteBatch(replies)
+		require.NoError(t, err)
+	}
+	for i := range got {
+		assert.Equal(t, fmt.Sprintf("request %d", i), got[i])
+	}
+	assert.EqualValues(t, count, server.metrics.udpPacketsIn.Value())
+
+	in = make([]Message, count)
+	for i := range in {
+		in[i].Buf = make([]byte, 64)
+	}
+	for read := 0; read < count; {
+		n, err := client.ReadBatch(in[read:])
+		require.NoError(t, err)
+		read += n
+	}
+	for i, m := range in {
+		assert.Equal(t, fmt.Sprintf("reply to request %d", i), string(m.Buf[:m.N]))
+		assert.Equal(t, server.LocalAddr().String(), m.Addr.String())
+	}
+
+	_, err = client.WriteBatch([]Message{{Buf: []byte("x"), Addr: server.LocalAddr()}})
+	assert.Error(t, err)
+	n, err = server.WriteBatch([]Message{{Buf: []byte("x"), Addr: client.LocalAddr()}, {Buf: []byte("x")}})
+	assert.Error(t, err)
+	assert.Zero(t, n, "nothing is sent when an address is missing")
+}
+
+type udpBatchEchoHandler struct{}
+
+func (udpBatchEchoHandler) OnPacket(c *HjPacketConn, p []byte, from net.Addr) {
+	panic("OnPackets is called instead")
+}
+
+func (udpBatchEchoHandler) OnPackets(c *HjPacketConn, ms []Message) {
+	replies := make([]Message, len(ms))
+	for i, m := range ms {
+		replies[i] = Message{Buf: m.Buf[:m.N], Addr: m.Addr}
+	}
+	_, _ = c.WriteBatch(replies)
+}
+
+func TestUDP_ServeBatch(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler PacketHandler
+		size    int
+	}{
+		{"batch handler", udpBatchEchoHandler{}, 0},
+		{"packet handler", new(udpEchoHandler), 8},
+		{"recvfrom", new(udpEchoHandler), 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := listenUDPTest(t, "udp4", "127.0.0.1:0", WithUDPBatchSize(tt.size))
+			client, err := net.Dial("udp4", c.LocalAddr().String())
+			require.NoError(t, err)
+			defer client.Close()
+			require.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+
+			// 先发送，Serve 开始后一次唤醒读到多个数据报
+			const count = 64
+			for i := 0; i < count; i++ {
+				_, err = client.Write([]byte(fmt.Sprintf("%03d", i)))
+				require.NoError(t, err)
+			}
+			go func() { assert.NoError(t, c.Serve(tt.handler)) }()
+
+			var got []string
+			buf := make([]byte, 16)
+			for len(got) < count {
+				n, err := client.Read(buf)
+				require.NoError(t, err)
+				got = append(got, string(buf[:n]))
+			}
+			sort.Strings(got)
+			for i := range got {
+				assert.Equal(t, fmt.Sprintf("%03d", i), got[i])
+			}
+
+			em := c.metrics
+			if tt.size == 1 {
+				assert.Zero(t, em.recvmmsgCalls.Value())
+				return
+			}
+			batches := em.udpBatchIn.Snapshot()
+			assert.EqualValues(t, count, batches.Sum)
+			assert.Less(t, batches.Count, uint64(count), "the datagrams are read in batches")
+		})
+	}
+}
+
+func TestUDP_RawSockaddr(t *testing.T) {
+	for _, addr := range []*net.UDPAddr{
+		{IP: net.IPv4(192, 0, 2, 1), Port: 53},
+		{IP: net.ParseIP("2001:db8::1"), Port: 65535},
+	} {
+		family := udpFamily("udp", addr.IP)
+		sa, err := udpSockaddr(family, addr)
+		require.NoError(t, err)
+		var b mmsgBatch
+		b.reset(1)
+		b.setName(0, sa)
+		assert.NotZero(t, b.hdrs[0].hdr.Namelen)
+		assert.Equal(t, addr.String(), socket.SockaddrToUDPAddr(rawSockaddr(&b.names[0])).String())
+	}
+}
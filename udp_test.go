@@ -0,0 +1,208 @@
+package haijun_net
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func listenUDPTest(t *testing.T, network, addr string, opts ...Option) *HjPacketConn {
+	c, err := ListenUDP(network, addr, opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = c.Close() })
+	return c
+}
+
+// udpRoundTrip sends msg from a client to c, which echoes it by ReadFrom and WriteTo.
+func udpRoundTrip(t *testing.T, c *HjPacketConn, network, addr string) {
+	client, err := net.Dial(network, addr)
+	require.NoError(t, err)
+	defer client.Close()
+	require.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+	require.NoError(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+
+	_, err = client.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 64)
+	n, from, err := c.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf[:n]))
+	assert.Equal(t, client.LocalAddr().(*net.UDPAddr).Port, from.(*net.UDPAddr).Port)
+
+	_, err = c.WriteTo([]byte("pong"), from)
+	require.NoError(t, err)
+	n, err = client.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(buf[:n]))
+}
+
+func TestUDP_ReadFromWriteTo(t *testing.T) {
+	c := listenUDPTest(t, "udp4", "127.0.0.1:0")
+	port := c.LocalAddr().(*net.UDPAddr).Port
+	assert.NotZero(t, port)
+	for i := 0; i < 3; i++ {
+		udpRoundTrip(t, c, "udp4", c.LocalAddr().String())
+	}
+	assert.EqualValues(t, 3, c.metrics.udpPacketsIn.Value())
+	assert.EqualValues(t, 3, c.metrics.udpPacketsOut.Value())
+
+	_, err := c.WriteTo([]byte("x"), nil)
+	assert.Error(t, err)
+	_, err = c.Write([]byte("x"))
+	assert.Error(t, err)
+}
+
+func TestUDP_IPv6(t *testing.T) {
+	c := listenUDPTest(t, "udp6", "[::1]:0")
+	udpRoundTrip(t, c, "udp6", c.LocalAddr().String())
+
+	// 没有指定主机时同时接收 IPv4 和 IPv6
+	dual := listenUDPTest(t, "udp", ":0")
+	port := dual.LocalAddr().(*net.UDPAddr).Port
+	udpRoundTrip(t, dual, "udp4", fmt.Sprintf("127.0.0.1:%d", port))
+	udpRoundTrip(t, dual, "udp6", fmt.Sprintf("[::1]:%d", port))
+}
+
+func TestUDP_Deadline(t *testing.T) {
+	c := listenUDPTest(t, "udp", "127.0.0.1:0")
+	buf := make([]byte, 16)
+
+	require.NoError(t, c.SetReadDeadline(time.Now().Add(50*time.Millisecond)))
+	start := time.Now()
+	_, _, err := c.ReadFrom(buf)
+	require.Error(t, err)
+	assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	var ne net.Error
+	require.True(t, errors.As(err, &ne))
+	assert.True(t, ne.Timeout())
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+
+	// 等待中修改截止时间
+	require.NoError(t, c.SetReadDeadline(time.Time{}))
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := c.ReadFrom(buf)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, c.SetReadDeadline(time.Now()))
+	select {
+	case err = <-done:
+		assert.True(t, errors.Is(err, os.ErrDeadlineExceeded))
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadFrom isn't woken up by the new deadline")
+	}
+
+	// 关闭时返回
+	require.NoError(t, c.SetReadDeadline(time.Time{}))
+	go func() {
+		_, _, err := c.ReadFrom(buf)
+		done <- err
+	}()
+	time.Sleep(20 * time.Millisecond)
+	require.NoError(t, c.Close())
+	select {
+	case err = <-done:
+		assert.True(t, errors.Is(err, net.ErrClosed))
+	case <-time.After(5 * time.Second):
+		t.Fatal("ReadFrom isn't woken up by Close")
+	}
+}
+
+type udpEchoHandler struct {
+	packets int64
+}
+
+func (h *udpEchoHandler) OnPacket(c *HjPacketConn, p []byte, from net.Addr) {
+	atomic.AddInt64(&h.packets, 1)
+	_, _ = c.WriteTo(p, from)
+}
+
+func TestUDP_Serve(t *testing.T) {
+	c := listenUDPTest(t, "udp4", "127.0.0.1:0", WithUDPLoops(4))
+	require.Len(t, c.shards, 4)
+	h := new(udpEchoHandler)
+	go func() { assert.NoError(t, c.Serve(h)) }()
+
+	// 不同的源端口由内核分到不同的 socket
+	const clients = 32
+	for i := 0; i < clients; i++ {
+		client, err := net.Dial("udp4", c.LocalAddr().String())
+		require.NoError(t, err)
+		require.NoError(t, client.SetDeadline(time.Now().Add(5*time.Second)))
+		msg := fmt.Sprintf("hello %d", i)
+		buf := make([]byte, 64)
+		var n int
+		// Serve 可能还没有开始，重发直到收到回复
+		for attempt := 0; ; attempt++ {
+			_, err = client.Write([]byte(msg))
+			require.NoError(t, err)
+			require.NoError(t, client.SetReadDeadline(time.Now().Add(100*time.Millisecond)))
+			if n, err = client.Read(buf); err == nil || attempt == 20 {
+				break
+			}
+		}
+		require.NoError(t, err)
+		assert.Equal(t, msg, string(buf[:n]))
+		_ = client.Close()
+	}
+
+	busy := 0
+	for _, s := range c.shards {
+		if atomic.LoadUint64(&s.packets) > 0 {
+			busy++
+		}
+	}
+	assert.Greater(t, busy, 1, "the datagrams are spread among the sockets")
+	assert.GreaterOrEqual(t, atomic.LoadInt64(&h.packets), int64(clients))
+
+	_, _, err := c.ReadFrom(make([]byte, 1))
+	assert.Error(t, err, "ReadFrom isn't available in the event-driven mode")
+}
+
+func TestUDP_Connected(t *testing.T) {
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	require.NoError(t, err)
+	defer server.Close()
+	require.NoError(t, server.SetDeadline(time.Now().Add(5*time.Second)))
+
+	c, err := DialUDP("udp", server.LocalAddr().String())
+	require.NoError(t, err)
+	defer c.Close()
+	require.NoError(t, c.SetDeadline(time.Now().Add(5*time.Second)))
+	assert.Equal(t, server.LocalAddr().String(), c.RemoteAddr().String())
+
+	_, err = c.Write([]byte("ping"))
+	require.NoError(t, err)
+	buf := make([]byte, 16)
+	n, from, err := server.ReadFrom(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "ping", string(buf[:n]))
+	assert.Equal(t, c.LocalAddr().(*net.UDPAddr).Port, from.(*net.UDPAddr).Port)
+
+	_, err = server.WriteTo([]byte("pong"), from)
+	require.NoError(t, err)
+	n, err = c.Read(buf)
+	require.NoError(t, err)
+	assert.Equal(t, "pong", string(buf[:n]))
+
+	_, err = c.WriteTo([]byte("x"), from)
+	assert.Error(t, err)
+	_, err = c.WriteTo([]byte("pong"), nil)
+	assert.NoError(t, err)
+
+	// 对端关闭后，ICMP 端口不可达由下一次读取返回
+	_ = server.Close()
+	_, err = c.Write([]byte("anyone?"))
+	require.NoError(t, err)
+	_, err = c.Read(buf)
+	assert.True(t, errors.Is(err, syscall.ECONNREFUSED), "%v", err)
+}
@@ -0,0 +1,376 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"math"
+	"net"
+	"sync"
+	"unicode/utf8"
+
+	hjnet "github.com/Ccheers/haijun-net"
+	"github.com/Ccheers/haijun-net/buffer"
+)
+
+// errTooBig is returned when a message exceeds the max size.
+var errTooBig = errors.New("websocket: message too big")
+
+// maxRetainedBuffer is the max capacity of the buffers kept by an idle conn, larger ones are dropped
+// after the message is handled.
+const maxRetainedBuffer = 64 << 10
+
+// Conn is an upgraded WebSocket conn, it implements httpserver.Upgraded. The writes are safe for
+// concurrent use, e.g. to push the messages from other goroutines.
+type Conn struct {
+	hc             *hjnet.HjConn
+	handler        Handler
+	maxMessageSize int
+	compress       bool
+	subprotocol    string
+	ctx            interface{}
+
+	// the state of reading, only accessed by the callbacks
+	// pending is the data of an incomplete frame, it's moved out of the inbound buffer of the conn
+	// without copying, so that a frame larger than the inbound buffer can be buffered whole
+	pending       *buffer.LinkBuffer
+	segs          [][]byte
+	scratch       []byte
+	fragmented    bool
+	msgOp         Opcode
+	msgCompressed bool
+	msg           []byte
+	inflated      []byte
+	closeErr      error
+
+	wmu       sync.Mutex
+	closeSent bool
+	whdr      []byte
+	deflated  []byte
+}
+
+// NetConn returns the underlying conn.
+func (c *Conn) NetConn() *hjnet.HjConn {
+	return c.hc
+}
+
+// RemoteAddr returns the remote address of the conn.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.hc.RemoteAddr()
+}
+
+// Subprotocol returns the subprotocol negotiated by the handshake, "" if there is none.
+func (c *Conn) Subprotocol() string {
+	return c.subprotocol
+}
+
+// Context returns the user-defined context of the conn.
+func (c *Conn) Context() interface{} {
+	return c.ctx
+}
+
+// SetContext sets the user-defined context of the conn.
+func (c *Conn) SetContext(ctx interface{}) {
+	c.ctx = ctx
+}
+
+// WriteMessage sends data as a text or binary message, it's compressed if permessage-deflate is negotiated.
+func (c *Conn) WriteMessage(op Opcode, data []byte) error {
+	if op != OpText && op != OpBinary {
+		return errors.New("websocket: invalid message opcode")
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	if c.compress && len(data) >= minCompressSize {
+		c.deflated = deflate(c.deflated[:0], data)
+		err := c.writeFrame(op, c.deflated, true)
+		if cap(c.deflated) > maxRetainedBuffer {
+			c.deflated = nil
+		}
+		return err
+	}
+	return c.writeFrame(op, data, false)
+}
+
+// Ping sends a ping, data is at most 125 bytes.
+func (c *Conn) Ping(data []byte) error {
+	if len(data) > maxControlPayload {
+		return errors.New("websocket: control frame too long")
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	return c.writeFrame(OpPing, data, false)
+}
+
+// Close starts the close handshake, the conn is closed once the peer replies. text is truncated to
+// fit in a control frame.
+func (c *Conn) Close(code int, text string) error {
+	if !validCloseCode(code) {
+		return errors.New("websocket: invalid close code")
+	}
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+	if c.closeSent {
+		return ErrClosed
+	}
+	return c.writeClose(code, text)
+}
+
+// writeClose sends a close frame, code is CloseNoStatusReceived for an empty frame. It must be
+// called with wmu held.
+func (c *Conn) writeClose(code int, text string) error {
+	c.closeSent = true
+	if code == CloseNoStatusReceived {
+		return c.writeFrame(OpClose, nil, false)
+	}
+	if len(text) > maxControlPayload-2 {
+		text = text[:maxControlPayload-2]
+	}
+	var b [maxControlPayload]byte
+	binary.BigEndian.PutUint16(b[:], uint16(code))
+	n := copy(b[2:], text)
+	return c.writeFrame(OpClose, b[:2+n], false)
+}
+
+// writeFrame sends a frame, it must be called with wmu held so that the frames aren't interleaved.
+func (c *Conn) writeFrame(op Opcode, payload []byte, rsv1 bool) error {
+	c.whdr = appendHeader(c.whdr[:0], true, rsv1, op, len(payload), nil)
+	if _, err := c.hc.Write(c.whdr); err != nil {
+		return err
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	_, err := c.hc.Write(payload)
+	return err
+}
+
+// OnUpgrade fires the OnOpen of the handler, and then handles the frames received with the upgrade request.
+func (c *Conn) OnUpgrade(hc *hjnet.HjConn, buffered *buffer.LinkBuffer) hjnet.Action {
+	c.hc, c.pending = hc, buffered
+	c.handler.OnOpen(c)
+	if c.pending.Len() > 0 {
+		return c.OnTraffic(hc)
+	}
+	return hjnet.None
+}
+
+// OnTraffic handles the frames buffered by the conn.
+func (c *Conn) OnTraffic(hc *hjnet.HjConn) hjnet.Action {
+	var cur cursor
+	pending := c.pending.Len() > 0
+	if pending {
+		if hc.InboundBuffered() > 0 {
+			if b, err := hc.Next(hc.InboundBuffered()); err == nil {
+				c.pending.AppendBuffer(b)
+			}
+		}
+		c.segs = c.pending.Vectors(c.segs[:0], c.pending.Len(), math.MaxInt32)
+	} else {
+		head, tail := hc.Peek(hc.InboundBuffered())
+		c.segs = append(c.segs[:0], head, tail)
+	}
+	cur.segs = c.segs
+
+	action := hjnet.None
+	var hb [maxHeaderSize]byte
+	for action == hjnet.None {
+		h, err := parseHeader(hb[:cur.peek(hb[:])])
+		if err == errIncomplete {
+			break
+		}
+		if err != nil {
+			action = c.fail(CloseProtocolError, err.Error())
+			break
+		}
+		if code, text := c.check(&h); code != 0 {
+			action = c.fail(code, text)
+			break
+		}
+		if int64(cur.avail()) < int64(h.size)+h.length {
+			break
+		}
+		cur.skip(h.size)
+		// 完整的帧才会被处理和消费，可以原地解掩码
+		payload := cur.take(int(h.length), &c.scratch)
+		maskBytes(h.mask, 0, payload)
+		action = c.frame(&h, payload)
+	}
+	for i := range c.segs {
+		c.segs[i] = nil
+	}
+	if cap(c.scratch) > maxRetainedBuffer {
+		c.scratch = nil
+	}
+
+	if pending {
+		_ = c.pending.Skip(cur.n)
+	} else {
+		hc.Discard(cur.n)
+		if action == hjnet.None && hc.InboundBuffered() > 0 {
+			if b, err := hc.Next(hc.InboundBuffered()); err == nil {
+				c.pending.AppendBuffer(b)
+			}
+		}
+	}
+	return action
+}
+
+// OnClose fires the OnClose of the handler and releases the buffers.
+func (c *Conn) OnClose(_ *hjnet.HjConn, err error) {
+	if c.closeErr == nil {
+		e := &CloseError{Code: CloseAbnormalClosure}
+		if err != nil {
+			e.Text = err.Error()
+		}
+		c.closeErr = e
+	}
+	c.handler.OnClose(c, c.closeErr)
+	c.pending.Release()
+	c.msg, c.inflated, c.scratch = nil, nil, nil
+}
+
+// check validates the header of the next frame against the state of the conn, it returns the close code
+// of the failure if it's invalid.
+func (c *Conn) check(h *header) (int, string) {
+	if !h.masked {
+		return CloseProtocolError, "unmasked frame"
+	}
+	rsv := h.rsv
+	if c.compress && (h.op == OpText || h.op == OpBinary) {
+		rsv &^= rsv1Bit
+	}
+	if rsv != 0 {
+		return CloseProtocolError, "reserved bits set"
+	}
+	switch h.op {
+	case OpPing, OpPong, OpClose:
+		if !h.fin || h.length > maxControlPayload {
+			return CloseProtocolError, "invalid control frame"
+		}
+	case OpText, OpBinary:
+		if c.fragmented {
+			return CloseProtocolError, "data frame within a fragmented message"
+		}
+	case OpContinuation:
+		if !c.fragmented {
+			return CloseProtocolError, "continuation without a message"
+		}
+	default:
+		return CloseProtocolError, "reserved opcode"
+	}
+	if h.length > int64(c.maxMessageSize) || (h.op == OpContinuation && int64(len(c.msg))+h.length > int64(c.maxMessageSize)) {
+		return CloseMessageTooBig, "message too big"
+	}
+	return 0, ""
+}
+
+// frame handles a frame validated by check.
+func (c *Conn) frame(h *header, payload []byte) hjnet.Action {
+	switch h.op {
+	case OpPing:
+		c.wmu.Lock()
+		if !c.closeSent {
+			_ = c.writeFrame(OpPong, payload, false)
+		}
+		c.wmu.Unlock()
+	case OpPong:
+		if ph, ok := c.handler.(PongHandler); ok {
+			ph.OnPong(c, payload)
+		}
+	case OpClose:
+		return c.onClose(payload)
+	case OpText, OpBinary:
+		compressed := h.rsv&rsv1Bit != 0
+		if !h.fin {
+			c.fragmented, c.msgOp, c.msgCompressed = true, h.op, compressed
+			c.msg = append(c.msg[:0], payload...)
+			return hjnet.None
+		}
+		return c.message(h.op, payload, compressed)
+	case OpContinuation:
+		c.msg = append(c.msg, payload...)
+		if h.fin {
+			c.fragmented = false
+			action := c.message(c.msgOp, c.msg, c.msgCompressed)
+			c.msg = c.msg[:0]
+			if cap(c.msg) > maxRetainedBuffer {
+				c.msg = nil
+			}
+			return action
+		}
+	}
+	return hjnet.None
+}
+
+// message passes a complete message to the handler.
+func (c *Conn) message(op Opcode, data []byte, compressed bool) hjnet.Action {
+	if compressed {
+		var err error
+		c.inflated, err = inflate(c.inflated[:0], data, c.maxMessageSize)
+		if err == errTooBig {
+			return c.fail(CloseMessageTooBig, "message too big")
+		}
+		if err != nil {
+			return c.fail(CloseInvalidFramePayloadData, "invalid compressed data")
+		}
+		data = c.inflated
+	}
+	if op == OpText && !utf8.Valid(data) {
+		return c.fail(CloseInvalidFramePayloadData, "invalid UTF-8 text")
+	}
+	c.wmu.Lock()
+	closing := c.closeSent
+	c.wmu.Unlock()
+	// 已经发起关闭握手，不再处理消息
+	if !closing {
+		c.handler.OnMessage(c, op, data)
+	}
+	if cap(c.inflated) > maxRetainedBuffer {
+		c.inflated = nil
+	}
+	return hjnet.None
+}
+
+// onClose handles the close frame of the peer: the close frame is echoed unless it has been sent,
+// and then the conn is closed once the frame is sent.
+func (c *Conn) onClose(payload []byte) hjnet.Action {
+	code, text := CloseNoStatusReceived, ""
+	if len(payload) == 1 {
+		return c.fail(CloseProtocolError, "invalid close frame")
+	}
+	if len(payload) >= 2 {
+		code = int(binary.BigEndian.Uint16(payload))
+		if !validCloseCode(code) {
+			return c.fail(CloseProtocolError, "invalid close code")
+		}
+		if !utf8.Valid(payload[2:]) {
+			return c.fail(CloseInvalidFramePayloadData, "invalid UTF-8 close reason")
+		}
+		text = string(payload[2:])
+	}
+	c.closeErr = &CloseError{Code: code, Text: text}
+	c.wmu.Lock()
+	if !c.closeSent {
+		_ = c.writeClose(code, "")
+	}
+	c.wmu.Unlock()
+	return hjnet.Shutdown
+}
+
+// fail fails the conn: a close frame of code is sent unless one has been sent, and then the conn is closed
+// once the frame is sent.
+func (c *Conn) fail(code int, text string) hjnet.Action {
+	c.closeErr = &CloseError{Code: code, Text: text}
+	c.wmu.Lock()
+	if !c.closeSent {
+		_ = c.writeClose(code, text)
+	}
+	c.wmu.Unlock()
+	return hjnet.Shutdown
+}
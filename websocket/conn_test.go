@@ -0,0 +1,573 @@
+package websocket
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	hjnet "github.com/Ccheers/haijun-net"
+	"github.com/Ccheers/haijun-net/httpserver"
+)
+
+type echoHandler struct {
+	BuiltinHandler
+
+	opened chan *Conn
+	closed chan error
+	pongs  chan []byte
+}
+
+func newEchoHandler() *echoHandler {
+	return &echoHandler{opened: make(chan *Conn, 16), closed: make(chan error, 16), pongs: make(chan []byte, 16)}
+}
+
+// the events are dropped when nobody waits for them, so that the event loop isn't blocked
+func (h *echoHandler) OnOpen(c *Conn) {
+	select {
+	case h.opened <- c:
+	default:
+	}
+}
+
+func (h *echoHandler) OnMessage(c *Conn, op Opcode, data []byte) {
+	if string(data) == "close-me" {
+		_ = c.Close(CloseGoingAway, "bye")
+		return
+	}
+	_ = c.WriteMessage(op, data)
+}
+
+func (h *echoHandler) OnPong(_ *Conn, data []byte) {
+	select {
+	case h.pongs <- append([]byte{}, data...):
+	default:
+	}
+}
+
+func (h *echoHandler) OnClose(_ *Conn, err error) {
+	select {
+	case h.closed <- err:
+	default:
+	}
+}
+
+// serveWS serves u on /ws, and a plain HTTP page on the other paths.
+func serveWS(t *testing.T, u *Upgrader, opts ...hjnet.Option) net.Addr {
+	l, err := hjnet.NewHjListener("127.0.0.1:0", opts...)
+	require.NoError(t, err)
+	hl := l.(*hjnet.HjListener)
+	srv := httpserver.NewServer(httpserver.HandlerFunc(func(w *httpserver.ResponseWriter, r *httpserver.Request) {
+		if string(r.Path()) == "/ws" {
+			u.ServeHTTP(w, r)
+			return
+		}
+		_, _ = w.WriteString("hello")
+	}))
+	go func() {
+		_ = hl.Serve(srv)
+	}()
+	t.Cleanup(func() { _ = hl.Close() })
+	return hl.Addr()
+}
+
+// wsClient is a minimal client writing raw frames.
+type wsClient struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+const testKey = "dGhlIHNhbXBsZSBub25jZQ=="
+
+func dialRaw(t *testing.T, addr net.Addr) *wsClient {
+	conn, err := net.Dial("tcp", addr.String())
+	require.NoError(t, err)
+	require.NoError(t, conn.SetDeadline(time.Now().Add(10*time.Second)))
+	t.Cleanup(func() { _ = conn.Close() })
+	return &wsClient{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+func upgradeRequest(addr net.Addr, extra string) string {
+	return "GET /ws HTTP/1.1\r\nHost: " + addr.String() + "\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Key: " + testKey + "\r\nSec-WebSocket-Version: 13\r\n" + extra + "\r\n"
+}
+
+// dialWS upgrades a conn, extra are the additional header lines of the request.
+func dialWS(t *testing.T, addr net.Addr, extra string) (*wsClient, *http.Response) {
+	c := dialRaw(t, addr)
+	c.send([]byte(upgradeRequest(addr, extra)))
+	resp := c.response()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+	return c, resp
+}
+
+func (c *wsClient) send(b []byte) {
+	_, err := c.conn.Write(b)
+	require.NoError(c.t, err)
+}
+
+func (c *wsClient) response() *http.Response {
+	resp, err := http.ReadResponse(c.r, &http.Request{Method: http.MethodGet})
+	require.NoError(c.t, err)
+	return resp
+}
+
+// frame encodes a masked frame, rsv are the raw reserved bits.
+func frame(fin bool, rsv byte, op Opcode, payload []byte) []byte {
+	key := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+	b := appendHeader(nil, fin, false, op, len(payload), &key)
+	b[0] |= rsv
+	start := len(b)
+	b = append(b, payload...)
+	maskBytes(key, 0, b[start:])
+	return b
+}
+
+func (c *wsClient) write(fin bool, rsv byte, op Opcode, payload []byte) {
+	c.send(frame(fin, rsv, op, payload))
+}
+
+// writeChopped writes b in chunks of n bytes.
+func (c *wsClient) writeChopped(b []byte, n int) {
+	for len(b) > 0 {
+		k := n
+		if k > len(b) {
+			k = len(b)
+		}
+		c.send(b[:k])
+		b = b[k:]
+	}
+}
+
+func (c *wsClient) read() (header, []byte) {
+	var hb [maxHeaderSize]byte
+	_, err := io.ReadFull(c.r, hb[:2])
+	require.NoError(c.t, err)
+	n := 2
+	for {
+		h, err := parseHeader(hb[:n])
+		if err == nil {
+			require.False(c.t, h.masked, "server frames mustn't be masked")
+			payload := make([]byte, h.length)
+			_, err = io.ReadFull(c.r, payload)
+			require.NoError(c.t, err)
+			return h, payload
+		}
+		require.Equal(c.t, errIncomplete, err)
+		_, err = io.ReadFull(c.r, hb[n:n+1])
+		require.NoError(c.t, err)
+		n++
+	}
+}
+
+func (c *wsClient) expect(op Opcode, payload []byte) {
+	h, got := c.read()
+	assert.True(c.t, h.fin)
+	assert.Equal(c.t, op, h.op)
+	assert.Equal(c.t, payload, got)
+}
+
+// expectClose reads the close frame of code, and then the end of the conn.
+func (c *wsClient) expectClose(code int) {
+	h, payload := c.read()
+	require.Equal(c.t, OpClose, h.op, "payload %q", payload)
+	got := CloseNoStatusReceived
+	if len(payload) >= 2 {
+		got = int(binary.BigEndian.Uint16(payload))
+	}
+	assert.Equal(c.t, code, got, "close reason %q", payload)
+	_, err := c.r.ReadByte()
+	assert.Equal(c.t, io.EOF, err)
+}
+
+func closePayload(code int, text string) []byte {
+	b := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(b, uint16(code))
+	return append(b, text...)
+}
+
+// conformanceCases follow the sections of the Autobahn test suite.
+var conformanceCases = []struct {
+	name string
+	run  func(c *wsClient)
+}{
+	{"1.1 text payload lengths", func(c *wsClient) {
+		for _, n := range []int{0, 125, 126, 127, 128, 0xffff, 0x10000} {
+			msg := bytes.Repeat([]byte("*"), n)
+			c.write(true, 0, OpText, msg)
+			c.expect(OpText, msg)
+		}
+	}},
+	{"1.2 binary payload lengths", func(c *wsClient) {
+		for _, n := range []int{0, 125, 126, 127, 128, 0xffff, 0x10000} {
+			msg := bytes.Repeat([]byte{0xfe}, n)
+			c.write(true, 0, OpBinary, msg)
+			c.expect(OpBinary, msg)
+		}
+	}},
+	{"1.3 chopped frame", func(c *wsClient) {
+		msg := bytes.Repeat([]byte("0123456789"), 6553)
+		c.writeChopped(frame(true, 0, OpBinary, msg), 997)
+		c.expect(OpBinary, msg)
+	}},
+	{"2.1 ping payloads", func(c *wsClient) {
+		for _, n := range []int{0, 1, 125} {
+			payload := bytes.Repeat([]byte{'p'}, n)
+			c.write(true, 0, OpPing, payload)
+			c.expect(OpPong, payload)
+		}
+	}},
+	{"2.2 ping too long", func(c *wsClient) {
+		c.write(true, 0, OpPing, make([]byte, 126))
+		c.expectClose(CloseProtocolError)
+	}},
+	{"2.3 fragmented ping", func(c *wsClient) {
+		c.write(false, 0, OpPing, []byte("ping"))
+		c.expectClose(CloseProtocolError)
+	}},
+	{"2.4 unsolicited pong", func(c *wsClient) {
+		c.write(true, 0, OpPong, []byte("unsolicited"))
+		c.write(true, 0, OpText, []byte("after pong"))
+		c.expect(OpText, []byte("after pong"))
+	}},
+	{"2.5 ping burst", func(c *wsClient) {
+		var b []byte
+		for i := 0; i < 10; i++ {
+			b = append(b, frame(true, 0, OpPing, []byte(fmt.Sprint(i)))...)
+		}
+		c.send(b)
+		for i := 0; i < 10; i++ {
+			c.expect(OpPong, []byte(fmt.Sprint(i)))
+		}
+	}},
+	{"3.1 RSV1 without extension", func(c *wsClient) {
+		c.write(true, rsv1Bit, OpText, []byte("hello"))
+		c.expectClose(CloseProtocolError)
+	}},
+	{"3.2 RSV2 after a valid message", func(c *wsClient) {
+		c.send(append(frame(true, 0, OpText, []byte("hello")), frame(true, 0x20, OpText, []byte("hello"))...))
+		c.expect(OpText, []byte("hello"))
+		c.expectClose(CloseProtocolError)
+	}},
+	{"3.3 RSV3 on ping", func(c *wsClient) {
+		c.write(true, 0x10, OpPing, nil)
+		c.expectClose(CloseProtocolError)
+	}},
+	{"4.1 reserved data opcode", func(c *wsClient) {
+		c.write(true, 0, Opcode(3), nil)
+		c.expectClose(CloseProtocolError)
+	}},
+	{"4.2 reserved control opcode", func(c *wsClient) {
+		c.write(true, 0, Opcode(0xb), []byte("x"))
+		c.expectClose(CloseProtocolError)
+	}},
+	{"5.1 fragmented text", func(c *wsClient) {
+		c.write(false, 0, OpText, []byte("frag"))
+		c.write(false, 0, OpContinuation, []byte("men"))
+		c.write(true, 0, OpContinuation, []byte("ted"))
+		c.expect(OpText, []byte("fragmented"))
+	}},
+	{"5.2 ping between fragments", func(c *wsClient) {
+		c.write(false, 0, OpBinary, []byte("frag"))
+		c.write(true, 0, OpPing, []byte("ping"))
+		c.write(true, 0, OpContinuation, []byte("ment"))
+		c.expect(OpPong, []byte("ping"))
+		c.expect(OpBinary, []byte("fragment"))
+	}},
+	{"5.3 continuation without a message", func(c *wsClient) {
+		c.write(true, 0, OpContinuation, []byte("orphan"))
+		c.expectClose(CloseProtocolError)
+	}},
+	{"5.4 new message within a fragmented one", func(c *wsClient) {
+		c.write(false, 0, OpText, []byte("frag"))
+		c.write(true, 0, OpText, []byte("new"))
+		c.expectClose(CloseProtocolError)
+	}},
+	{"5.5 one byte fragments chopped", func(c *wsClient) {
+		msg := []byte("fragmented message")
+		var b []byte
+		for i := range msg {
+			op := OpContinuation
+			if i == 0 {
+				op = OpText
+			}
+			b = append(b, frame(i == len(msg)-1, 0, op, msg[i:i+1])...)
+		}
+		c.writeChopped(b, 1)
+		c.expect(OpText, msg)
+	}},
+	{"5.6 empty fragments", func(c *wsClient) {
+		c.write(false, 0, OpText, nil)
+		c.write(false, 0, OpContinuation, []byte("x"))
+		c.write(true, 0, OpContinuation, nil)
+		c.expect(OpText, []byte("x"))
+	}},
+	{"6.1 valid UTF-8", func(c *wsClient) {
+		msg := []byte("κόσμε 世界 🌍")
+		c.write(true, 0, OpText, msg)
+		c.expect(OpText, msg)
+	}},
+	{"6.2 invalid UTF-8", func(c *wsClient) {
+		c.write(true, 0, OpText, []byte{'a', 0xff, 'b'})
+		c.expectClose(CloseInvalidFramePayloadData)
+	}},
+	{"6.3 code point split across fragments", func(c *wsClient) {
+		msg := []byte("κόσμε")
+		c.write(false, 0, OpText, msg[:3])
+		c.write(true, 0, OpContinuation, msg[3:])
+		c.expect(OpText, msg)
+	}},
+	{"6.4 invalid UTF-8 across fragments", func(c *wsClient) {
+		c.write(false, 0, OpText, []byte("valid"))
+		c.write(true, 0, OpContinuation, []byte{0xed, 0xa0, 0x80})
+		c.expectClose(CloseInvalidFramePayloadData)
+	}},
+	{"7.1 close handshake", func(c *wsClient) {
+		c.write(true, 0, OpClose, closePayload(CloseNormalClosure, "done"))
+		c.expectClose(CloseNormalClosure)
+	}},
+	{"7.2 empty close", func(c *wsClient) {
+		c.write(true, 0, OpClose, nil)
+		c.expectClose(CloseNoStatusReceived)
+	}},
+	{"7.3 close payload of one byte", func(c *wsClient) {
+		c.write(true, 0, OpClose, []byte{0x03})
+		c.expectClose(CloseProtocolError)
+	}},
+	{"7.4 data after close", func(c *wsClient) {
+		c.send(append(frame(true, 0, OpClose, closePayload(CloseNormalClosure, "")), frame(true, 0, OpText, []byte("late"))...))
+		c.expectClose(CloseNormalClosure)
+	}},
+	{"7.5 invalid UTF-8 close reason", func(c *wsClient) {
+		c.write(true, 0, OpClose, closePayload(CloseNormalClosure, "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80"))
+		c.expectClose(CloseInvalidFramePayloadData)
+	}},
+	{"9.1 message too big", func(c *wsClient) {
+		// 帧头就已超出限制，不等待消息体
+		c.send(appendHeader(nil, true, false, OpBinary, testMaxMessageSize+1, &[4]byte{1, 2, 3, 4}))
+		c.expectClose(CloseMessageTooBig)
+	}},
+	{"9.2 fragmented message too big", func(c *wsClient) {
+		c.write(false, 0, OpBinary, make([]byte, testMaxMessageSize/2))
+		c.write(false, 0, OpContinuation, make([]byte, testMaxMessageSize/2))
+		c.write(true, 0, OpContinuation, []byte{1})
+		c.expectClose(CloseMessageTooBig)
+	}},
+	{"10.1 unmasked frame", func(c *wsClient) {
+		c.send(appendHeader(nil, true, false, OpText, 0, nil))
+		c.expectClose(CloseProtocolError)
+	}},
+}
+
+const testMaxMessageSize = 256 << 10
+
+func TestConformance(t *testing.T) {
+	for _, opts := range [][]hjnet.Option{nil, {hjnet.WithWorkerPool(4, 64)}} {
+		addr := serveWS(t, &Upgrader{Handler: newEchoHandler(), MaxMessageSize: testMaxMessageSize}, opts...)
+		for _, tc := range conformanceCases {
+			t.Run(tc.name, func(t *testing.T) {
+				c, _ := dialWS(t, addr, "")
+				tc.run(c)
+			})
+		}
+	}
+}
+
+func TestConformance_CloseCodes(t *testing.T) {
+	addr := serveWS(t, &Upgrader{Handler: newEchoHandler()})
+	for _, code := range []int{1000, 1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011, 3000, 3999, 4000, 4999} {
+		c, _ := dialWS(t, addr, "")
+		c.write(true, 0, OpClose, closePayload(code, ""))
+		c.expectClose(code)
+	}
+	for _, code := range []int{0, 999, 1004, 1005, 1006, 1012, 1016, 1100, 2000, 2999, 5000, 65535} {
+		c, _ := dialWS(t, addr, "")
+		c.write(true, 0, OpClose, closePayload(code, ""))
+		c.expectClose(CloseProtocolError)
+	}
+}
+
+func TestUpgrader_Handshake(t *testing.T) {
+	addr := serveWS(t, &Upgrader{Handler: newEchoHandler(), Subprotocols: []string{"v2.chat", "v1.chat"}})
+
+	c, resp := dialWS(t, addr, "Sec-WebSocket-Protocol: v1.chat, v2.chat\r\nOrigin: http://"+addr.String()+"\r\n")
+	// RFC 6455 1.3 的示例
+	assert.Equal(t, "s3pPLMBiTxaQ9kYGzzhZRbK+xOo=", resp.Header.Get("Sec-WebSocket-Accept"))
+	assert.Equal(t, "websocket", resp.Header.Get("Upgrade"))
+	assert.Equal(t, "v2.chat", resp.Header.Get("Sec-WebSocket-Protocol"))
+	assert.Empty(t, resp.Header.Get("Sec-WebSocket-Extensions"))
+	c.write(true, 0, OpText, []byte("hi"))
+	c.expect(OpText, []byte("hi"))
+
+	cases := []struct {
+		req    string
+		status int
+	}{
+		{strings.Replace(upgradeRequest(addr, ""), "Sec-WebSocket-Version: 13", "Sec-WebSocket-Version: 8", 1), http.StatusUpgradeRequired},
+		{strings.Replace(upgradeRequest(addr, ""), testKey, "short", 1), http.StatusBadRequest},
+		{strings.Replace(upgradeRequest(addr, ""), "Upgrade: websocket\r\n", "", 1), http.StatusBadRequest},
+		{strings.Replace(upgradeRequest(addr, ""), "GET", "POST", 1), http.StatusMethodNotAllowed},
+		{upgradeRequest(addr, "Origin: http://evil.example\r\n"), http.StatusForbidden},
+	}
+	for _, tc := range cases {
+		c := dialRaw(t, addr)
+		c.send([]byte(tc.req))
+		resp := c.response()
+		assert.Equal(t, tc.status, resp.StatusCode, tc.req)
+		if tc.status == http.StatusUpgradeRequired {
+			assert.Equal(t, "13", resp.Header.Get("Sec-WebSocket-Version"))
+		}
+	}
+
+	// 同一端口上的普通请求不受影响
+	c = dialRaw(t, addr)
+	c.send([]byte("GET / HTTP/1.1\r\nHost: test\r\n\r\n"))
+	resp = c.response()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(body))
+}
+
+func TestConn_FramesWithUpgradeRequest(t *testing.T) {
+	addr := serveWS(t, &Upgrader{Handler: newEchoHandler()})
+	c := dialRaw(t, addr)
+	// 握手请求之后紧跟的帧交给升级后的连接
+	c.send(append([]byte(upgradeRequest(addr, "")), frame(true, 0, OpText, []byte("early"))...))
+	assert.Equal(t, http.StatusSwitchingProtocols, c.response().StatusCode)
+	c.expect(OpText, []byte("early"))
+}
+
+func TestConn_LargeMessage(t *testing.T) {
+	// 消息远大于读缓冲区
+	addr := serveWS(t, &Upgrader{Handler: newEchoHandler()}, hjnet.WithReadBuffer(4096, 0))
+	c, _ := dialWS(t, addr, "")
+	msg := bytes.Repeat([]byte("large message "), 1<<16)
+	go func() {
+		_, _ = c.conn.Write(frame(true, 0, OpBinary, msg))
+	}()
+	c.expect(OpBinary, msg)
+}
+
+func TestConn_Deflate(t *testing.T) {
+	addr := serveWS(t, &Upgrader{Handler: newEchoHandler(), EnableCompression: true})
+	c, resp := dialWS(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n")
+	assert.Equal(t, "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+		resp.Header.Get("Sec-WebSocket-Extensions"))
+
+	msg := bytes.Repeat([]byte("compressible text "), 100)
+	c.write(true, rsv1Bit, OpText, deflate(nil, msg))
+	h, payload := c.read()
+	assert.Equal(t, OpText, h.op)
+	assert.EqualValues(t, rsv1Bit, h.rsv, "large replies are compressed")
+	got, err := inflate(nil, payload, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+
+	// 小消息不压缩
+	c.write(true, 0, OpText, []byte("tiny"))
+	h, payload = c.read()
+	assert.EqualValues(t, 0, h.rsv)
+	assert.Equal(t, "tiny", string(payload))
+
+	// 压缩的分片消息只在第一帧设置 RSV1
+	compressed := deflate(nil, msg)
+	c.write(false, rsv1Bit, OpBinary, compressed[:10])
+	c.write(true, 0, OpContinuation, compressed[10:])
+	_, payload = c.read()
+	got, err = inflate(nil, payload, 1<<20)
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+
+	c.write(true, rsv1Bit, OpBinary, []byte{0xff, 0xff, 0xff, 0xff})
+	c.expectClose(CloseInvalidFramePayloadData)
+
+	// 不支持的参数不协商压缩
+	_, resp = dialWS(t, addr, "Sec-WebSocket-Extensions: permessage-deflate; server_max_window_bits=9\r\n")
+	assert.Empty(t, resp.Header.Get("Sec-WebSocket-Extensions"))
+}
+
+func TestConn_ServerClose(t *testing.T) {
+	h := newEchoHandler()
+	addr := serveWS(t, &Upgrader{Handler: h})
+	c, _ := dialWS(t, addr, "")
+	c.write(true, 0, OpText, []byte("close-me"))
+	f, payload := c.read()
+	require.Equal(t, OpClose, f.op)
+	assert.Equal(t, closePayload(CloseGoingAway, "bye"), payload)
+	// 已发起关闭，之后的消息不再处理
+	c.write(true, 0, OpText, []byte("ignored"))
+	c.write(true, 0, OpClose, closePayload(CloseGoingAway, ""))
+	_, err := c.r.ReadByte()
+	assert.Equal(t, io.EOF, err)
+
+	select {
+	case err := <-h.closed:
+		assert.Equal(t, &CloseError{Code: CloseGoingAway}, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose didn't fire")
+	}
+}
+
+func TestConn_Push(t *testing.T) {
+	h := newEchoHandler()
+	addr := serveWS(t, &Upgrader{Handler: h})
+	c, _ := dialWS(t, addr, "")
+	conn := <-h.opened
+
+	// 从其他协程并发推送，帧不会交错
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				assert.NoError(t, conn.WriteMessage(OpText, bytes.Repeat([]byte("push"), 1000)))
+			}
+		}()
+	}
+	require.NoError(t, conn.Ping([]byte("are you there")))
+	for i := 0; i < 201; i++ {
+		f, payload := c.read()
+		if f.op == OpPing {
+			assert.Equal(t, "are you there", string(payload))
+			c.write(true, 0, OpPong, payload)
+			continue
+		}
+		assert.Equal(t, bytes.Repeat([]byte("push"), 1000), payload)
+	}
+	wg.Wait()
+	select {
+	case pong := <-h.pongs:
+		assert.Equal(t, "are you there", string(pong))
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnPong didn't fire")
+	}
+}
+
+func TestConn_AbnormalClosure(t *testing.T) {
+	h := newEchoHandler()
+	addr := serveWS(t, &Upgrader{Handler: h})
+	c, _ := dialWS(t, addr, "")
+	conn := <-h.opened
+	_ = c.conn.Close()
+	select {
+	case err := <-h.closed:
+		e, ok := err.(*CloseError)
+		require.True(t, ok)
+		assert.Equal(t, CloseAbnormalClosure, e.Code)
+	case <-time.After(5 * time.Second):
+		t.Fatal("OnClose didn't fire")
+	}
+	assert.Error(t, conn.WriteMessage(OpText, []byte("late")))
+}
@@ -0,0 +1,104 @@
+package websocket
+
+import (
+	"bytes"
+	"compress/flate"
+	"io"
+	"strings"
+	"sync"
+)
+
+// minCompressSize is the size under which the messages are sent uncompressed, compressing them saves
+// little and costs much.
+const minCompressSize = 64
+
+// deflateTail is appended to a compressed message before inflating it: the tail removed by the sender,
+// see RFC 7692 7.2.2, and an empty final block so that the reader ends with io.EOF.
+const deflateTail = "\x00\x00\xff\xff\x01\x00\x00\xff\xff"
+
+var (
+	flateReaders sync.Pool // io.ReadCloser implementing flate.Resetter
+	flateWriters sync.Pool // *flate.Writer
+)
+
+// inflate appends the decompressed payload of a message to dst, it fails if the result exceeds limit bytes.
+func inflate(dst, payload []byte, limit int) ([]byte, error) {
+	src := io.MultiReader(bytes.NewReader(payload), strings.NewReader(deflateTail))
+	fr, ok := flateReaders.Get().(io.ReadCloser)
+	if ok {
+		_ = fr.(flate.Resetter).Reset(src, nil)
+	} else {
+		fr = flate.NewReader(src)
+	}
+	defer flateReaders.Put(fr)
+
+	for {
+		if cap(dst)-len(dst) < 512 {
+			b := make([]byte, len(dst), 2*cap(dst)+512)
+			copy(b, dst)
+			dst = b
+		}
+		n, err := fr.Read(dst[len(dst):cap(dst)])
+		dst = dst[:len(dst)+n]
+		if len(dst) > limit {
+			return dst, errTooBig
+		}
+		if err == io.EOF {
+			return dst, nil
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+}
+
+// deflate appends the compressed payload of a message to dst, without the tail of RFC 7692 7.2.1.
+func deflate(dst, payload []byte) []byte {
+	buf := bytes.NewBuffer(dst)
+	fw, ok := flateWriters.Get().(*flate.Writer)
+	if ok {
+		fw.Reset(buf)
+	} else {
+		// 与常见实现一致使用最快的压缩级别，压缩率差别不大
+		fw, _ = flate.NewWriter(buf, flate.BestSpeed)
+	}
+	_, _ = fw.Write(payload)
+	_ = fw.Flush()
+	flateWriters.Put(fw)
+	b := buf.Bytes()
+	return b[:len(b)-4]
+}
+
+// negotiateDeflate returns the response to the permessage-deflate offers of the Sec-WebSocket-Extensions
+// header value, or "" if none of them is acceptable. The server doesn't take over the context in both
+// directions, so that an idle conn holds no compression state.
+func negotiateDeflate(offers string) string {
+	for _, offer := range strings.Split(offers, ",") {
+		params := strings.Split(offer, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "permessage-deflate") {
+			continue
+		}
+		ok := true
+		for _, p := range params[1:] {
+			name := strings.TrimSpace(p)
+			value := ""
+			if i := strings.IndexByte(name, '='); i >= 0 {
+				name, value = strings.TrimSpace(name[:i]), strings.Trim(strings.TrimSpace(name[i+1:]), `"`)
+			}
+			switch strings.ToLower(name) {
+			case "server_no_context_takeover", "client_no_context_takeover":
+			case "client_max_window_bits":
+				// 解压不受窗口大小影响
+			case "server_max_window_bits":
+				// compress/flate 总是使用 32KB 的窗口
+				ok = value == "15"
+			default:
+				ok = false
+			}
+		}
+		if ok {
+			return "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+		}
+	}
+	return ""
+}
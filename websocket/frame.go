@@ -0,0 +1,192 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+const (
+	finBit  = 0x80
+	rsv1Bit = 0x40
+	rsvBits = 0x70
+	maskBit = 0x80
+
+	// maxHeaderSize is the size of the longest frame header, with the 64-bit length and the mask key.
+	maxHeaderSize = 14
+	// maxControlPayload is the max payload length of the control frames.
+	maxControlPayload = 125
+)
+
+// errIncomplete is returned when the frame isn't buffered whole.
+var errIncomplete = errors.New("websocket: incomplete frame")
+
+// header is the header of a frame, see RFC 6455 5.2.
+type header struct {
+	fin    bool
+	rsv    byte // RSV1-3 的原始比特位
+	op     Opcode
+	masked bool
+	mask   [4]byte
+	length int64
+	size   int // the size of the header
+}
+
+// parseHeader parses the frame header at the start of b, it returns errIncomplete if b is too short.
+func parseHeader(b []byte) (h header, err error) {
+	if len(b) < 2 {
+		return h, errIncomplete
+	}
+	h.fin = b[0]&finBit != 0
+	h.rsv = b[0] & rsvBits
+	h.op = Opcode(b[0] & 0x0f)
+	h.masked = b[1]&maskBit != 0
+	h.size = 2
+	switch n := b[1] & 0x7f; n {
+	case 126:
+		if len(b) < 4 {
+			return h, errIncomplete
+		}
+		h.length = int64(binary.BigEndian.Uint16(b[2:]))
+		h.size = 4
+	case 127:
+		if len(b) < 10 {
+			return h, errIncomplete
+		}
+		u := binary.BigEndian.Uint64(b[2:])
+		if u>>63 != 0 {
+			return h, errors.New("invalid payload length")
+		}
+		h.length = int64(u)
+		h.size = 10
+	default:
+		h.length = int64(n)
+	}
+	if h.masked {
+		if len(b) < h.size+4 {
+			return h, errIncomplete
+		}
+		copy(h.mask[:], b[h.size:])
+		h.size += 4
+	}
+	return h, nil
+}
+
+// appendHeader appends the header of a frame of n bytes to dst, the frame is masked by mask unless it's nil.
+func appendHeader(dst []byte, fin, rsv1 bool, op Opcode, n int, mask *[4]byte) []byte {
+	b0 := byte(op)
+	if fin {
+		b0 |= finBit
+	}
+	if rsv1 {
+		b0 |= rsv1Bit
+	}
+	var b1 byte
+	if mask != nil {
+		b1 = maskBit
+	}
+	switch {
+	case n <= 125:
+		dst = append(dst, b0, b1|byte(n))
+	case n <= 0xffff:
+		dst = append(dst, b0, b1|126, byte(n>>8), byte(n))
+	default:
+		dst = append(dst, b0, b1|127)
+		var l [8]byte
+		binary.BigEndian.PutUint64(l[:], uint64(n))
+		dst = append(dst, l[:]...)
+	}
+	if mask != nil {
+		dst = append(dst, mask[:]...)
+	}
+	return dst
+}
+
+// maskBytes masks b with key, which starts at its byte pos, and returns the position after b.
+// Masking is its own inverse.
+func maskBytes(key [4]byte, pos int, b []byte) int {
+	i := 0
+	if len(b) >= 8 {
+		// 按 8 字节一组异或
+		var k [8]byte
+		for j := range k {
+			k[j] = key[(pos+j)&3]
+		}
+		kw := binary.LittleEndian.Uint64(k[:])
+		for ; i+8 <= len(b); i += 8 {
+			binary.LittleEndian.PutUint64(b[i:], binary.LittleEndian.Uint64(b[i:])^kw)
+		}
+	}
+	for ; i < len(b); i++ {
+		b[i] ^= key[(pos+i)&3]
+	}
+	return (pos + len(b)) & 3
+}
+
+// cursor reads the data split into segments, e.g. the head and the tail returned by HjConn.Peek.
+type cursor struct {
+	segs [][]byte
+	i    int // segs[i][off] is the next byte
+	off  int
+	n    int // the number of bytes read
+}
+
+func (c *cursor) avail() int {
+	n := 0
+	for i, off := c.i, c.off; i < len(c.segs); i, off = i+1, 0 {
+		n += len(c.segs[i]) - off
+	}
+	return n
+}
+
+// peek copies the next bytes to dst without reading them.
+func (c *cursor) peek(dst []byte) int {
+	m := 0
+	for i, off := c.i, c.off; i < len(c.segs) && m < len(dst); i, off = i+1, 0 {
+		m += copy(dst[m:], c.segs[i][off:])
+	}
+	return m
+}
+
+// skip skips n bytes, which must be available.
+func (c *cursor) skip(n int) {
+	c.n += n
+	for n > 0 {
+		k := len(c.segs[c.i]) - c.off
+		if n < k {
+			c.off += n
+			return
+		}
+		n -= k
+		c.i, c.off = c.i+1, 0
+	}
+}
+
+// take reads n bytes, which must be available. They're returned in place, or copied into scratch
+// when they span two segments.
+func (c *cursor) take(n int, scratch *[]byte) []byte {
+	for c.i < len(c.segs) && c.off == len(c.segs[c.i]) {
+		c.i, c.off = c.i+1, 0
+	}
+	if n == 0 {
+		return nil
+	}
+	if seg := c.segs[c.i][c.off:]; len(seg) >= n {
+		c.skip(n)
+		return seg[:n:n]
+	}
+	b := (*scratch)[:0]
+	c.n += n
+	for n > 0 {
+		seg := c.segs[c.i][c.off:]
+		if len(seg) > n {
+			seg = seg[:n]
+		}
+		b = append(b, seg...)
+		n -= len(seg)
+		if c.off += len(seg); c.off == len(c.segs[c.i]) {
+			c.i, c.off = c.i+1, 0
+		}
+	}
+	*scratch = b
+	return b
+}
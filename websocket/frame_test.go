@@ -0,0 +1,106 @@
+package websocket
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeader_RoundTrip(t *testing.T) {
+	mask := [4]byte{1, 2, 3, 4}
+	for _, n := range []int{0, 1, 125, 126, 127, 0xffff, 0x10000, 1 << 24} {
+		for _, m := range []*[4]byte{nil, &mask} {
+			b := appendHeader(nil, n%2 == 0, true, OpBinary, n, m)
+			h, err := parseHeader(b)
+			require.NoError(t, err)
+			assert.Equal(t, n%2 == 0, h.fin)
+			assert.EqualValues(t, rsv1Bit, h.rsv)
+			assert.Equal(t, OpBinary, h.op)
+			assert.EqualValues(t, n, h.length)
+			assert.Equal(t, len(b), h.size)
+			assert.Equal(t, m != nil, h.masked)
+			if m != nil {
+				assert.Equal(t, mask, h.mask)
+			}
+			for i := 0; i < len(b); i++ {
+				_, err = parseHeader(b[:i])
+				assert.Equal(t, errIncomplete, err)
+			}
+		}
+	}
+	_, err := parseHeader([]byte{0x82, 127, 0x80, 0, 0, 0, 0, 0, 0, 0})
+	assert.Error(t, err)
+}
+
+func TestMaskBytes(t *testing.T) {
+	key := [4]byte{0x12, 0x34, 0x56, 0x78}
+	for _, n := range []int{0, 3, 8, 13, 64, 1001} {
+		for pos := 0; pos < 4; pos++ {
+			b := make([]byte, n)
+			rand.Read(b)
+			want := append([]byte{}, b...)
+			for i := range want {
+				want[i] ^= key[(pos+i)&3]
+			}
+			next := maskBytes(key, pos, b)
+			assert.Equal(t, want, b)
+			assert.Equal(t, (pos+n)&3, next)
+		}
+	}
+	// 分段掩码与整体掩码一致
+	b := bytes.Repeat([]byte("websocket"), 20)
+	whole := append([]byte(nil), b...)
+	maskBytes(key, 0, whole)
+	pos := maskBytes(key, 0, b[:37])
+	maskBytes(key, pos, b[37:])
+	assert.Equal(t, whole, b)
+}
+
+func TestCursor_Take(t *testing.T) {
+	var scratch []byte
+	c := cursor{segs: [][]byte{[]byte("abc"), nil, []byte("defg")}}
+	var hb [4]byte
+	assert.Equal(t, 4, c.peek(hb[:]))
+	assert.Equal(t, "abcd", string(hb[:]))
+	assert.Equal(t, "ab", string(c.take(2, &scratch)))
+	assert.Equal(t, "cde", string(c.take(3, &scratch)))
+	assert.Equal(t, 2, c.avail())
+	assert.Equal(t, "fg", string(c.take(2, &scratch)))
+	assert.Equal(t, 7, c.n)
+}
+
+func TestDeflate_RoundTrip(t *testing.T) {
+	msg := bytes.Repeat([]byte("hello websocket "), 100)
+	compressed := deflate(nil, msg)
+	assert.Less(t, len(compressed), len(msg))
+	got, err := inflate(nil, compressed, len(msg))
+	require.NoError(t, err)
+	assert.Equal(t, msg, got)
+
+	_, err = inflate(nil, compressed, len(msg)-1)
+	assert.Equal(t, errTooBig, err)
+	_, err = inflate(nil, []byte{0xff, 0xff, 0xff}, 1024)
+	assert.Error(t, err)
+}
+
+func TestNegotiateDeflate(t *testing.T) {
+	const ok = "permessage-deflate; server_no_context_takeover; client_no_context_takeover"
+	cases := []struct {
+		offers string
+		want   string
+	}{
+		{"", ""},
+		{"permessage-deflate", ok},
+		{"permessage-deflate; client_max_window_bits", ok},
+		{"x-webkit-deflate-frame, permessage-deflate; client_no_context_takeover", ok},
+		{"permessage-deflate; server_max_window_bits=10", ""},
+		{"permessage-deflate; server_max_window_bits=10, permessage-deflate", ok},
+		{"permessage-deflate; unknown_param", ""},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.want, negotiateDeflate(c.offers), c.offers)
+	}
+}
@@ -0,0 +1,138 @@
+package websocket
+
+import (
+	"crypto/sha1"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/Ccheers/haijun-net/httpserver"
+)
+
+// acceptGUID is concatenated with the key of the client to compute Sec-WebSocket-Accept.
+const acceptGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Upgrader upgrades the HTTP requests to WebSocket conns served by Handler, it's an httpserver.Handler
+// so that it can serve the upgrade requests of a path, or all the requests of a Server. It mustn't be
+// modified after it starts serving.
+type Upgrader struct {
+	// Handler handles the events of the upgraded conns.
+	Handler Handler
+	// Subprotocols are the subprotocols supported by the server in order of preference.
+	Subprotocols []string
+	// CheckOrigin returns whether the origin of the request is accepted. If it's nil, the requests whose
+	// Origin header is set are accepted only if the host of the origin is the Host of the request.
+	CheckOrigin func(r *httpserver.Request) bool
+	// EnableCompression negotiates the permessage-deflate extension if the client offers it.
+	EnableCompression bool
+	// MaxMessageSize is the max size of a message, DefaultMaxMessageSize if zero.
+	MaxMessageSize int
+}
+
+// ServeHTTP upgrades the request, see Upgrade.
+func (u *Upgrader) ServeHTTP(w *httpserver.ResponseWriter, r *httpserver.Request) {
+	_, _ = u.Upgrade(w, r)
+}
+
+// Upgrade validates the upgrade request and writes the response of the handshake, the conn is switched to
+// WebSocket once the response is sent and then Handler.OnOpen fires. The Conn mustn't be written before.
+// An error status is written and ErrBadHandshake is returned if the request is invalid.
+func (u *Upgrader) Upgrade(w *httpserver.ResponseWriter, r *httpserver.Request) (*Conn, error) {
+	if r.Method != http.MethodGet {
+		return nil, reject(w, http.StatusMethodNotAllowed)
+	}
+	if !hasToken(headerValues(r, "Connection"), "upgrade") || !hasToken(headerValues(r, "Upgrade"), "websocket") {
+		return nil, reject(w, http.StatusBadRequest)
+	}
+	if string(r.HeaderValue("Sec-WebSocket-Version")) != "13" {
+		w.AddHeader("Sec-WebSocket-Version", "13")
+		return nil, reject(w, http.StatusUpgradeRequired)
+	}
+	key := string(r.HeaderValue("Sec-WebSocket-Key"))
+	if b, err := base64.StdEncoding.DecodeString(key); err != nil || len(b) != 16 {
+		return nil, reject(w, http.StatusBadRequest)
+	}
+	checkOrigin := u.CheckOrigin
+	if checkOrigin == nil {
+		checkOrigin = sameOrigin
+	}
+	if !checkOrigin(r) {
+		return nil, reject(w, http.StatusForbidden)
+	}
+
+	c := &Conn{hc: r.Conn, handler: u.Handler, maxMessageSize: u.MaxMessageSize}
+	if c.maxMessageSize <= 0 {
+		c.maxMessageSize = DefaultMaxMessageSize
+	}
+	w.AddHeader("Upgrade", "websocket")
+	w.AddHeader("Connection", "Upgrade")
+	w.AddHeader("Sec-WebSocket-Accept", acceptKey(key))
+	if offered := headerValues(r, "Sec-WebSocket-Protocol"); offered != "" {
+		for _, p := range u.Subprotocols {
+			if hasToken(offered, p) {
+				c.subprotocol = p
+				w.AddHeader("Sec-WebSocket-Protocol", p)
+				break
+			}
+		}
+	}
+	if u.EnableCompression {
+		if ext := negotiateDeflate(headerValues(r, "Sec-WebSocket-Extensions")); ext != "" {
+			c.compress = true
+			w.AddHeader("Sec-WebSocket-Extensions", ext)
+		}
+	}
+	w.Upgrade(c)
+	return c, nil
+}
+
+func reject(w *httpserver.ResponseWriter, status int) error {
+	w.WriteHeader(status)
+	w.AddHeader("Content-Type", "text/plain; charset=utf-8")
+	_, _ = w.WriteString(http.StatusText(status))
+	return ErrBadHandshake
+}
+
+func acceptKey(key string) string {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write([]byte(acceptGUID))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func sameOrigin(r *httpserver.Request) bool {
+	origin := r.HeaderValue("Origin")
+	if len(origin) == 0 {
+		return true
+	}
+	u, err := url.Parse(string(origin))
+	if err != nil {
+		return false
+	}
+	return strings.EqualFold(u.Host, string(r.HeaderValue("Host")))
+}
+
+// headerValues returns the values of the header fields named key joined by commas.
+func headerValues(r *httpserver.Request, key string) string {
+	var s string
+	for _, h := range r.Headers {
+		if strings.EqualFold(string(h.Key), key) {
+			if s != "" {
+				s += ", "
+			}
+			s += string(h.Value)
+		}
+	}
+	return s
+}
+
+// hasToken reports whether the comma-separated list v contains token case-insensitively.
+func hasToken(v, token string) bool {
+	for _, t := range strings.Split(v, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
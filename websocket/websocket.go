@@ -0,0 +1,110 @@
+// Package websocket implements the WebSocket protocol of RFC 6455 on the event-driven API of haijun-net,
+// with the permessage-deflate extension of RFC 7692.
+//
+// The conns are upgraded by the httpserver.Server, an Upgrader is the handler of the upgrade requests.
+// The frames are decoded from the inbound buffer of the conn on the event loop, so an idle conn costs no
+// goroutine. The messages are passed to a Handler, ping, pong and the close handshake are handled by
+// the Conn.
+package websocket
+
+import (
+	"errors"
+	"strconv"
+)
+
+// Opcode is the type of a frame.
+type Opcode byte
+
+// The opcodes of RFC 6455 5.2.
+const (
+	OpContinuation Opcode = 0x0
+	OpText         Opcode = 0x1
+	OpBinary       Opcode = 0x2
+	OpClose        Opcode = 0x8
+	OpPing         Opcode = 0x9
+	OpPong         Opcode = 0xa
+)
+
+// IsControl reports whether op is the opcode of a control frame.
+func (op Opcode) IsControl() bool {
+	return op&0x8 != 0
+}
+
+// The status codes of the close frames, see RFC 6455 7.4.1.
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005
+	CloseAbnormalClosure         = 1006
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+)
+
+// DefaultMaxMessageSize is the default max size of a message, after decompression.
+const DefaultMaxMessageSize = 4 << 20 // 4MB
+
+var (
+	// ErrClosed is returned when writing to a conn whose close handshake has started.
+	ErrClosed = errors.New("websocket: conn closed")
+	// ErrBadHandshake is returned by Upgrader.Upgrade when the request isn't a valid upgrade request.
+	ErrBadHandshake = errors.New("websocket: bad handshake")
+)
+
+// CloseError is the error passed to Handler.OnClose when the conn is closed by the close handshake,
+// or by a failure of the protocol. Code is CloseAbnormalClosure if the conn is closed without a close frame.
+type CloseError struct {
+	Code int
+	Text string
+}
+
+func (e *CloseError) Error() string {
+	s := "websocket: close " + strconv.Itoa(e.Code)
+	if e.Text != "" {
+		s += " " + e.Text
+	}
+	return s
+}
+
+// validCloseCode reports whether code can be sent in a close frame.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= 1000 && code <= 1003, code >= 1007 && code <= 1011:
+		return true
+	case code >= 3000 && code <= 4999:
+		return true
+	}
+	return false
+}
+
+// Handler handles the events of the conns, the callbacks of one conn are invoked one by one.
+type Handler interface {
+	// OnOpen fires when the conn has been upgraded.
+	OnOpen(c *Conn)
+	// OnMessage fires when a text or binary message is received, data is only valid until it returns.
+	OnMessage(c *Conn, op Opcode, data []byte)
+	// OnClose fires when the conn has been closed, see CloseError.
+	OnClose(c *Conn, err error)
+}
+
+// PongHandler is implemented by the Handlers interested in the pongs.
+type PongHandler interface {
+	// OnPong fires when a pong is received, data is only valid until it returns.
+	OnPong(c *Conn, data []byte)
+}
+
+// BuiltinHandler is a built-in implementation for all the callbacks of Handler.
+type BuiltinHandler struct{}
+
+// OnOpen fires when the conn has been upgraded.
+func (*BuiltinHandler) OnOpen(_ *Conn) {}
+
+// OnMessage fires when a message is received.
+func (*BuiltinHandler) OnMessage(_ *Conn, _ Opcode, _ []byte) {}
+
+// OnClose fires when the conn has been closed.
+func (*BuiltinHandler) OnClose(_ *Conn, _ error) {}